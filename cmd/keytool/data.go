@@ -10,13 +10,12 @@ package main
 // - -- --- ---- -----
 
 import (
-	"bufio"
 	"bytes"
 	"encoding/base64"
 	"encoding/hex"
 	"errors"
+	"io"
 	"io/ioutil"
-	"os"
 
 	"github.com/ndau/ndau/pkg/ndauapi/routes"
 
@@ -54,12 +53,12 @@ func getDataClosure(cmd *cli.Cmd, allowStdin bool) func() []byte {
 			data, err = ioutil.ReadFile(*filei)
 			check(err)
 		case stdini != nil && *stdini:
-			in := bufio.NewScanner(os.Stdin)
-			if !in.Scan() {
+			line, err := readLine(stdin)
+			if err == io.EOF {
 				check(errors.New("stdin selected but empty"))
 			}
-			check(in.Err())
-			data = []byte(in.Text())
+			check(err)
+			data = line
 		default:
 			check(errors.New("no data provided; should be unreachable"))
 		}
@@ -10,9 +10,14 @@ package main
 // - -- --- ---- -----
 
 import (
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
 	"os"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 
 	cli "github.com/jawher/mow.cli"
 	"github.com/ndau/ndaumath/pkg/address"
@@ -198,3 +203,206 @@ func cmdHDWords(cmd *cli.Cmd) {
 		fmt.Println(s)
 	}
 }
+
+// a derivedAddr is a single row of derive-range output
+type derivedAddr struct {
+	Index   int    `json:"index"`
+	Path    string `json:"path"`
+	Public  string `json:"public_key"`
+	Address string `json:"address"`
+}
+
+func deriveAddr(root *key.ExtendedKey, rootPath, path string, kind byte) (derivedAddr, error) {
+	d := derivedAddr{Path: path}
+	child, err := root.DeriveFrom(rootPath, path)
+	if err != nil {
+		return d, errors.Wrap(err, "deriving "+path)
+	}
+	if child.IsPrivate() {
+		child, err = child.Public()
+		if err != nil {
+			return d, errors.Wrap(err, "converting to public "+path)
+		}
+	}
+	pub, err := child.SPubKey()
+	if err != nil {
+		return d, errors.Wrap(err, "converting to ndau fmt "+path)
+	}
+	d.Public, err = pub.MarshalString()
+	if err != nil {
+		return d, errors.Wrap(err, "stringifying "+path)
+	}
+	addr, err := address.Generate(kind, pub.KeyBytes())
+	if err != nil {
+		return d, errors.Wrap(err, "generating address "+path)
+	}
+	d.Address = addr.String()
+	return d, nil
+}
+
+// a rangePattern is a derivation path with a single %d, which is replaced
+// by each index of a range
+type rangePattern struct {
+	prefix, suffix string
+}
+
+func parseRangePattern(pattern string) (rangePattern, error) {
+	parts := strings.Split(pattern, "%d")
+	if len(parts) != 2 {
+		return rangePattern{}, errors.New("pattern must contain exactly one %d")
+	}
+	if strings.Contains(parts[0], "%") || strings.Contains(parts[1], "%") {
+		return rangePattern{}, errors.New("pattern must not contain any verb but %d")
+	}
+	return rangePattern{prefix: parts[0], suffix: parts[1]}, nil
+}
+
+func (p rangePattern) path(idx int) string {
+	return p.prefix + strconv.Itoa(idx) + p.suffix
+}
+
+// below returns the components of the pattern below the path of the key
+// from which it's derived, which must be a prefix of the pattern
+func (p rangePattern) below(rootPath string) ([]string, error) {
+	root := strings.Trim(rootPath, "/")
+	pattern := strings.Trim(p.prefix+"%d"+p.suffix, "/")
+	if root == "" {
+		return strings.Split(pattern, "/"), nil
+	}
+	if !strings.HasPrefix(pattern, root+"/") {
+		return nil, fmt.Errorf("pattern is not below the root path %s", rootPath)
+	}
+	return strings.Split(strings.TrimPrefix(pattern, root+"/"), "/"), nil
+}
+
+// checkUnhardened ensures that every component of the pattern below the
+// root path can be derived from a public key: hardened components can only
+// be derived from a private key.
+func (p rangePattern) checkUnhardened(rootPath string) error {
+	components, err := p.below(rootPath)
+	if err != nil {
+		return err
+	}
+	for _, c := range components {
+		if strings.HasSuffix(c, "'") {
+			return fmt.Errorf("hardened component %s can't be derived from a public key; supply the public key at the hardened path with --root-path", c)
+		}
+	}
+	return nil
+}
+
+// publicRoot converts a public key to the root of a public-only derivation,
+// refusing private keys
+func publicRoot(k signature.Key) (*key.ExtendedKey, error) {
+	pub, ok := k.(*signature.PublicKey)
+	if !ok {
+		return nil, errors.New("a public key is required")
+	}
+	return key.FromSignatureKey(pub)
+}
+
+func cmdHDDeriveRange(cmd *cli.Cmd) {
+	deriveRange(cmd, false)
+}
+
+// cmdHDDeriveRangePublic derives from a public key only: it takes no key
+// file, and refuses a private key before deriving anything
+func cmdHDDeriveRangePublic(cmd *cli.Cmd) {
+	deriveRange(cmd, true)
+}
+
+func deriveRange(cmd *cli.Cmd, publicOnly bool) {
+	ktype := ""
+	if publicOnly {
+		ktype = "PUB"
+	}
+	cmd.Spec = fmt.Sprintf(
+		"%s --pattern=<PATTERN> --from=<N> --to=<N> [--root-path=<PATH>] [--json] [--workers=<N>] %s",
+		getKeySpec(ktype),
+		getKindSpec(),
+	)
+
+	var getKey func() *key.ExtendedKey
+	if publicOnly {
+		getPub := getKeyClosure(cmd, ktype, "public key from which to derive children")
+		getKey = func() *key.ExtendedKey {
+			root, err := publicRoot(getPub())
+			check(err)
+			return root
+		}
+	} else {
+		getKey = getKeyClosureHD(cmd, ktype, "key from which to derive children")
+	}
+	getKind := getKindClosure(cmd)
+
+	var (
+		patternS = cmd.StringOpt("pattern", "", "derivation path pattern; %d is replaced by each index")
+		from     = cmd.IntOpt("from", 0, "first index to derive")
+		to       = cmd.IntOpt("to", 0, "last index to derive, inclusive")
+		rootPath = cmd.StringOpt("root-path", "/", "derivation path of the supplied key; the pattern must be below it")
+		asJSON   = cmd.BoolOpt("json", false, "emit JSON instead of CSV")
+		workers  = cmd.IntOpt("w workers", runtime.NumCPU(), "number of keys to derive in parallel")
+	)
+
+	cmd.Action = func() {
+		pattern, err := parseRangePattern(*patternS)
+		check(err)
+		if publicOnly {
+			check(pattern.checkUnhardened(*rootPath))
+		} else {
+			_, err = pattern.below(*rootPath)
+			check(err)
+		}
+		if *to < *from {
+			check(fmt.Errorf("empty range: %d to %d", *from, *to))
+		}
+		if *from < 0 {
+			check(errors.New("indices must not be negative"))
+		}
+		if *workers < 1 {
+			*workers = 1
+		}
+
+		root := getKey()
+		kind := getKind()
+
+		rows := make([]derivedAddr, *to-*from+1)
+		errs := make([]error, len(rows))
+		indices := make(chan int)
+		wg := sync.WaitGroup{}
+		for w := 0; w < *workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range indices {
+					idx := *from + i
+					rows[i], errs[i] = deriveAddr(root, *rootPath, pattern.path(idx), kind)
+					rows[i].Index = idx
+				}
+			}()
+		}
+		for i := range rows {
+			indices <- i
+		}
+		close(indices)
+		wg.Wait()
+
+		for _, err := range errs {
+			check(err)
+		}
+
+		if *asJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			check(enc.Encode(rows))
+			return
+		}
+		w := csv.NewWriter(os.Stdout)
+		check(w.Write([]string{"index", "path", "public_key", "address"}))
+		for _, r := range rows {
+			check(w.Write([]string{strconv.Itoa(r.Index), r.Path, r.Public, r.Address}))
+		}
+		w.Flush()
+		check(w.Error())
+	}
+}
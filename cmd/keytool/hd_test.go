@@ -0,0 +1,114 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"testing"
+
+	"github.com/ndau/ndaumath/pkg/address"
+	"github.com/ndau/ndaumath/pkg/key"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRangePattern(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		ok      bool
+		path    string
+	}{
+		{"/44'/20036'/100/%d", true, "/44'/20036'/100/7"},
+		{"/44'/20036'/%d/1", true, "/44'/20036'/7/1"},
+		{"/44'/20036'/100/%d'", true, "/44'/20036'/100/7'"},
+		{"/44'/20036'/100", false, ""},
+		{"/44'/%d/100/%d", false, ""},
+		{"/44'/%s/100/%d", false, ""},
+		{"/44'/20036'/100/%5d", false, ""},
+		{"/44'/20036'/100/%d%%", false, ""},
+	} {
+		t.Run(tc.pattern, func(t *testing.T) {
+			p, err := parseRangePattern(tc.pattern)
+			if !tc.ok {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.path, p.path(7))
+		})
+	}
+}
+
+func TestRangePatternCheckUnhardened(t *testing.T) {
+	for _, tc := range []struct {
+		pattern  string
+		rootPath string
+		ok       bool
+	}{
+		{"/44'/20036'/100/%d", "/", false},
+		{"/44'/20036'/100/%d", "/44'/20036'/100", true},
+		{"/44'/20036'/100/%d", "/44'/20036'", true},
+		{"/44'/20036'/100/%d'", "/44'/20036'/100", false},
+		{"/44'/20036'/100/%d", "/44'/20036'/1", false},
+		{"/44'/20036'/100/%d", "/44'/20036'/100/", true},
+		{"/1/%d", "/", true},
+	} {
+		t.Run(tc.pattern+" from "+tc.rootPath, func(t *testing.T) {
+			p, err := parseRangePattern(tc.pattern)
+			require.NoError(t, err)
+			err = p.checkUnhardened(tc.rootPath)
+			if tc.ok {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestDeriveRangeFromPublicKey(t *testing.T) {
+	seed, err := key.GenerateSeed(key.RecommendedSeedLen)
+	require.NoError(t, err)
+	root, err := key.NewMaster(seed)
+	require.NoError(t, err)
+
+	const accountPath = "/44'/20036'/100"
+	account, err := root.DeriveFrom("/", accountPath)
+	require.NoError(t, err)
+	accountPub, err := account.Public()
+	require.NoError(t, err)
+
+	p, err := parseRangePattern(accountPath + "/%d")
+	require.NoError(t, err)
+	require.NoError(t, p.checkUnhardened(accountPath))
+	for idx := 1; idx <= 3; idx++ {
+		fromPvt, err := deriveAddr(root, "/", p.path(idx), address.KindUser)
+		require.NoError(t, err)
+		fromPub, err := deriveAddr(accountPub, accountPath, p.path(idx), address.KindUser)
+		require.NoError(t, err)
+		require.Equal(t, fromPvt, fromPub)
+	}
+}
+
+func TestPublicRootRefusesPrivateKeys(t *testing.T) {
+	seed, err := key.GenerateSeed(key.RecommendedSeedLen)
+	require.NoError(t, err)
+	root, err := key.NewMaster(seed)
+	require.NoError(t, err)
+
+	pvt, err := root.SPrivKey()
+	require.NoError(t, err)
+	_, err = publicRoot(pvt)
+	require.Error(t, err)
+
+	pub, err := root.SPubKey()
+	require.NoError(t, err)
+	ek, err := publicRoot(pub)
+	require.NoError(t, err)
+	require.False(t, ek.IsPrivate())
+}
@@ -10,10 +10,9 @@ package main
 // - -- --- ---- -----
 
 import (
-	"bufio"
 	"errors"
 	"fmt"
-	"os"
+	"io"
 	"strings"
 
 	cli "github.com/jawher/mow.cli"
@@ -26,23 +25,39 @@ func keytype(ktype string) string {
 	return strings.ToUpper(strings.TrimSpace(ktype)) + "KEY"
 }
 
+// key files only ever hold private keys, so public key arguments can't come from them
+func allowKeyfile(ktype string) bool {
+	return keytype(ktype) != keytype("PUB")
+}
+
 func getKeySpec(ktype string) string {
+	if allowKeyfile(ktype) {
+		return fmt.Sprintf("(%s | --stdin | --keyfile=<PATH>)", keytype(ktype))
+	}
 	return fmt.Sprintf("(%s | --stdin)", keytype(ktype))
 }
 
 func getKeyClosure(cmd *cli.Cmd, ktype string, desc string) func() signature.Key {
 	key := cmd.StringArg(keytype(ktype), "", desc)
-	stdin := cmd.BoolOpt("S stdin", false, "if set, read the key from stdin")
+	stdini := cmd.BoolOpt("S stdin", false, "if set, read the key from stdin")
+	var keyfilep *string
+	if allowKeyfile(ktype) {
+		keyfilep = cmd.StringOpt("keyfile", "", "read the key from this encrypted key file, prompting for its passphrase")
+	}
 
 	return func() signature.Key {
 		var keys string
-		if stdin != nil && *stdin {
-			in := bufio.NewScanner(os.Stdin)
-			if !in.Scan() {
+		if keyfilep != nil && len(*keyfilep) > 0 {
+			k, err := loadKeyFile(*keyfilep)
+			check(err)
+			return k
+		} else if stdini != nil && *stdini {
+			line, err := readLine(stdin)
+			if err == io.EOF {
 				check(errors.New("stdin selected but empty"))
 			}
-			check(in.Err())
-			keys = in.Text()
+			check(err)
+			keys = string(line)
 		} else if key != nil && len(*key) > 0 {
 			keys = *key
 		} else {
@@ -0,0 +1,337 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	cli "github.com/jawher/mow.cli"
+	"github.com/ndau/ndaumath/pkg/address"
+	"github.com/ndau/ndaumath/pkg/key"
+	"github.com/ndau/ndaumath/pkg/signature"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// An encrypted key file is a JSON document. Everything except the ciphertext
+// is authenticated as additional data, so tampering with the header or the
+// metadata is detected on decryption just as tampering with the key is.
+
+const (
+	keyFileVersion = 1
+	keyFileKDF     = "scrypt"
+	keyFileCipher  = "aes-256-gcm"
+
+	// scrypt parameters for new files: about 100ms and 32MB on a modern machine
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	scryptKeyLen = 32
+	scryptSalt   = 32
+
+	// refuse to honor absurd work factors from files we didn't write
+	scryptMaxN = 1 << 22
+	scryptMaxR = 32
+	scryptMaxP = 16
+)
+
+// KDFParams describe how the encryption key is derived from the passphrase
+type KDFParams struct {
+	Name string `json:"name"`
+	N    int    `json:"n"`
+	R    int    `json:"r"`
+	P    int    `json:"p"`
+	Salt []byte `json:"salt"`
+}
+
+// CipherParams describe how the key is encrypted
+type CipherParams struct {
+	Name  string `json:"name"`
+	Nonce []byte `json:"nonce"`
+}
+
+// KeyFile is the on-disk representation of an encrypted key
+type KeyFile struct {
+	Version    int          `json:"version"`
+	Algorithm  string       `json:"algorithm"`
+	Public     string       `json:"public,omitempty"`
+	Address    string       `json:"address,omitempty"`
+	KDF        KDFParams    `json:"kdf"`
+	Cipher     CipherParams `json:"cipher"`
+	Ciphertext []byte       `json:"ciphertext"`
+}
+
+// additionalData is the authenticated, unencrypted portion of the file
+func (kf KeyFile) additionalData() ([]byte, error) {
+	kf.Ciphertext = nil
+	return json.Marshal(kf)
+}
+
+func (kf KeyFile) aead(passphrase []byte) (cipher.AEAD, error) {
+	if kf.Version != keyFileVersion {
+		return nil, fmt.Errorf("unsupported key file version %d", kf.Version)
+	}
+	if kf.KDF.Name != keyFileKDF {
+		return nil, fmt.Errorf("unsupported kdf %q", kf.KDF.Name)
+	}
+	if kf.KDF.N > scryptMaxN {
+		return nil, fmt.Errorf("kdf work factor %d exceeds maximum %d", kf.KDF.N, scryptMaxN)
+	}
+	if kf.KDF.R > scryptMaxR {
+		return nil, fmt.Errorf("kdf block size %d exceeds maximum %d", kf.KDF.R, scryptMaxR)
+	}
+	if kf.KDF.P > scryptMaxP {
+		return nil, fmt.Errorf("kdf parallelism %d exceeds maximum %d", kf.KDF.P, scryptMaxP)
+	}
+	if kf.Cipher.Name != keyFileCipher {
+		return nil, fmt.Errorf("unsupported cipher %q", kf.Cipher.Name)
+	}
+	dk, err := scrypt.Key(passphrase, kf.KDF.Salt, kf.KDF.N, kf.KDF.R, kf.KDF.P, scryptKeyLen)
+	if err != nil {
+		return nil, errors.Wrap(err, "deriving encryption key")
+	}
+	block, err := aes.NewCipher(dk)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Seal encrypts plaintext into the key file using a fresh salt and nonce
+//
+// Algorithm, Public, and Address should be set before calling Seal; they
+// are authenticated along with the ciphertext.
+func (kf *KeyFile) Seal(plaintext, passphrase []byte) error {
+	kf.Version = keyFileVersion
+	kf.KDF = KDFParams{
+		Name: keyFileKDF,
+		N:    scryptN,
+		R:    scryptR,
+		P:    scryptP,
+		Salt: make([]byte, scryptSalt),
+	}
+	_, err := rand.Read(kf.KDF.Salt)
+	if err != nil {
+		return err
+	}
+
+	kf.Cipher = CipherParams{Name: keyFileCipher}
+	aead, err := kf.aead(passphrase)
+	if err != nil {
+		return err
+	}
+	kf.Cipher.Nonce = make([]byte, aead.NonceSize())
+	_, err = rand.Read(kf.Cipher.Nonce)
+	if err != nil {
+		return err
+	}
+
+	ad, err := kf.additionalData()
+	if err != nil {
+		return err
+	}
+	kf.Ciphertext = aead.Seal(nil, kf.Cipher.Nonce, plaintext, ad)
+	return nil
+}
+
+// Open decrypts and authenticates the key file's contents
+func (kf KeyFile) Open(passphrase []byte) ([]byte, error) {
+	aead, err := kf.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if len(kf.Cipher.Nonce) != aead.NonceSize() {
+		return nil, errors.New("invalid nonce size")
+	}
+	ad, err := kf.additionalData()
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, kf.Cipher.Nonce, kf.Ciphertext, ad)
+	if err != nil {
+		return nil, errors.New("wrong passphrase or corrupt key file")
+	}
+	return plaintext, nil
+}
+
+func readKeyFile(path string) (KeyFile, error) {
+	var kf KeyFile
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return kf, err
+	}
+	err = json.Unmarshal(data, &kf)
+	return kf, errors.Wrap(err, "parsing key file")
+}
+
+func writeKeyFile(path string, kf KeyFile) error {
+	data, err := json.MarshalIndent(kf, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	// O_EXCL: never silently overwrite an existing key
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// stdin is shared by everything which reads lines from standard input, so
+// that read-ahead by one reader never swallows input meant for the next
+var stdin = bufio.NewReader(os.Stdin)
+
+// readLine reads a single line, without its line ending
+//
+// A final line with no newline is returned as-is; io.EOF is only returned
+// when there was nothing left to read.
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadBytes('\n')
+	if err != nil && len(line) == 0 {
+		return nil, err
+	}
+	return bytes.TrimRight(line, "\r\n"), nil
+}
+
+// readPassphrase prompts on stderr and reads a passphrase
+//
+// If stdin is a terminal, echo is disabled. Otherwise, a single line is read,
+// which permits scripted use.
+func readPassphrase(prompt string) ([]byte, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	fd := int(os.Stdin.Fd())
+	if terminal.IsTerminal(fd) {
+		pass, err := terminal.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return pass, err
+	}
+	line, err := readLine(stdin)
+	return line, errors.Wrap(err, "reading passphrase")
+}
+
+// loadKeyFile prompts for a passphrase and decrypts the key at path
+func loadKeyFile(path string) (signature.Key, error) {
+	kf, err := readKeyFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pass, err := readPassphrase(fmt.Sprintf("passphrase for %s: ", path))
+	if err != nil {
+		return nil, err
+	}
+	text, err := kf.Open(pass)
+	if err != nil {
+		return nil, err
+	}
+	return signature.ParseKey(string(text))
+}
+
+// keyfile subcommand
+func keyfile(cmd *cli.Cmd) {
+	cmd.Command("write", "encrypt a key into a new key file", cmdKeyfileWrite)
+	cmd.Command("read", "decrypt a key file and print the key", cmdKeyfileRead)
+	cmd.Command("info", "show a key file's unencrypted metadata", cmdKeyfileInfo)
+}
+
+func cmdKeyfileWrite(cmd *cli.Cmd) {
+	cmd.Spec = fmt.Sprintf(
+		"PATH %s %s",
+		getKeySpec(""),
+		getKindSpec(),
+	)
+
+	path := cmd.StringArg("PATH", "", "write the key file here")
+	getKey := getKeyClosure(cmd, "", "key to encrypt")
+	getKind := getKindClosure(cmd)
+
+	cmd.Action = func() {
+		k := getKey()
+		text, err := k.MarshalText()
+		check(err)
+
+		kf := KeyFile{Algorithm: signature.NameOf(k.Algorithm())}
+		// HD keys can also record their public key and address; other keys
+		// are stored without that metadata
+		if ek, err := key.FromSignatureKey(k); err == nil {
+			pub := ek
+			if ek.IsPrivate() {
+				pub, err = ek.Public()
+				check(err)
+			}
+			spub, err := pub.SPubKey()
+			check(err)
+			kf.Public, err = spub.MarshalString()
+			check(err)
+			addr, err := address.Generate(getKind(), spub.KeyBytes())
+			check(err)
+			kf.Address = addr.String()
+		}
+
+		pass, err := readPassphrase("new passphrase: ")
+		check(err)
+		if len(pass) == 0 {
+			check(errors.New("passphrase must not be empty"))
+		}
+		again, err := readPassphrase("repeat passphrase: ")
+		check(err)
+		if !bytes.Equal(pass, again) {
+			check(errors.New("passphrases do not match"))
+		}
+
+		check(kf.Seal(text, pass))
+		check(writeKeyFile(*path, kf))
+	}
+}
+
+func cmdKeyfileRead(cmd *cli.Cmd) {
+	path := cmd.StringArg("PATH", "", "key file to decrypt")
+
+	cmd.Action = func() {
+		k, err := loadKeyFile(*path)
+		check(err)
+		text, err := k.MarshalText()
+		check(err)
+		fmt.Println(string(text))
+	}
+}
+
+func cmdKeyfileInfo(cmd *cli.Cmd) {
+	path := cmd.StringArg("PATH", "", "key file to inspect")
+
+	cmd.Action = func() {
+		kf, err := readKeyFile(*path)
+		check(err)
+		fmt.Printf("%10s: %d\n", "version", kf.Version)
+		fmt.Printf("%10s: %s\n", "algorithm", kf.Algorithm)
+		if kf.Public != "" {
+			fmt.Printf("%10s: %s\n", "public", kf.Public)
+		}
+		if kf.Address != "" {
+			fmt.Printf("%10s: %s\n", "address", kf.Address)
+		}
+		fmt.Printf("%10s: %s (N=%d, r=%d, p=%d)\n", "kdf", kf.KDF.Name, kf.KDF.N, kf.KDF.R, kf.KDF.P)
+		fmt.Printf("%10s: %s\n", "cipher", kf.Cipher.Name)
+	}
+}
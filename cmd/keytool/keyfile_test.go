@@ -0,0 +1,106 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func sealedKeyFile(t *testing.T) KeyFile {
+	kf := KeyFile{Algorithm: "secp256k1", Address: "ndaexample"}
+	require.NoError(t, kf.Seal([]byte("npvtexample"), []byte("hunter2")))
+	return kf
+}
+
+func TestKeyFileRoundtrip(t *testing.T) {
+	kf := sealedKeyFile(t)
+	require.NotContains(t, string(kf.Ciphertext), "npvtexample")
+
+	text, err := kf.Open([]byte("hunter2"))
+	require.NoError(t, err)
+	require.Equal(t, "npvtexample", string(text))
+}
+
+func TestKeyFileWrongPassphrase(t *testing.T) {
+	kf := sealedKeyFile(t)
+	_, err := kf.Open([]byte("hunter3"))
+	require.Error(t, err)
+}
+
+func TestKeyFileMetadataIsAuthenticated(t *testing.T) {
+	kf := sealedKeyFile(t)
+	kf.Address = "ndaforgery"
+	_, err := kf.Open([]byte("hunter2"))
+	require.Error(t, err)
+}
+
+func TestKeyFileRejectsHugeWorkFactor(t *testing.T) {
+	kf := sealedKeyFile(t)
+	kf.KDF.N = scryptMaxN * 2
+	_, err := kf.Open([]byte("hunter2"))
+	require.Error(t, err)
+}
+
+func TestKeyFileRejectsHugeBlockSizeAndParallelism(t *testing.T) {
+	kf := sealedKeyFile(t)
+	kf.KDF.R = scryptMaxR * 2
+	_, err := kf.Open([]byte("hunter2"))
+	require.Error(t, err)
+
+	kf = sealedKeyFile(t)
+	kf.KDF.P = scryptMaxP * 2
+	_, err = kf.Open([]byte("hunter2"))
+	require.Error(t, err)
+}
+
+func TestReadLineSharesInput(t *testing.T) {
+	// a key followed by its passphrase, as a script would pipe them in
+	r := bufio.NewReader(strings.NewReader("npvtexample\r\nhunter2\nlast"))
+	for _, want := range []string{"npvtexample", "hunter2", "last"} {
+		line, err := readLine(r)
+		require.NoError(t, err)
+		require.Equal(t, want, string(line))
+	}
+	_, err := readLine(r)
+	require.Equal(t, io.EOF, err)
+}
+
+func TestKeyFileDisk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyfile")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "key.json")
+
+	kf := sealedKeyFile(t)
+	require.NoError(t, writeKeyFile(path, kf))
+	// never overwrite an existing key
+	require.Error(t, writeKeyFile(path, kf))
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	got, err := readKeyFile(path)
+	require.NoError(t, err)
+	gotJS, err := json.Marshal(got)
+	require.NoError(t, err)
+	kfJS, err := json.Marshal(kf)
+	require.NoError(t, err)
+	require.JSONEq(t, string(kfJS), string(gotJS))
+}
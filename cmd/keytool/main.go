@@ -25,6 +25,8 @@ func main() {
 	app.Command("addr", "generate addresses from public keys", cmdAddr)
 	app.Command("truncate", "remove any extra data from a key", cmdTruncate)
 	app.Command("inspect", "inspect a key", cmdInspect)
+	app.Command("keyfile", "manage encrypted key files", keyfile)
+	app.Command("shamir", "split and combine secrets with shamir secret sharing", shamir)
 
 	app.Run(os.Args)
 }
@@ -38,6 +40,8 @@ func hd(cmd *cli.Cmd) {
 	cmd.Command("addr", "convert HD key to address", cmdHDAddr)
 	cmd.Command("raw", "create an ndau-style secp256k1 key or signature from raw bytes", cmdHDRaw)
 	cmd.Command("from-words words", "generate a hd root key from a seed phrase", cmdHDWords)
+	cmd.Command("derive-range", "derive public keys and addresses for a range of child indices", cmdHDDeriveRange)
+	cmd.Command("derive-range-public", "derive-range from a public key, without accepting any private key", cmdHDDeriveRangePublic)
 }
 
 // ed subcommand
@@ -0,0 +1,510 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"strings"
+
+	cli "github.com/jawher/mow.cli"
+	"github.com/ndau/ndaumath/pkg/address"
+	"github.com/ndau/ndaumath/pkg/b32"
+	"github.com/ndau/ndaumath/pkg/key"
+	"github.com/ndau/ndaumath/pkg/signature"
+	"github.com/ndau/ndaumath/pkg/words"
+	"github.com/pkg/errors"
+)
+
+// Shamir's secret sharing over GF(2^8).
+//
+// Each byte of the secret is the constant term of an independent random
+// polynomial of degree threshold-1. Share i is the evaluation of every
+// polynomial at x = i, for i in 1..n. Any threshold shares suffice to
+// recover the constant terms by Lagrange interpolation at x = 0.
+
+// field arithmetic uses the AES polynomial x^8 + x^4 + x^3 + x + 1,
+// with 3 as the generator for the log tables
+var (
+	gfExp [510]byte
+	gfLog [256]byte
+)
+
+func init() {
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		gfExp[i] = x
+		gfExp[i+255] = x
+		gfLog[x] = byte(i)
+		// multiply x by the generator 3: x*2 ^ x
+		hi := x & 0x80
+		x2 := x << 1
+		if hi != 0 {
+			x2 ^= 0x1b
+		}
+		x = x2 ^ x
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfDiv(a, b byte) byte {
+	if b == 0 {
+		panic("division by zero in GF(256)")
+	}
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+255-int(gfLog[b])]
+}
+
+// shamirSplit splits secret into n shares, any m of which can reconstruct it
+//
+// The returned slice has n elements; element i is the share for x = i+1.
+func shamirSplit(secret []byte, m, n int) ([][]byte, error) {
+	if m < 1 {
+		return nil, errors.New("threshold must be at least 1")
+	}
+	if n < m {
+		return nil, fmt.Errorf("cannot require %d of only %d shares", m, n)
+	}
+	if n > 255 {
+		return nil, fmt.Errorf("at most 255 shares are supported; got %d", n)
+	}
+	if len(secret) == 0 {
+		return nil, errors.New("cannot split an empty secret")
+	}
+
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret))
+	}
+
+	coefs := make([]byte, m)
+	for bidx, sb := range secret {
+		coefs[0] = sb
+		_, err := rand.Read(coefs[1:])
+		if err != nil {
+			return nil, err
+		}
+		for i := range shares {
+			x := byte(i + 1)
+			// Horner's method
+			var y byte
+			for c := m - 1; c >= 0; c-- {
+				y = gfMul(y, x) ^ coefs[c]
+			}
+			shares[i][bidx] = y
+		}
+	}
+	// don't leave the polynomial lying around in memory
+	for i := range coefs {
+		coefs[i] = 0
+	}
+	return shares, nil
+}
+
+// shamirCombine reconstructs a secret from shares
+//
+// xs[i] is the x coordinate of ys[i]. Every element of ys must have the same
+// length. It is the caller's responsibility to supply at least threshold
+// shares; with fewer, the output is garbage.
+func shamirCombine(xs []byte, ys [][]byte) ([]byte, error) {
+	if len(xs) == 0 || len(xs) != len(ys) {
+		return nil, errors.New("shares and x coordinates must be nonempty and equal in number")
+	}
+	seen := make(map[byte]struct{}, len(xs))
+	for i, x := range xs {
+		if x == 0 {
+			return nil, errors.New("share x coordinate must not be 0")
+		}
+		if _, ok := seen[x]; ok {
+			return nil, fmt.Errorf("duplicate share %d", x)
+		}
+		seen[x] = struct{}{}
+		if len(ys[i]) != len(ys[0]) {
+			return nil, errors.New("shares have inconsistent lengths")
+		}
+	}
+
+	// lagrange basis polynomials evaluated at 0
+	basis := make([]byte, len(xs))
+	for i, xi := range xs {
+		l := byte(1)
+		for j, xj := range xs {
+			if i == j {
+				continue
+			}
+			// (0 - xj) / (xi - xj); subtraction is xor
+			l = gfMul(l, gfDiv(xj, xi^xj))
+		}
+		basis[i] = l
+	}
+
+	secret := make([]byte, len(ys[0]))
+	for bidx := range secret {
+		var s byte
+		for i := range xs {
+			s ^= gfMul(basis[i], ys[i][bidx])
+		}
+		secret[bidx] = s
+	}
+	return secret, nil
+}
+
+// kinds of secret which a share can hold
+const (
+	shareKindKey    byte = 'k' // secp256k1 HD private key: 32 key bytes + 40 extra bytes
+	shareKindPhrase byte = 'p' // seed phrase entropy
+)
+
+// A share's header is its version, kind, threshold and index, followed by
+// the ID of the split it came from, which keeps shares of different splits
+// from being combined.
+//
+// What is split is the secret followed by its checksum, so that the checksum
+// can only be read, and the combined secret verified, once enough shares
+// are combined; no single share reveals anything about the secret.
+const (
+	shareVersion     byte = 1
+	shareSplitIDLen       = 4
+	shareChecksumLen      = 4
+	shareHeaderLen        = 4 + shareSplitIDLen
+	shareTextPrefix       = "nshr"
+)
+
+// A share is one piece of a split secret
+type share struct {
+	kind      byte
+	threshold byte
+	index     byte
+	splitID   [shareSplitIDLen]byte
+	data      []byte
+}
+
+func shareChecksum(b []byte) []byte {
+	sum := sha256.Sum256(b)
+	return sum[:shareChecksumLen]
+}
+
+// Bytes serializes the share with its header and checksum
+func (s share) Bytes() []byte {
+	b := make([]byte, 0, shareHeaderLen+len(s.data)+shareChecksumLen)
+	b = append(b, shareVersion, s.kind, s.threshold, s.index)
+	b = append(b, s.splitID[:]...)
+	b = append(b, s.data...)
+	return append(b, shareChecksum(b)...)
+}
+
+func shareFromBytes(b []byte) (share, error) {
+	if len(b) <= shareHeaderLen+shareChecksumLen {
+		return share{}, errors.New("share too short")
+	}
+	body := b[:len(b)-shareChecksumLen]
+	if !bytes.Equal(shareChecksum(body), b[len(body):]) {
+		return share{}, errors.New("share checksum mismatch")
+	}
+	if body[0] != shareVersion {
+		return share{}, fmt.Errorf("unsupported share version %d", body[0])
+	}
+	s := share{
+		kind:      body[1],
+		threshold: body[2],
+		index:     body[3],
+		data:      append([]byte{}, body[shareHeaderLen:]...),
+	}
+	copy(s.splitID[:], body[4:])
+	if s.kind != shareKindKey && s.kind != shareKindPhrase {
+		return share{}, fmt.Errorf("unknown share kind %q", s.kind)
+	}
+	if s.index == 0 || s.threshold == 0 {
+		return share{}, errors.New("share header is invalid")
+	}
+	return s, nil
+}
+
+// Text encodes the share in ndau style: a fixed prefix and base32
+func (s share) Text() string {
+	return shareTextPrefix + b32.Encode(s.Bytes())
+}
+
+// shareChunks breaks a length into chunks which are valid bip39 entropy
+// lengths: multiples of 4 between 16 and 32 bytes.
+//
+// The input length must be a multiple of 4 and at least 16.
+func shareChunks(n int) []int {
+	var chunks []int
+	for n > 48 {
+		chunks = append(chunks, 32)
+		n -= 32
+	}
+	if n > 32 {
+		chunks = append(chunks, n-16)
+		n = 16
+	}
+	return append(chunks, n)
+}
+
+// Words encodes the share as a sequence of bip39 words
+//
+// Shares are generally longer than a single bip39 phrase supports, so the
+// share is broken into several chunks, each of which carries its own bip39
+// checksum in addition to the share's own checksum.
+func (s share) Words(lang string) ([]string, error) {
+	// a 4-byte prefix records how much zero padding follows the share,
+	// keeping the total length a multiple of 4
+	raw := s.Bytes()
+	pad := (4 - len(raw)%4) % 4
+	b := make([]byte, 0, 4+len(raw)+pad)
+	b = append(b, byte(pad), 0, 0, 0)
+	b = append(b, raw...)
+	b = append(b, make([]byte, pad)...)
+
+	var out []string
+	for _, clen := range shareChunks(len(b)) {
+		ws, err := words.FromBytes(lang, b[:clen])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, ws...)
+		b = b[clen:]
+	}
+	return out, nil
+}
+
+func shareFromWords(lang string, ws []string) (share, error) {
+	if len(ws)%3 != 0 {
+		return share{}, errors.New("share word count must be a multiple of 3")
+	}
+	// each chunk of 4k bytes encodes to 3k words
+	n := len(ws) / 3 * 4
+	if n < 16 {
+		return share{}, errors.New("too few words for a share")
+	}
+	var b []byte
+	for _, clen := range shareChunks(n) {
+		wlen := clen / 4 * 3
+		chunk, err := words.ToBytes(lang, ws[:wlen])
+		if err != nil {
+			return share{}, err
+		}
+		b = append(b, chunk...)
+		ws = ws[wlen:]
+	}
+	pad := int(b[0])
+	b = b[4:]
+	if pad > 3 || pad > len(b) {
+		return share{}, errors.New("share padding is invalid")
+	}
+	return shareFromBytes(b[:len(b)-pad])
+}
+
+// parseShare decodes a share from either its text or its word form
+func parseShare(lang, s string) (share, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, shareTextPrefix) {
+		b, err := b32.Decode(strings.TrimPrefix(s, shareTextPrefix))
+		if err != nil {
+			return share{}, err
+		}
+		return shareFromBytes(b)
+	}
+	ws := strings.Fields(strings.ToLower(s))
+	return shareFromWords(lang, ws)
+}
+
+// splitShares splits a secret of the given kind into n shares with threshold m
+func splitShares(kind byte, secret []byte, m, n int) ([]share, error) {
+	payload := append(append([]byte{}, secret...), shareChecksum(secret)...)
+	ys, err := shamirSplit(payload, m, n)
+	if err != nil {
+		return nil, err
+	}
+	var splitID [shareSplitIDLen]byte
+	_, err = rand.Read(splitID[:])
+	if err != nil {
+		return nil, err
+	}
+	shares := make([]share, n)
+	for i := range ys {
+		shares[i] = share{
+			kind:      kind,
+			threshold: byte(m),
+			index:     byte(i + 1),
+			splitID:   splitID,
+			data:      ys[i],
+		}
+	}
+	return shares, nil
+}
+
+// combineShares reconstructs the secret from a set of shares
+//
+// It ensures that the shares all come from the same split, that there are
+// at least as many of them as the threshold requires, and that the secret
+// they rebuild matches the checksum which was split along with it.
+func combineShares(shares []share) (kind byte, secret []byte, err error) {
+	if len(shares) == 0 {
+		return 0, nil, errors.New("no shares supplied")
+	}
+	first := shares[0]
+	xs := make([]byte, len(shares))
+	ys := make([][]byte, len(shares))
+	for i, s := range shares {
+		if s.splitID != first.splitID ||
+			s.kind != first.kind || s.threshold != first.threshold {
+			return 0, nil, fmt.Errorf("share %d does not belong with share %d", s.index, first.index)
+		}
+		xs[i] = s.index
+		ys[i] = s.data
+	}
+	if len(shares) < int(first.threshold) {
+		return 0, nil, fmt.Errorf("%d shares are required; only %d supplied", first.threshold, len(shares))
+	}
+	payload, err := shamirCombine(xs, ys)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(payload) <= shareChecksumLen {
+		return 0, nil, errors.New("shares are too short to hold a secret")
+	}
+	secret = payload[:len(payload)-shareChecksumLen]
+	if !bytes.Equal(shareChecksum(secret), payload[len(secret):]) {
+		return 0, nil, errors.New("shares do not rebuild the secret they were split from")
+	}
+	return first.kind, secret, nil
+}
+
+// shamir subcommand
+func shamir(cmd *cli.Cmd) {
+	cmd.Command("split", "split an HD private key or seed phrase into shares", cmdShamirSplit)
+	cmd.Command("combine", "rebuild an HD private key or seed phrase from shares", cmdShamirCombine)
+}
+
+const defaultVerifyPath = "/44'/20036'/100/1"
+
+func cmdShamirSplit(cmd *cli.Cmd) {
+	cmd.Spec = fmt.Sprintf(
+		"(%s | --phrase=<WORDS>) -m=<M> -n=<N> [--words] [--lang=<LANG_CODE>]",
+		getKeySpec("PVT"),
+	)
+
+	getKey := getKeyClosure(cmd, "PVT", "HD private key to split")
+	var (
+		phrase    = cmd.StringOpt("p phrase", "", "seed phrase to split, as a single quoted argument")
+		threshold = cmd.IntOpt("m threshold", 0, "number of shares required to rebuild the secret")
+		nshares   = cmd.IntOpt("n shares", 0, "number of shares to generate")
+		asWords   = cmd.BoolOpt("w words", false, "emit shares as words instead of ndau-style text")
+		lang      = cmd.StringOpt("l lang", "en", "language of wordlist")
+	)
+
+	cmd.Action = func() {
+		var (
+			kind   byte
+			secret []byte
+			err    error
+		)
+		if phrase != nil && *phrase != "" {
+			kind = shareKindPhrase
+			secret, err = words.ToBytes(*lang, strings.Fields(strings.ToLower(*phrase)))
+			check(errors.Wrap(err, "interpreting words"))
+		} else {
+			pvt, ok := getKey().(*signature.PrivateKey)
+			if !ok {
+				check(errors.New("only private keys can be split"))
+			}
+			if signature.NameOf(pvt.Algorithm()) != signature.NameOf(signature.Secp256k1) || len(pvt.ExtraBytes()) != 40 {
+				check(errors.New("only HD private keys can be split"))
+			}
+			kind = shareKindKey
+			secret = append(append([]byte{}, pvt.KeyBytes()...), pvt.ExtraBytes()...)
+		}
+
+		shares, err := splitShares(kind, secret, *threshold, *nshares)
+		check(err)
+		for _, s := range shares {
+			if *asWords {
+				ws, err := s.Words(*lang)
+				check(errors.Wrap(err, "encoding share as words"))
+				fmt.Println(strings.Join(ws, " "))
+			} else {
+				fmt.Println(s.Text())
+			}
+		}
+	}
+}
+
+func cmdShamirCombine(cmd *cli.Cmd) {
+	cmd.Spec = fmt.Sprintf(
+		"SHARE... [--lang=<LANG_CODE>] [--verify=<ADDR> [--path=<PATH>] %s]",
+		getKindSpec(),
+	)
+
+	var (
+		sharesS = cmd.StringsArg("SHARE", nil, "shares, as text or as a single quoted argument of words")
+		lang    = cmd.StringOpt("l lang", "en", "language of wordlist")
+		verify  = cmd.StringOpt("verify", "", "ensure the rebuilt key generates this address")
+		path    = cmd.StringOpt("path", defaultVerifyPath, "derivation path of the address to verify")
+	)
+	getKind := getKindClosure(cmd)
+
+	cmd.Action = func() {
+		shares := make([]share, 0, len(*sharesS))
+		for idx, s := range *sharesS {
+			sh, err := parseShare(*lang, s)
+			check(errors.Wrap(err, fmt.Sprintf("parsing share %d", idx+1)))
+			shares = append(shares, sh)
+		}
+
+		kind, secret, err := combineShares(shares)
+		check(err)
+
+		var root *key.ExtendedKey
+		switch kind {
+		case shareKindPhrase:
+			phrase, err := words.FromBytes(*lang, secret)
+			check(errors.Wrap(err, "converting secret to words"))
+			fmt.Println(strings.Join(phrase, " "))
+			root, err = key.NewMaster(secret)
+			check(errors.Wrap(err, "generating root key"))
+		case shareKindKey:
+			if len(secret) != 72 {
+				check(fmt.Errorf("rebuilt key has wrong length %d", len(secret)))
+			}
+			pvt, err := signature.RawPrivateKey(signature.Secp256k1, secret[:32], secret[32:])
+			check(err)
+			text, err := pvt.MarshalText()
+			check(err)
+			fmt.Println(string(text))
+			root, err = key.FromSignatureKey(pvt)
+			check(err)
+		}
+
+		if verify != nil && *verify != "" {
+			child, err := root.DeriveFrom("/", *path)
+			check(errors.Wrap(err, "deriving verification key"))
+			addr, err := address.Generate(getKind(), child.PubKeyBytes())
+			check(err)
+			if addr.String() != *verify {
+				fmt.Fprintf(os.Stderr, "address mismatch: %s derives %s\n", *path, addr)
+				cli.Exit(2)
+			}
+			fmt.Fprintln(os.Stderr, "address verified")
+		}
+	}
+}
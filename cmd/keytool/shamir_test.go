@@ -0,0 +1,181 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// subsets calls f with every subset of the indices 0..n-1
+func subsets(n int, f func([]int)) {
+	for mask := 1; mask < 1<<uint(n); mask++ {
+		var idxs []int
+		for i := 0; i < n; i++ {
+			if mask&(1<<uint(i)) != 0 {
+				idxs = append(idxs, i)
+			}
+		}
+		f(idxs)
+	}
+}
+
+func TestGFInverse(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		require.Equal(t, byte(1), gfMul(byte(a), gfDiv(1, byte(a))), "a=%d", a)
+	}
+}
+
+func TestShamirEveryCombination(t *testing.T) {
+	secret := make([]byte, 72)
+	_, err := rand.Read(secret)
+	require.NoError(t, err)
+
+	for n := 1; n <= 6; n++ {
+		for m := 1; m <= n; m++ {
+			t.Run(fmt.Sprintf("%d of %d", m, n), func(t *testing.T) {
+				shares, err := splitShares(shareKindKey, secret, m, n)
+				require.NoError(t, err)
+				require.Len(t, shares, n)
+
+				subsets(n, func(idxs []int) {
+					subset := make([]share, 0, len(idxs))
+					for _, i := range idxs {
+						subset = append(subset, shares[i])
+					}
+					kind, got, err := combineShares(subset)
+					if len(idxs) < m {
+						require.Error(t, err, "%v", idxs)
+						return
+					}
+					require.NoError(t, err, "%v", idxs)
+					require.Equal(t, shareKindKey, kind)
+					require.Equal(t, secret, got, "%v", idxs)
+				})
+			})
+		}
+	}
+}
+
+func TestShamirTooFewSharesDoNotReveal(t *testing.T) {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	require.NoError(t, err)
+
+	ys, err := shamirSplit(secret, 3, 5)
+	require.NoError(t, err)
+	got, err := shamirCombine([]byte{1, 2}, ys[:2])
+	require.NoError(t, err)
+	require.NotEqual(t, secret, got)
+}
+
+func TestShamirBadParameters(t *testing.T) {
+	secret := []byte{1, 2, 3}
+	_, err := shamirSplit(secret, 0, 3)
+	require.Error(t, err)
+	_, err = shamirSplit(secret, 4, 3)
+	require.Error(t, err)
+	_, err = shamirSplit(secret, 2, 256)
+	require.Error(t, err)
+	_, err = shamirSplit(nil, 2, 3)
+	require.Error(t, err)
+}
+
+func TestShareEncodingRoundtrip(t *testing.T) {
+	for _, tc := range []struct {
+		kind byte
+		len  int
+	}{
+		{shareKindPhrase, 16},
+		{shareKindPhrase, 32},
+		{shareKindKey, 72},
+	} {
+		t.Run(fmt.Sprintf("%c %d", tc.kind, tc.len), func(t *testing.T) {
+			secret := make([]byte, tc.len)
+			_, err := rand.Read(secret)
+			require.NoError(t, err)
+			shares, err := splitShares(tc.kind, secret, 2, 3)
+			require.NoError(t, err)
+
+			for _, s := range shares {
+				got, err := parseShare("en", s.Text())
+				require.NoError(t, err)
+				require.Equal(t, s, got)
+
+				ws, err := s.Words("en")
+				require.NoError(t, err)
+				got, err = parseShare("en", strings.Join(ws, " "))
+				require.NoError(t, err)
+				require.Equal(t, s, got)
+			}
+		})
+	}
+}
+
+func TestShareChecksum(t *testing.T) {
+	shares, err := splitShares(shareKindPhrase, make([]byte, 16), 2, 2)
+	require.NoError(t, err)
+	b := shares[0].Bytes()
+	b[5] ^= 0xff
+	_, err = shareFromBytes(b)
+	require.Error(t, err)
+}
+
+func TestCombineRejectsMixedShares(t *testing.T) {
+	a, err := splitShares(shareKindPhrase, make([]byte, 16), 2, 3)
+	require.NoError(t, err)
+	b, err := splitShares(shareKindPhrase, make([]byte, 16), 3, 3)
+	require.NoError(t, err)
+	_, _, err = combineShares([]share{a[0], b[1], b[2]})
+	require.Error(t, err)
+	_, _, err = combineShares([]share{a[0], a[0]})
+	require.Error(t, err)
+
+	// same kind and threshold, but a different split of the same secret
+	c, err := splitShares(shareKindPhrase, make([]byte, 16), 2, 3)
+	require.NoError(t, err)
+	_, _, err = combineShares([]share{a[0], c[1]})
+	require.Error(t, err)
+}
+
+func TestCombineVerifiesSecret(t *testing.T) {
+	secret := make([]byte, 16)
+	_, err := rand.Read(secret)
+	require.NoError(t, err)
+	shares, err := splitShares(shareKindPhrase, secret, 2, 3)
+	require.NoError(t, err)
+
+	// a share whose data was altered, but whose own checksum is intact
+	shares[1].data[0] ^= 0xff
+	b := shares[1].Bytes()
+	bad, err := shareFromBytes(b)
+	require.NoError(t, err)
+	_, _, err = combineShares([]share{shares[0], bad})
+	require.Error(t, err)
+
+	_, got, err := combineShares([]share{shares[0], shares[2]})
+	require.NoError(t, err)
+	require.Equal(t, secret, got)
+}
+
+func TestShareDoesNotCarrySecretChecksum(t *testing.T) {
+	secret := make([]byte, 16)
+	_, err := rand.Read(secret)
+	require.NoError(t, err)
+	shares, err := splitShares(shareKindPhrase, secret, 2, 3)
+	require.NoError(t, err)
+	for _, s := range shares {
+		require.NotContains(t, string(s.Bytes()), string(shareChecksum(secret)))
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// In dev mode, ndaunode needs no noms or redis server: noms is kept in
+// memory, or in a local store under -dev-dir, and the index is served by a
+// redis server embedded in the process: see indexServer. The index always
+// starts empty, so the app rebuilds it from the noms state at startup, as it
+// does whenever indexVersion changes.
+
+// the embedded index server, started on first use
+var devIndex *indexServer
+
+func getDevDbSpec() string {
+	if len(*devDir) > 0 {
+		return filepath.Join(*devDir, "noms")
+	}
+	return "mem"
+}
+
+func getDevIndexAddr() string {
+	if devIndex == nil {
+		var err error
+		devIndex, err = startIndexServer()
+		check(errors.Wrap(err, "starting embedded index"))
+	}
+	return devIndex.Addr()
+}
+
+// checkDevState fails if flags which change the state and exit are used
+// under -dev while the state is in memory, where the change would be lost
+func checkDevState(flags string) {
+	if *devMode && len(*devDir) == 0 && len(*dbspec) == 0 {
+		check(fmt.Errorf("%s would change the state in memory and exit, losing it; use -dev-dir with -dev to keep it", flags))
+	}
+}
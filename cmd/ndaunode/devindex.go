@@ -0,0 +1,1179 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// An indexServer is the redis server which serves the search index under
+// -dev. It keeps its data in memory, speaks the redis protocol, and
+// implements only the commands in indexCommands: the string, key, set,
+// sorted set, hash and list commands the search index uses, and MULTI and
+// EXEC for its transactions. Anything else is an error, which is written
+// to stderr too, so that an index which comes to need another command
+// fails where it can be seen.
+type indexServer struct {
+	ln   net.Listener
+	mu   sync.Mutex
+	keys map[string]interface{}
+	// failures lists the commands which got an error reply
+	failures []string
+}
+
+type (
+	// a status is a simple string reply, like OK
+	status string
+	// a redisError is an error reply
+	redisError string
+
+	redisSet  map[string]struct{}
+	redisZSet map[string]float64
+	redisHash map[string]string
+	redisList struct{ items []string }
+)
+
+const (
+	errWrongType = redisError("WRONGTYPE Operation against a key holding the wrong kind of value")
+	errSyntax    = redisError("ERR syntax error")
+	errNotInt    = redisError("ERR value is not an integer or out of range")
+	errNotFloat  = redisError("ERR value is not a valid float")
+	errLexRange  = redisError("ERR min or max not valid string range item")
+)
+
+// an indexCommand takes at least min arguments, after its name, and at
+// most max, or any number if max is negative
+type indexCommand struct {
+	min, max int
+	run      func(s *indexServer, args []string) interface{}
+}
+
+var indexCommands = map[string]indexCommand{
+	// connection and server
+	"ping":     {0, 1, (*indexServer).ping},
+	"echo":     {1, 1, func(s *indexServer, args []string) interface{} { return args[0] }},
+	"select":   {1, 1, (*indexServer).selectdb},
+	"dbsize":   {0, 0, func(s *indexServer, args []string) interface{} { return len(s.keys) }},
+	"flushdb":  {0, 1, (*indexServer).flush},
+	"flushall": {0, 1, (*indexServer).flush},
+
+	// keys
+	"del":    {1, -1, (*indexServer).del},
+	"exists": {1, -1, (*indexServer).exists},
+	"type":   {1, 1, (*indexServer).keytype},
+	"keys":   {1, 1, (*indexServer).keysMatching},
+	"scan":   {1, -1, (*indexServer).scan},
+
+	// strings
+	"get":    {1, 1, (*indexServer).get},
+	"set":    {2, 3, (*indexServer).set},
+	"setnx":  {2, 2, (*indexServer).setnx},
+	"mget":   {1, -1, (*indexServer).mget},
+	"incr":   {1, 1, func(s *indexServer, args []string) interface{} { return s.incrby(args[0], "1") }},
+	"incrby": {2, 2, func(s *indexServer, args []string) interface{} { return s.incrby(args[0], args[1]) }},
+
+	// sets
+	"sadd":      {2, -1, (*indexServer).sadd},
+	"srem":      {2, -1, (*indexServer).srem},
+	"smembers":  {1, 1, (*indexServer).smembers},
+	"sismember": {2, 2, (*indexServer).sismember},
+	"scard":     {1, 1, (*indexServer).scard},
+
+	// sorted sets
+	"zadd":             {3, -1, (*indexServer).zadd},
+	"zincrby":          {3, 3, (*indexServer).zincrby},
+	"zrem":             {2, -1, (*indexServer).zrem},
+	"zcard":            {1, 1, (*indexServer).zcard},
+	"zscore":           {2, 2, (*indexServer).zscore},
+	"zcount":           {3, 3, (*indexServer).zcount},
+	"zrange":           {3, 4, func(s *indexServer, args []string) interface{} { return s.zrange(args, false) }},
+	"zrevrange":        {3, 4, func(s *indexServer, args []string) interface{} { return s.zrange(args, true) }},
+	"zrangebyscore":    {3, 7, func(s *indexServer, args []string) interface{} { return s.zrangebyscore(args, false) }},
+	"zrevrangebyscore": {3, 7, func(s *indexServer, args []string) interface{} { return s.zrangebyscore(args, true) }},
+	"zrangebylex":      {3, 6, func(s *indexServer, args []string) interface{} { return s.zrangebylex(args, false) }},
+	"zrevrangebylex":   {3, 6, func(s *indexServer, args []string) interface{} { return s.zrangebylex(args, true) }},
+
+	// hashes
+	"hset":    {3, -1, func(s *indexServer, args []string) interface{} { return s.hset(args, false) }},
+	"hmset":   {3, -1, func(s *indexServer, args []string) interface{} { return s.hset(args, true) }},
+	"hget":    {2, 2, (*indexServer).hget},
+	"hmget":   {2, -1, (*indexServer).hmget},
+	"hdel":    {2, -1, (*indexServer).hdel},
+	"hexists": {2, 2, (*indexServer).hexists},
+	"hgetall": {1, 1, (*indexServer).hgetall},
+	"hkeys":   {1, 1, (*indexServer).hkeys},
+	"hlen":    {1, 1, (*indexServer).hlen},
+	"hincrby": {3, 3, (*indexServer).hincrby},
+
+	// lists
+	"lpush":  {2, -1, func(s *indexServer, args []string) interface{} { return s.push(args, true) }},
+	"rpush":  {2, -1, func(s *indexServer, args []string) interface{} { return s.push(args, false) }},
+	"lrange": {3, 3, (*indexServer).lrange},
+	"llen":   {1, 1, (*indexServer).llen},
+}
+
+// startIndexServer starts an empty index server on a free local port
+func startIndexServer() (*indexServer, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &indexServer{ln: ln, keys: make(map[string]interface{})}
+	go s.serve()
+	return s, nil
+}
+
+// Addr is the address the server listens on
+func (s *indexServer) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Failures returns each command which got an error reply, with the error
+func (s *indexServer) Failures() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.failures...)
+}
+
+// Close stops the server accepting connections
+func (s *indexServer) Close() error {
+	return s.ln.Close()
+}
+
+func (s *indexServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+// handle serves a connection until the client closes it or sends something
+// which isn't a command
+func (s *indexServer) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	var multi bool
+	var queued [][]string
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			if err != io.EOF {
+				writeReply(w, redisError("ERR Protocol error: "+err.Error()))
+				w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		var reply interface{}
+		switch name := strings.ToLower(args[0]); {
+		case name == "quit":
+			writeReply(w, status("OK"))
+			w.Flush()
+			return
+		case name == "multi" && multi:
+			reply = redisError("ERR MULTI calls can not be nested")
+		case name == "multi":
+			multi, queued = true, nil
+			reply = status("OK")
+		case name == "exec" && !multi:
+			reply = redisError("ERR EXEC without MULTI")
+		case name == "exec":
+			reply = s.exec(queued...)
+			multi, queued = false, nil
+		case name == "discard" && !multi:
+			reply = redisError("ERR DISCARD without MULTI")
+		case name == "discard":
+			multi, queued = false, nil
+			reply = status("OK")
+		case multi:
+			queued = append(queued, args)
+			reply = status("QUEUED")
+		default:
+			reply = s.exec(args)[0]
+		}
+
+		// pipelined commands are answered together
+		writeReply(w, reply)
+		if r.Buffered() == 0 {
+			if w.Flush() != nil {
+				return
+			}
+		}
+	}
+}
+
+// exec runs commands one after another, with nothing in between
+func (s *indexServer) exec(cmds ...[]string) []interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	replies := make([]interface{}, len(cmds))
+	for i, args := range cmds {
+		replies[i] = s.run(args)
+		if e, ok := replies[i].(redisError); ok {
+			s.failures = append(s.failures, fmt.Sprintf("%s: %s", strings.ToUpper(args[0]), e))
+		}
+	}
+	return replies
+}
+
+func (s *indexServer) run(args []string) interface{} {
+	name := strings.ToLower(args[0])
+	cmd, ok := indexCommands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "embedded index: unsupported command %s\n", strings.ToUpper(name))
+		return redisError(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+	}
+	n := len(args) - 1
+	if n < cmd.min || (cmd.max >= 0 && n > cmd.max) {
+		return redisError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", name))
+	}
+	return cmd.run(s, args[1:])
+}
+
+// readCommand reads a command: an array of bulk strings
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	n, err := readLength(line, '*')
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err = readLine(r)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		size, err := readLength(line, '$')
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err = io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		if data[size] != '\r' || data[size+1] != '\n' {
+			return nil, fmt.Errorf("bulk string %d isn't %d bytes", i, size)
+		}
+		args[i] = string(data[:size])
+	}
+	return args, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(line[:len(line)-1], "\r"), nil
+}
+
+// readLength parses the length in an array or bulk string header
+func readLength(line string, prefix byte) (int, error) {
+	if len(line) == 0 || line[0] != prefix {
+		return 0, fmt.Errorf("expected '%c', got %q", prefix, line)
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 || n > 512*1024*1024 {
+		return 0, fmt.Errorf("invalid length %q", line[1:])
+	}
+	return n, nil
+}
+
+// writeReply writes a reply: nil is a null bulk string, a string is a bulk
+// string, an int is an integer, and a slice is an array
+func writeReply(w *bufio.Writer, reply interface{}) {
+	switch r := reply.(type) {
+	case nil:
+		w.WriteString("$-1\r\n")
+	case status:
+		fmt.Fprintf(w, "+%s\r\n", r)
+	case redisError:
+		fmt.Fprintf(w, "-%s\r\n", r)
+	case int:
+		fmt.Fprintf(w, ":%d\r\n", r)
+	case string:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(r), r)
+	case []string:
+		fmt.Fprintf(w, "*%d\r\n", len(r))
+		for _, item := range r {
+			writeReply(w, item)
+		}
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(r))
+		for _, item := range r {
+			writeReply(w, item)
+		}
+	default:
+		panic(fmt.Sprintf("embedded index can't reply with a %T", reply))
+	}
+}
+
+// ----- connection, server and keys
+
+func (s *indexServer) ping(args []string) interface{} {
+	if len(args) > 0 {
+		return args[0]
+	}
+	return status("PONG")
+}
+
+func (s *indexServer) selectdb(args []string) interface{} {
+	if args[0] != "0" {
+		return redisError("ERR the embedded index has only database 0")
+	}
+	return status("OK")
+}
+
+func (s *indexServer) flush(args []string) interface{} {
+	s.keys = make(map[string]interface{})
+	return status("OK")
+}
+
+func (s *indexServer) del(args []string) interface{} {
+	n := 0
+	for _, key := range args {
+		if _, ok := s.keys[key]; ok {
+			delete(s.keys, key)
+			n++
+		}
+	}
+	return n
+}
+
+func (s *indexServer) exists(args []string) interface{} {
+	n := 0
+	for _, key := range args {
+		if _, ok := s.keys[key]; ok {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *indexServer) keytype(args []string) interface{} {
+	switch s.keys[args[0]].(type) {
+	case string:
+		return status("string")
+	case redisSet:
+		return status("set")
+	case redisZSet:
+		return status("zset")
+	case redisHash:
+		return status("hash")
+	case *redisList:
+		return status("list")
+	}
+	return status("none")
+}
+
+// matching returns the keys matching a glob pattern, sorted
+func (s *indexServer) matching(pattern string) ([]string, error) {
+	keys := []string{}
+	for key := range s.keys {
+		ok, err := path.Match(pattern, key)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *indexServer) keysMatching(args []string) interface{} {
+	keys, err := s.matching(args[0])
+	if err != nil {
+		return errSyntax
+	}
+	return keys
+}
+
+// scan returns every matching key at once, with a cursor of 0
+func (s *indexServer) scan(args []string) interface{} {
+	pattern := "*"
+	for i := 1; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			return errSyntax
+		}
+		switch strings.ToLower(args[i]) {
+		case "match":
+			pattern = args[i+1]
+		case "count":
+			if _, err := strconv.Atoi(args[i+1]); err != nil {
+				return errNotInt
+			}
+		default:
+			return errSyntax
+		}
+	}
+	keys, err := s.matching(pattern)
+	if err != nil {
+		return errSyntax
+	}
+	return []interface{}{"0", keys}
+}
+
+// prune removes a key whose collection has become empty
+func (s *indexServer) prune(key string) {
+	switch v := s.keys[key].(type) {
+	case redisSet:
+		if len(v) == 0 {
+			delete(s.keys, key)
+		}
+	case redisZSet:
+		if len(v) == 0 {
+			delete(s.keys, key)
+		}
+	case redisHash:
+		if len(v) == 0 {
+			delete(s.keys, key)
+		}
+	case *redisList:
+		if len(v.items) == 0 {
+			delete(s.keys, key)
+		}
+	}
+}
+
+// ----- strings
+
+func (s *indexServer) get(args []string) interface{} {
+	v, ok := s.keys[args[0]]
+	if !ok {
+		return nil
+	}
+	str, ok := v.(string)
+	if !ok {
+		return errWrongType
+	}
+	return str
+}
+
+func (s *indexServer) set(args []string) interface{} {
+	key := args[0]
+	_, exists := s.keys[key]
+	if len(args) == 3 {
+		switch strings.ToLower(args[2]) {
+		case "nx":
+			if exists {
+				return nil
+			}
+		case "xx":
+			if !exists {
+				return nil
+			}
+		default:
+			return errSyntax
+		}
+	}
+	s.keys[key] = args[1]
+	return status("OK")
+}
+
+func (s *indexServer) setnx(args []string) interface{} {
+	if _, exists := s.keys[args[0]]; exists {
+		return 0
+	}
+	s.keys[args[0]] = args[1]
+	return 1
+}
+
+func (s *indexServer) mget(args []string) interface{} {
+	values := make([]interface{}, len(args))
+	for i, key := range args {
+		if str, ok := s.keys[key].(string); ok {
+			values[i] = str
+		}
+	}
+	return values
+}
+
+func (s *indexServer) incrby(key, by string) interface{} {
+	inc, err := strconv.ParseInt(by, 10, 64)
+	if err != nil {
+		return errNotInt
+	}
+	var n int64
+	if v, ok := s.keys[key]; ok {
+		str, ok := v.(string)
+		if !ok {
+			return errWrongType
+		}
+		if n, err = strconv.ParseInt(str, 10, 64); err != nil {
+			return errNotInt
+		}
+	}
+	n += inc
+	s.keys[key] = strconv.FormatInt(n, 10)
+	return int(n)
+}
+
+// ----- sets
+
+// setAt returns the set at key, creating it if asked, or false if the key
+// holds something else
+func (s *indexServer) setAt(key string, create bool) (redisSet, bool) {
+	v, ok := s.keys[key]
+	if !ok {
+		if !create {
+			return nil, true
+		}
+		set := make(redisSet)
+		s.keys[key] = set
+		return set, true
+	}
+	set, ok := v.(redisSet)
+	return set, ok
+}
+
+func (s *indexServer) sadd(args []string) interface{} {
+	set, ok := s.setAt(args[0], true)
+	if !ok {
+		return errWrongType
+	}
+	n := 0
+	for _, member := range args[1:] {
+		if _, ok := set[member]; !ok {
+			set[member] = struct{}{}
+			n++
+		}
+	}
+	return n
+}
+
+func (s *indexServer) srem(args []string) interface{} {
+	set, ok := s.setAt(args[0], false)
+	if !ok {
+		return errWrongType
+	}
+	n := 0
+	for _, member := range args[1:] {
+		if _, ok := set[member]; ok {
+			delete(set, member)
+			n++
+		}
+	}
+	s.prune(args[0])
+	return n
+}
+
+func (s *indexServer) smembers(args []string) interface{} {
+	set, ok := s.setAt(args[0], false)
+	if !ok {
+		return errWrongType
+	}
+	members := make([]string, 0, len(set))
+	for member := range set {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+	return members
+}
+
+func (s *indexServer) sismember(args []string) interface{} {
+	set, ok := s.setAt(args[0], false)
+	if !ok {
+		return errWrongType
+	}
+	if _, ok := set[args[1]]; ok {
+		return 1
+	}
+	return 0
+}
+
+func (s *indexServer) scard(args []string) interface{} {
+	set, ok := s.setAt(args[0], false)
+	if !ok {
+		return errWrongType
+	}
+	return len(set)
+}
+
+// ----- sorted sets
+
+type zmember struct {
+	member string
+	score  float64
+}
+
+func (s *indexServer) zsetAt(key string, create bool) (redisZSet, bool) {
+	v, ok := s.keys[key]
+	if !ok {
+		if !create {
+			return nil, true
+		}
+		zset := make(redisZSet)
+		s.keys[key] = zset
+		return zset, true
+	}
+	zset, ok := v.(redisZSet)
+	return zset, ok
+}
+
+// sorted returns the members of a sorted set by score, then member
+func (z redisZSet) sorted(reverse bool) []zmember {
+	members := make([]zmember, 0, len(z))
+	for member, score := range z {
+		members = append(members, zmember{member, score})
+	}
+	sort.Slice(members, func(i, j int) bool {
+		a, b := members[i], members[j]
+		if reverse {
+			a, b = b, a
+		}
+		if a.score != b.score {
+			return a.score < b.score
+		}
+		return a.member < b.member
+	})
+	return members
+}
+
+func formatScore(score float64) string {
+	switch {
+	case math.IsInf(score, 1):
+		return "inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(score, 'f', -1, 64)
+}
+
+func parseScore(s string) (float64, bool) {
+	switch strings.ToLower(s) {
+	case "+inf", "inf":
+		return math.Inf(1), true
+	case "-inf":
+		return math.Inf(-1), true
+	}
+	score, err := strconv.ParseFloat(s, 64)
+	return score, err == nil && !math.IsNaN(score)
+}
+
+func (s *indexServer) zadd(args []string) interface{} {
+	pairs := args[1:]
+	if len(pairs)%2 != 0 {
+		return errSyntax
+	}
+	scores := make([]float64, len(pairs)/2)
+	for i := range scores {
+		var ok bool
+		if scores[i], ok = parseScore(pairs[2*i]); !ok {
+			return errNotFloat
+		}
+	}
+	zset, ok := s.zsetAt(args[0], true)
+	if !ok {
+		return errWrongType
+	}
+	n := 0
+	for i, score := range scores {
+		member := pairs[2*i+1]
+		if _, ok := zset[member]; !ok {
+			n++
+		}
+		zset[member] = score
+	}
+	return n
+}
+
+func (s *indexServer) zincrby(args []string) interface{} {
+	inc, ok := parseScore(args[1])
+	if !ok {
+		return errNotFloat
+	}
+	zset, ok := s.zsetAt(args[0], true)
+	if !ok {
+		return errWrongType
+	}
+	zset[args[2]] += inc
+	return formatScore(zset[args[2]])
+}
+
+func (s *indexServer) zrem(args []string) interface{} {
+	zset, ok := s.zsetAt(args[0], false)
+	if !ok {
+		return errWrongType
+	}
+	n := 0
+	for _, member := range args[1:] {
+		if _, ok := zset[member]; ok {
+			delete(zset, member)
+			n++
+		}
+	}
+	s.prune(args[0])
+	return n
+}
+
+func (s *indexServer) zcard(args []string) interface{} {
+	zset, ok := s.zsetAt(args[0], false)
+	if !ok {
+		return errWrongType
+	}
+	return len(zset)
+}
+
+func (s *indexServer) zscore(args []string) interface{} {
+	zset, ok := s.zsetAt(args[0], false)
+	if !ok {
+		return errWrongType
+	}
+	score, ok := zset[args[1]]
+	if !ok {
+		return nil
+	}
+	return formatScore(score)
+}
+
+// rangeReply lists the members of a range, with their scores if asked
+func rangeReply(members []zmember, withScores bool) []string {
+	reply := make([]string, 0, len(members))
+	for _, m := range members {
+		reply = append(reply, m.member)
+		if withScores {
+			reply = append(reply, formatScore(m.score))
+		}
+	}
+	return reply
+}
+
+// indexRange converts start and stop indexes, which count back from the
+// end if they're negative, into a slice range of a sequence of n
+func indexRange(start, stop, n int) (int, int) {
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	if start > stop {
+		return 0, 0
+	}
+	return start, stop + 1
+}
+
+func (s *indexServer) zrange(args []string, reverse bool) interface{} {
+	start, err1 := strconv.Atoi(args[1])
+	stop, err2 := strconv.Atoi(args[2])
+	if err1 != nil || err2 != nil {
+		return errNotInt
+	}
+	withScores := len(args) == 4
+	if withScores && strings.ToLower(args[3]) != "withscores" {
+		return errSyntax
+	}
+	zset, ok := s.zsetAt(args[0], false)
+	if !ok {
+		return errWrongType
+	}
+	members := zset.sorted(reverse)
+	from, to := indexRange(start, stop, len(members))
+	return rangeReply(members[from:to], withScores)
+}
+
+// a scoreBound is the min or max of a range of scores, like 5, (5 or -inf
+type scoreBound struct {
+	score     float64
+	exclusive bool
+}
+
+func parseScoreBound(s string) (scoreBound, bool) {
+	var b scoreBound
+	if strings.HasPrefix(s, "(") {
+		b.exclusive = true
+		s = s[1:]
+	}
+	var ok bool
+	b.score, ok = parseScore(s)
+	return b, ok
+}
+
+func inScoreRange(score float64, min, max scoreBound) bool {
+	return (score > min.score || (!min.exclusive && score == min.score)) &&
+		(score < max.score || (!max.exclusive && score == max.score))
+}
+
+// limit applies the LIMIT offset and count of a ranged query; a negative
+// count means all that remain
+func limit(members []zmember, offset, count int) []zmember {
+	if offset < 0 || offset >= len(members) {
+		return nil
+	}
+	members = members[offset:]
+	if count >= 0 && count < len(members) {
+		members = members[:count]
+	}
+	return members
+}
+
+// rangeOptions parses the WITHSCORES and LIMIT options of a ranged query
+func rangeOptions(opts []string, scores bool) (withScores bool, offset, count int, err interface{}) {
+	count = -1
+	for i := 0; i < len(opts); i++ {
+		switch strings.ToLower(opts[i]) {
+		case "withscores":
+			if !scores {
+				return false, 0, 0, errSyntax
+			}
+			withScores = true
+		case "limit":
+			if i+2 >= len(opts) {
+				return false, 0, 0, errSyntax
+			}
+			var err1, err2 error
+			offset, err1 = strconv.Atoi(opts[i+1])
+			count, err2 = strconv.Atoi(opts[i+2])
+			if err1 != nil || err2 != nil {
+				return false, 0, 0, errNotInt
+			}
+			i += 2
+		default:
+			return false, 0, 0, errSyntax
+		}
+	}
+	return withScores, offset, count, nil
+}
+
+func (s *indexServer) zrangebyscore(args []string, reverse bool) interface{} {
+	min, max := args[1], args[2]
+	if reverse {
+		min, max = max, min
+	}
+	lo, ok1 := parseScoreBound(min)
+	hi, ok2 := parseScoreBound(max)
+	if !ok1 || !ok2 {
+		return redisError("ERR min or max is not a float")
+	}
+	withScores, offset, count, err := rangeOptions(args[3:], true)
+	if err != nil {
+		return err
+	}
+	zset, ok := s.zsetAt(args[0], false)
+	if !ok {
+		return errWrongType
+	}
+	var members []zmember
+	for _, m := range zset.sorted(reverse) {
+		if inScoreRange(m.score, lo, hi) {
+			members = append(members, m)
+		}
+	}
+	return rangeReply(limit(members, offset, count), withScores)
+}
+
+func (s *indexServer) zcount(args []string) interface{} {
+	lo, ok1 := parseScoreBound(args[1])
+	hi, ok2 := parseScoreBound(args[2])
+	if !ok1 || !ok2 {
+		return redisError("ERR min or max is not a float")
+	}
+	zset, ok := s.zsetAt(args[0], false)
+	if !ok {
+		return errWrongType
+	}
+	n := 0
+	for _, score := range zset {
+		if inScoreRange(score, lo, hi) {
+			n++
+		}
+	}
+	return n
+}
+
+// a lexBound is the min or max of a range of members: -, +, [x or (x
+type lexBound struct {
+	value     string
+	exclusive bool
+	infinite  int
+}
+
+func parseLexBound(s string) (lexBound, bool) {
+	switch {
+	case s == "-":
+		return lexBound{infinite: -1}, true
+	case s == "+":
+		return lexBound{infinite: 1}, true
+	case strings.HasPrefix(s, "["):
+		return lexBound{value: s[1:]}, true
+	case strings.HasPrefix(s, "("):
+		return lexBound{value: s[1:], exclusive: true}, true
+	}
+	return lexBound{}, false
+}
+
+func inLexRange(member string, min, max lexBound) bool {
+	above := min.infinite < 0 || (min.infinite == 0 && (member > min.value || (!min.exclusive && member == min.value)))
+	below := max.infinite > 0 || (max.infinite == 0 && (member < max.value || (!max.exclusive && member == max.value)))
+	return above && below
+}
+
+// zrangebylex ranges over the members by name, which only makes sense
+// when they all have the same score, as in redis
+func (s *indexServer) zrangebylex(args []string, reverse bool) interface{} {
+	min, max := args[1], args[2]
+	if reverse {
+		min, max = max, min
+	}
+	lo, ok1 := parseLexBound(min)
+	hi, ok2 := parseLexBound(max)
+	if !ok1 || !ok2 {
+		return errLexRange
+	}
+	_, offset, count, err := rangeOptions(args[3:], false)
+	if err != nil {
+		return err
+	}
+	zset, ok := s.zsetAt(args[0], false)
+	if !ok {
+		return errWrongType
+	}
+	var members []zmember
+	for _, m := range zset.sorted(reverse) {
+		if inLexRange(m.member, lo, hi) {
+			members = append(members, m)
+		}
+	}
+	return rangeReply(limit(members, offset, count), false)
+}
+
+// ----- hashes
+
+func (s *indexServer) hashAt(key string, create bool) (redisHash, bool) {
+	v, ok := s.keys[key]
+	if !ok {
+		if !create {
+			return nil, true
+		}
+		hash := make(redisHash)
+		s.keys[key] = hash
+		return hash, true
+	}
+	hash, ok := v.(redisHash)
+	return hash, ok
+}
+
+// hset sets fields of a hash, and returns how many are new, or OK for HMSET
+func (s *indexServer) hset(args []string, multi bool) interface{} {
+	pairs := args[1:]
+	if len(pairs)%2 != 0 {
+		return redisError("ERR wrong number of arguments for HMSET")
+	}
+	hash, ok := s.hashAt(args[0], true)
+	if !ok {
+		return errWrongType
+	}
+	n := 0
+	for i := 0; i < len(pairs); i += 2 {
+		if _, ok := hash[pairs[i]]; !ok {
+			n++
+		}
+		hash[pairs[i]] = pairs[i+1]
+	}
+	if multi {
+		return status("OK")
+	}
+	return n
+}
+
+func (s *indexServer) hget(args []string) interface{} {
+	hash, ok := s.hashAt(args[0], false)
+	if !ok {
+		return errWrongType
+	}
+	value, ok := hash[args[1]]
+	if !ok {
+		return nil
+	}
+	return value
+}
+
+func (s *indexServer) hmget(args []string) interface{} {
+	hash, ok := s.hashAt(args[0], false)
+	if !ok {
+		return errWrongType
+	}
+	values := make([]interface{}, len(args)-1)
+	for i, field := range args[1:] {
+		if value, ok := hash[field]; ok {
+			values[i] = value
+		}
+	}
+	return values
+}
+
+func (s *indexServer) hdel(args []string) interface{} {
+	hash, ok := s.hashAt(args[0], false)
+	if !ok {
+		return errWrongType
+	}
+	n := 0
+	for _, field := range args[1:] {
+		if _, ok := hash[field]; ok {
+			delete(hash, field)
+			n++
+		}
+	}
+	s.prune(args[0])
+	return n
+}
+
+func (s *indexServer) hexists(args []string) interface{} {
+	hash, ok := s.hashAt(args[0], false)
+	if !ok {
+		return errWrongType
+	}
+	if _, ok := hash[args[1]]; ok {
+		return 1
+	}
+	return 0
+}
+
+// fields returns the fields of a hash, sorted
+func (h redisHash) fields() []string {
+	fields := make([]string, 0, len(h))
+	for field := range h {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func (s *indexServer) hgetall(args []string) interface{} {
+	hash, ok := s.hashAt(args[0], false)
+	if !ok {
+		return errWrongType
+	}
+	reply := make([]string, 0, 2*len(hash))
+	for _, field := range hash.fields() {
+		reply = append(reply, field, hash[field])
+	}
+	return reply
+}
+
+func (s *indexServer) hkeys(args []string) interface{} {
+	hash, ok := s.hashAt(args[0], false)
+	if !ok {
+		return errWrongType
+	}
+	return hash.fields()
+}
+
+func (s *indexServer) hlen(args []string) interface{} {
+	hash, ok := s.hashAt(args[0], false)
+	if !ok {
+		return errWrongType
+	}
+	return len(hash)
+}
+
+func (s *indexServer) hincrby(args []string) interface{} {
+	inc, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return errNotInt
+	}
+	hash, ok := s.hashAt(args[0], true)
+	if !ok {
+		return errWrongType
+	}
+	var n int64
+	if value, ok := hash[args[1]]; ok {
+		if n, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return redisError("ERR hash value is not an integer")
+		}
+	}
+	n += inc
+	hash[args[1]] = strconv.FormatInt(n, 10)
+	return int(n)
+}
+
+// ----- lists
+
+func (s *indexServer) listAt(key string, create bool) (*redisList, bool) {
+	v, ok := s.keys[key]
+	if !ok {
+		if !create {
+			return &redisList{}, true
+		}
+		list := new(redisList)
+		s.keys[key] = list
+		return list, true
+	}
+	list, ok := v.(*redisList)
+	return list, ok
+}
+
+func (s *indexServer) push(args []string, left bool) interface{} {
+	list, ok := s.listAt(args[0], true)
+	if !ok {
+		return errWrongType
+	}
+	for _, item := range args[1:] {
+		if left {
+			list.items = append([]string{item}, list.items...)
+		} else {
+			list.items = append(list.items, item)
+		}
+	}
+	return len(list.items)
+}
+
+func (s *indexServer) lrange(args []string) interface{} {
+	start, err1 := strconv.Atoi(args[1])
+	stop, err2 := strconv.Atoi(args[2])
+	if err1 != nil || err2 != nil {
+		return errNotInt
+	}
+	list, ok := s.listAt(args[0], false)
+	if !ok {
+		return errWrongType
+	}
+	from, to := indexRange(start, stop, len(list.items))
+	return append([]string{}, list.items[from:to]...)
+}
+
+func (s *indexServer) llen(args []string) interface{} {
+	list, ok := s.listAt(args[0], false)
+	if !ok {
+		return errWrongType
+	}
+	return len(list.items)
+}
@@ -0,0 +1,198 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/ndau/ndau/pkg/ndau"
+	"github.com/ndau/ndau/pkg/ndau/config"
+	"github.com/stretchr/testify/require"
+)
+
+// testIndex starts an index server, and a client of it as the search index
+// has, and returns a function which closes them both
+func testIndex(t *testing.T) (*indexServer, *redis.Client, func()) {
+	s, err := startIndexServer()
+	require.NoError(t, err)
+	client := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	return s, client, func() {
+		client.Close()
+		s.Close()
+	}
+}
+
+func TestIndexServerKeys(t *testing.T) {
+	_, c, done := testIndex(t)
+	defer done()
+	require.Equal(t, "PONG", c.Ping().Val())
+
+	require.NoError(t, c.Set("height", "5", 0).Err())
+	require.Equal(t, "5", c.Get("height").Val())
+	require.Equal(t, redis.Nil, c.Get("missing").Err())
+	require.Equal(t, int64(6), c.Incr("height").Val())
+	require.Equal(t, int64(10), c.IncrBy("height", 4).Val())
+	require.False(t, c.SetNX("height", "1", 0).Val())
+	require.Equal(t, []interface{}{"10", nil}, c.MGet("height", "missing").Val())
+
+	require.NoError(t, c.SAdd("set", "b", "a").Err())
+	require.Equal(t, []string{"height", "set"}, c.Keys("*").Val())
+	keys, cursor, err := c.Scan(0, "s*", 10).Result()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), cursor)
+	require.Equal(t, []string{"set"}, keys)
+	require.Equal(t, "set", c.Type("set").Val())
+	require.Equal(t, int64(2), c.Exists("set", "height", "missing").Val())
+	require.Equal(t, int64(2), c.DBSize().Val())
+
+	// a key of one type can't be used as another
+	require.Error(t, c.Get("set").Err())
+	require.Error(t, c.HGet("height", "x").Err())
+
+	require.Equal(t, int64(1), c.Del("set", "missing").Val())
+	require.NoError(t, c.FlushDB().Err())
+	require.Equal(t, int64(0), c.DBSize().Val())
+}
+
+func TestIndexServerCollections(t *testing.T) {
+	_, c, done := testIndex(t)
+	defer done()
+
+	require.Equal(t, int64(2), c.SAdd("s", "b", "a", "b").Val())
+	require.Equal(t, []string{"a", "b"}, c.SMembers("s").Val())
+	require.True(t, c.SIsMember("s", "a").Val())
+	require.Equal(t, int64(1), c.SRem("s", "a").Val())
+	require.Equal(t, int64(1), c.SCard("s").Val())
+	require.Equal(t, int64(1), c.SRem("s", "b").Val())
+	require.Equal(t, int64(0), c.Exists("s").Val(), "an emptied set is removed")
+
+	require.True(t, c.HSet("h", "f", "1").Val())
+	require.True(t, c.HSet("h", "g", "2").Val())
+	require.False(t, c.HSet("h", "g", "2").Val())
+	require.Equal(t, "1", c.HGet("h", "f").Val())
+	require.Equal(t, map[string]string{"f": "1", "g": "2"}, c.HGetAll("h").Val())
+	require.Equal(t, []string{"f", "g"}, c.HKeys("h").Val())
+	require.Equal(t, []interface{}{"2", nil}, c.HMGet("h", "g", "x").Val())
+	require.Equal(t, int64(4), c.HIncrBy("h", "f", 3).Val())
+	require.NoError(t, c.HMSet("h", map[string]interface{}{"x": "y"}).Err())
+	require.Equal(t, int64(3), c.HLen("h").Val())
+	require.Equal(t, int64(1), c.HDel("h", "x").Val())
+	require.False(t, c.HExists("h", "x").Val())
+
+	require.Equal(t, int64(2), c.RPush("l", "b", "c").Val())
+	require.Equal(t, int64(3), c.LPush("l", "a").Val())
+	require.Equal(t, []string{"a", "b", "c"}, c.LRange("l", 0, -1).Val())
+	require.Equal(t, []string{"b"}, c.LRange("l", 1, -2).Val())
+	require.Equal(t, int64(3), c.LLen("l").Val())
+}
+
+func TestIndexServerSortedSets(t *testing.T) {
+	_, c, done := testIndex(t)
+	defer done()
+
+	require.Equal(t, int64(4), c.ZAdd("z",
+		redis.Z{Score: 3, Member: "c"},
+		redis.Z{Score: 1, Member: "a"},
+		redis.Z{Score: 2, Member: "b"},
+		redis.Z{Score: 2, Member: "bb"},
+	).Val())
+	require.Equal(t, []string{"a", "b", "bb", "c"}, c.ZRange("z", 0, -1).Val())
+	require.Equal(t, []string{"c", "bb"}, c.ZRevRange("z", 0, 1).Val())
+	require.Equal(t, []redis.Z{{Score: 1, Member: "a"}, {Score: 2, Member: "b"}}, c.ZRangeWithScores("z", 0, 1).Val())
+	require.Equal(t, float64(2), c.ZScore("z", "bb").Val())
+	require.Equal(t, int64(4), c.ZCard("z").Val())
+	require.Equal(t, int64(2), c.ZCount("z", "(1", "2").Val())
+
+	rangeBy := func(min, max string, offset, count int64) redis.ZRangeBy {
+		return redis.ZRangeBy{Min: min, Max: max, Offset: offset, Count: count}
+	}
+	require.Equal(t, []string{"b", "bb", "c"}, c.ZRangeByScore("z", rangeBy("2", "+inf", 0, 0)).Val())
+	require.Equal(t, []string{"bb"}, c.ZRangeByScore("z", rangeBy("-inf", "+inf", 2, 1)).Val())
+	require.Equal(t, []string{"c", "bb"}, c.ZRevRangeByScore("z", rangeBy("(1", "3", 0, 2)).Val())
+	require.Equal(t, []redis.Z{{Score: 3, Member: "c"}}, c.ZRangeByScoreWithScores("z", rangeBy("(2", "3", 0, 0)).Val())
+
+	require.Equal(t, float64(5), c.ZIncrBy("z", 4, "a").Val())
+	require.Equal(t, int64(1), c.ZRem("z", "a", "x").Val())
+
+	require.NoError(t, c.ZAdd("lex", redis.Z{Member: "apple"}, redis.Z{Member: "banana"}, redis.Z{Member: "cherry"}).Err())
+	require.Equal(t, []string{"apple", "banana"}, c.ZRangeByLex("lex", rangeBy("-", "(cherry", 0, 0)).Val())
+	require.Equal(t, []string{"cherry", "banana"}, c.ZRevRangeByLex("lex", rangeBy("[b", "[cherry", 0, 0)).Val())
+}
+
+func TestIndexServerTransactions(t *testing.T) {
+	_, c, done := testIndex(t)
+	defer done()
+
+	cmds, err := c.TxPipelined(func(p redis.Pipeliner) error {
+		p.Set("a", "1", 0)
+		p.Incr("a")
+		p.SAdd("s", "x")
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, cmds, 3)
+	require.Equal(t, int64(2), cmds[1].(*redis.IntCmd).Val())
+
+	_, err = c.Pipelined(func(p redis.Pipeliner) error {
+		p.Get("a")
+		p.SMembers("s")
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, "2", c.Get("a").Val())
+}
+
+func TestIndexServerUnknownCommand(t *testing.T) {
+	s, c, done := testIndex(t)
+	defer done()
+
+	err := c.Do("georadius", "k", 0, 0, 1, "km").Err()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unknown command")
+
+	// the connection is still usable
+	require.Equal(t, "PONG", c.Ping().Val())
+	require.Error(t, c.Do("get").Err(), "wrong number of arguments")
+	require.Equal(t, []string{
+		"GEORADIUS: ERR unknown command 'georadius'",
+		"GET: ERR wrong number of arguments for 'get' command",
+	}, s.Failures())
+}
+
+// The app builds and updates its search index against the server just as
+// it does under -dev, so an index which comes to need a command the server
+// lacks fails here rather than in a dev localnet.
+func TestIndexServerServesSearchIndex(t *testing.T) {
+	s, err := startIndexServer()
+	require.NoError(t, err)
+	defer s.Close()
+
+	home, err := ioutil.TempDir("", "devindex")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	conf, err := config.LoadDefault(config.DefaultConfigPath(home))
+	require.NoError(t, err)
+
+	app, err := ndau.NewAppSilent("mem", s.Addr(), indexVersion, *conf)
+	require.NoError(t, err)
+	start := time.Now()
+	for h := int64(1); h <= 3; h++ {
+		applyBlock(app, &replayBlock{
+			Height:  h,
+			Time:    start.Add(time.Duration(h) * time.Second),
+			ChainID: "devindex",
+		})
+	}
+	require.Empty(t, s.Failures())
+}
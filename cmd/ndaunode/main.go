@@ -33,6 +33,14 @@ var echoHash = flag.Bool("echo-hash", false, "if set, echo the current DB hash a
 var echoVersion = flag.Bool("version", false, "if set, echo the current version and exit")
 var genesisfilePath = flag.String("genesisfile", "", "if set, update system variables from the genesisfle and exit")
 var asscfilePath = flag.String("asscfile", "", "if set, create special accounts from the given associated data file and exit")
+var exportSnapshotPath = flag.String("export-snapshot", "", "if set, export the noms state to this snapshot archive and exit")
+var snapshotHeight = flag.Int("snapshot-height", -1, "with -export-snapshot, export the state at this committed height rather than the latest")
+var importSnapshotPath = flag.String("import-snapshot", "", "if set, import the noms state from this snapshot archive into an empty database, verify its app hash, and exit; tendermint's data and the search index are not restored")
+var devMode = flag.Bool("dev", false, "if set, run entirely in-process, keeping noms in memory or in -dev-dir and embedding the search index; for development and tests")
+var devDir = flag.String("dev-dir", "", "with -dev, keep noms in this directory rather than in memory")
+var replayPath = flag.String("replay", "", "if set, replay the blocks of this tendermint block store or JSONL file into a scratch database, verifying app hashes, and exit")
+var replaySpec = flag.String("replay-spec", "mem", "with -replay, the noms db spec of the scratch database")
+var replayTMGenesis = flag.String("replay-tmgenesis", "", "with -replay, initialize the chain from this tendermint genesis file")
 
 // Bump this any time we need to reset and reindex the ndau chain.  For example, if we change the
 // format of something in the index, say, needing to use unsorted sets instead of sorted sets; if
@@ -62,6 +70,9 @@ func getDbSpec() string {
 	if len(*dbspec) > 0 {
 		return *dbspec
 	}
+	if *devMode {
+		return getDevDbSpec()
+	}
 	if *useNh {
 		return filepath.Join(getNdauConfigDir(), "noms")
 	}
@@ -73,6 +84,9 @@ func getIndexAddr() string {
 	if len(*indexAddr) > 0 {
 		return *indexAddr
 	}
+	if *devMode {
+		return getDevIndexAddr()
+	}
 	if *useNh {
 		return filepath.Join(getNdauConfigDir(), "redis")
 	}
@@ -104,6 +118,11 @@ func main() {
 		version.Emit()
 	}
 
+	if len(*exportSnapshotPath) > 0 {
+		exportSnapshot(*exportSnapshotPath, *snapshotHeight)
+		os.Exit(0)
+	}
+
 	ndauhome := getNdauhome()
 	configPath := config.DefaultConfigPath(ndauhome)
 
@@ -115,7 +134,20 @@ func main() {
 		os.Exit(0)
 	}
 
+	if len(*importSnapshotPath) > 0 {
+		checkDevState("-import-snapshot")
+		importSnapshot(*importSnapshotPath, conf)
+		os.Exit(0)
+	}
+
+	if len(*replayPath) > 0 {
+		// -genesisfile and -asscfile set up the scratch database instead
+		replay(*replayPath, *replaySpec, *replayTMGenesis, *genesisfilePath, *asscfilePath, conf)
+		os.Exit(0)
+	}
+
 	if len(*asscfilePath) > 0 || len(*genesisfilePath) > 0 {
+		checkDevState("-genesisfile and -asscfile")
 		updateFromGenesis(*genesisfilePath, *asscfilePath, conf)
 		os.Exit(0)
 	}
@@ -0,0 +1,259 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ndau/commands/cmd/nomscompare/nomscompare"
+	"github.com/ndau/ndau/pkg/ndau"
+	"github.com/ndau/ndau/pkg/ndau/backing"
+	"github.com/ndau/ndau/pkg/ndau/config"
+	"github.com/pkg/errors"
+	abci "github.com/tendermint/tendermint/abci/types"
+	"github.com/tendermint/tendermint/store"
+	tmtypes "github.com/tendermint/tendermint/types"
+	dbm "github.com/tendermint/tm-db"
+)
+
+// A replayBlock is a block to replay. In a JSONL file of blocks, each line
+// is one of these, in order of height.
+type replayBlock struct {
+	Height  int64     `json:"height"`
+	Time    time.Time `json:"time"`
+	ChainID string    `json:"chain_id"`
+	// AppHash is the app hash after the previous block, in hex, as recorded
+	// in this block's header
+	AppHash string `json:"app_hash"`
+	// Txs are the transactions of the block, in base64
+	Txs [][]byte `json:"txs"`
+
+	header *abci.Header
+}
+
+// a blockSource returns the blocks to replay in order, then io.EOF
+type blockSource interface {
+	next() (*replayBlock, error)
+	close() error
+}
+
+// openBlocks opens a tendermint block store directory, like
+// data/blockstore.db, or a JSONL file of blocks
+func openBlocks(path string) (blockSource, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		path = filepath.Clean(path)
+		db, err := dbm.NewGoLevelDB(strings.TrimSuffix(filepath.Base(path), ".db"), filepath.Dir(path))
+		if err != nil {
+			return nil, errors.Wrap(err, "opening block store")
+		}
+		return &storeBlocks{db: db, store: store.NewBlockStore(db)}, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64*1024*1024)
+	return &jsonlBlocks{f: f, scanner: scanner}, nil
+}
+
+type storeBlocks struct {
+	db     dbm.DB
+	store  *store.BlockStore
+	height int64
+}
+
+func (sb *storeBlocks) next() (*replayBlock, error) {
+	sb.height++
+	if sb.height > sb.store.Height() {
+		return nil, io.EOF
+	}
+	block := sb.store.LoadBlock(sb.height)
+	if block == nil {
+		return nil, fmt.Errorf("block store has no block at height %d", sb.height)
+	}
+	header := tmtypes.TM2PB.Header(&block.Header)
+	rb := &replayBlock{
+		Height:  block.Height,
+		Time:    block.Time,
+		ChainID: block.ChainID,
+		AppHash: hex.EncodeToString(block.AppHash),
+		header:  &header,
+	}
+	for _, tx := range block.Data.Txs {
+		rb.Txs = append(rb.Txs, tx)
+	}
+	return rb, nil
+}
+
+func (sb *storeBlocks) close() error {
+	sb.db.Close()
+	return nil
+}
+
+type jsonlBlocks struct {
+	f       *os.File
+	scanner *bufio.Scanner
+}
+
+func (jb *jsonlBlocks) next() (*replayBlock, error) {
+	for jb.scanner.Scan() {
+		if len(strings.TrimSpace(jb.scanner.Text())) == 0 {
+			continue
+		}
+		var rb replayBlock
+		if err := json.Unmarshal(jb.scanner.Bytes(), &rb); err != nil {
+			return nil, err
+		}
+		return &rb, nil
+	}
+	if err := jb.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+func (jb *jsonlBlocks) close() error {
+	return jb.f.Close()
+}
+
+// replay applies the blocks of a block store or JSONL file to a scratch
+// database through the app's ABCI methods. The app hash after each block
+// must match that recorded in the next block's header; at the first which
+// doesn't, it reports how that block changed the state, and fails.
+func replay(path, scratchSpec, tmGenesisPath, gfilePath, asscpath string, conf *config.Config) {
+	blocks, err := openBlocks(path)
+	check(err)
+	defer blocks.close()
+
+	app, err := ndau.NewAppSilent(scratchSpec, "", -1, *conf)
+	check(errors.Wrap(err, "creating scratch app"))
+	if gfilePath != "" || asscpath != "" {
+		check(app.UpdateStateImmediately(genesisUpdate(gfilePath, asscpath)))
+	}
+	if tmGenesisPath != "" {
+		check(initChain(app, tmGenesisPath))
+	}
+
+	var prev *backing.State
+	var prevHeight int64
+	for {
+		block, err := blocks.next()
+		if err == io.EOF {
+			break
+		}
+		check(errors.Wrapf(err, "reading the block after %d", prevHeight))
+
+		// this block records the app hash after the one before
+		if hash := app.HashStr(); !strings.EqualFold(hash, block.AppHash) {
+			if prev == nil {
+				check(fmt.Errorf("initial state has app hash %s; block %d expects %s", hash, block.Height, block.AppHash))
+			}
+			fmt.Printf("block %d: app hash %s; block %d expects %s\n", prevHeight, hash, block.Height, block.AppHash)
+			dumpDelta(os.Stdout, prevHeight, prev, app.GetState().(*backing.State))
+			os.Exit(1)
+		}
+
+		prev = copyState(app.GetState().(*backing.State))
+		applyBlock(app, block)
+		prevHeight = block.Height
+		if prevHeight%1000 == 0 {
+			fmt.Fprintf(os.Stderr, "replayed through block %d\n", prevHeight)
+		}
+	}
+	fmt.Printf("replayed through block %d; app hash %s (not verified: no later block)\n", prevHeight, app.HashStr())
+}
+
+// initChain initializes the app as tendermint does from its genesis file
+func initChain(app *ndau.App, path string) error {
+	gdoc, err := tmtypes.GenesisDocFromFile(path)
+	if err != nil {
+		return errors.Wrap(err, "reading tendermint genesis")
+	}
+	validators := make([]abci.ValidatorUpdate, len(gdoc.Validators))
+	for i, v := range gdoc.Validators {
+		validators[i] = tmtypes.TM2PB.NewValidatorUpdate(v.PubKey, v.Power)
+	}
+	app.InitChain(abci.RequestInitChain{
+		Time:          gdoc.GenesisTime,
+		ChainId:       gdoc.ChainID,
+		Validators:    validators,
+		AppStateBytes: gdoc.AppState,
+	})
+	return nil
+}
+
+func applyBlock(app *ndau.App, block *replayBlock) {
+	header := block.header
+	if header == nil {
+		header = &abci.Header{ChainID: block.ChainID, Height: block.Height, Time: block.Time}
+	}
+	app.BeginBlock(abci.RequestBeginBlock{Header: *header})
+	for idx, tx := range block.Txs {
+		resp := app.DeliverTx(abci.RequestDeliverTx{Tx: tx})
+		if resp.Code != 0 {
+			// tendermint records failed txs too, so this isn't a mismatch
+			fmt.Fprintf(os.Stderr, "block %d tx %d failed (code %d): %s\n", block.Height, idx, resp.Code, resp.Log)
+		}
+	}
+	app.EndBlock(abci.RequestEndBlock{Height: block.Height})
+	app.Commit()
+}
+
+// copyState deep-copies a state, so that it keeps its value as the app
+// changes it
+func copyState(st *backing.State) *backing.State {
+	data, err := st.MarshalMsg(nil)
+	check(errors.Wrap(err, "copying state"))
+	c := new(backing.State)
+	_, err = c.UnmarshalMsg(data)
+	check(errors.Wrap(err, "copying state"))
+	return c
+}
+
+// a delta is a single change to the state, as a line of JSON
+type delta struct {
+	Block  int64       `json:"block"`
+	Kind   string      `json:"kind"`
+	ID     string      `json:"id,omitempty"`
+	Node   string      `json:"node,omitempty"`
+	Field  string      `json:"field,omitempty"`
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// dumpDelta writes every account, node, sysvar, delegate and state field
+// which a block changed as lines of JSON
+func dumpDelta(w io.Writer, height int64, before, after *backing.State) {
+	enc := json.NewEncoder(w)
+	nomscompare.CompareStates(before, after, func(d nomscompare.Difference) {
+		check(enc.Encode(delta{
+			Block:  height,
+			Kind:   d.Item,
+			ID:     d.ID,
+			Node:   d.Node,
+			Field:  d.Field,
+			Before: d.A,
+			After:  d.B,
+		}))
+	})
+}
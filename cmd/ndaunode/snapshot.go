@@ -0,0 +1,274 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/attic-labs/noms/go/chunks"
+	"github.com/attic-labs/noms/go/datas"
+	"github.com/attic-labs/noms/go/hash"
+	"github.com/attic-labs/noms/go/spec"
+	nt "github.com/attic-labs/noms/go/types"
+	"github.com/ndau/commands/cmd/nomsinfo/nomsinfo"
+	"github.com/ndau/ndau/pkg/ndau/config"
+	"github.com/pkg/errors"
+)
+
+// A snapshot archive is a gzipped tar file of two entries:
+//
+//   - manifest.json describes the snapshot: its app hash and height, and
+//     the number, size and sha256 checksum of its chunks
+//   - chunks holds every noms chunk reachable from the snapshot's commit,
+//     including the whole history, each written after those it refers to.
+//     Each is its 20-byte hash, its length as a uvarint, and its data.
+const (
+	snapshotFormat   = "ndau-snapshot"
+	snapshotVersion  = 1
+	snapshotDataset  = "ndau"
+	snapshotManifest = "manifest.json"
+	snapshotChunks   = "chunks"
+)
+
+type manifest struct {
+	Format     string `json:"format"`
+	Version    int    `json:"version"`
+	Dataset    string `json:"dataset"`
+	AppHash    string `json:"app_hash"`
+	Height     uint64 `json:"height"`
+	NomsHeight uint64 `json:"noms_height"`
+	Chunks     int    `json:"chunks"`
+	Bytes      int64  `json:"bytes"`
+	SHA256     string `json:"sha256"`
+	Created    string `json:"created"`
+}
+
+// exportSnapshot writes the state at a committed height, or the latest if
+// height is negative, to a snapshot archive
+func exportSnapshot(path string, height int) {
+	sp, err := spec.ForDatabase(getDbSpec())
+	check(err)
+	db := sp.GetDatabase()
+	defer db.Close()
+
+	head, ok := db.GetDataset(snapshotDataset).MaybeHeadRef()
+	if !ok {
+		check(errors.New("there is no state to export"))
+	}
+	if height >= 0 {
+		head, err = nomsinfo.CommitAt(db, head, uint64(height))
+		check(err)
+	}
+	m := manifest{
+		Format:     snapshotFormat,
+		Version:    snapshotVersion,
+		Dataset:    snapshotDataset,
+		AppHash:    nomsinfo.AppHash(head),
+		NomsHeight: head.Height(),
+		Created:    time.Now().UTC().Format(time.RFC3339),
+	}
+	m.Height, err = nomsinfo.NodeHeight(db, head)
+	check(err)
+
+	// the chunks are written to a temporary file first, so that the
+	// manifest, with their checksum, can come first in the archive
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".snapshot-chunks")
+	check(err)
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	sum := sha256.New()
+	w := bufio.NewWriter(io.MultiWriter(tmp, sum))
+	m.Chunks, m.Bytes, err = writeChunks(db, head.TargetHash(), w)
+	check(errors.Wrap(err, "exporting chunks"))
+	check(w.Flush())
+	m.SHA256 = hex.EncodeToString(sum.Sum(nil))
+
+	mdata, err := json.MarshalIndent(m, "", "  ")
+	check(err)
+	chunksSize, err := tmp.Seek(0, io.SeekCurrent)
+	check(err)
+	_, err = tmp.Seek(0, io.SeekStart)
+	check(err)
+
+	out, err := os.Create(path + ".tmp")
+	check(err)
+	gz := gzip.NewWriter(out)
+	tw := tar.NewWriter(gz)
+	check(tw.WriteHeader(&tar.Header{Name: snapshotManifest, Mode: 0644, Size: int64(len(mdata)), ModTime: time.Now()}))
+	_, err = tw.Write(mdata)
+	check(err)
+	check(tw.WriteHeader(&tar.Header{Name: snapshotChunks, Mode: 0644, Size: chunksSize, ModTime: time.Now()}))
+	_, err = io.Copy(tw, tmp)
+	check(err)
+	check(tw.Close())
+	check(gz.Close())
+	check(out.Close())
+	check(os.Rename(path+".tmp", path))
+
+	fmt.Println(string(mdata))
+}
+
+// writeChunks writes every chunk reachable from root, each after all the
+// chunks it refers to, and returns how many there were and their size
+func writeChunks(db datas.Database, root hash.Hash, w io.Writer) (int, int64, error) {
+	const (
+		unseen = iota
+		expanded
+		written
+	)
+	type frame struct {
+		hash hash.Hash
+		v    nt.Value
+	}
+	state := make(map[hash.Hash]int)
+	stack := []frame{{hash: root}}
+	var n int
+	var size int64
+	lenbuf := make([]byte, binary.MaxVarintLen64)
+	for len(stack) > 0 {
+		top := len(stack) - 1
+		f := stack[top]
+		if f.v == nil {
+			if state[f.hash] == written {
+				// it was reached another way
+				stack = stack[:top]
+				continue
+			}
+			v := db.ReadValue(f.hash)
+			if v == nil {
+				return n, size, fmt.Errorf("chunk %s is missing", f.hash)
+			}
+			stack[top].v = v
+			state[f.hash] = expanded
+			v.WalkRefs(func(r nt.Ref) {
+				if state[r.TargetHash()] != written {
+					stack = append(stack, frame{hash: r.TargetHash()})
+				}
+			})
+			continue
+		}
+
+		// everything it refers to has been written
+		stack = stack[:top]
+		data := nt.EncodeValue(f.v).Data()
+		h := [hash.ByteLen]byte(f.hash)
+		if _, err := w.Write(h[:]); err != nil {
+			return n, size, err
+		}
+		if _, err := w.Write(lenbuf[:binary.PutUvarint(lenbuf, uint64(len(data)))]); err != nil {
+			return n, size, err
+		}
+		if _, err := w.Write(data); err != nil {
+			return n, size, err
+		}
+		state[f.hash] = written
+		n++
+		size += int64(len(data))
+	}
+	return n, size, nil
+}
+
+// importSnapshot loads a snapshot archive into an empty database, and
+// checks that the app then has the snapshot's app hash
+func importSnapshot(path string, conf *config.Config) {
+	f, err := os.Open(path)
+	check(err)
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	check(errors.Wrap(err, "reading snapshot"))
+	tr := tar.NewReader(gz)
+
+	hdr, err := tr.Next()
+	check(errors.Wrap(err, "reading snapshot"))
+	if hdr.Name != snapshotManifest {
+		check(fmt.Errorf("snapshot starts with %s, not %s", hdr.Name, snapshotManifest))
+	}
+	var m manifest
+	check(errors.Wrap(json.NewDecoder(tr).Decode(&m), "reading snapshot manifest"))
+	if m.Format != snapshotFormat || m.Version != snapshotVersion {
+		check(fmt.Errorf("snapshot is %s version %d; expected %s version %d", m.Format, m.Version, snapshotFormat, snapshotVersion))
+	}
+
+	hdr, err = tr.Next()
+	check(errors.Wrap(err, "reading snapshot"))
+	if hdr.Name != snapshotChunks {
+		check(fmt.Errorf("snapshot has %s, not %s", hdr.Name, snapshotChunks))
+	}
+
+	sp, err := spec.ForDatabase(getDbSpec())
+	check(err)
+	db := sp.GetDatabase()
+	defer db.Close()
+	ds := db.GetDataset(m.Dataset)
+	if _, ok := ds.MaybeHeadRef(); ok {
+		check(errors.New("the database already has state; snapshots can only be imported into an empty database"))
+	}
+
+	sum := sha256.New()
+	head, n, err := readChunks(db, bufio.NewReader(io.TeeReader(tr, sum)))
+	check(errors.Wrap(err, "importing chunks"))
+	switch {
+	case hex.EncodeToString(sum.Sum(nil)) != m.SHA256:
+		check(errors.New("snapshot chunks don't match their checksum"))
+	case n != m.Chunks:
+		check(fmt.Errorf("snapshot has %d chunks; its manifest says %d", n, m.Chunks))
+	case nomsinfo.AppHash(head) != m.AppHash:
+		check(fmt.Errorf("snapshot's last chunk has app hash %s; its manifest says %s", nomsinfo.AppHash(head), m.AppHash))
+	}
+	_, err = db.SetHead(ds, head)
+	check(errors.Wrap(err, "setting the imported head"))
+
+	// the app must agree before the node serves from this state
+	if hash := getHash(conf); hash != m.AppHash {
+		check(fmt.Errorf("imported state has app hash %s; the snapshot's is %s", hash, m.AppHash))
+	}
+	fmt.Printf("imported snapshot at height %d with app hash %s\n", m.Height, m.AppHash)
+}
+
+// readChunks writes the chunks of a snapshot to a database, checking each
+// against its hash, and returns a ref to the last, which is the commit
+func readChunks(db datas.Database, r *bufio.Reader) (nt.Ref, int, error) {
+	var last nt.Ref
+	var n int
+	for {
+		var hb [hash.ByteLen]byte
+		if _, err := io.ReadFull(r, hb[:]); err == io.EOF {
+			return last, n, nil
+		} else if err != nil {
+			return last, n, err
+		}
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			return last, n, err
+		}
+		data := make([]byte, size)
+		if _, err = io.ReadFull(r, data); err != nil {
+			return last, n, err
+		}
+		c := chunks.NewChunk(data)
+		if [hash.ByteLen]byte(c.Hash()) != hb {
+			return last, n, fmt.Errorf("chunk %d is corrupt: its data has hash %s", n, c.Hash())
+		}
+		last = db.WriteValue(nt.DecodeValue(c, db))
+		n++
+	}
+}
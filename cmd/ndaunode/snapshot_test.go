@@ -0,0 +1,106 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"bufio"
+	"bytes"
+	"strconv"
+	"testing"
+
+	"github.com/attic-labs/noms/go/datas"
+	"github.com/attic-labs/noms/go/spec"
+	nt "github.com/attic-labs/noms/go/types"
+	"github.com/ndau/commands/cmd/nomsinfo/nomsinfo"
+	"github.com/stretchr/testify/require"
+)
+
+func memDatabase(t *testing.T) datas.Database {
+	sp, err := spec.ForDatabase("mem")
+	require.NoError(t, err)
+	return sp.GetDatabase()
+}
+
+// commitHeights commits a metastate at each node height in turn, and
+// returns the head
+func commitHeights(t *testing.T, db datas.Database, heights ...uint64) nt.Ref {
+	ds := db.GetDataset(snapshotDataset)
+	var err error
+	for _, h := range heights {
+		ds, err = db.CommitValue(ds, nt.NewStruct("Metastate", nt.StructData{
+			"Height": nt.String(strconv.FormatUint(h, 36)),
+		}))
+		require.NoError(t, err)
+	}
+	return ds.HeadRef()
+}
+
+func TestChunksRoundTrip(t *testing.T) {
+	src := memDatabase(t)
+	defer src.Close()
+	head := commitHeights(t, src, 1, 2, 3)
+
+	var buf bytes.Buffer
+	n, size, err := writeChunks(src, head.TargetHash(), &buf)
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+	require.True(t, size > 0)
+
+	dst := memDatabase(t)
+	defer dst.Close()
+	last, read, err := readChunks(dst, bufio.NewReader(bytes.NewReader(buf.Bytes())))
+	require.NoError(t, err)
+	require.Equal(t, n, read)
+	require.Equal(t, nomsinfo.AppHash(head), nomsinfo.AppHash(last))
+
+	// the whole history came across
+	_, err = dst.SetHead(dst.GetDataset(snapshotDataset), last)
+	require.NoError(t, err)
+	for h := uint64(3); h > 0; h-- {
+		ref, err := nomsinfo.CommitAt(dst, last, h)
+		require.NoError(t, err)
+		got, err := nomsinfo.NodeHeight(dst, ref)
+		require.NoError(t, err)
+		require.Equal(t, h, got)
+	}
+}
+
+func TestReadChunksRejectsDamage(t *testing.T) {
+	src := memDatabase(t)
+	defer src.Close()
+	head := commitHeights(t, src, 1, 2)
+	var buf bytes.Buffer
+	_, _, err := writeChunks(src, head.TargetHash(), &buf)
+	require.NoError(t, err)
+
+	corrupt := append([]byte{}, buf.Bytes()...)
+	corrupt[len(corrupt)-1] ^= 0xff
+	dst := memDatabase(t)
+	defer dst.Close()
+	_, _, err = readChunks(dst, bufio.NewReader(bytes.NewReader(corrupt)))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "corrupt")
+
+	truncated := buf.Bytes()[:buf.Len()-1]
+	_, _, err = readChunks(memDatabase(t), bufio.NewReader(bytes.NewReader(truncated)))
+	require.Error(t, err)
+}
+
+func TestWriteChunksMissing(t *testing.T) {
+	src := memDatabase(t)
+	defer src.Close()
+	head := commitHeights(t, src, 1)
+
+	empty := memDatabase(t)
+	defer empty.Close()
+	_, _, err := writeChunks(empty, head.TargetHash(), new(bytes.Buffer))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "missing")
+}
@@ -31,7 +31,14 @@ func updateFromGenesis(gfilePath, asscpath string, conf *config.Config) {
 	app, err := ndau.NewAppSilent(getDbSpec(), "", -1, *conf)
 	check(err)
 
-	check(app.UpdateStateImmediately(func(stI metast.State) (metast.State, error) {
+	check(app.UpdateStateImmediately(genesisUpdate(gfilePath, asscpath)))
+}
+
+// genesisUpdate returns a state update which sets the system variables from
+// a genesis file and creates the special accounts from an associated data
+// file; either may be empty
+func genesisUpdate(gfilePath, asscpath string) func(metast.State) (metast.State, error) {
+	return func(stI metast.State) (metast.State, error) {
 		st := stI.(*backing.State)
 
 		if gfilePath != "" {
@@ -106,5 +113,5 @@ func updateFromGenesis(gfilePath, asscpath string, conf *config.Config) {
 		}
 
 		return st, nil
-	}))
+	}
 }
@@ -123,35 +123,44 @@ func IsAccountDoesNotExist(err error) bool {
 // Writes debug data if the print function is non-nil and sh.Verbose is true.
 // It is safe to pass a nil print function.
 func (acct *Account) Update(sh *Shell, print func(format string, args ...interface{})) (err error) {
-	if sh.Verbose && print != nil {
+	ad, err := acct.fetch(sh, print)
+	if ad != nil {
+		acct.Data = ad
+	}
+	return err
+}
+
+// fetch gets this account's current data from the blockchain without
+// changing the account, so that it's safe to call in the background.
+//
+// If the account does not exist, it returns empty data and AccountDoesNotExist.
+func (acct *Account) fetch(sh *Shell, print func(format string, args ...interface{})) (*backing.AccountData, error) {
+	if print != nil && sh.Verbose {
 		print("updating %s", acct.Address)
 	}
 	ad, resp, err := tool.GetAccount(sh.Node, acct.Address)
 	if err != nil {
-		if sh.Verbose && print != nil {
+		if print != nil && sh.Verbose {
 			print("    %s", err.Error())
 		}
-		return err
+		return nil, err
 	}
 	exists := false
 	_, err = fmt.Sscanf(resp.Response.Info, query.AccountInfoFmt, &exists)
-	if sh.Verbose && print != nil {
+	if print != nil && sh.Verbose {
 		print("    exists: %t", exists)
 	}
 	if err != nil {
-		if sh.Verbose && print != nil {
+		if print != nil && sh.Verbose {
 			print("    err determing whether acct exists: %s", err.Error())
 		}
-		return err
+		return nil, err
 	}
 	if !exists {
-		acct.Data = &backing.AccountData{}
-		return AccountDoesNotExist{acct.Address}
+		return &backing.AccountData{}, AccountDoesNotExist{acct.Address}
 	}
 
-	acct.Data = ad
-
-	return nil
+	return ad, nil
 }
 
 func (acct *Account) display(sh *Shell, nicknames []string) {
@@ -0,0 +1,265 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/alexflint/go-arg"
+	"github.com/ndau/ndau/pkg/ndau/backing"
+	"github.com/pkg/errors"
+	tmclient "github.com/tendermint/tendermint/rpc/client"
+	tmtypes "github.com/tendermint/tendermint/types"
+)
+
+// Follow tracks accounts live, reporting changes as new blocks arrive
+type Follow struct{}
+
+var _ Command = (*Follow)(nil)
+
+// Name implements Command
+func (Follow) Name() string { return "follow" }
+
+type followargs struct {
+	Accounts []string `arg:"positional" help:"follow these accounts"`
+	JSON     bool     `arg:"-j" help:"emit one JSON object per change instead of human-readable text"`
+	Out      string   `arg:"-o" help:"write events to this file instead of the shell"`
+	Stop     bool     `arg:"-s" help:"stop following"`
+}
+
+func (followargs) Description() string {
+	return strings.TrimSpace(`
+Follow accounts, reporting changes as they happen.
+
+This subscribes to new blocks from the connected node. Each time a block is
+committed, the followed accounts are updated from the blockchain, and any
+changes to their balance, sequence, lock, delegation node or validation keys
+are reported.
+
+Accounts must already be known to the shell; use 'watch' to add foreign
+accounts. If no accounts are named, every known account is followed.
+
+Following happens in the background until 'follow --stop' or 'exit'. Only one
+follow may be active at a time; starting a new one replaces the old.
+
+With --json, each change is emitted as a single line of JSON, suitable for
+piping into other tools via --out.
+	`)
+}
+
+// a followField names an account data field which follow reports on
+type followField struct {
+	name string
+	get  func(*backing.AccountData) interface{}
+}
+
+var followFields = []followField{
+	{"balance", func(ad *backing.AccountData) interface{} { return ad.Balance }},
+	{"sequence", func(ad *backing.AccountData) interface{} { return ad.Sequence }},
+	{"lock", func(ad *backing.AccountData) interface{} { return ad.Lock }},
+	{"delegation_node", func(ad *backing.AccountData) interface{} { return ad.DelegationNode }},
+	{"validation_keys", func(ad *backing.AccountData) interface{} { return ad.ValidationKeys }},
+}
+
+// a followEvent describes a single change to a single field of an account
+type followEvent struct {
+	Height    int64       `json:"height"`
+	Address   string      `json:"address"`
+	Nicknames []string    `json:"nicknames,omitempty"`
+	Field     string      `json:"field"`
+	Old       interface{} `json:"old"`
+	New       interface{} `json:"new"`
+}
+
+// followDiff returns an event for each followed field which differs between
+// prev and cur. Height and identity fields are left for the caller.
+func followDiff(prev, cur *backing.AccountData) []followEvent {
+	if prev == nil {
+		prev = &backing.AccountData{}
+	}
+	if cur == nil {
+		cur = &backing.AccountData{}
+	}
+	var events []followEvent
+	for _, f := range followFields {
+		was := f.get(prev)
+		is := f.get(cur)
+		if !reflect.DeepEqual(was, is) {
+			events = append(events, followEvent{
+				Field: f.name,
+				Old:   was,
+				New:   is,
+			})
+		}
+	}
+	return events
+}
+
+// Run implements Command
+func (Follow) Run(argvs []string, sh *Shell) (err error) {
+	args := followargs{}
+
+	err = ParseInto(argvs, &args)
+	if err != nil {
+		if err == arg.ErrHelp || err == arg.ErrVersion {
+			err = nil
+		}
+		return
+	}
+
+	// whatever happens, an existing follower is superseded
+	sh.stopFollowing()
+	if args.Stop {
+		return
+	}
+
+	var accts []*Account
+	if len(args.Accounts) == 0 {
+		for acct := range sh.Accts.Reverse() {
+			accts = append(accts, acct)
+		}
+	} else {
+		for _, name := range args.Accounts {
+			var acct *Account
+			acct, err = sh.Accts.Get(name)
+			if err != nil {
+				return
+			}
+			accts = append(accts, acct)
+		}
+	}
+	if len(accts) == 0 {
+		return errors.New("no accounts to follow")
+	}
+
+	node, ok := sh.Node.(tmclient.Client)
+	if !ok {
+		return fmt.Errorf("node client %T cannot subscribe to events", sh.Node)
+	}
+	if !node.IsRunning() {
+		err = node.Start()
+		if err != nil {
+			return errors.Wrap(err, "starting event client")
+		}
+	}
+
+	const subscriber = "ndsh-follow"
+	query := tmtypes.EventQueryNewBlock.String()
+	blocks, err := node.Subscribe(context.Background(), subscriber, query)
+	if err != nil {
+		return errors.Wrap(err, "subscribing to new blocks")
+	}
+
+	write := sh.Write
+	var outf *os.File
+	if args.Out != "" {
+		outf, err = os.Create(args.Out)
+		if err != nil {
+			node.Unsubscribe(context.Background(), subscriber, query)
+			return errors.Wrap(err, "creating output file")
+		}
+		write = func(format string, a ...interface{}) {
+			if !strings.HasSuffix(format, "\n") {
+				format += "\n"
+			}
+			fmt.Fprintf(outf, format, a...)
+		}
+	}
+
+	// establish a baseline so that the first block only reports real changes.
+	// The follower keeps its own copies of the account data and names, so
+	// that it never touches what foreground commands are using.
+	prevs := make(map[*Account]*backing.AccountData, len(accts))
+	for _, acct := range accts {
+		var ad *backing.AccountData
+		ad, err = acct.fetch(sh, sh.Write)
+		if err != nil && !IsAccountDoesNotExist(err) {
+			node.Unsubscribe(context.Background(), subscriber, query)
+			if outf != nil {
+				outf.Close()
+			}
+			return errors.Wrap(err, "updating "+acct.Address.String())
+		}
+		err = nil
+		prevs[acct] = ad
+	}
+	names := sh.Accts.Reverse()
+
+	emit := func(ev followEvent) {
+		if args.JSON {
+			js, err := json.Marshal(ev)
+			if err != nil {
+				sh.Write("follow: marshaling event: %s", err)
+				return
+			}
+			write(string(js))
+			return
+		}
+		was, _ := json.Marshal(ev.Old)
+		is, _ := json.Marshal(ev.New)
+		name := ev.Address
+		if len(ev.Nicknames) > 0 {
+			name = fmt.Sprintf("%s (%s)", ev.Address, strings.Join(ev.Nicknames, " "))
+		}
+		write("@%d %s: %s: %s -> %s", ev.Height, name, ev.Field, was, is)
+	}
+
+	f := &follower{stop: make(chan struct{}), done: make(chan struct{})}
+	sh.following = f
+
+	sh.Running.Add(1)
+	go func() {
+		defer sh.Running.Done()
+		defer close(f.done)
+		defer node.Unsubscribe(context.Background(), subscriber, query)
+		if outf != nil {
+			defer outf.Close()
+		}
+		for {
+			select {
+			case <-sh.Stop:
+				return
+			case <-f.stop:
+				return
+			case ev, ok := <-blocks:
+				if !ok {
+					sh.Write("follow: event subscription closed")
+					return
+				}
+				nb, ok := ev.Data.(tmtypes.EventDataNewBlock)
+				if !ok || nb.Block == nil {
+					continue
+				}
+				for _, acct := range accts {
+					ad, err := acct.fetch(sh, nil)
+					if err != nil && !IsAccountDoesNotExist(err) {
+						sh.Write("follow: updating %s: %s", acct.Address, err)
+						continue
+					}
+					for _, change := range followDiff(prevs[acct], ad) {
+						change.Height = nb.Block.Height
+						change.Address = acct.Address.String()
+						change.Nicknames = names[acct]
+						emit(change)
+					}
+					prevs[acct] = ad
+				}
+			}
+		}
+	}()
+
+	sh.VWrite("following %d accounts", len(accts))
+	return
+}
@@ -0,0 +1,65 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ndau/ndau/pkg/ndau/backing"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFollowDiff(t *testing.T) {
+	prev := &backing.AccountData{Balance: 100, Sequence: 1}
+
+	t.Run("unchanged", func(t *testing.T) {
+		cur := *prev
+		require.Empty(t, followDiff(prev, &cur))
+	})
+
+	t.Run("balance and sequence", func(t *testing.T) {
+		cur := *prev
+		cur.Balance = 50
+		cur.Sequence = 2
+		events := followDiff(prev, &cur)
+		require.Len(t, events, 2)
+		require.Equal(t, "balance", events[0].Field)
+		require.Equal(t, prev.Balance, events[0].Old)
+		require.Equal(t, cur.Balance, events[0].New)
+		require.Equal(t, "sequence", events[1].Field)
+	})
+
+	t.Run("nil previous", func(t *testing.T) {
+		events := followDiff(nil, prev)
+		require.Len(t, events, 2)
+	})
+}
+
+func TestStopFollowingWaits(t *testing.T) {
+	sh := &Shell{}
+	f := &follower{stop: make(chan struct{}), done: make(chan struct{})}
+	sh.following = f
+	unsubscribed := false
+	go func() {
+		<-f.stop
+		// unsubscribing takes a while
+		time.Sleep(10 * time.Millisecond)
+		unsubscribed = true
+		close(f.done)
+	}()
+
+	sh.stopFollowing()
+	require.True(t, unsubscribed)
+	require.Nil(t, sh.following)
+
+	// with no follower, it's a no-op
+	sh.stopFollowing()
+}
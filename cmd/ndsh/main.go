@@ -77,6 +77,7 @@ func main() {
 		Net{},
 		Add{},
 		Watch{},
+		Follow{},
 		View{},
 		New{},
 		RecoverKeys{},
@@ -44,6 +44,14 @@ type Shell struct {
 	writelock   sync.Mutex
 	writer      *bufio.Writer
 	systemAccts map[string]string
+	following   *follower
+}
+
+// a follower is the background goroutine of the follow command
+type follower struct {
+	stop chan struct{}
+	// done is closed once the goroutine has unsubscribed
+	done chan struct{}
 }
 
 // NewShell initializes the shell
@@ -98,6 +106,17 @@ func (sh *Shell) Exit(err error) {
 	os.Exit(0)
 }
 
+// stopFollowing stops the background follow command, if any is running, and
+// waits for it to unsubscribe. Tendermint keys subscriptions by query, so a
+// new follow's subscription could otherwise be removed with the old one.
+func (sh *Shell) stopFollowing() {
+	if sh.following != nil {
+		close(sh.following.stop)
+		<-sh.following.done
+		sh.following = nil
+	}
+}
+
 // this is just a stub for now, but the intent is to be able to expand variables
 // into the ndau shell's prompt
 func (sh *Shell) expandPrompt() string {
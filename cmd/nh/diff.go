@@ -0,0 +1,243 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// a change is a single field which differs between two values
+//
+// A value which is absent on one side, like a lock which was added or a
+// validation key which was removed, is nil on that side.
+type change struct {
+	path     string
+	old, new interface{}
+}
+
+// fullStringer is implemented by keys, whose String is abbreviated
+type fullStringer interface {
+	FullString() string
+}
+
+// diff returns every leaf field which differs between old and new, with
+// paths like "lock.notice_period" or "validation_keys.1", in field order
+func diff(old, new interface{}) []change {
+	return diffValues("", reflect.ValueOf(old), reflect.ValueOf(new), nil)
+}
+
+// flatten returns every leaf field of a value which isn't absent, as the
+// new side of a change from nothing
+func flatten(v interface{}) []change {
+	return diff(nil, v)
+}
+
+func diffValues(path string, a, b reflect.Value, changes []change) []change {
+	av, aleaf := leaf(a)
+	bv, bleaf := leaf(b)
+	if aleaf || bleaf {
+		// if only one side is a leaf, the other is absent
+		if !reflect.DeepEqual(av, bv) {
+			changes = append(changes, change{path, av, bv})
+		}
+		return changes
+	}
+	// if one side is absent, follow the other side's structure
+	t := a
+	if !t.IsValid() {
+		t = b
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		return diffValues(path, elem(a), elem(b), changes)
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Type().Field(i)
+			if f.PkgPath != "" {
+				// unexported
+				continue
+			}
+			changes = diffValues(joinPath(path, snake(f.Name)), field(a, i), field(b, i), changes)
+		}
+	case reflect.Slice, reflect.Array:
+		alen, blen := length(a), length(b)
+		if alen != blen {
+			changes = append(changes, change{joinPath(path, "qty"), alen, blen})
+		}
+		n := alen
+		if blen > n {
+			n = blen
+		}
+		for i := 0; i < n; i++ {
+			changes = diffValues(joinPath(path, fmt.Sprint(i)), sliceIndex(a, i), sliceIndex(b, i), changes)
+		}
+	case reflect.Map:
+		keys := make(map[string]reflect.Value)
+		for _, m := range []reflect.Value{a, b} {
+			if m.IsValid() && m.Kind() == reflect.Map {
+				for _, k := range m.MapKeys() {
+					keys[fmt.Sprint(k.Interface())] = k
+				}
+			}
+		}
+		names := make([]string, 0, len(keys))
+		for name := range keys {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			changes = diffValues(joinPath(path, name), mapIndex(a, keys[name]), mapIndex(b, keys[name]), changes)
+		}
+	}
+	return changes
+}
+
+// leaf renders a value which is compared as a whole. Values which have to
+// be compared field by field aren't leaves.
+func leaf(v reflect.Value) (interface{}, bool) {
+	if !v.IsValid() {
+		return nil, false
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice:
+		if v.IsNil() {
+			return nil, false
+		}
+	}
+	if v.Kind() != reflect.Ptr && v.Kind() != reflect.Interface && v.CanInterface() {
+		// methods with pointer receivers need an addressable copy
+		p := reflect.New(v.Type())
+		p.Elem().Set(v)
+		if fs, ok := p.Interface().(fullStringer); ok {
+			return fs.FullString(), true
+		}
+		switch v.Kind() {
+		case reflect.Bool, reflect.String,
+			reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Float32, reflect.Float64:
+			return v.Interface(), true
+		}
+		if s, ok := p.Interface().(fmt.Stringer); ok {
+			return s.String(), true
+		}
+		if (v.Kind() == reflect.Slice || v.Kind() == reflect.Array) && v.Type().Elem().Kind() == reflect.Uint8 {
+			bs := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(bs), v)
+			return base64.StdEncoding.EncodeToString(bs), true
+		}
+	}
+	return nil, false
+}
+
+// the helpers below treat a missing or nil value as absent
+
+func elem(v reflect.Value) reflect.Value {
+	if !v.IsValid() || v.IsNil() {
+		return reflect.Value{}
+	}
+	return v.Elem()
+}
+
+func field(v reflect.Value, i int) reflect.Value {
+	if !v.IsValid() || v.Kind() != reflect.Struct {
+		return reflect.Value{}
+	}
+	return v.Field(i)
+}
+
+func length(v reflect.Value) int {
+	if !v.IsValid() {
+		return 0
+	}
+	return v.Len()
+}
+
+func sliceIndex(v reflect.Value, i int) reflect.Value {
+	if !v.IsValid() || i >= v.Len() {
+		return reflect.Value{}
+	}
+	return v.Index(i)
+}
+
+func mapIndex(v reflect.Value, k reflect.Value) reflect.Value {
+	if !v.IsValid() || v.Kind() != reflect.Map || v.IsNil() {
+		return reflect.Value{}
+	}
+	return v.MapIndex(k)
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// snake turns a field name like LastEAIUpdate into last_eai_update
+func snake(name string) string {
+	var b strings.Builder
+	rs := []rune(name)
+	for i, r := range rs {
+		if unicode.IsUpper(r) {
+			// start a word at a lower-to-upper change, or at the last
+			// capital of an acronym
+			if i > 0 && (unicode.IsLower(rs[i-1]) ||
+				(i+1 < len(rs) && unicode.IsLower(rs[i+1]) && unicode.IsUpper(rs[i-1]))) {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// fieldFilter selects changes by field. A term containing a dot, like
+// lock.notice_period, matches that path and everything below it; any other
+// term, like lock or delegation, matches the top-level fields whose names
+// contain it. An empty filter matches everything.
+type fieldFilter []string
+
+func parseFieldFilter(s string) fieldFilter {
+	var ff fieldFilter
+	for _, term := range strings.Split(s, ",") {
+		term = strings.ToLower(strings.TrimSpace(term))
+		if term != "" {
+			ff = append(ff, term)
+		}
+	}
+	return ff
+}
+
+func (ff fieldFilter) match(path string) bool {
+	if len(ff) == 0 {
+		return true
+	}
+	top := strings.SplitN(path, ".", 2)[0]
+	for _, term := range ff {
+		if strings.Contains(term, ".") {
+			if path == term || strings.HasPrefix(path, term+".") {
+				return true
+			}
+			continue
+		}
+		if strings.Contains(strings.Replace(top, "_", "", -1), strings.Replace(term, "_", "", -1)) {
+			return true
+		}
+	}
+	return false
+}
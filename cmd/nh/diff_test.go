@@ -0,0 +1,159 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testKey abbreviates its String, like the keys in account data
+type testKey struct {
+	id byte
+}
+
+func (k *testKey) String() string     { return "key" }
+func (k *testKey) FullString() string { return "key-" + string('0'+k.id) }
+
+type testLock struct {
+	NoticePeriod int64
+	UnlocksOn    *int64
+}
+
+type testData struct {
+	Balance  int64
+	Lock     *testLock
+	Keys     []testKey
+	Script   []byte
+	Settings map[string]int
+	hidden   int
+}
+
+func TestDiff(t *testing.T) {
+	five := int64(5)
+	tests := []struct {
+		name     string
+		old, new testData
+		want     []change
+	}{
+		{"equal", testData{Balance: 1}, testData{Balance: 1}, nil},
+		{"unexported", testData{hidden: 1}, testData{hidden: 2}, nil},
+		{
+			"leaf",
+			testData{Balance: 1}, testData{Balance: 2},
+			[]change{{"balance", int64(1), int64(2)}},
+		},
+		{
+			"pointer added",
+			testData{}, testData{Lock: &testLock{NoticePeriod: 5}},
+			[]change{{"lock.notice_period", nil, int64(5)}},
+		},
+		{
+			"nested pointer",
+			testData{Lock: &testLock{}}, testData{Lock: &testLock{UnlocksOn: &five}},
+			[]change{{"lock.unlocks_on", nil, int64(5)}},
+		},
+		{
+			"pointer removed",
+			testData{Lock: &testLock{NoticePeriod: 5}}, testData{},
+			[]change{
+				{"lock.notice_period", int64(5), nil},
+			},
+		},
+		{
+			"slice grown",
+			testData{Keys: []testKey{{1}}}, testData{Keys: []testKey{{1}, {2}}},
+			[]change{{"keys.qty", 1, 2}, {"keys.1", nil, "key-2"}},
+		},
+		{
+			"full string",
+			testData{Keys: []testKey{{1}}}, testData{Keys: []testKey{{3}}},
+			[]change{{"keys.0", "key-1", "key-3"}},
+		},
+		{
+			"bytes",
+			testData{Script: []byte{1}}, testData{Script: []byte{1, 2}},
+			[]change{{"script", "AQ==", "AQI="}},
+		},
+		{
+			"map",
+			testData{Settings: map[string]int{"x": 1, "z": 3}},
+			testData{Settings: map[string]int{"x": 1, "y": 2}},
+			[]change{{"settings.y", nil, 2}, {"settings.z", 3, nil}},
+		},
+		{
+			"field order",
+			testData{Balance: 1, Script: []byte{1}}, testData{Balance: 2, Lock: &testLock{}, Script: []byte{2}},
+			[]change{
+				{"balance", int64(1), int64(2)},
+				{"lock.notice_period", nil, int64(0)},
+				{"script", "AQ==", "Ag=="},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, diff(tt.old, tt.new))
+		})
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	require.Equal(t, []change{
+		{"balance", nil, int64(3)},
+		{"keys.qty", 0, 1},
+		{"keys.0", nil, "key-1"},
+	}, flatten(testData{Balance: 3, Keys: []testKey{{1}}}))
+}
+
+func TestSnake(t *testing.T) {
+	tests := map[string]string{
+		"Balance":          "balance",
+		"ValidationKeys":   "validation_keys",
+		"LastEAIUpdate":    "last_eai_update",
+		"UncreditedEAI":    "uncredited_eai",
+		"ID":               "id",
+		"HTTPServer":       "http_server",
+		"CurrencySeatDate": "currency_seat_date",
+	}
+	for name, want := range tests {
+		require.Equal(t, want, snake(name), name)
+	}
+}
+
+func TestFieldFilter(t *testing.T) {
+	require.Equal(t, fieldFilter{"lock", "delegation"}, parseFieldFilter(" Lock, delegation ,,"))
+	require.Empty(t, parseFieldFilter(""))
+
+	tests := []struct {
+		filter string
+		path   string
+		want   bool
+	}{
+		{"", "balance", true},
+		{"lock", "lock.notice_period", true},
+		{"lock", "balance", false},
+		{"lock.notice_period", "lock.notice_period", true},
+		{"lock.notice_period", "lock.notice_period.x", true},
+		{"lock.notice_period", "lock.unlocks_on", false},
+		{"lock.notice_period", "lock.notice_period_x", false},
+		{"delegation", "delegation_node", true},
+		{"eai", "last_eai_update", true},
+		{"lasteai", "last_eai_update", true},
+		{"last_eai", "last_eai_update", true},
+		{"validationkeys", "validation_keys.0", true},
+		{"keys", "lock.keys", false},
+		{"balance,lock", "lock.bonus", true},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.want, parseFieldFilter(tt.filter).match(tt.path), "%q matching %q", tt.filter, tt.path)
+	}
+}
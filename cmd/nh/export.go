@@ -0,0 +1,232 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	arg "github.com/alexflint/go-arg"
+	"github.com/ndau/commands/cmd/nomsinfo/nomsinfo"
+)
+
+// exportVersion is the version of the export schema. It changes whenever
+// the schema changes in a way which could break a reader.
+const exportVersion = 1
+
+type exportargs struct {
+	Path     string  `arg:"positional,required" help:"path to noms db"`
+	App      string  `help:"app name (dataset name)"`
+	AtHeight *uint64 `arg:"--at-height" help:"export the state at this block height rather than the head"`
+	Format   string  `help:"jsonl or csv"`
+	Out      string  `arg:"-o" help:"write the export to this file rather than stdout"`
+}
+
+func (exportargs) Description() string {
+	return strings.TrimSpace(`
+Export every account, node, sysvar and delegate record of the state.
+
+The export starts with a manifest, which records the app hash and heights of
+the state, so it can be checked against nomsinfo. See the README for the
+schema.
+`)
+}
+
+// an exportRecord is a line of a JSONL export. In a CSV export, each field
+// of its data is a row.
+type exportRecord struct {
+	Type string                 `json:"type"`
+	ID   string                 `json:"id"`
+	Data map[string]interface{} `json:"data"`
+	// fields keeps the data in order for CSV
+	fields []string
+}
+
+func (r *exportRecord) set(field string, value interface{}) *exportRecord {
+	if r.Data == nil {
+		r.Data = make(map[string]interface{})
+	}
+	r.Data[field] = value
+	r.fields = append(r.fields, field)
+	return r
+}
+
+// an exportWriter writes records in some format
+type exportWriter interface {
+	write(*exportRecord) error
+	flush() error
+}
+
+type jsonlWriter struct {
+	enc *json.Encoder
+	w   *bufio.Writer
+}
+
+func (jw jsonlWriter) write(r *exportRecord) error {
+	return jw.enc.Encode(r)
+}
+
+func (jw jsonlWriter) flush() error {
+	return jw.w.Flush()
+}
+
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func (cw csvWriter) write(r *exportRecord) error {
+	for _, field := range r.fields {
+		var value string
+		if v := r.Data[field]; v != nil {
+			value = fmt.Sprint(v)
+		}
+		if err := cw.w.Write([]string{r.Type, r.ID, field, value}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cw csvWriter) flush() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+func export(argv []string) {
+	var args exportargs
+	args.App = "ndau"
+	args.Format = "jsonl"
+	p, err := arg.NewParser(arg.Config{Program: "nh export"}, &args)
+	check(err, "configuring arguments")
+	err = p.Parse(argv)
+	switch {
+	case err == arg.ErrHelp:
+		p.WriteHelp(os.Stdout)
+		os.Exit(0)
+	case err != nil:
+		p.Fail(err.Error())
+	}
+
+	var out io.Writer = os.Stdout
+	var f *os.File
+	if args.Out != "" {
+		f, err = os.Create(args.Out)
+		check(err, "creating %s", args.Out)
+		out = f
+	}
+	var w exportWriter
+	switch args.Format {
+	case "jsonl":
+		bw := bufio.NewWriter(out)
+		w = jsonlWriter{enc: json.NewEncoder(bw), w: bw}
+	case "csv":
+		cw := csv.NewWriter(out)
+		check(cw.Write([]string{"type", "id", "field", "value"}), "writing csv header")
+		w = csvWriter{w: cw}
+	default:
+		p.Fail(fmt.Sprintf("unknown format %q; use jsonl or csv", args.Format))
+	}
+
+	st := load(args.Path, args.App)
+	if args.AtHeight != nil {
+		st.seek(*args.AtHeight)
+	}
+	check(st.export(args.App, w), "exporting state")
+	check(w.flush(), "writing export")
+	// check exits without running deferred calls, and a failed close can
+	// lose the end of the export, so close the file explicitly
+	if f != nil {
+		check(f.Close(), "closing %s", args.Out)
+	}
+}
+
+// export writes the manifest, then the accounts, nodes, sysvars and
+// delegates, each sorted by id
+func (st state) export(app string, w exportWriter) error {
+	bs := st.state()
+	if bs == nil {
+		return fmt.Errorf("state is nil")
+	}
+	var delegates int
+	for _, accounts := range bs.Delegates {
+		delegates += len(accounts)
+	}
+
+	manifest := (&exportRecord{Type: "manifest", ID: app}).
+		set("version", exportVersion).
+		set("apphash", nomsinfo.AppHash(st.ref)).
+		set("noms height", st.ref.Height()).
+		set("node height", st.ms.Height).
+		set("accounts", len(bs.Accounts)).
+		set("nodes", len(bs.Nodes)).
+		set("sysvars", len(bs.Sysvars)).
+		set("delegates", delegates)
+	if err := w.write(manifest); err != nil {
+		return err
+	}
+
+	for _, addr := range sortedAddrs(bs.Accounts) {
+		if err := w.write(flatRecord("account", addr, bs.Accounts[addr])); err != nil {
+			return err
+		}
+	}
+
+	for _, addr := range sortedKeys(bs.Nodes) {
+		if err := w.write(flatRecord("node", addr, bs.Nodes[addr])); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range sortedKeys(bs.Sysvars) {
+		r := (&exportRecord{Type: "sysvar", ID: name}).
+			set("value", base64.StdEncoding.EncodeToString(bs.Sysvars[name]))
+		if err := w.write(r); err != nil {
+			return err
+		}
+	}
+
+	for _, node := range sortedKeys(bs.Delegates) {
+		for _, addr := range sortedKeys(bs.Delegates[node]) {
+			r := (&exportRecord{Type: "delegate", ID: node}).set("account", addr)
+			if err := w.write(r); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// flatRecord makes a record of every field of a value, named as they are
+// in traces
+func flatRecord(typ, id string, v interface{}) *exportRecord {
+	r := &exportRecord{Type: typ, ID: id, Data: make(map[string]interface{})}
+	for _, c := range flatten(v) {
+		r.set(c.path, c.new)
+	}
+	return r
+}
+
+// sortedKeys returns the keys of any map with string keys, in order
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	for _, k := range reflect.ValueOf(m).MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,66 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"bytes"
+	"encoding/csv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlatRecord(t *testing.T) {
+	tests := []struct {
+		name   string
+		v      testData
+		fields []string
+		data   map[string]interface{}
+	}{
+		{"zero", testData{}, []string{"balance"}, map[string]interface{}{"balance": int64(0)}},
+		{
+			"absent fields are left out",
+			testData{Balance: 3, Lock: &testLock{NoticePeriod: 5}},
+			[]string{"balance", "lock.notice_period"},
+			map[string]interface{}{"balance": int64(3), "lock.notice_period": int64(5)},
+		},
+		{
+			"lists and maps",
+			testData{Keys: []testKey{{1}, {2}}, Settings: map[string]int{"b": 2, "a": 1}},
+			[]string{"balance", "keys.qty", "keys.0", "keys.1", "settings.a", "settings.b"},
+			map[string]interface{}{
+				"balance":  int64(0),
+				"keys.qty": 2, "keys.0": "key-1", "keys.1": "key-2",
+				"settings.a": 1, "settings.b": 2,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := flatRecord("account", "addr", tt.v)
+			require.Equal(t, "account", r.Type)
+			require.Equal(t, "addr", r.ID)
+			require.Equal(t, tt.fields, r.fields)
+			require.Equal(t, tt.data, r.Data)
+		})
+	}
+}
+
+func TestCSVExport(t *testing.T) {
+	var buf bytes.Buffer
+	w := csvWriter{w: csv.NewWriter(&buf)}
+	r := (&exportRecord{Type: "account", ID: "addr"}).
+		set("balance", int64(3)).
+		set("absent", nil).
+		set("note", "a,b")
+	require.NoError(t, w.write(r))
+	require.NoError(t, w.flush())
+	require.Equal(t, "account,addr,balance,3\naccount,addr,absent,\naccount,addr,note,\"a,b\"\n", buf.String())
+}
@@ -0,0 +1,418 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"sync"
+
+	metast "github.com/ndau/metanode/pkg/meta/state"
+	"github.com/ndau/ndau/pkg/ndau/backing"
+	"github.com/ndau/ndaumath/pkg/address"
+	"github.com/pkg/errors"
+)
+
+// An index records the history of every account, so that traces don't
+// need to walk the noms history again.
+//
+// It's a directory of three files:
+//
+//   - blocks.jsonl has a line for each block which changed any account,
+//     mapping the address of each account it changed to the hash of its
+//     new data, or to "" if the account was removed. The first line is the
+//     lowest height indexed, and has every account.
+//   - objects.jsonl has a line for each distinct account data, by hash.
+//   - head.json has the highest height indexed, and the dataset and app
+//     hash of the commit at that height.
+//
+// Lines are only ever appended, and head.json is replaced once they've been
+// written, so an interrupted update is just done again.
+type index struct {
+	dir     string
+	Height  uint64      `json:"height"`
+	Base    uint64      `json:"base"`
+	Source  indexSource `json:"source"`
+	built   bool
+	blocks  []indexBlock
+	objects map[string]json.RawMessage
+}
+
+type indexBlock struct {
+	Height   uint64            `json:"height"`
+	Accounts map[string]string `json:"accounts"`
+}
+
+type indexObject struct {
+	Hash string          `json:"hash"`
+	Data json.RawMessage `json:"data"`
+}
+
+// an indexSource identifies the commit an index was brought up to
+type indexSource struct {
+	Dataset string `json:"dataset"`
+	AppHash string `json:"apphash"`
+}
+
+// indexFiles are the files of an index
+var indexFiles = []string{"head.json", "blocks.jsonl", "objects.jsonl"}
+
+// openIndex loads the index in dir, creating the directory if need be.
+//
+// current identifies the commit at a height of the history the index is
+// for. If that isn't the commit the index was brought up to, because the
+// index is of another database or dataset, or the chain was reset or
+// rolled back, the index is removed, to be built again.
+func openIndex(dir string, current func(height uint64) (indexSource, error), progress io.Writer) (*index, error) {
+	ix := &index{dir: dir, objects: make(map[string]json.RawMessage)}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	head, err := ioutil.ReadFile(ix.path("head.json"))
+	switch {
+	case os.IsNotExist(err):
+		return ix, nil
+	case err != nil:
+		return nil, err
+	}
+	if err = json.Unmarshal(head, ix); err != nil {
+		return nil, errors.Wrap(err, "reading index head")
+	}
+	src, err := current(ix.Height)
+	if err != nil || src != ix.Source {
+		if progress != nil {
+			fmt.Fprintf(progress, "index doesn't match the history at block %d; rebuilding it\n", ix.Height)
+		}
+		for _, name := range indexFiles {
+			if err := os.Remove(ix.path(name)); err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+		return &index{dir: dir, objects: make(map[string]json.RawMessage)}, nil
+	}
+	ix.built = true
+
+	// blocks beyond the head were written by an interrupted update, and a
+	// height may have been written more than once
+	byHeight := make(map[uint64]indexBlock)
+	err = readLines(ix.path("blocks.jsonl"), func(line []byte) error {
+		var b indexBlock
+		if err := json.Unmarshal(line, &b); err != nil {
+			return err
+		}
+		if b.Height <= ix.Height {
+			byHeight[b.Height] = b
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "reading index blocks")
+	}
+	for _, b := range byHeight {
+		ix.blocks = append(ix.blocks, b)
+	}
+	sort.Slice(ix.blocks, func(i, j int) bool { return ix.blocks[i].Height < ix.blocks[j].Height })
+
+	err = readLines(ix.path("objects.jsonl"), func(line []byte) error {
+		var o indexObject
+		if err := json.Unmarshal(line, &o); err != nil {
+			return err
+		}
+		ix.objects[o.Hash] = o.Data
+		return nil
+	})
+	return ix, errors.Wrap(err, "reading index objects")
+}
+
+func (ix *index) path(name string) string {
+	return filepath.Join(ix.dir, name)
+}
+
+// readLines calls f with each line of a file; a missing file has none
+func readLines(name string, f func([]byte) error) error {
+	file, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		if err = f(scanner.Bytes()); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// extend indexes the blocks added since the index was last updated. The
+// first time, it walks the whole history.
+func (ix *index) extend(st state, progress io.Writer) error {
+	return ix.update(st.history, st.sourceAt, progress)
+}
+
+// update indexes the blocks of a history above the index's height.
+// current identifies the commit at a height of the history.
+func (ix *index) update(h history, current func(height uint64) (indexSource, error), progress io.Writer) error {
+	// the history is walked from the head down, so the new blocks are
+	// found newest first
+	var found []indexBlock
+	objects := make(map[string]json.RawMessage)
+	var later map[string]backing.AccountData
+	var laterHeight uint64
+	var headHeight uint64
+	err := h(func(accounts map[string]backing.AccountData, height uint64) error {
+		accounts = copyAccounts(accounts)
+		if later == nil {
+			headHeight = height
+		} else {
+			b := indexBlock{Height: laterHeight, Accounts: changedAccounts(accounts, later, objects)}
+			if n := len(found); n > 0 && found[n-1].Height == b.Height {
+				// several commits at one height: the newer ones win
+				for addr, h := range b.Accounts {
+					if _, ok := found[n-1].Accounts[addr]; !ok {
+						found[n-1].Accounts[addr] = h
+					}
+				}
+			} else if len(b.Accounts) > 0 {
+				found = append(found, b)
+			}
+			if height%10000 == 0 && progress != nil {
+				fmt.Fprintf(progress, "indexed back to block %d\n", height)
+			}
+		}
+		if ix.built && height <= ix.Height {
+			return metast.StopIteration()
+		}
+		later, laterHeight = accounts, height
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "iterating noms history")
+	}
+	if later == nil {
+		// there's no history to index
+		return nil
+	}
+	if ix.built && headHeight <= ix.Height {
+		return nil
+	}
+	if !ix.built && later != nil {
+		// the lowest height has every account
+		found = append(found, indexBlock{Height: laterHeight, Accounts: changedAccounts(nil, later, objects)})
+		ix.Base = laterHeight
+	}
+
+	// objects first, so that every block refers to objects which exist
+	err = appendLines(ix.path("objects.jsonl"), len(objects), func(enc *json.Encoder) error {
+		hashes := make([]string, 0, len(objects))
+		for h := range objects {
+			hashes = append(hashes, h)
+		}
+		sort.Strings(hashes)
+		for _, h := range hashes {
+			if err := enc.Encode(indexObject{Hash: h, Data: objects[h]}); err != nil {
+				return err
+			}
+			ix.objects[h] = objects[h]
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "writing index objects")
+	}
+	err = appendLines(ix.path("blocks.jsonl"), len(found), func(enc *json.Encoder) error {
+		for i := len(found) - 1; i >= 0; i-- {
+			if err := enc.Encode(found[i]); err != nil {
+				return err
+			}
+			ix.blocks = append(ix.blocks, found[i])
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "writing index blocks")
+	}
+
+	if ix.Source, err = current(headHeight); err != nil {
+		return errors.Wrapf(err, "identifying the commit at block %d", headHeight)
+	}
+	ix.Height = headHeight
+	ix.built = true
+	head, err := json.Marshal(ix)
+	if err != nil {
+		return err
+	}
+	tmp := ix.path("head.json.tmp")
+	if err = ioutil.WriteFile(tmp, head, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ix.path("head.json"))
+}
+
+func appendLines(name string, n int, write func(*json.Encoder) error) error {
+	if n == 0 {
+		return nil
+	}
+	f, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	err = write(json.NewEncoder(w))
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func copyAccounts(accounts map[string]backing.AccountData) map[string]backing.AccountData {
+	c := make(map[string]backing.AccountData, len(accounts))
+	for k, v := range accounts {
+		c[k] = v
+	}
+	return c
+}
+
+// changedAccounts returns the hashes of the accounts which differ between
+// earlier and later, and adds their data to objects. The accounts are
+// compared in parallel.
+func changedAccounts(earlier, later map[string]backing.AccountData, objects map[string]json.RawMessage) map[string]string {
+	addrs := make([]string, 0, len(later))
+	for addr := range later {
+		addrs = append(addrs, addr)
+	}
+	for addr := range earlier {
+		if _, ok := later[addr]; !ok {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	changed := make(map[string]string)
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	workers := runtime.NumCPU()
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < len(addrs); i += workers {
+				addr := addrs[i]
+				ad, exists := later[addr]
+				prev, existed := earlier[addr]
+				if exists == existed && reflect.DeepEqual(ad, prev) {
+					continue
+				}
+				var h string
+				var data []byte
+				if exists {
+					var err error
+					data, err = json.Marshal(ad)
+					check(err, "marshaling account %s", addr)
+					sum := sha256.Sum256(data)
+					h = hex.EncodeToString(sum[:])
+				}
+				lock.Lock()
+				changed[addr] = h
+				if exists {
+					objects[h] = data
+				}
+				lock.Unlock()
+			}
+		}(w)
+	}
+	wg.Wait()
+	return changed
+}
+
+// an event is a record waiting to be emitted
+type event struct {
+	r      record
+	header string
+}
+
+// trace answers traces from the index, for all the accounts at once and in
+// parallel. The output is the same as walking the history, one account
+// after another.
+func (ix *index) trace(addrs []address.Address, filter fieldFilter, out record) {
+	events := make([][]event, len(addrs))
+	var wg sync.WaitGroup
+	for i := range addrs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			events[i] = ix.traceOne(addrs[i], len(addrs) > 1, filter, out)
+		}(i)
+	}
+	wg.Wait()
+	for _, es := range events {
+		for _, e := range es {
+			e.r.Emit(e.header)
+		}
+	}
+}
+
+// traceOne returns the events of one account's history, newest first
+func (ix *index) traceOne(addr address.Address, named bool, filter fieldFilter, out record) []event {
+	if named {
+		out = out.Field("account", addr.String())
+	}
+	var events []event
+	var prev backing.AccountData
+	var prevHash string
+	for i, b := range ix.blocks {
+		h, ok := b.Accounts[addr.String()]
+		if !ok {
+			continue
+		}
+		var ad backing.AccountData
+		if h != "" {
+			data, ok := ix.objects[h]
+			if !ok {
+				bail(fmt.Sprintf("index is missing object %s for %s at block %d", h, addr, b.Height))
+			}
+			check(json.Unmarshal(data, &ad), "unmarshaling account %s at block %d", addr, b.Height)
+		}
+		switch {
+		case i == 0 && b.Height == ix.Base:
+			// it existed when the index starts
+		case prevHash == "" && h != "":
+			events = append(events, event{out.Field("block", b.Height), "account created"})
+		default:
+			if r, ok := changeRecord(out, b.Height, prev, ad, filter); ok {
+				events = append(events, event{r, "account data change"})
+			}
+		}
+		prev, prevHash = ad, h
+	}
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	return events
+}
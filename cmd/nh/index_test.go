@@ -0,0 +1,191 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ndau/ndau/pkg/ndau/backing"
+	"github.com/ndau/ndaumath/pkg/address"
+	"github.com/stretchr/testify/require"
+)
+
+// a fakeBlock is the accounts at a height of a fake history
+type fakeBlock struct {
+	height   uint64
+	accounts map[string]backing.AccountData
+}
+
+// fakeHistory walks blocks, which are oldest first, from the head down
+func fakeHistory(blocks []fakeBlock) history {
+	return func(f func(map[string]backing.AccountData, uint64) error) error {
+		for i := len(blocks) - 1; i >= 0; i-- {
+			// the only error the callers return is StopIteration
+			if f(blocks[i].accounts, blocks[i].height) != nil {
+				return nil
+			}
+		}
+		return nil
+	}
+}
+
+func fixedSource(src indexSource) func(uint64) (indexSource, error) {
+	return func(uint64) (indexSource, error) {
+		return src, nil
+	}
+}
+
+func testAddrs(t *testing.T, n int) []address.Address {
+	addrs := make([]address.Address, n)
+	for i := range addrs {
+		data := make([]byte, 32)
+		data[0] = byte(i + 1)
+		var err error
+		addrs[i], err = address.Generate(address.KindUser, data)
+		require.NoError(t, err)
+	}
+	return addrs
+}
+
+func accountHash(t *testing.T, ad backing.AccountData) string {
+	data, err := json.Marshal(ad)
+	require.NoError(t, err)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestChangedAccounts(t *testing.T) {
+	a := backing.AccountData{Balance: 1}
+	b := backing.AccountData{Balance: 2}
+	scripted := backing.AccountData{Balance: 1, ValidationScript: []byte{1}}
+	tests := []struct {
+		name           string
+		earlier, later map[string]backing.AccountData
+		want           map[string]backing.AccountData
+	}{
+		{"first block", nil, map[string]backing.AccountData{"x": a, "y": b}, map[string]backing.AccountData{"x": a, "y": b}},
+		{"unchanged", map[string]backing.AccountData{"x": a}, map[string]backing.AccountData{"x": a}, nil},
+		{"changed", map[string]backing.AccountData{"x": a, "y": b}, map[string]backing.AccountData{"x": scripted, "y": b}, map[string]backing.AccountData{"x": scripted}},
+		{"created", map[string]backing.AccountData{"x": a}, map[string]backing.AccountData{"x": a, "y": b}, map[string]backing.AccountData{"y": b}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objects := make(map[string]json.RawMessage)
+			changed := changedAccounts(tt.earlier, tt.later, objects)
+			want := make(map[string]string)
+			for addr, ad := range tt.want {
+				want[addr] = accountHash(t, ad)
+				require.Contains(t, objects, want[addr])
+			}
+			require.Equal(t, want, changed)
+			require.Len(t, objects, len(tt.want))
+		})
+	}
+
+	t.Run("removed", func(t *testing.T) {
+		objects := make(map[string]json.RawMessage)
+		changed := changedAccounts(map[string]backing.AccountData{"x": a, "y": b}, map[string]backing.AccountData{"y": b}, objects)
+		require.Equal(t, map[string]string{"x": ""}, changed)
+		require.Empty(t, objects)
+	})
+}
+
+// traceBlocks is a history in which accounts change, are created and are
+// removed
+func traceBlocks(addrs []address.Address) []fakeBlock {
+	a, b, c := addrs[0].String(), addrs[1].String(), addrs[2].String()
+	node := addrs[2]
+	return []fakeBlock{
+		{1, map[string]backing.AccountData{a: {Balance: 1}, b: {Balance: 5}}},
+		{2, map[string]backing.AccountData{a: {Balance: 2}, b: {Balance: 5}}},
+		{3, map[string]backing.AccountData{a: {Balance: 2}, b: {Balance: 5}, c: {Balance: 7}}},
+		{4, map[string]backing.AccountData{a: {Balance: 2, ValidationScript: []byte{1}}, c: {Balance: 7}}},
+		{5, map[string]backing.AccountData{a: {Balance: 2, ValidationScript: []byte{1}, DelegationNode: &node}, c: {Balance: 8}}},
+	}
+}
+
+func TestIndexTraceMatchesWalk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nh-index")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	addrs := testAddrs(t, 3)
+	h := fakeHistory(traceBlocks(addrs))
+	ix, err := openIndex(dir, fixedSource(indexSource{}), nil)
+	require.NoError(t, err)
+	require.NoError(t, ix.update(h, fixedSource(indexSource{}), nil))
+
+	for _, filter := range []string{"", "balance", "validation_script"} {
+		ff := parseFieldFilter(filter)
+		var all bytes.Buffer
+		for _, addr := range addrs {
+			var walked, indexed bytes.Buffer
+			require.NoError(t, traceHistory(h, []address.Address{addr}, ff, new(TextRecord).Writer(&walked)))
+			ix.trace([]address.Address{addr}, ff, new(TextRecord).Writer(&indexed))
+			if filter == "" {
+				require.NotEmpty(t, walked.String())
+			}
+			require.Equal(t, walked.String(), indexed.String(), "%s with filter %q", addr, filter)
+
+			// several accounts are traced one after another, and named
+			out := new(TextRecord).Writer(&all).Field("account", addr.String())
+			require.NoError(t, traceHistory(h, []address.Address{addr}, ff, out))
+		}
+		var indexed bytes.Buffer
+		ix.trace(addrs, ff, new(TextRecord).Writer(&indexed))
+		require.Equal(t, all.String(), indexed.String(), "filter %q", filter)
+	}
+}
+
+func TestIndexRebuildsForAnotherHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nh-index")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	addrs := testAddrs(t, 3)
+	blocks := traceBlocks(addrs)
+	src := indexSource{Dataset: "ndau", AppHash: "aa"}
+	ix, err := openIndex(dir, fixedSource(src), nil)
+	require.NoError(t, err)
+	require.NoError(t, ix.update(fakeHistory(blocks[:4]), fixedSource(src), nil))
+
+	// the same history is extended
+	ix, err = openIndex(dir, fixedSource(src), nil)
+	require.NoError(t, err)
+	require.True(t, ix.built)
+	require.Equal(t, uint64(4), ix.Height)
+	require.NoError(t, ix.update(fakeHistory(blocks), fixedSource(src), nil))
+	require.Equal(t, uint64(5), ix.Height)
+	require.Equal(t, uint64(1), ix.Base)
+
+	// another history at the same height is not
+	for _, other := range []indexSource{{Dataset: "ndau", AppHash: "bb"}, {Dataset: "other", AppHash: "aa"}} {
+		var progress bytes.Buffer
+		ix, err = openIndex(dir, fixedSource(other), &progress)
+		require.NoError(t, err)
+		require.False(t, ix.built)
+		require.Empty(t, ix.blocks)
+		require.Contains(t, progress.String(), "rebuilding")
+		for _, name := range indexFiles {
+			_, err := os.Stat(filepath.Join(dir, name))
+			require.True(t, os.IsNotExist(err), name)
+		}
+
+		require.NoError(t, ix.update(fakeHistory(blocks[2:]), fixedSource(other), nil))
+		require.Equal(t, uint64(3), ix.Base)
+	}
+}
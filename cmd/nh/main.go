@@ -14,9 +14,6 @@ import (
 	"os"
 
 	arg "github.com/alexflint/go-arg"
-	"github.com/attic-labs/noms/go/d"
-	"github.com/attic-labs/noms/go/spec"
-	"github.com/ndau/ndau/pkg/ndau/backing"
 	"github.com/ndau/ndaumath/pkg/address"
 )
 
@@ -44,44 +41,69 @@ func bail(err string) {
 }
 
 type args struct {
-	Path  string          `arg:"positional,required" help:"path to noms db"`
-	App   string          `help:"app name (dataset name)"`
-	Trace address.Address `help:"trace this account's history"`
-	JSON  bool            `help:"when set, emit output as structured JSON"`
+	Path     string            `arg:"positional,required" help:"path to noms db"`
+	App      string            `help:"app name (dataset name)"`
+	Trace    []address.Address `help:"trace these accounts' histories, in one pass"`
+	Fields   string            `help:"with --trace, only show changes to these comma-separated fields, like lock,delegation"`
+	Index    string            `help:"keep an index of account history in this directory, bring it up to date, and answer traces from it"`
+	AtHeight *uint64           `arg:"--at-height" help:"use the state at this block height rather than the head"`
+	Query    string            `help:"run these comma-separated queries against the state: supply, histogram, top, locked, delegation, scripts, or all"`
+	Top      int               `help:"with --query top, how many holders to list"`
+	JSON     bool              `help:"when set, emit output as structured JSON"`
+	CSV      bool              `help:"when set, emit output as comma-separated values"`
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		export(os.Args[2:])
+		return
+	}
+
 	var args args
 	args.App = "ndau"
-	arg.MustParse(&args)
-
-	sp, err := spec.ForDatabase(args.Path)
-	check(err, "getting noms spec")
+	args.Top = 10
+	p := arg.MustParse(&args)
+	if args.Top < 1 {
+		p.Fail("--top must be at least 1")
+	}
 
-	var st state
-	// we can fail to connect to noms for a variety of reasons, catch these here and report error
-	// we use Try() because noms panics in various places
-	err = d.Try(func() {
-		st.db = sp.GetDatabase()
-	})
-	check(err, "connecting to noms db")
+	st := load(args.Path, args.App)
 
-	st.ms.ChildState = new(backing.State)
-	st.ms.ChildState.Init(st.db)
-	st.ds, err = st.ms.Load(st.db, st.db.GetDataset(args.App), st.ms.ChildState)
-	check(err, "loading existing state")
+	if args.AtHeight != nil {
+		if len(args.Trace) > 0 || args.Index != "" {
+			bail("--at-height can't be used with --trace or --index")
+		}
+		st.seek(*args.AtHeight)
+	}
 
 	// configure output
 	var out record
-	if args.JSON {
+	switch {
+	case args.JSON && args.CSV:
+		bail("--json and --csv can't both be set")
+	case args.JSON:
 		out = new(JSONRecord).Writer(os.Stdout)
-	} else {
+	case args.CSV:
+		out = new(CSVRecord).Writer(os.Stdout)
+	default:
 		out = new(TextRecord).Writer(os.Stdout)
 	}
 
+	filter := parseFieldFilter(args.Fields)
 	switch {
-	case args.Trace.String() != "":
-		st.trace(args.Trace, out)
+	case args.Index != "":
+		ix, err := openIndex(args.Index, st.sourceAt, os.Stderr)
+		check(err, "opening index")
+		check(ix.extend(st, os.Stderr), "updating index")
+		if len(args.Trace) > 0 {
+			ix.trace(args.Trace, filter, out)
+		} else {
+			ix.summary(out)
+		}
+	case len(args.Trace) > 0:
+		st.trace(args.Trace, filter, out)
+	case args.Query != "":
+		st.query(parseQueries(args.Query), args.Top, out)
 	default:
 		st.summary(out)
 	}
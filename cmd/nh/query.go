@@ -0,0 +1,236 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ndau/ndau/pkg/ndau/backing"
+	"github.com/ndau/ndaumath/pkg/constants"
+)
+
+// queries are the aggregate reports which can be run against a state, in
+// the order in which they're run. Every quantity is in napu.
+var queries = []struct {
+	name string
+	run  func(st state, out record, top int)
+}{
+	{"supply", querySupply},
+	{"histogram", queryHistogram},
+	{"top", queryTop},
+	{"locked", queryLocked},
+	{"delegation", queryDelegation},
+	{"scripts", queryScripts},
+}
+
+// parseQueries checks a comma-separated list of query names; "all" runs
+// every query
+func parseQueries(s string) map[string]bool {
+	qs := make(map[string]bool)
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		known := name == "all"
+		for _, q := range queries {
+			if q.name == name || name == "all" {
+				qs[q.name] = true
+				known = true
+			}
+		}
+		if !known {
+			names := make([]string, len(queries))
+			for i, q := range queries {
+				names[i] = q.name
+			}
+			bail(fmt.Sprintf("unknown query %q; known queries are %s and all", name, strings.Join(names, ", ")))
+		}
+	}
+	return qs
+}
+
+// query runs the selected queries against the state. Each record names
+// its query, so the reports can be told apart in JSON or CSV.
+func (st state) query(names map[string]bool, top int, out record) {
+	if st.state() == nil {
+		out.Emit("state is nil")
+		return
+	}
+	for _, q := range queries {
+		if names[q.name] {
+			q.run(st, out.Field("query", q.name), top)
+		}
+	}
+}
+
+func napu(ad backing.AccountData) int64 {
+	return int64(ad.Balance)
+}
+
+func querySupply(st state, out record, _ int) {
+	var total int64
+	for _, ad := range st.state().Accounts {
+		total += napu(ad)
+	}
+	out.Field("block height", st.ms.Height).
+		Field("accounts", len(st.state().Accounts)).
+		Field("napu", total).
+		Emit("total supply")
+}
+
+// queryHistogram buckets the accounts by balance: empty accounts, those
+// with less than 1 ndau, and then by powers of ten ndau. Each bucket
+// includes its lower bound and excludes its upper bound.
+func queryHistogram(st state, out record, _ int) {
+	type bucket struct {
+		from, to int64
+		accounts int
+		napu     int64
+	}
+	buckets := []*bucket{{from: 0, to: 1}, {from: 1, to: constants.QuantaPerUnit}}
+	for _, ad := range st.state().Accounts {
+		n := napu(ad)
+		var b *bucket
+		switch {
+		case n < 1:
+			b = buckets[0]
+		case n < constants.QuantaPerUnit:
+			b = buckets[1]
+		default:
+			i := 2
+			for to := int64(10 * constants.QuantaPerUnit); n >= to; to *= 10 {
+				i++
+			}
+			for len(buckets) <= i {
+				from := buckets[len(buckets)-1].to
+				buckets = append(buckets, &bucket{from: from, to: from * 10})
+			}
+			b = buckets[i]
+		}
+		b.accounts++
+		b.napu += n
+	}
+	for _, b := range buckets {
+		out.Field("from napu", b.from).
+			Field("to napu", b.to).
+			Field("accounts", b.accounts).
+			Field("napu", b.napu).
+			Emit("balance histogram")
+	}
+}
+
+// queryTop reports the accounts with the highest balances, richest first;
+// ties are broken by address
+func queryTop(st state, out record, top int) {
+	accounts := st.state().Accounts
+	addrs := sortedAddrs(accounts)
+	sort.SliceStable(addrs, func(i, j int) bool {
+		return napu(accounts[addrs[i]]) > napu(accounts[addrs[j]])
+	})
+	if top < len(addrs) {
+		addrs = addrs[:top]
+	}
+	for i, addr := range addrs {
+		out.Field("rank", i+1).
+			Field("address", addr).
+			Field("napu", napu(accounts[addr])).
+			Emit("top holder")
+	}
+}
+
+// queryLocked totals the accounts which are unlocked, locked, and locked
+// but notified to unlock
+func queryLocked(st state, out record, _ int) {
+	statuses := []string{"unlocked", "locked", "notified"}
+	accounts := make(map[string]int)
+	totals := make(map[string]int64)
+	for _, ad := range st.state().Accounts {
+		status := "unlocked"
+		if ad.Lock != nil {
+			status = "locked"
+			if ad.Lock.UnlocksOn != nil {
+				status = "notified"
+			}
+		}
+		accounts[status]++
+		totals[status] += napu(ad)
+	}
+	for _, status := range statuses {
+		out.Field("status", status).
+			Field("accounts", accounts[status]).
+			Field("napu", totals[status]).
+			Emit("lock status")
+	}
+}
+
+// queryDelegation totals the accounts delegated to each node, most napu
+// first, followed by the accounts which aren't delegated
+func queryDelegation(st state, out record, _ int) {
+	accounts := make(map[string]int)
+	totals := make(map[string]int64)
+	for _, ad := range st.state().Accounts {
+		node := ""
+		if ad.DelegationNode != nil {
+			node = ad.DelegationNode.String()
+		}
+		accounts[node]++
+		totals[node] += napu(ad)
+	}
+	nodes := make([]string, 0, len(accounts))
+	for node := range accounts {
+		if node != "" {
+			nodes = append(nodes, node)
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		if totals[nodes[i]] != totals[nodes[j]] {
+			return totals[nodes[i]] > totals[nodes[j]]
+		}
+		return nodes[i] < nodes[j]
+	})
+	for _, node := range append(nodes, "") {
+		name := node
+		if node == "" {
+			name = "undelegated"
+		}
+		out.Field("node", name).
+			Field("accounts", accounts[node]).
+			Field("napu", totals[node]).
+			Emit("delegation")
+	}
+}
+
+// queryScripts lists the accounts which have a validation script
+func queryScripts(st state, out record, _ int) {
+	accounts := st.state().Accounts
+	for _, addr := range sortedAddrs(accounts) {
+		ad := accounts[addr]
+		if len(ad.ValidationScript) == 0 {
+			continue
+		}
+		out.Field("address", addr).
+			Field("napu", napu(ad)).
+			Field("script", base64.StdEncoding.EncodeToString(ad.ValidationScript)).
+			Emit("validation script")
+	}
+}
+
+func sortedAddrs(accounts map[string]backing.AccountData) []string {
+	addrs := make([]string, 0, len(accounts))
+	for addr := range accounts {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
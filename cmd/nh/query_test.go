@@ -0,0 +1,78 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	metast "github.com/ndau/metanode/pkg/meta/state"
+	"github.com/ndau/ndau/pkg/ndau/backing"
+	math "github.com/ndau/ndaumath/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+// testState is a state whose accounts have these balances
+func testState(balances ...int64) state {
+	accounts := make(map[string]backing.AccountData)
+	for i, b := range balances {
+		accounts[fmt.Sprintf("addr%02d", i)] = backing.AccountData{Balance: math.Ndau(b)}
+	}
+	return state{ms: metast.Metastate{Height: 7, ChildState: &backing.State{Accounts: accounts}}}
+}
+
+// csvRows runs a query and returns its rows, without the titles
+func csvRows(st state, query func(state, record, int), top int) []string {
+	var buf bytes.Buffer
+	query(st, new(CSVRecord).Writer(&buf), top)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	return lines[1:]
+}
+
+func TestHistogramBuckets(t *testing.T) {
+	const ndau = 100000000
+	tests := []struct {
+		name     string
+		balances []int64
+		want     []string
+	}{
+		{"no accounts", nil, []string{
+			"0,1,0,0",
+			"1,100000000,0,0",
+		}},
+		{"bounds", []int64{0, 1, ndau - 1, ndau, 10*ndau - 1, 10 * ndau}, []string{
+			"0,1,1,0",
+			"1,100000000,2,100000000",
+			"100000000,1000000000,2,1099999999",
+			"1000000000,10000000000,1,1000000000",
+		}},
+		{"empty buckets between", []int64{5, 1000 * ndau}, []string{
+			"0,1,0,0",
+			"1,100000000,1,5",
+			"100000000,1000000000,0,0",
+			"1000000000,10000000000,0,0",
+			"10000000000,100000000000,0,0",
+			"100000000000,1000000000000,1,100000000000",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, csvRows(testState(tt.balances...), queryHistogram, 0))
+		})
+	}
+}
+
+func TestQueryTop(t *testing.T) {
+	st := testState(5, 9, 5, 1)
+	require.Equal(t, []string{"1,addr01,9", "2,addr00,5"}, csvRows(st, queryTop, 2))
+	require.Len(t, csvRows(st, queryTop, 10), 4)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -102,3 +103,67 @@ func (tr JSONRecord) Emit(string) {
 	_, err = tr.writer.Write(data)
 	check(err, "sending json record to output stream")
 }
+
+// A CSVRecord writes itself as a row of comma-separated values. A row of
+// titles comes first, and again after a blank line whenever the fields
+// change.
+type CSVRecord struct {
+	fs  fields
+	out *csvOutput
+}
+
+// csvOutput is shared by every record written to one stream
+type csvOutput struct {
+	writer *csv.Writer
+	titles []string
+}
+
+var _ record = (*CSVRecord)(nil)
+
+// Writer implements record by storing an output stream
+func (tr CSVRecord) Writer(w io.Writer) record {
+	tr.out = &csvOutput{writer: csv.NewWriter(w)}
+	return tr
+}
+
+// Field implements record by storing a field/value pair
+func (tr CSVRecord) Field(k string, v interface{}) record {
+	tr.fs = tr.fs.Field(k, v)
+	return tr
+}
+
+// Emit the fields as a row, preceded by their titles if need be
+func (tr CSVRecord) Emit(string) {
+	// omit the header
+	w := tr.out.writer
+	if !sameTitles(tr.out.titles, tr.fs.titles) {
+		if tr.out.titles != nil {
+			w.Write(nil)
+		}
+		w.Write(tr.fs.titles)
+		// records built from a common prefix share its backing array, so
+		// keep a copy which they can't change
+		tr.out.titles = append([]string(nil), tr.fs.titles...)
+	}
+	row := make([]string, len(tr.fs.values))
+	for idx, v := range tr.fs.values {
+		if v != nil {
+			row[idx] = fmt.Sprint(v)
+		}
+	}
+	w.Write(row)
+	w.Flush()
+	check(w.Error(), "sending csv record to output stream")
+}
+
+func sameTitles(a, b []string) bool {
+	if a == nil || len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
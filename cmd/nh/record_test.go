@@ -0,0 +1,70 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCSVRecord(t *testing.T) {
+	tests := []struct {
+		name    string
+		records [][]interface{}
+		want    string
+	}{
+		{
+			"titles once",
+			[][]interface{}{{"a", 1, "b", "x"}, {"a", 2, "b", "y"}},
+			"a,b\n1,x\n2,y\n",
+		},
+		{
+			"titles again when the fields change",
+			[][]interface{}{{"a", 1}, {"a", 2, "b", "y"}, {"a", 3, "b", "z"}, {"c", true}},
+			"a\n1\n\na,b\n2,y\n3,z\n\nc\ntrue\n",
+		},
+		{
+			"nil is empty",
+			[][]interface{}{{"a", nil, "b", 1}},
+			"a,b\n,1\n",
+		},
+		{
+			"quoting",
+			[][]interface{}{{"a, b", "x,y", "c", "say \"hi\""}},
+			"\"a, b\",c\n\"x,y\",\"say \"\"hi\"\"\"\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			out := new(CSVRecord).Writer(&buf)
+			for _, fs := range tt.records {
+				r := out
+				for i := 0; i < len(fs); i += 2 {
+					r = r.Field(fs[i].(string), fs[i+1])
+				}
+				r.Emit("ignored")
+			}
+			require.Equal(t, tt.want, buf.String())
+		})
+	}
+}
+
+func TestCSVRecordSharedPrefix(t *testing.T) {
+	var buf bytes.Buffer
+	// three fields leave room for a fourth in the same array, which both
+	// records below append into
+	base := new(CSVRecord).Writer(&buf).Field("a", 1).Field("b", 2).Field("c", 3)
+	base.Field("x", 4).Emit("ignored")
+	base.Field("y", 5).Emit("ignored")
+	require.Equal(t, "a,b,c,x\n1,2,3,4\n\na,b,c,y\n1,2,3,5\n", buf.String())
+}
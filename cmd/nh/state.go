@@ -10,7 +10,13 @@ package main
 // - -- --- ---- -----
 
 import (
+	"fmt"
+
+	"github.com/attic-labs/noms/go/d"
 	"github.com/attic-labs/noms/go/datas"
+	"github.com/attic-labs/noms/go/spec"
+	nt "github.com/attic-labs/noms/go/types"
+	"github.com/ndau/commands/cmd/nomsinfo/nomsinfo"
 	metast "github.com/ndau/metanode/pkg/meta/state"
 	"github.com/ndau/ndau/pkg/ndau/backing"
 )
@@ -19,8 +25,79 @@ type state struct {
 	db datas.Database
 	ds datas.Dataset
 	ms metast.Metastate
+	// ref is the commit of the state
+	ref nt.Ref
+}
+
+// load connects to the noms db and loads the head of the app's dataset
+func load(path, app string) state {
+	sp, err := spec.ForDatabase(path)
+	check(err, "getting noms spec")
+
+	var st state
+	// we can fail to connect to noms for a variety of reasons, catch these here and report error
+	// we use Try() because noms panics in various places
+	err = d.Try(func() {
+		st.db = sp.GetDatabase()
+	})
+	check(err, "connecting to noms db")
+
+	st.ms.ChildState = new(backing.State)
+	st.ms.ChildState.Init(st.db)
+	st.ds, err = st.ms.Load(st.db, st.db.GetDataset(app), st.ms.ChildState)
+	check(err, "loading existing state")
+	if ref, ok := st.ds.MaybeHeadRef(); ok {
+		st.ref = ref
+	}
+	return st
+}
+
+// a history calls f with the accounts of each commit, from the head down,
+// until f returns metast.StopIteration()
+type history func(f func(accounts map[string]backing.AccountData, height uint64) error) error
+
+// history walks the state's history, as a history
+func (st state) history(f func(accounts map[string]backing.AccountData, height uint64) error) error {
+	return metast.IterHistory(st.db, st.ds, &backing.State{}, func(stI metast.State, height uint64) error {
+		return f(stI.(*backing.State).Accounts, height)
+	})
+}
+
+// sourceAt identifies the commit at a node height, so that an index can
+// tell whether it was built from this history
+func (st state) sourceAt(height uint64) (indexSource, error) {
+	ref, err := nomsinfo.CommitAt(st.db, st.ref, height)
+	if err != nil {
+		return indexSource{}, err
+	}
+	return indexSource{Dataset: st.ds.ID(), AppHash: nomsinfo.AppHash(ref)}, nil
 }
 
 func (st state) state() *backing.State {
 	return st.ms.ChildState.(*backing.State)
 }
+
+// seek replaces the state with the state at a node height. Like
+// nomscompare's seekHeight, it walks the history back from the head, so
+// recent heights are found sooner than old ones. If several commits share
+// the height, the newest is used.
+func (st *state) seek(height uint64) {
+	var found bool
+	err := metast.IterHistory(st.db, st.ds, &backing.State{}, func(stI metast.State, h uint64) error {
+		if h > height {
+			return nil
+		}
+		if h == height {
+			st.ms.ChildState = stI
+			st.ms.Height = h
+			found = true
+		}
+		return metast.StopIteration()
+	})
+	check(err, "iterating noms history")
+	if !found {
+		bail(fmt.Sprintf("no state at height %d; the history runs from the head at %d", height, st.ms.Height))
+	}
+	st.ref, err = nomsinfo.CommitAt(st.db, st.ref, height)
+	check(err, "finding the commit at height %d", height)
+}
@@ -21,3 +21,11 @@ func (st state) summary(out record) {
 		Field("nodes", len(bs.Nodes)).
 		Emit("state summary")
 }
+
+func (ix *index) summary(out record) {
+	out.Field("base height", ix.Base).
+		Field("block height", ix.Height).
+		Field("blocks with changes", len(ix.blocks)).
+		Field("account states", len(ix.objects)).
+		Emit("index summary")
+}
@@ -10,64 +10,105 @@ package main
 // - -- --- ---- -----
 
 import (
-	"fmt"
+	"sync"
 
 	metast "github.com/ndau/metanode/pkg/meta/state"
 	"github.com/ndau/ndau/pkg/ndau/backing"
 	"github.com/ndau/ndaumath/pkg/address"
 )
 
-func (st state) trace(addr address.Address, out record) {
-	var prevHeight uint64
-	var prevAD backing.AccountData
-	var existed bool
-	err := metast.IterHistory(st.db, st.ds, &backing.State{}, func(stI metast.State, height uint64) error {
-		defer func() { prevHeight = height }()
-		out = out.Field("block", prevHeight)
-		st := stI.(*backing.State)
+// trace emits every change to the data of some accounts, newest first, down
+// to the block on which each was created. Only the fields matched by the
+// filter are considered.
+//
+// The history is walked once for all of the accounts, and at each block the
+// accounts are compared in parallel. With more than one account, each
+// record names the account it's about.
+func (st state) trace(addrs []address.Address, filter fieldFilter, out record) {
+	check(traceHistory(st.history, addrs, filter, out), "iterating noms history")
+}
 
-		ad, exists := st.Accounts[addr.String()]
-		defer func() {
-			prevAD = ad
-			existed = exists
-		}()
-		if !exists && existed {
-			out.Emit("account created")
-			return metast.StopIteration()
+// traceHistory traces some accounts through a history
+func traceHistory(h history, addrs []address.Address, filter fieldFilter, out record) error {
+	type tracked struct {
+		addr    string
+		out     record
+		prevAD  backing.AccountData
+		existed bool
+		done    bool
+	}
+	ts := make([]*tracked, len(addrs))
+	for i, addr := range addrs {
+		ts[i] = &tracked{addr: addr.String(), out: out}
+		if len(addrs) > 1 {
+			ts[i].out = out.Field("account", addr.String())
 		}
+	}
+	remaining := len(ts)
 
-		if prevHeight != 0 {
-			var diff bool
-			if ad.Balance != prevAD.Balance {
-				// remember, we're iterating backwards, so 'prev' is really subsequent
-				out = out.Field("balance", prevAD.Balance).
-					Field("prev.balance", ad.Balance)
-				diff = true
-			}
-			if len(ad.ValidationKeys) != len(prevAD.ValidationKeys) {
-				out = out.Field("validation_keys.qty", len(prevAD.ValidationKeys)).
-					Field("prev.validation_keys.qty", len(ad.ValidationKeys))
-				diff = true
-			}
-			klen := len(ad.ValidationKeys)
-			if len(prevAD.ValidationKeys) < klen {
-				klen = len(prevAD.ValidationKeys)
+	var prevHeight uint64
+	return h(func(accounts map[string]backing.AccountData, height uint64) error {
+		defer func() { prevHeight = height }()
+
+		events := make([]*event, len(ts))
+		var wg sync.WaitGroup
+		for i, t := range ts {
+			if t.done {
+				continue
 			}
-			for idx := 0; idx < klen; idx++ {
-				ks := ad.ValidationKeys[idx].FullString()
-				pks := prevAD.ValidationKeys[idx].FullString()
-				if ks != pks {
-					out = out.Field(fmt.Sprintf("validation_keys.%d", idx), pks).
-						Field(fmt.Sprintf("prev.validation_keys.%d", idx), ks)
-					diff = true
+			wg.Add(1)
+			go func(i int, t *tracked) {
+				defer wg.Done()
+				ad, exists := accounts[t.addr]
+				defer func() {
+					t.prevAD = ad
+					t.existed = exists
+				}()
+				if !exists && t.existed {
+					events[i] = &event{t.out.Field("block", prevHeight), "account created"}
+					t.done = true
+					return
 				}
+				if prevHeight != 0 {
+					// remember, we're iterating backwards, so 'prev' is
+					// really subsequent
+					if r, ok := changeRecord(t.out, prevHeight, ad, t.prevAD, filter); ok {
+						events[i] = &event{r, "account data change"}
+					}
+				}
+			}(i, t)
+		}
+		wg.Wait()
+
+		for i, e := range events {
+			if e == nil {
+				continue
 			}
-			if diff {
-				out.Emit("account data change")
+			e.r.Emit(e.header)
+			if ts[i].done {
+				remaining--
 			}
 		}
-
+		if remaining == 0 {
+			return metast.StopIteration()
+		}
 		return nil
 	})
-	check(err, "iterating noms history")
+}
+
+// changeRecord builds a record of the changes between an account's data at
+// two heights. The fields are named for the data at the later height, and
+// prefixed with "prev." for the earlier height. It returns false if no
+// field matched by the filter changed.
+func changeRecord(out record, block uint64, earlier, later backing.AccountData, filter fieldFilter) (record, bool) {
+	r := out.Field("block", block)
+	var any bool
+	for _, c := range diff(earlier, later) {
+		if !filter.match(c.path) {
+			continue
+		}
+		r = r.Field(c.path, c.new).Field("prev."+c.path, c.old)
+		any = true
+	}
+	return r, any
 }
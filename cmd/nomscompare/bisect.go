@@ -0,0 +1,80 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"github.com/attic-labs/noms/go/datas"
+	nt "github.com/attic-labs/noms/go/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// firstDivergence binary-searches the node heights of two datasets for the
+// first at which their app hashes differ. It returns that height and the
+// commits of each dataset there, or false if they agree at the highest
+// height they share.
+//
+// A commit's hash covers its parents, so once two datasets diverge they
+// never agree again. The search starts at the lowest height both histories
+// have, which takes a walk of each history to find. Each probe seeks down
+// from the lowest height known to differ, so the whole search walks each
+// history about three times.
+func firstDivergence(
+	dba datas.Database, refa nt.Ref,
+	dbb datas.Database, refb nt.Ref,
+	logger log.FieldLogger,
+) (uint64, nt.Ref, nt.Ref, bool) {
+	loggera := logger.WithFields(log.Fields{"dataset": "a", "seek": "node"})
+	loggerb := logger.WithFields(log.Fields{"dataset": "b", "seek": "node"})
+
+	probe := func(height uint64, froma, fromb nt.Ref) (nt.Ref, nt.Ref, bool) {
+		refa := seekHeight(height, dba, froma, metanodeheight, loggera)
+		refb := seekHeight(height, dbb, fromb, metanodeheight, loggerb)
+		agree := apphash(refa) == apphash(refb)
+		logger.WithFields(log.Fields{
+			"node height": height,
+			"a apphash":   apphash(refa),
+			"b apphash":   apphash(refb),
+			"agree":       agree,
+		}).Debug("bisect probe")
+		return refa, refb, agree
+	}
+
+	hi := metanodeheight(dba, refa)
+	if hb := metanodeheight(dbb, refb); hb < hi {
+		hi = hb
+	}
+	refa, refb, agree := probe(hi, refa, refb)
+	if agree {
+		return hi, refa, refb, false
+	}
+
+	lo := lowestNodeHeight(dba, refa, loggera)
+	if lb := lowestNodeHeight(dbb, refb, loggerb); lb > lo {
+		lo = lb
+	}
+	if hi <= lo {
+		// there's no lower height which both histories have
+		return hi, refa, refb, true
+	}
+	if pa, pb, agree := probe(lo, refa, refb); !agree {
+		return lo, pa, pb, true
+	}
+	// the datasets agree at lo and differ at hi
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		pa, pb, agree := probe(mid, refa, refb)
+		if agree {
+			lo = mid
+		} else {
+			hi, refa, refb = mid, pa, pb
+		}
+	}
+	return hi, refa, refb, true
+}
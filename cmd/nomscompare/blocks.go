@@ -0,0 +1,61 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"encoding/base64"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	metatx "github.com/ndau/metanode/pkg/meta/transaction"
+	"github.com/ndau/ndau/pkg/ndau"
+	log "github.com/sirupsen/logrus"
+	"github.com/tendermint/tendermint/store"
+	dbm "github.com/tendermint/tm-db"
+)
+
+// logBlockTxs logs the transactions of a block from a tendermint block
+// store, such as data/blockstore.db in a tendermint home directory
+func logBlockTxs(path string, height uint64, logger log.FieldLogger) error {
+	path = strings.TrimSuffix(filepath.Clean(path), string(filepath.Separator))
+	name := strings.TrimSuffix(filepath.Base(path), ".db")
+	db, err := dbm.NewGoLevelDB(name, filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	block := store.NewBlockStore(db).LoadBlock(int64(height))
+	if block == nil {
+		return fmt.Errorf("block store has no block at height %d", height)
+	}
+
+	logger = logger.WithField("node height", height)
+	logger.WithFields(log.Fields{
+		"block time": block.Time,
+		"qty txs":    len(block.Data.Txs),
+	}).Info("offending block")
+	for idx, txb := range block.Data.Txs {
+		txlogger := logger.WithField("tx index", idx)
+		tx, err := metatx.Unmarshal(txb, ndau.TxIDs)
+		if err != nil {
+			txlogger.WithError(err).WithField("tx bytes", base64.StdEncoding.EncodeToString(txb)).
+				Error("undecodable tx")
+			continue
+		}
+		txlogger.WithFields(log.Fields{
+			"tx type": metatx.NameOf(tx),
+			"tx hash": metatx.Hash(tx),
+			"tx":      tx,
+		}).Info("tx")
+	}
+	return nil
+}
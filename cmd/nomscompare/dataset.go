@@ -35,7 +35,7 @@ func validateInput(dsa, dsb string) {
 	}
 }
 
-func compareDS(dsa, dsb string, height int, nodeHeight int) {
+func compareDS(dsa, dsb string, height int, nodeHeight int, semantic bool, blockstore string) {
 	validateInput(dsa, dsb)
 
 	log.SetFormatter(&log.JSONFormatter{})
@@ -109,7 +109,8 @@ func compareDS(dsa, dsb string, height int, nodeHeight int) {
 		)
 	}
 
-	if height < 0 && nodeHeight < 0 && refa.Height() != refb.Height() {
+	// semantic comparisons find a common height by themselves
+	if height < 0 && nodeHeight < 0 && !semantic && refa.Height() != refb.Height() {
 		logger.WithFields(log.Fields{
 			"a height": refa.Height(),
 			"b height": refb.Height(),
@@ -127,7 +128,64 @@ func compareDS(dsa, dsb string, height int, nodeHeight int) {
 		logger.WithField("apphash", hasha).Debug("apphashes agree")
 	}
 
+	if semantic {
+		if hasha == hashb {
+			// the same commit has the same state
+			return
+		}
+		seeked := height >= 0 || nodeHeight >= 0
+		compareSemantic(speca.GetDataset(), dba, refa, specb.GetDataset(), dbb, refb, seeked, blockstore, logger)
+		return
+	}
+
 	vala := valueAt(dba, refa)
 	valb := valueAt(dbb, refb)
 	compare(vala, valb, "", logger)
 }
+
+// compareSemantic compares the ndau state of two datasets. If the commits
+// weren't sought to a height, it compares them at the first divergent block.
+// Given a tendermint block store, it first logs the transactions of the
+// block at that height.
+func compareSemantic(
+	dsa datas.Dataset, dba datas.Database, refa nt.Ref,
+	dsb datas.Dataset, dbb datas.Database, refb nt.Ref,
+	seeked bool,
+	blockstore string,
+	logger log.FieldLogger,
+) {
+	height := metanodeheight(dba, refa)
+	if !seeked {
+		var diverged bool
+		height, refa, refb, diverged = firstDivergence(dba, refa, dbb, refb, logger)
+		if !diverged {
+			logger.WithField("node height", height).Info("datasets agree up to the lower head")
+			return
+		}
+		fields := log.Fields{
+			"node height": height,
+			"a apphash":   apphash(refa),
+			"b apphash":   apphash(refb),
+		}
+		if height > 0 {
+			fields["last agreeing node height"] = height - 1
+		}
+		logger.WithFields(fields).Warn("first divergent block")
+	}
+
+	if blockstore != "" {
+		checkc(logBlockTxs(blockstore, height, logger), blockstore)
+	}
+
+	logger = logger.WithField("node height", height)
+	if hb := metanodeheight(dbb, refb); hb != height {
+		// the datasets were sought to a noms height
+		logger = logger.WithField("b node height", hb)
+	}
+	// the states are those of the commits found, not just of their heights
+	statea, err := loadState(dba, dsa, refa, logger.WithField("dataset", "a"))
+	checkc(err, "a")
+	stateb, err := loadState(dbb, dsb, refb, logger.WithField("dataset", "b"))
+	checkc(err, "b")
+	compareStates(statea, stateb, logger)
+}
@@ -39,6 +39,13 @@ func main() {
 	app.LongDesc = strings.TrimSpace(`
 Recursively compares noms datasets.
 
+With --semantic, the datasets are loaded as ndau state and compared by
+account, node, sysvar and delegate, with decoded values. Unless a height is
+given, the node heights are bisected to find the first block at which the
+app hashes differ, and the states are compared there. --bisect is the same
+as --semantic, but refuses a height. With --blockstore, the transactions of that block are logged from a
+tendermint block store, such as data/blockstore.db in a tendermint home.
+
 For help specifying your datasets, see
 https://github.com/attic-labs/noms/blob/master/doc/spelling.md
 `)
@@ -48,16 +55,26 @@ https://github.com/attic-labs/noms/blob/master/doc/spelling.md
 	verbose := app.BoolOpt("v verbose", false, "emit additional output")
 	height := app.IntOpt("h height", -1, "compare at a given noms height")
 	nodeHeight := app.IntOpt("H node-height", -1, "compare at a given node height")
+	semantic := app.BoolOpt("s semantic", false, "compare the ndau state by account, node, sysvar and delegate; without a height, at the first divergent block")
+	bisect := app.BoolOpt("b bisect", false, "the same as --semantic without a height: find the first divergent block, then compare the ndau state there")
+	blockstore := app.StringOpt("blockstore", "", "with a semantic comparison, log the compared block's transactions from this tendermint block store")
 
 	// set the spec to prevent both height and node height being set
-	app.Spec = "[-v][-h|-H] DATASET_A DATASET_B"
+	app.Spec = "[-v][-s][-b][-h|-H][--blockstore] DATASET_A DATASET_B"
 
 	app.Action = func() {
 		log.SetLevel(log.InfoLevel)
 		if *verbose {
 			log.SetLevel(log.DebugLevel)
 		}
-		compareDS(*dsa, *dsb, *height, *nodeHeight)
+		if *bisect && (*height >= 0 || *nodeHeight >= 0) {
+			bail("--bisect searches every height, so can't be given one")
+		}
+		if *blockstore != "" && !(*semantic || *bisect) {
+			bail("--blockstore needs --semantic or --bisect")
+		}
+		// bisection is a semantic comparison without a height
+		compareDS(*dsa, *dsb, *height, *nodeHeight, *semantic || *bisect, *blockstore)
 		log.Debug("done")
 	}
 	app.Run(os.Args)
@@ -66,6 +66,17 @@ func seekHeight(
 	return ref
 }
 
+// lowestNodeHeight returns the node height of the first commit of a history
+func lowestNodeHeight(db datas.Database, ref nt.Ref, logger log.FieldLogger) uint64 {
+	for {
+		parents := ref.TargetValue(db).(nt.Struct).Get(datas.ParentsField).(nt.Set)
+		if parents.First() == nil {
+			return metanodeheight(db, ref)
+		}
+		ref = parentOf(db, ref, logger)
+	}
+}
+
 func valueAt(db datas.Database, ref nt.Ref) nt.Value {
 	return ref.TargetValue(db).(nt.Struct).Get(datas.ValueField)
 }
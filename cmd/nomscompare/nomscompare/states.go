@@ -0,0 +1,203 @@
+package nomscompare
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/ndau/ndau/pkg/ndau/backing"
+)
+
+// A Difference is one way in which two ndau states differ: an item which
+// only one of them has, or a field of an item which both have
+type Difference struct {
+	// Item is what differs: an account, node, sysvar, delegate, or the
+	// state itself
+	Item string
+	// ID identifies the item: an address or a sysvar name. It's empty for
+	// the state's own fields.
+	ID string
+	// Node is the node of a delegate
+	Node string
+	// Field is the field which differs, or empty if the whole item does
+	Field string
+	// InA and InB are whether each state has the item
+	InA, InB bool
+	// A and B are the values in each state, decoded for reading, or nil
+	// where a state doesn't have the item
+	A, B interface{}
+}
+
+// CompareStates reports the differences between two ndau states by
+// account, node, sysvar and delegate, and by field within them, in that
+// order and sorted by ID. Values are decoded where their types know how:
+// ndau amounts, timestamps, durations, keys and addresses are shown as
+// strings, and other bytes as base64.
+func CompareStates(a, b *backing.State, report func(Difference)) {
+	// accounts and nodes are keyed by address
+	for _, addr := range UnionKeys(a.Accounts, b.Accounts) {
+		adA, okA := a.Accounts[addr]
+		adB, okB := b.Accounts[addr]
+		compareItems(Difference{Item: "account", ID: addr, InA: okA, InB: okB}, adA, adB, report)
+	}
+	for _, addr := range UnionKeys(a.Nodes, b.Nodes) {
+		nodeA, okA := a.Nodes[addr]
+		nodeB, okB := b.Nodes[addr]
+		compareItems(Difference{Item: "node", ID: addr, InA: okA, InB: okB}, nodeA, nodeB, report)
+	}
+
+	for _, name := range UnionKeys(a.Sysvars, b.Sysvars) {
+		svA, okA := a.Sysvars[name]
+		svB, okB := b.Sysvars[name]
+		if okA != okB || !bytes.Equal(svA, svB) {
+			report(present(Difference{Item: "sysvar", ID: name, InA: okA, InB: okB}, svA, svB))
+		}
+	}
+
+	for _, node := range UnionKeys(a.Delegates, b.Delegates) {
+		for _, addr := range UnionKeys(a.Delegates[node], b.Delegates[node]) {
+			_, okA := a.Delegates[node][addr]
+			_, okB := b.Delegates[node][addr]
+			if okA != okB {
+				report(Difference{Item: "delegate", ID: addr, Node: node, InA: okA, InB: okB})
+			}
+		}
+	}
+
+	// everything else in the state is compared field by field
+	compareFields(Difference{Item: "state", InA: true, InB: true}, *a, *b, report, "Accounts", "Nodes", "Sysvars", "Delegates")
+}
+
+// compareItems compares an account or node which may be missing on either side
+func compareItems(d Difference, a, b interface{}, report func(Difference)) {
+	if d.InA && d.InB {
+		compareFields(d, a, b, report)
+	} else {
+		report(present(d, a, b))
+	}
+}
+
+// present fills in the decoded values of an item on the sides which have it
+func present(d Difference, a, b interface{}) Difference {
+	if d.InA {
+		d.A = Decode(reflect.ValueOf(a))
+	}
+	if d.InB {
+		d.B = Decode(reflect.ValueOf(b))
+	}
+	return d
+}
+
+// compareFields reports each exported field of two structs which differs,
+// except those which are skipped
+func compareFields(d Difference, a, b interface{}, report func(Difference), skip ...string) {
+	av := reflect.ValueOf(a)
+	bv := reflect.ValueOf(b)
+	skipped := make(map[string]bool)
+	for _, name := range skip {
+		skipped[name] = true
+	}
+	for i := 0; i < av.NumField(); i++ {
+		f := av.Type().Field(i)
+		if f.PkgPath != "" || skipped[f.Name] {
+			continue
+		}
+		fa := av.Field(i).Interface()
+		fb := bv.Field(i).Interface()
+		if !reflect.DeepEqual(fa, fb) {
+			fd := d
+			fd.Field = f.Name
+			fd.A = Decode(reflect.ValueOf(fa))
+			fd.B = Decode(reflect.ValueOf(fb))
+			report(fd)
+		}
+	}
+}
+
+// fullStringer is implemented by keys, whose String is abbreviated
+type fullStringer interface {
+	FullString() string
+}
+
+// Decode renders a value in its most readable form
+func Decode(v reflect.Value) interface{} {
+	if !v.IsValid() {
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return Decode(v.Elem())
+	}
+	if v.CanInterface() {
+		// methods with pointer receivers need an addressable copy
+		p := reflect.New(v.Type())
+		p.Elem().Set(v)
+		if fs, ok := p.Interface().(fullStringer); ok {
+			return fs.FullString()
+		}
+		if s, ok := p.Interface().(fmt.Stringer); ok {
+			return s.String()
+		}
+	}
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			bs := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(bs), v)
+			return base64.StdEncoding.EncodeToString(bs)
+		}
+		items := make([]interface{}, v.Len())
+		for i := range items {
+			items[i] = Decode(v.Index(i))
+		}
+		return items
+	case reflect.Map:
+		items := make(map[string]interface{}, v.Len())
+		for _, k := range v.MapKeys() {
+			items[fmt.Sprint(Decode(k))] = Decode(v.MapIndex(k))
+		}
+		return items
+	case reflect.Struct:
+		fields := make(map[string]interface{})
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath == "" {
+				fields[v.Type().Field(i).Name] = Decode(v.Field(i))
+			}
+		}
+		return fields
+	}
+	if v.CanInterface() {
+		return v.Interface()
+	}
+	return nil
+}
+
+// UnionKeys returns the keys of two maps with string keys, sorted
+func UnionKeys(a, b interface{}) []string {
+	seen := make(map[string]bool)
+	var keys []string
+	for _, m := range []interface{}{a, b} {
+		for _, k := range reflect.ValueOf(m).MapKeys() {
+			if !seen[k.String()] {
+				seen[k.String()] = true
+				keys = append(keys, k.String())
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,66 @@
+package nomscompare
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"testing"
+
+	"github.com/ndau/ndau/pkg/ndau/backing"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompareStates(t *testing.T) {
+	a := &backing.State{
+		Accounts: map[string]backing.AccountData{
+			"x": {ValidationScript: []byte{1}},
+			"y": {},
+		},
+		Nodes:     map[string]backing.Node{"n": {}},
+		Sysvars:   map[string][]byte{"s": {1}, "t": {2}},
+		Delegates: map[string]map[string]struct{}{"n": {"x": {}}},
+	}
+	b := &backing.State{
+		Accounts: map[string]backing.AccountData{
+			"x": {ValidationScript: []byte{2}},
+			"z": {},
+		},
+		Nodes:     map[string]backing.Node{"n": {Active: true}},
+		Sysvars:   map[string][]byte{"s": {1}, "t": {3}},
+		Delegates: map[string]map[string]struct{}{"n": {"z": {}}},
+	}
+
+	var got []Difference
+	CompareStates(a, b, func(d Difference) {
+		got = append(got, d)
+	})
+	require.Len(t, got, 7)
+	require.Equal(t, Difference{Item: "account", ID: "x", Field: "ValidationScript", InA: true, InB: true, A: "AQ==", B: "Ag=="}, got[0])
+	require.Equal(t, "y", got[1].ID)
+	require.True(t, got[1].InA)
+	require.False(t, got[1].InB)
+	require.NotNil(t, got[1].A)
+	require.Nil(t, got[1].B)
+	require.Equal(t, "z", got[2].ID)
+	require.False(t, got[2].InA)
+	require.True(t, got[2].InB)
+	require.Equal(t, Difference{Item: "node", ID: "n", Field: "Active", InA: true, InB: true, A: false, B: true}, got[3])
+	require.Equal(t, Difference{Item: "sysvar", ID: "t", InA: true, InB: true, A: "Ag==", B: "Aw=="}, got[4])
+	require.Equal(t, Difference{Item: "delegate", ID: "x", Node: "n", InA: true}, got[5])
+	require.Equal(t, Difference{Item: "delegate", ID: "z", Node: "n", InB: true}, got[6])
+
+	CompareStates(a, a, func(d Difference) {
+		t.Errorf("a state differs from itself: %+v", d)
+	})
+}
+
+func TestUnionKeys(t *testing.T) {
+	require.Equal(t, []string{"a", "b", "c"}, UnionKeys(map[string]int{"c": 1, "a": 2}, map[string]bool{"b": true, "a": false}))
+	require.Empty(t, UnionKeys(map[string]int{}, map[string]int(nil)))
+}
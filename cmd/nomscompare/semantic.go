@@ -0,0 +1,82 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"fmt"
+
+	"github.com/attic-labs/noms/go/datas"
+	nt "github.com/attic-labs/noms/go/types"
+	"github.com/ndau/commands/cmd/nomscompare/nomscompare"
+	metast "github.com/ndau/metanode/pkg/meta/state"
+	"github.com/ndau/ndau/pkg/ndau/backing"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// loadState loads the ndau state of a dataset at one of its commits
+func loadState(db datas.Database, ds datas.Dataset, ref nt.Ref, logger log.FieldLogger) (*backing.State, error) {
+	var ms metast.Metastate
+	child := new(backing.State)
+	child.Init(db)
+	ds, err := ms.Load(db, ds, child)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading metastate")
+	}
+
+	// the history is iterated a commit at a time from the head, so count
+	// the commits down to ref
+	depth := 0
+	for r := ds.HeadRef(); r.TargetHash() != ref.TargetHash(); depth++ {
+		r = parentOf(db, r, logger)
+	}
+
+	var found *backing.State
+	err = metast.IterHistory(db, ds, &backing.State{}, func(stI metast.State, h uint64) error {
+		if depth > 0 {
+			depth--
+			return nil
+		}
+		found = stI.(*backing.State)
+		return metast.StopIteration()
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "iterating noms history")
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no state at noms height %d", ref.Height())
+	}
+	return found, nil
+}
+
+// compareStates logs the differences between two ndau states
+func compareStates(a, b *backing.State, logger log.FieldLogger) {
+	nomscompare.CompareStates(a, b, func(d nomscompare.Difference) {
+		l := logger
+		if d.Node != "" {
+			l = l.WithField("node", d.Node)
+		}
+		if d.ID != "" {
+			l = l.WithField(d.Item, d.ID)
+		}
+		switch {
+		case d.InA && !d.InB:
+			l.Info(d.Item + " present in a and not b")
+		case d.InB && !d.InA:
+			l.Info(d.Item + " present in b and not a")
+		default:
+			fields := log.Fields{"a value": d.A, "b value": d.B}
+			if d.Field != "" {
+				fields["field"] = d.Field
+			}
+			l.WithFields(fields).Info(d.Item + " mismatch")
+		}
+	})
+}
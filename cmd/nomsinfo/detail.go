@@ -0,0 +1,297 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/attic-labs/noms/go/d"
+	"github.com/attic-labs/noms/go/datas"
+	"github.com/attic-labs/noms/go/hash"
+	nt "github.com/attic-labs/noms/go/types"
+	"github.com/ndau/commands/cmd/nomsinfo/nomsinfo"
+)
+
+// how many of the largest chunks to report
+const largest = 10
+
+// a chunkInfo describes a chunk found by a walk
+type chunkInfo struct {
+	hash hash.Hash
+	size int
+	kind string
+}
+
+// a problem is a chunk which is missing or corrupt
+type problem struct {
+	hash   hash.Hash
+	parent hash.Hash
+	err    string
+}
+
+// walkStats summarizes the chunks reachable from a value
+type walkStats struct {
+	chunks   int
+	bytes    int
+	largest  []chunkInfo
+	problems []problem
+}
+
+// walk visits every chunk reachable from some hashes once. A chunk which
+// can't be read, or whose contents don't match its hash, is a problem, and
+// what it refers to isn't walked.
+func walk(db datas.Database, roots []hash.Hash, progress bool) walkStats {
+	var ws walkStats
+	type item struct{ hash, parent hash.Hash }
+	var stack []item
+	seen := make(map[hash.Hash]struct{})
+	for _, root := range roots {
+		if _, ok := seen[root]; !ok {
+			seen[root] = struct{}{}
+			stack = append(stack, item{hash: root})
+		}
+	}
+	for len(stack) > 0 {
+		it := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		var v nt.Value
+		var size int
+		err := d.Try(func() {
+			v = db.ReadValue(it.hash)
+			if v != nil {
+				size = len(nt.EncodeValue(v).Data())
+			}
+		})
+		switch {
+		case err != nil:
+			ws.problems = append(ws.problems, problem{it.hash, it.parent, fmt.Sprintf("can't decode: %s", err)})
+			continue
+		case v == nil:
+			ws.problems = append(ws.problems, problem{it.hash, it.parent, "missing"})
+			continue
+		case v.Hash() != it.hash:
+			ws.problems = append(ws.problems, problem{it.hash, it.parent, fmt.Sprintf("contents have hash %s", v.Hash())})
+			continue
+		}
+
+		ws.chunks++
+		ws.bytes += size
+		ws.addLargest(chunkInfo{it.hash, size, fmt.Sprint(v.Kind())})
+		if progress && ws.chunks%100000 == 0 {
+			fmt.Fprintf(os.Stderr, "walked %d chunks\n", ws.chunks)
+		}
+
+		v.WalkRefs(func(r nt.Ref) {
+			h := r.TargetHash()
+			if _, ok := seen[h]; !ok {
+				seen[h] = struct{}{}
+				stack = append(stack, item{h, it.hash})
+			}
+		})
+	}
+	return ws
+}
+
+func (ws *walkStats) hasProblem(h hash.Hash) bool {
+	for _, p := range ws.problems {
+		if p.hash == h {
+			return true
+		}
+	}
+	return false
+}
+
+func (ws *walkStats) addLargest(ci chunkInfo) {
+	if len(ws.largest) == largest && ci.size <= ws.largest[largest-1].size {
+		return
+	}
+	ws.largest = append(ws.largest, ci)
+	sort.SliceStable(ws.largest, func(i, j int) bool { return ws.largest[i].size > ws.largest[j].size })
+	if len(ws.largest) > largest {
+		ws.largest = ws.largest[:largest]
+	}
+}
+
+// readCommit reads a commit, referred to by parent. Like a chunk found by a
+// walk, a commit which can't be read is a problem.
+func readCommit(db datas.Database, ref nt.Ref, parent hash.Hash) (nt.Struct, *problem) {
+	var v nt.Value
+	err := d.Try(func() {
+		v = ref.TargetValue(db)
+	})
+	switch {
+	case err != nil:
+		return nt.Struct{}, &problem{ref.TargetHash(), parent, fmt.Sprintf("can't decode: %s", err)}
+	case v == nil:
+		return nt.Struct{}, &problem{ref.TargetHash(), parent, "missing"}
+	}
+	s, ok := v.(nt.Struct)
+	if !ok {
+		return nt.Struct{}, &problem{ref.TargetHash(), parent, fmt.Sprintf("commit is a %s, not a struct", v.Kind())}
+	}
+	return s, nil
+}
+
+// commits walks the first parents of a commit back to the first commit,
+// returning how many there are and the first. If a commit can't be read,
+// it stops there, and returns the problem.
+func commits(db datas.Database, head nt.Ref) (int, nt.Ref, *problem) {
+	n := 1
+	ref := head
+	var child hash.Hash
+	for {
+		c, p := readCommit(db, ref, child)
+		if p != nil {
+			return n, ref, p
+		}
+		parents, ok := c.MaybeGet(datas.ParentsField)
+		if !ok {
+			return n, ref, &problem{ref.TargetHash(), child, "commit has no parents"}
+		}
+		set, ok := parents.(nt.Set)
+		if !ok {
+			return n, ref, &problem{ref.TargetHash(), child, "commit's parents aren't a set"}
+		}
+		var parent nt.Value
+		if err := d.Try(func() { parent = set.First() }); err != nil {
+			return n, ref, &problem{ref.TargetHash(), child, fmt.Sprintf("can't read parents: %s", err)}
+		}
+		if parent == nil {
+			return n, ref, nil
+		}
+		pref, ok := parent.(nt.Ref)
+		if !ok {
+			return n, ref, &problem{ref.TargetHash(), child, "commit's parent isn't a ref"}
+		}
+		child, ref = ref.TargetHash(), pref
+		n++
+	}
+}
+
+// commitDate returns the date recorded in a commit's metadata, if any
+func commitDate(db datas.Database, ref nt.Ref) string {
+	c, p := readCommit(db, ref, hash.Hash{})
+	if p != nil {
+		return "unreadable: " + p.err
+	}
+	meta, ok := c.MaybeGet("meta")
+	if ok {
+		if ms, ok := meta.(nt.Struct); ok {
+			if date, ok := ms.MaybeGet("date"); ok {
+				if ds, ok := date.(nt.String); ok {
+					return string(ds)
+				}
+			}
+		}
+	}
+	return "not recorded"
+}
+
+// collections finds the collections in a state: the Maps, Sets and Lists
+// which are fields of the metastate, or of the structs within it, like the
+// app's own state
+func collections(v nt.Value, path string, found map[string]nt.Value) {
+	s, ok := v.(nt.Struct)
+	if !ok {
+		return
+	}
+	s.IterFields(func(name string, fv nt.Value) bool {
+		fpath := name
+		if path != "" {
+			fpath = path + "." + name
+		}
+		switch fv.(type) {
+		case nt.Map, nt.Set, nt.List:
+			found[fpath] = fv
+		case nt.Struct:
+			if path == "" {
+				collections(fv, fpath, found)
+			}
+		}
+		return false
+	})
+}
+
+func collectionLen(v nt.Value) uint64 {
+	switch c := v.(type) {
+	case nt.Map:
+		return c.Len()
+	case nt.Set:
+		return c.Len()
+	case nt.List:
+		return c.Len()
+	}
+	return 0
+}
+
+// detail reports statistics about the whole database as seen from the
+// head. It returns the walk of every chunk, for verification.
+func detail(db datas.Database, head nt.Ref) walkStats {
+	n, first, bad := commits(db, head)
+	if bad != nil {
+		fmt.Printf("%20s: at least %d, back to a bad commit\n", "commits", n)
+	} else {
+		fmt.Printf("%20s: %d\n", "commits", n)
+	}
+	fmt.Printf("%20s: %s\n", "first commit", commitDate(db, first))
+	fmt.Printf("%20s: %s\n", "last commit", commitDate(db, head))
+
+	colls := make(map[string]nt.Value)
+	var state nt.Value
+	if d.Try(func() { state = nomsinfo.ValueAt(db, head) }) == nil {
+		// an unreadable head is reported by the walk
+		collections(state, "", colls)
+	}
+	names := make([]string, 0, len(colls))
+	for name := range colls {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Println("collections:")
+	for _, name := range names {
+		// small collections are stored within their parent's chunk, so
+		// count their own encoding and walk what they refer to
+		coll := colls[name]
+		var refs []hash.Hash
+		coll.WalkRefs(func(r nt.Ref) {
+			refs = append(refs, r.TargetHash())
+		})
+		ws := walk(db, refs, false)
+		size := len(nt.EncodeValue(coll).Data()) + ws.bytes
+		fmt.Printf("%20s: %d items, %d bytes\n", name, collectionLen(coll), size)
+	}
+
+	ws := walk(db, []hash.Hash{head.TargetHash()}, true)
+	if bad != nil && !ws.hasProblem(bad.hash) {
+		ws.problems = append(ws.problems, *bad)
+	}
+	fmt.Printf("%20s: %d\n", "chunks", ws.chunks)
+	fmt.Printf("%20s: %d\n", "bytes", ws.bytes)
+	fmt.Println("largest chunks:")
+	for _, ci := range ws.largest {
+		fmt.Printf("%20d: %s %s\n", ci.size, ci.hash, ci.kind)
+	}
+	return ws
+}
+
+// verify reports the missing and corrupt chunks found by a walk, and fails
+// if there are any
+func verify(ws walkStats) {
+	for _, p := range ws.problems {
+		fmt.Printf("%20s: %s (referred to by %s): %s\n", "bad chunk", p.hash, p.parent, p.err)
+	}
+	if len(ws.problems) > 0 {
+		bail(fmt.Sprintf("%d missing or corrupt chunks", len(ws.problems)))
+	}
+	fmt.Printf("%20s: %d chunks, %d bytes\n", "verified", ws.chunks, ws.bytes)
+}
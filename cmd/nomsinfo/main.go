@@ -10,18 +10,16 @@ package main
 // - -- --- ---- -----
 
 import (
-	"encoding/hex"
 	"fmt"
 	"os"
-	"strconv"
 	"strings"
 
 	"github.com/attic-labs/noms/go/spec"
 
-	"github.com/attic-labs/noms/go/datas"
+	"github.com/attic-labs/noms/go/d"
 	"github.com/attic-labs/noms/go/hash"
-	nt "github.com/attic-labs/noms/go/types"
 	cli "github.com/jawher/mow.cli"
+	"github.com/ndau/commands/cmd/nomsinfo/nomsinfo"
 	"github.com/pkg/errors"
 )
 
@@ -43,11 +41,20 @@ func bail(err string) {
 func main() {
 	app := cli.App("nomsinfo", "get basic info about a noms db")
 	app.LongDesc = strings.TrimSpace(`
+With --detail, it also reports the number of commits and their dates, the
+size of each collection in the state, and the number and size of the chunks
+reachable from the head, which include the whole history. --verify walks
+those chunks, reporting any which are missing or corrupt, and fails if there
+are any.
+
 For help specifying your datasets, see
 https://github.com/attic-labs/noms/blob/master/doc/spelling.md
 `)
 
 	ds := app.StringArg("DATASET", "", "noms dataset")
+	nodeHeight := app.IntOpt("H node-height", -1, "report on the newest commit at or below this node height rather than the head")
+	detailed := app.BoolOpt("d detail", false, "report commits, chunks, collection sizes and the largest chunks")
+	verified := app.BoolOpt("verify", false, "walk every reachable chunk, and report those which are missing or corrupt")
 
 	app.Action = func() {
 		if ds == nil || *ds == "" {
@@ -63,46 +70,40 @@ https://github.com/attic-labs/noms/blob/master/doc/spelling.md
 			bail("Dataset has no head ref")
 		}
 
-		fmt.Printf("%20s: %s\n", "apphash", apphash(head))
+		if *nodeHeight >= 0 {
+			var serr error
+			check(d.Try(func() {
+				head, serr = nomsinfo.CommitAt(db, head, uint64(*nodeHeight))
+			}))
+			check(serr)
+		}
+
+		fmt.Printf("%20s: %s\n", "apphash", nomsinfo.AppHash(head))
 		fmt.Printf("%20s: %d\n", "noms height", head.Height())
-		nodeheight, err := metanodeheight(db, head)
+		var nodeheight uint64
+		var herr error
+		err = d.Try(func() {
+			nodeheight, herr = nomsinfo.NodeHeight(db, head)
+		})
+		if err == nil {
+			err = herr
+		}
 		if err == nil {
 			fmt.Printf("%20s: %d\n", "node height", nodeheight)
 		} else {
 			fmt.Fprintf(os.Stderr, "%20s: %s\n", "bad metastate", err)
 		}
-	}
-	app.Run(os.Args)
-}
-
-func apphash(ref nt.Ref) string {
-	h := [hash.ByteLen]byte(ref.Hash())
-	return hex.EncodeToString(h[:])
-}
 
-func valueAt(db datas.Database, ref nt.Ref) nt.Value {
-	return ref.TargetValue(db).(nt.Struct).Get(datas.ValueField)
-}
-
-func metanodeheight(db datas.Database, ref nt.Ref) (uint64, error) {
-	metastate, ok := valueAt(db, ref).(nt.Struct)
-	if !ok {
-		return 0, errors.New("expected metastate to be a nt.Struct")
-	}
-	heightv, ok := metastate.MaybeGet("Height")
-	if !ok {
-		return 0, errors.New("metastate did not have a .Height field")
-	}
-	heights, ok := heightv.(nt.String)
-	if !ok {
-		return 0, errors.New("expected .Height to be stored as a nt.String")
-	}
-	v, err := strconv.ParseUint(
-		string(heights),
-		36, 64,
-	)
-	if err != nil {
-		return 0, errors.Wrap(err, "node height not a base36 string")
+		var ws walkStats
+		if *detailed {
+			ws = detail(db, head)
+		}
+		if *verified {
+			if !*detailed {
+				ws = walk(db, []hash.Hash{head.TargetHash()}, true)
+			}
+			verify(ws)
+		}
 	}
-	return v, nil
+	app.Run(os.Args)
 }
@@ -0,0 +1,102 @@
+package nomsinfo
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"encoding/hex"
+	"strconv"
+
+	"github.com/attic-labs/noms/go/datas"
+	"github.com/attic-labs/noms/go/hash"
+	nt "github.com/attic-labs/noms/go/types"
+	"github.com/pkg/errors"
+)
+
+// AppHash is the app hash of a commit: the hash of its ref, as reported to
+// tendermint
+func AppHash(ref nt.Ref) string {
+	h := [hash.ByteLen]byte(ref.Hash())
+	return hex.EncodeToString(h[:])
+}
+
+// ValueAt returns the value of a commit: the metastate. It's nil if the
+// commit is missing or isn't a commit.
+func ValueAt(db datas.Database, ref nt.Ref) nt.Value {
+	commit, ok := ref.TargetValue(db).(nt.Struct)
+	if !ok {
+		return nil
+	}
+	v, _ := commit.MaybeGet(datas.ValueField)
+	return v
+}
+
+// ParentOf returns the first parent of a commit
+func ParentOf(db datas.Database, ref nt.Ref) (nt.Ref, error) {
+	commit, ok := ref.TargetValue(db).(nt.Struct)
+	if !ok {
+		return nt.Ref{}, errors.New("commit is missing")
+	}
+	parentsv, _ := commit.MaybeGet(datas.ParentsField)
+	parents, ok := parentsv.(nt.Set)
+	if !ok {
+		return nt.Ref{}, errors.New("commit has no set of parents")
+	}
+	first, ok := parents.First().(nt.Ref)
+	if !ok {
+		return nt.Ref{}, errors.New("commit has no parent")
+	}
+	return first, nil
+}
+
+// NodeHeight returns the node height, which is the block height, recorded
+// in the metastate of a commit
+func NodeHeight(db datas.Database, ref nt.Ref) (uint64, error) {
+	value := ValueAt(db, ref)
+	if value == nil {
+		return 0, errors.New("commit is missing or has no value")
+	}
+	metastate, ok := value.(nt.Struct)
+	if !ok {
+		return 0, errors.New("expected metastate to be a nt.Struct")
+	}
+	heightv, ok := metastate.MaybeGet("Height")
+	if !ok {
+		return 0, errors.New("metastate did not have a .Height field")
+	}
+	heights, ok := heightv.(nt.String)
+	if !ok {
+		return 0, errors.New("expected .Height to be stored as a nt.String")
+	}
+	v, err := strconv.ParseUint(
+		string(heights),
+		36, 64,
+	)
+	if err != nil {
+		return 0, errors.Wrap(err, "node height not a base36 string")
+	}
+	return v, nil
+}
+
+// CommitAt walks back from ref to the newest commit whose node height is no
+// greater than height
+func CommitAt(db datas.Database, ref nt.Ref, height uint64) (nt.Ref, error) {
+	for {
+		h, err := NodeHeight(db, ref)
+		if err != nil {
+			return ref, errors.Wrapf(err, "at noms height %d", ref.Height())
+		}
+		if h <= height {
+			return ref, nil
+		}
+		if ref, err = ParentOf(db, ref); err != nil {
+			return ref, errors.Wrapf(err, "seeking node height %d", height)
+		}
+	}
+}
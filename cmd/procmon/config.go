@@ -14,9 +14,11 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -38,8 +40,14 @@ const (
 type Config struct {
 	Env      map[string]string
 	Logger   map[string]string
+	Control  map[string]string
+	Metrics  map[string]string
 	Prologue []map[string]string
 	Task     []ConfigTask
+
+	// where the config came from, so that it can be reloaded
+	filename string
+	nocheck  bool
 }
 
 // The ConfigTask section is a map ("table") of tasks
@@ -55,6 +63,13 @@ type ConfigTask struct {
 	MaxShutdown string
 	Monitors    []map[string]string
 	Prerun      []string
+	DependsOn   []string `toml:"depends_on"`
+	Restart     map[string]string
+	Limits      map[string]string
+	Dir         string
+	User        string
+	Group       string
+	Logs        map[string]string
 }
 
 // Tasks is the container for all the task types that get manipulated.
@@ -63,6 +78,31 @@ type Tasks struct {
 	Signals  map[os.Signal]*Task
 	Periodic []*Task
 	All      map[string]*Task
+
+	periodicStop chan struct{}
+}
+
+// tasksLock guards the running tasks' maps and links, which a reload
+// replaces while the control api and metrics read them
+var tasksLock sync.RWMutex
+
+// list returns every task
+func (ts *Tasks) list() []*Task {
+	tasksLock.RLock()
+	defer tasksLock.RUnlock()
+	out := make([]*Task, 0, len(ts.All))
+	for _, t := range ts.All {
+		out = append(out, t)
+	}
+	return out
+}
+
+// get returns the named task
+func (ts *Tasks) get(name string) (*Task, bool) {
+	tasksLock.RLock()
+	defer tasksLock.RUnlock()
+	t, ok := ts.All[name]
+	return t, ok
 }
 
 // NewTasks creates the Tasks object
@@ -147,15 +187,119 @@ func (ct *ConfigTask) interpolate(env map[string]string) {
 	ct.Parent = interpolate(ct.Parent, env)
 	ct.MaxShutdown = interpolate(ct.MaxShutdown, env)
 	ct.Args = interpolateAll(ct.Args, env).([]string)
+	ct.DependsOn = interpolateAll(ct.DependsOn, env).([]string)
 	ct.Specials = interpolateAll(ct.Specials, env).(map[string]interface{})
+	ct.Restart = interpolateAll(ct.Restart, env).(map[string]string)
+	ct.Limits = interpolateAll(ct.Limits, env).(map[string]string)
+	ct.Dir = interpolate(ct.Dir, env)
+	ct.User = interpolate(ct.User, env)
+	ct.Group = interpolate(ct.Group, env)
+	ct.Logs = interpolateAll(ct.Logs, env).(map[string]string)
 	for i := range ct.Monitors {
 		ct.Monitors[i] = interpolateAll(ct.Monitors[i], env).(map[string]string)
 	}
 }
 
+// longRunning is true for tasks which are kept running, as opposed to
+// signal, periodic, and onetime tasks
+func (ct *ConfigTask) longRunning() bool {
+	periodic, err := parseDuration(ct.Specials["periodic"], 0)
+	return err == nil && periodic == 0 && specialString(ct.Specials, "cron") == "" &&
+		parseSignal(ct.Specials["signal"]) == nil &&
+		!parseBool(ct.Specials["onetime"], false)
+}
+
+// Dependencies returns the names of the tasks each task depends on: its
+// parent, if any, followed by the tasks in its depends_on list. It returns
+// an error if a dependency doesn't exist, isn't a long-running task, or if
+// the dependencies contain a cycle.
+func (c *Config) Dependencies() (map[string][]string, error) {
+	defined := make(map[string]ConfigTask)
+	for _, ct := range c.Task {
+		defined[ct.Name] = ct
+	}
+	deps := make(map[string][]string)
+	for _, ct := range c.Task {
+		var ds []string
+		if ct.Parent != "" {
+			ds = append(ds, ct.Parent)
+		}
+		for _, d := range ct.DependsOn {
+			if d == ct.Name {
+				return nil, fmt.Errorf("task %s depends on itself", ct.Name)
+			}
+			dt, ok := defined[d]
+			if !ok {
+				return nil, fmt.Errorf("task %s depends on unknown task %s", ct.Name, d)
+			}
+			if !ct.longRunning() {
+				return nil, fmt.Errorf("task %s has depends_on, but only long-running tasks can", ct.Name)
+			}
+			if !dt.longRunning() {
+				return nil, fmt.Errorf("task %s depends on %s, which is not a long-running task", ct.Name, d)
+			}
+			if d != ct.Parent {
+				ds = append(ds, d)
+			}
+		}
+		deps[ct.Name] = ds
+	}
+
+	names := make([]string, len(c.Task))
+	for i, ct := range c.Task {
+		names[i] = ct.Name
+	}
+	if cycle := dependencyCycle(deps, names); cycle != nil {
+		return nil, fmt.Errorf("dependency cycle: %s", strings.Join(cycle, " -> "))
+	}
+	return deps, nil
+}
+
+// dependencyCycle returns the first cycle it finds in deps, starting and
+// ending with the same task, or nil. It searches depth first from each of
+// names in turn, so the result is stable.
+func dependencyCycle(deps map[string][]string, names []string) []string {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int)
+	var stack []string
+	var visit func(name string) []string
+	visit = func(name string) []string {
+		switch state[name] {
+		case visiting:
+			for i := range stack {
+				if stack[i] == name {
+					return append(append([]string{}, stack[i:]...), name)
+				}
+			}
+		case visited:
+			return nil
+		}
+		state[name] = visiting
+		stack = append(stack, name)
+		for _, d := range deps[name] {
+			if cycle := visit(d); cycle != nil {
+				return cycle
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[name] = visited
+		return nil
+	}
+	for _, name := range names {
+		if cycle := visit(name); cycle != nil {
+			return cycle
+		}
+	}
+	return nil
+}
+
 // Load does the toml load into a config object
 func Load(filename string, nocheck bool) (Config, error) {
-	cfg := Config{}
+	cfg := Config{filename: filename, nocheck: nocheck}
 	metadata, err := toml.DecodeFile(filename, &cfg)
 	if err != nil {
 		return cfg, errors.Wrap(err, fmt.Sprintf("metadata = %#v", metadata))
@@ -189,6 +333,8 @@ func Load(filename string, nocheck bool) (Config, error) {
 	// Now we can use that to interpolate the rest
 	// of the loaded configuration
 	cfg.Logger = interpolateAll(cfg.Logger, cfg.Env).(map[string]string)
+	cfg.Control = interpolateAll(cfg.Control, cfg.Env).(map[string]string)
+	cfg.Metrics = interpolateAll(cfg.Metrics, cfg.Env).(map[string]string)
 
 	for i := range cfg.Prologue {
 		cfg.Prologue[i] = interpolateAll(cfg.Prologue[i], cfg.Env).(map[string]string)
@@ -221,9 +367,30 @@ func (c *Config) RunPrologue(logger logrus.FieldLogger) error {
 	return nil
 }
 
+// MonitorCommonKeys are the keys every monitor understands
+var MonitorCommonKeys = []string{"name", "type", "period", "retries"}
+
+// MonitorKeys are the keys each type of monitor understands, on top of
+// MonitorCommonKeys. BuildMonitor builds exactly these types.
+var MonitorKeys = map[string][]string{
+	"portavailable": {"port"},
+	"portinuse":     {"port", "timeout"},
+	"ensuredir":     {"path", "perm"},
+	"redis":         {"addr"},
+	"http":          {"url", "timeout"},
+	"tendermint":    {"url", "within", "timeout"},
+	"exec":          {"command", "expect", "timeout"},
+	"filefresh":     {"path", "maxage"},
+	"diskfree":      {"path", "minfree", "minpercent"},
+	"httpjson":      {"url", "path", "op", "value", "timeout"},
+}
+
 // BuildMonitor constructs a monitor from an element in the
 // Monitors map
 func BuildMonitor(mon map[string]string, logger logrus.FieldLogger) (func() Eventer, error) {
+	if _, ok := MonitorKeys[mon["type"]]; !ok {
+		return nil, errors.New("unknown monitor type " + mon["type"])
+	}
 	switch mon["type"] {
 	case "portavailable":
 		if mon["port"] == "" {
@@ -268,16 +435,105 @@ func BuildMonitor(mon map[string]string, logger logrus.FieldLogger) (func() Even
 		}
 		m := HTTPPinger(mon["url"], timeout, logger)
 		return m, nil
+	case "tendermint":
+		if mon["url"] == "" {
+			mon["url"] = "http://localhost:26657"
+		}
+		within, err := parseDuration(mon["within"], time.Minute)
+		if err != nil {
+			return nil, err
+		}
+		timeout, err := parseDuration(mon["timeout"], time.Second)
+		if err != nil {
+			return nil, err
+		}
+		m := TendermintHeight(mon["url"], within, timeout, logger)
+		return m, nil
+	case "exec":
+		if mon["command"] == "" {
+			return nil, errors.New("exec requires a command parm")
+		}
+		expect := 0
+		if mon["expect"] != "" {
+			var err error
+			expect, err = strconv.Atoi(mon["expect"])
+			if err != nil {
+				return nil, errors.Wrap(err, "exec expect")
+			}
+		}
+		timeout, err := parseDuration(mon["timeout"], 10*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		m := ExecPinger(mon["command"], expect, timeout, logger)
+		return m, nil
+	case "filefresh":
+		if mon["path"] == "" {
+			return nil, errors.New("filefresh requires a path parm")
+		}
+		if mon["maxage"] == "" {
+			return nil, errors.New("filefresh requires a maxage parm")
+		}
+		maxage, err := parseDuration(mon["maxage"], 0)
+		if err != nil {
+			return nil, err
+		}
+		m := FileFresh(mon["path"], maxage)
+		return m, nil
+	case "diskfree":
+		if mon["path"] == "" {
+			mon["path"] = "/"
+		}
+		if mon["minfree"] == "" && mon["minpercent"] == "" {
+			return nil, errors.New("diskfree requires a minfree or minpercent parm")
+		}
+		var minfree uint64
+		if mon["minfree"] != "" {
+			var err error
+			minfree, err = parseBytes(mon["minfree"])
+			if err != nil {
+				return nil, err
+			}
+		}
+		var minpct float64
+		if mon["minpercent"] != "" {
+			var err error
+			minpct, err = strconv.ParseFloat(strings.TrimSuffix(mon["minpercent"], "%"), 64)
+			if err != nil {
+				return nil, errors.Wrap(err, "diskfree minpercent")
+			}
+		}
+		m := DiskFree(mon["path"], minfree, minpct)
+		return m, nil
+	case "httpjson":
+		if mon["url"] == "" {
+			return nil, errors.New("httpjson requires a url parm")
+		}
+		if mon["path"] == "" {
+			return nil, errors.New("httpjson requires a path parm")
+		}
+		switch mon["op"] {
+		case "", "eq", "ne", "lt", "le", "gt", "ge", "exists":
+		default:
+			return nil, errors.New("httpjson op must be one of eq, ne, lt, le, gt, ge, exists")
+		}
+		timeout, err := parseDuration(mon["timeout"], time.Second)
+		if err != nil {
+			return nil, err
+		}
+		m := HTTPJSON(mon["url"], mon["path"], mon["op"], mon["value"], timeout, logger)
+		return m, nil
 	default:
-		return nil, errors.New("unknown monitor type " + mon["type"])
+		return nil, errors.New("monitor type " + mon["type"] + " has no builder")
 	}
 }
 
 // Pass in one of the LoggerOutput* contants.
 // If blank, the given default is used.
-// Otherwise, the logger output is assumed to be a file name.
+// Otherwise, the logger output is assumed to be a file name, which is
+// rotated as rot says.
 // If the HONEYCOMB_* env vars are set, then all logging goes to honeycomb.
-func fileparse(taskName, loggerOutput string, def io.Writer) (io.Writer, error) {
+func fileparse(taskName, loggerOutput string, def io.Writer, rot Rotation) (io.Writer, error) {
 	if useHoneycomb {
 		// Route all output from a given task to its own honeycomb filter.
 		return newFilter(taskName), nil
@@ -293,19 +549,141 @@ func fileparse(taskName, loggerOutput string, def io.Writer) (io.Writer, error)
 	case LoggerOutputSuppress:
 		return ioutil.Discard, nil
 	default:
-		f, err := os.OpenFile(loggerOutput, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		return OpenLogFile(loggerOutput, rot)
+	}
+}
+
+// taskOutput opens a task's stdout or stderr, and adds a timestamp and
+// task name prefix to the lines written to it if the config asks for that
+func (c *Config) taskOutput(ct ConfigTask, output string, def io.Writer) (io.Writer, error) {
+	rot, err := BuildRotation(c.Logger, Rotation{})
+	if err != nil {
+		return nil, errors.Wrap(err, "logger")
+	}
+	if rot, err = BuildRotation(ct.Logs, rot); err != nil {
+		return nil, errors.Wrap(err, "task "+ct.Name+" logs")
+	}
+	w, err := fileparse(ct.Name, output, def, rot)
+	if err != nil || useHoneycomb || output == LoggerOutputSuppress {
+		return w, err
+	}
+	prefix := parseBool(c.Logger["prefix"], false)
+	if ct.Logs["prefix"] != "" {
+		prefix = parseBool(ct.Logs["prefix"], prefix)
+	}
+	if prefix {
+		w = NewPrefixWriter(w, ct.Name)
+	}
+	return w, nil
+}
+
+// A RotationConflict is a log file which two settings in a config would
+// rotate differently. Since they share one file, only one rotation could be
+// honored.
+type RotationConflict struct {
+	File string
+	// the config paths of the settings, like task[2].stderr
+	Path, FirstPath string
+	// the tasks they belong to; the logger's own output has none
+	Task, FirstTask string
+}
+
+func (rc RotationConflict) Error() string {
+	return fmt.Sprintf("log file %s is rotated differently by %s than by %s", rc.File, rc.Path, rc.FirstPath)
+}
+
+// RotationConflicts finds the log files which the config would rotate in
+// more than one way. Settings whose rotation can't be built are skipped.
+func (c *Config) RotationConflicts() []RotationConflict {
+	type use struct {
+		path, task string
+		rot        Rotation
+	}
+	var conflicts []RotationConflict
+	first := make(map[string]use)
+	add := func(path, task, output string, rot Rotation) {
+		switch output {
+		case "", LoggerOutputStdout, LoggerOutputStderr, LoggerOutputSuppress:
+			return
+		}
+		file, err := filepath.Abs(output)
 		if err != nil {
-			return nil, err
+			return
+		}
+		f, ok := first[file]
+		switch {
+		case !ok:
+			first[file] = use{path, task, rot}
+		case f.rot != rot:
+			conflicts = append(conflicts, RotationConflict{
+				File: file, Path: path, FirstPath: f.path, Task: task, FirstTask: f.task,
+			})
+		}
+	}
+
+	def, err := BuildRotation(c.Logger, Rotation{})
+	if err != nil {
+		return nil
+	}
+	add("logger.output", "", c.Logger["output"], def)
+	for i, ct := range c.Task {
+		rot, err := BuildRotation(ct.Logs, def)
+		if err != nil {
+			continue
 		}
-		return f, nil
+		path := fmt.Sprintf("task[%d]", i)
+		add(path+".stdout", ct.Name, ct.Stdout, rot)
+		add(path+".stderr", ct.Name, ct.Stderr, rot)
 	}
+	return conflicts
 }
 
 // BuildTasks constructs all the tasks from a loaded config
 // It returns an array of the tasks that need to be individually
 // started. All child tasks will be descendants of these.
 func (c *Config) BuildTasks(logger logrus.FieldLogger) (Tasks, error) {
+	tasks, err := c.buildTasks(logger)
+	if err != nil {
+		return tasks, err
+	}
+	return tasks, c.openOutputs(&tasks, nil)
+}
+
+// openOutputs opens the stdout and stderr of every task except those in
+// skip. If any can't be opened, the ones already opened are closed again.
+func (c *Config) openOutputs(tasks *Tasks, skip map[string]bool) error {
+	for _, ct := range c.Task {
+		if skip[ct.Name] {
+			continue
+		}
+		t := tasks.All[ct.Name]
+		stdout, err := c.taskOutput(ct, ct.Stdout, os.Stdout)
+		if err != nil {
+			closeAllOutputs(*tasks)
+			return err
+		}
+		t.Stdout = stdout
+		stderr, err := c.taskOutput(ct, ct.Stderr, os.Stderr)
+		if err != nil {
+			closeAllOutputs(*tasks)
+			return err
+		}
+		t.Stderr = stderr
+	}
+	return nil
+}
+
+// buildTasks constructs the tasks without opening their outputs, so that it
+// can be used to plan a reload without touching any files
+func (c *Config) buildTasks(logger logrus.FieldLogger) (Tasks, error) {
 	tasks := NewTasks()
+	deps, err := c.Dependencies()
+	if err != nil {
+		return tasks, err
+	}
+	if rcs := c.RotationConflicts(); len(rcs) > 0 {
+		return tasks, rcs[0]
+	}
 	// taskm := make(map[string]*Task)
 	// tasks := make([]*Task, 0)
 	for _, ct := range c.Task {
@@ -325,22 +703,25 @@ func (c *Config) BuildTasks(logger logrus.FieldLogger) (Tasks, error) {
 				if err != nil {
 					return tasks, err
 				}
-				nm := NewFailMonitor(NewMonitor(t.Status, period, m))
+				mm := NewMonitor(t.Status, period, m)
+				mm.Name = mon["name"]
+				mm.Type = mon["type"]
+				mm.Task = t.Name
+				nm := NewFailMonitor(mm)
+				// a monitor only stops its task if the config says how
+				// many successive failures to tolerate first; otherwise
+				// its results are just recorded
+				nm.Observe = mon["retries"] == ""
+				if mon["retries"] != "" {
+					retries, err := strconv.Atoi(mon["retries"])
+					if err != nil {
+						return tasks, errors.Wrap(err, "monitor retries")
+					}
+					nm.WithRetries(retries)
+				}
 				t.Monitors = append(t.Monitors, nm)
 			}
 		}
-		// check for stdout/err assignments
-		stdout, err := fileparse(t.Name, ct.Stdout, os.Stdout)
-		if err != nil {
-			return tasks, err
-		}
-		t.Stdout = stdout
-		stderr, err := fileparse(t.Name, ct.Stderr, os.Stderr)
-		if err != nil {
-			return tasks, err
-		}
-		t.Stderr = stderr
-
 		// MaxStartup
 		maxstartup, err := parseDuration(ct.MaxStartup, t.MaxStartup)
 		if err != nil {
@@ -365,6 +746,19 @@ func (c *Config) BuildTasks(logger logrus.FieldLogger) (Tasks, error) {
 			t.Prerun = append(t.Prerun, tasks.All[prerun])
 		}
 
+		t.Policy, err = BuildRestartPolicy(ct.Restart)
+		if err != nil {
+			return tasks, errors.Wrap(err, "task "+ct.Name)
+		}
+		if t.Policy != nil && !ct.longRunning() {
+			return tasks, errors.New("task " + ct.Name + " has a restart policy, but only long-running tasks are restarted")
+		}
+
+		t.Limits, err = BuildLimits(ct)
+		if err != nil {
+			return tasks, errors.Wrap(err, "task "+ct.Name)
+		}
+
 		t.Onetime = parseBool(ct.Specials["onetime"], false)
 		t.Periodic, err = parseDuration(ct.Specials["periodic"], 0)
 		t.Terminate = parseBool(ct.Specials["terminate"], false)
@@ -372,17 +766,26 @@ func (c *Config) BuildTasks(logger logrus.FieldLogger) (Tasks, error) {
 		if err != nil {
 			return tasks, err
 		}
+		if err = buildSchedule(t, ct.Specials); err != nil {
+			return tasks, errors.Wrap(err, "task "+ct.Name)
+		}
 		sig := parseSignal(ct.Specials["signal"])
 		switch {
 		case sig != nil:
 			tasks.Signals[sig] = t
+			// a signal task can be scheduled as well
+			if t.Schedule != nil {
+				tasks.Periodic = append(tasks.Periodic, t)
+			}
 		case ct.Parent != "":
 			if _, ok := tasks.All[ct.Parent]; !ok {
 				return tasks, errors.New("did not find parent task " + ct.Parent)
 			}
 			tasks.All[ct.Parent].AddDependent(t)
-		case t.Periodic != 0:
+		case t.Schedule != nil:
 			tasks.Periodic = append(tasks.Periodic, t)
+		case len(ct.DependsOn) > 0:
+			// its first dependency becomes its parent, below
 		case ct.Parent == "" && t.Onetime == false:
 			// if no parent and not a onetime task, then it's in the root set of tasks that have to
 			// be started directly
@@ -394,9 +797,53 @@ func (c *Config) BuildTasks(logger logrus.FieldLogger) (Tasks, error) {
 		tasks.All[t.Name] = t
 	}
 
+	// a breaker can run any special task, wherever it's defined
+	defs := make(map[string]ConfigTask)
+	for _, ct := range c.Task {
+		defs[ct.Name] = ct
+	}
+	for _, ct := range c.Task {
+		p := tasks.All[ct.Name].Policy
+		if p == nil || p.Action != BreakerRun {
+			continue
+		}
+		rt, ok := defs[p.Run]
+		if !ok {
+			return tasks, errors.New("did not find restart breaker task " + p.Run + " for task " + ct.Name)
+		}
+		if rt.longRunning() {
+			return tasks, errors.New("restart breaker task " + p.Run + " for task " + ct.Name + " must be a special task")
+		}
+	}
+
+	// now that every task exists, wire up depends_on; a task without a
+	// parent is started and restarted by its first dependency, and
+	// requires the rest
+	for _, ct := range c.Task {
+		if len(ct.DependsOn) == 0 {
+			continue
+		}
+		t := tasks.All[ct.Name]
+		for i, name := range deps[ct.Name] {
+			if i == 0 && ct.Parent == "" {
+				tasks.All[name].AddDependent(t)
+				continue
+			}
+			if name != ct.Parent {
+				t.AddRequirement(tasks.All[name])
+			}
+		}
+	}
+
 	return tasks, nil
 }
 
+// LoggerKeys are the keys of the [logger] section
+var LoggerKeys = append([]string{"output", "format", "level", "prefix", "reopen_signal"}, RotationKeys...)
+
+// LogsKeys are the keys of a task's [task.logs] table
+var LogsKeys = append([]string{"prefix"}, RotationKeys...)
+
 // BuildLogger constructs a logger given the configuration info.
 // The returned logger is used by all tasks including the root task.  Tasks can apply additional
 // logger.WithField()s, but if honeycomb logging is enabled, then all tasks will log to honeycomb
@@ -420,7 +867,16 @@ func (c *Config) BuildLogger(rootTaskName string) logrus.FieldLogger {
 		case LoggerOutputSuppress:
 			out = ioutil.Discard
 		default:
-			out = ioutil.Discard
+			// a file name, which is rotated like the tasks' files; if it
+			// can't be used, we still need to log somewhere
+			rot, err := BuildRotation(c.Logger, Rotation{})
+			if err == nil {
+				out, err = OpenLogFile(c.Logger["output"], rot)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "logger output %s: %s; logging to stderr\n", c.Logger["output"], err)
+				out = os.Stderr
+			}
 		}
 
 		switch c.Logger["format"] {
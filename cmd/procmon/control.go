@@ -0,0 +1,427 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Task kinds, as reported by the control API
+const (
+	KindMain     = "main"
+	KindChild    = "child"
+	KindSignal   = "signal"
+	KindPeriodic = "periodic"
+	KindOnetime  = "onetime"
+)
+
+// Task states, as reported by the control API
+const (
+	StateRunning = "running"
+	StateStopped = "stopped"
+	StateHeld    = "held"
+)
+
+// MonitorStatus reports the most recent result of a behavior monitor
+type MonitorStatus struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Last   string `json:"last,omitempty"`
+	LastAt string `json:"last_at,omitempty"`
+}
+
+// TaskStatus reports the state of a single task
+type TaskStatus struct {
+	Name         string          `json:"name"`
+	Kind         string          `json:"kind"`
+	Parent       string          `json:"parent,omitempty"`
+	Requires     []string        `json:"requires,omitempty"`
+	State        string          `json:"state"`
+	PID          int             `json:"pid,omitempty"`
+	Uptime       string          `json:"uptime,omitempty"`
+	FailCount    int             `json:"failcount"`
+	RestartDelay string          `json:"restart_delay"`
+	NextRun      string          `json:"next_run,omitempty"`
+	Monitors     []MonitorStatus `json:"monitors,omitempty"`
+}
+
+// controlHeader must be set on every command sent to the control API.
+// A web page can make a browser send a plain POST to a loopback address,
+// but not one with a custom header, so this keeps pages from driving the
+// API.
+const controlHeader = "X-Procmon-Request"
+
+// controlResponse is the body returned by the control API's commands
+type controlResponse struct {
+	Message string `json:"message,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Controller serves the local control API.
+//
+// It is deliberately only available on a unix socket or a loopback
+// address: anyone who can reach it can stop every task procmon manages.
+type Controller struct {
+	root     *Task
+	tasks    *Tasks
+	reloader *Reloader
+	logger   logrus.FieldLogger
+	mux      *http.ServeMux
+
+	lock    sync.Mutex
+	running map[string]bool
+}
+
+// NewController creates a Controller for the given task tree
+//
+// The reloader may be nil, in which case the reload command is unavailable.
+func NewController(root *Task, tasks *Tasks, reloader *Reloader, logger logrus.FieldLogger) *Controller {
+	c := &Controller{
+		root:     root,
+		tasks:    tasks,
+		reloader: reloader,
+		logger:   logger,
+		mux:      http.NewServeMux(),
+		running:  make(map[string]bool),
+	}
+	c.mux.HandleFunc("/status", c.handleStatus)
+	c.mux.HandleFunc("/task/", c.handleTask)
+	c.mux.HandleFunc("/reload", c.handleReload)
+	return c
+}
+
+// kind classifies a task for the control API
+func (c *Controller) kind(t *Task) string {
+	// a signal task may also be onetime, but it's more useful to know that
+	// it's bound to a signal
+	for _, st := range c.tasks.Signals {
+		if st == t {
+			return KindSignal
+		}
+	}
+	switch {
+	case t.Schedule != nil:
+		return KindPeriodic
+	case t.Onetime:
+		return KindOnetime
+	case t.parent == c.root:
+		return KindMain
+	default:
+		return KindChild
+	}
+}
+
+// ServeHTTP implements http.Handler
+func (c *Controller) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mux.ServeHTTP(w, r)
+}
+
+// ListenUnix serves the control API on a unix socket at path.
+// Any stale socket left behind by a previous procmon is removed.
+func (c *Controller) ListenUnix(path string) error {
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return errors.Wrap(err, "listening on control socket")
+	}
+	if err = os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return errors.Wrap(err, "setting control socket permissions")
+	}
+	c.serve(l)
+	return nil
+}
+
+// ListenTCP serves the control API over http on addr, which must be a
+// loopback address.
+func (c *Controller) ListenTCP(addr string) error {
+	if err := checkLoopback(addr); err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrap(err, "listening on control address")
+	}
+	c.serve(l)
+	return nil
+}
+
+func (c *Controller) serve(l net.Listener) {
+	c.logger.WithField("addr", l.Addr().String()).Info("control api listening")
+	go func() {
+		err := http.Serve(l, c)
+		c.logger.WithError(err).Error("control api stopped")
+	}()
+}
+
+// checkLoopback returns an error unless addr is a host:port on a loopback
+// interface
+func checkLoopback(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return errors.Wrap(err, "control http address")
+	}
+	if host == "localhost" {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("control http address %s is not a loopback address", addr)
+	}
+	return nil
+}
+
+// Status reports the state of every task, sorted by name
+func (c *Controller) Status() []TaskStatus {
+	tasksLock.RLock()
+	defer tasksLock.RUnlock()
+	out := make([]TaskStatus, 0, len(c.tasks.All))
+	for _, t := range c.tasks.All {
+		out = append(out, c.status(t))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// status must be called with tasksLock held
+func (c *Controller) status(t *Task) TaskStatus {
+	snap := t.snapshot()
+	ts := TaskStatus{
+		Name:         t.Name,
+		Kind:         c.kind(t),
+		State:        StateStopped,
+		FailCount:    snap.failCount,
+		RestartDelay: snap.restartDelay.String(),
+	}
+	if t.parent != nil {
+		ts.Parent = t.parent.Name
+	}
+	for _, req := range t.Requires {
+		ts.Requires = append(ts.Requires, req.Name)
+	}
+	if next := t.NextRun(); !next.IsZero() {
+		ts.NextRun = next.Format(time.RFC3339)
+	}
+	if snap.pid != 0 {
+		ts.State = StateRunning
+		ts.PID = snap.pid
+		ts.Uptime = time.Since(snap.started).Round(time.Second).String()
+	} else if t.held() != nil {
+		ts.State = StateHeld
+	}
+	for _, fm := range t.Monitors {
+		m := fm.Child
+		ms := MonitorStatus{Name: m.Name, Type: m.Type}
+		if last, at := m.Last(); last != nil {
+			ms.Last = last.Code().String()
+			ms.LastAt = at.Format(time.RFC3339)
+		}
+		ts.Monitors = append(ts.Monitors, ms)
+	}
+	return ts
+}
+
+// Restart stops a running task so that its parent restarts it immediately.
+// As with any other stop, the task's dependents are stopped first and are
+// restarted once it is ready again.
+func (c *Controller) Restart(t *Task) error {
+	if err := c.restartable(t); err != nil {
+		return err
+	}
+	t.markRestart(RestartOperator)
+	return c.sendStop(t)
+}
+
+// Stop stops a running task and keeps it stopped until Start is called
+func (c *Controller) Stop(t *Task) error {
+	if err := c.restartable(t); err != nil {
+		return err
+	}
+	t.Hold()
+	return c.sendStop(t)
+}
+
+// Start starts a task which was stopped by Stop
+func (c *Controller) Start(t *Task) error {
+	if t.held() == nil {
+		return fmt.Errorf("%s was not stopped by the control api", t.Name)
+	}
+	t.Release()
+	return nil
+}
+
+// Run runs a signal, periodic, or onetime task now, exactly as if its signal
+// or timer had fired. It returns without waiting for the task to finish.
+func (c *Controller) Run(t *Task) error {
+	switch c.kind(t) {
+	case KindSignal, KindPeriodic, KindOnetime:
+	default:
+		return fmt.Errorf("%s is a %s task; only special tasks can be run", t.Name, c.kind(t))
+	}
+	if t.Window != nil && !t.Window.Contains(time.Now()) {
+		return fmt.Errorf("%s is outside its maintenance window %s", t.Name, t.Window)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.running[t.Name] {
+		return fmt.Errorf("%s is already running", t.Name)
+	}
+	c.running[t.Name] = true
+	f := runfunc(t, c.root, c.tasks)
+	go func() {
+		f()
+		c.lock.Lock()
+		delete(c.running, t.Name)
+		c.lock.Unlock()
+	}()
+	return nil
+}
+
+// restartable returns an error unless t is a running long-lived task
+func (c *Controller) restartable(t *Task) error {
+	switch c.kind(t) {
+	case KindMain, KindChild:
+	default:
+		return fmt.Errorf("%s is a %s task; use run instead", t.Name, c.kind(t))
+	}
+	if snap := t.snapshot(); snap.status == nil || snap.pid == 0 {
+		return fmt.Errorf("%s is not running", t.Name)
+	}
+	return nil
+}
+
+func (c *Controller) sendStop(t *Task) error {
+	select {
+	case t.snapshot().status <- Stop:
+		c.logger.WithField("task", t.Name).Warn("stop requested by control api")
+		return nil
+	case <-time.After(5 * time.Second):
+		return fmt.Errorf("timed out asking %s to stop", t.Name)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (c *Controller) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, controlResponse{Error: "use GET"})
+		return
+	}
+	writeJSON(w, http.StatusOK, c.Status())
+}
+
+// checkCommand ensures that a request is a POST with the control header,
+// and writes an error response if it isn't
+func checkCommand(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, controlResponse{Error: "use POST"})
+		return false
+	}
+	if r.Header.Get(controlHeader) != "1" {
+		writeJSON(w, http.StatusForbidden, controlResponse{Error: "commands require the " + controlHeader + ": 1 header"})
+		return false
+	}
+	return true
+}
+
+// handleTask handles POST /task/{name}/{restart|stop|start|run}
+func (c *Controller) handleTask(w http.ResponseWriter, r *http.Request) {
+	if !checkCommand(w, r) {
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/task/"), "/")
+	if len(parts) != 2 {
+		writeJSON(w, http.StatusNotFound, controlResponse{Error: "expected /task/{name}/{command}"})
+		return
+	}
+	name, command := parts[0], parts[1]
+	t, ok := c.tasks.get(name)
+	if !ok {
+		writeJSON(w, http.StatusNotFound, controlResponse{Error: "no such task " + name})
+		return
+	}
+
+	var err error
+	switch command {
+	case "restart":
+		err = c.Restart(t)
+	case "stop":
+		err = c.Stop(t)
+	case "start":
+		err = c.Start(t)
+	case "run":
+		err = c.Run(t)
+	default:
+		writeJSON(w, http.StatusNotFound, controlResponse{Error: "unknown command " + command})
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusConflict, controlResponse{Error: err.Error()})
+		return
+	}
+	c.logger.WithField("task", name).WithField("command", command).Info("control command accepted")
+	writeJSON(w, http.StatusOK, controlResponse{Message: fmt.Sprintf("%s %s: ok", command, name)})
+}
+
+func (c *Controller) handleReload(w http.ResponseWriter, r *http.Request) {
+	if !checkCommand(w, r) {
+		return
+	}
+	if c.reloader == nil {
+		writeJSON(w, http.StatusNotFound, controlResponse{Error: "reload is not available"})
+		return
+	}
+	dryrun := parseBool(r.URL.Query().Get("dryrun"), false)
+	plan, err := c.reloader.Reload(dryrun)
+	if err != nil {
+		writeJSON(w, http.StatusConflict, controlResponse{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, plan)
+}
+
+// ControlKeys are the keys of the [control] section
+var ControlKeys = []string{"socket", "http", "reload_signal"}
+
+// startController starts the control api if the config asks for it
+func startController(cfg Config, root *Task, tasks *Tasks, reloader *Reloader, logger logrus.FieldLogger) (*Controller, error) {
+	if cfg.Control["socket"] == "" && cfg.Control["http"] == "" {
+		return nil, nil
+	}
+	c := NewController(root, tasks, reloader, logger)
+	if path := cfg.Control["socket"]; path != "" {
+		if err := c.ListenUnix(path); err != nil {
+			return nil, err
+		}
+	}
+	if addr := cfg.Control["http"]; addr != "" {
+		if err := c.ListenTCP(addr); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_checkLoopback(t *testing.T) {
+	for addr, ok := range map[string]bool{
+		"127.0.0.1:7070": true,
+		"[::1]:7070":     true,
+		"localhost:7070": true,
+		"0.0.0.0:7070":   false,
+		":7070":          false,
+		"10.0.0.1:7070":  false,
+		"example.com:80": false,
+		"127.0.0.1":      false,
+	} {
+		err := checkLoopback(addr)
+		if ok {
+			require.NoError(t, err, addr)
+		} else {
+			require.Error(t, err, addr)
+		}
+	}
+}
+
+func testController() *Controller {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	tasks := NewTasks()
+	root := NewTask(rootTaskName, "")
+	a := NewTask("a", "/bin/true")
+	b := NewTask("b", "/bin/true")
+	hup := NewTask("hup", "/bin/true")
+	hup.Onetime = true
+	root.AddDependent(a)
+	a.AddDependent(b)
+	tasks.Main = append(tasks.Main, a)
+	tasks.Signals[parseSignal("HUP")] = hup
+	for _, t := range []*Task{a, b, hup} {
+		t.Logger = logger
+		tasks.All[t.Name] = t
+	}
+	root.Logger = logger
+	return NewController(root, &tasks, nil, logger)
+}
+
+func TestControllerStatus(t *testing.T) {
+	c := testController()
+	s := c.Status()
+	require.Len(t, s, 3)
+	require.Equal(t, "a", s[0].Name)
+	require.Equal(t, KindMain, s[0].Kind)
+	require.Equal(t, rootTaskName, s[0].Parent)
+	require.Equal(t, StateStopped, s[0].State)
+	require.Equal(t, KindChild, s[1].Kind)
+	require.Equal(t, "a", s[1].Parent)
+	require.Equal(t, KindSignal, s[2].Kind)
+}
+
+func TestControllerCommands(t *testing.T) {
+	c := testController()
+	post := func(path string) (int, controlResponse) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, path, nil)
+		r.Header.Set(controlHeader, "1")
+		c.ServeHTTP(w, r)
+		var cr controlResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&cr))
+		return w.Code, cr
+	}
+
+	code, _ := post("/task/nope/restart")
+	require.Equal(t, http.StatusNotFound, code)
+	code, _ = post("/task/a/explode")
+	require.Equal(t, http.StatusNotFound, code)
+	// nothing is running, so there's nothing to restart
+	code, cr := post("/task/a/restart")
+	require.Equal(t, http.StatusConflict, code)
+	require.Contains(t, cr.Error, "not running")
+	// only special tasks can be run
+	code, _ = post("/task/b/run")
+	require.Equal(t, http.StatusConflict, code)
+	// and special tasks can't be restarted
+	code, _ = post("/task/hup/restart")
+	require.Equal(t, http.StatusConflict, code)
+	// start only undoes stop
+	code, _ = post("/task/b/start")
+	require.Equal(t, http.StatusConflict, code)
+	c.tasks.All["b"].Hold()
+	code, _ = post("/task/b/start")
+	require.Equal(t, http.StatusOK, code)
+	require.Nil(t, c.tasks.All["b"].held())
+}
+
+func TestControllerRequiresHeader(t *testing.T) {
+	c := testController()
+	c.tasks.All["b"].Hold()
+	for _, path := range []string{"/task/b/start", "/reload"} {
+		// a form post, as a web page could make a browser send
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader("x=1"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		c.ServeHTTP(w, r)
+		require.Equal(t, http.StatusForbidden, w.Code, path)
+	}
+	require.NotNil(t, c.tasks.All["b"].held(), "b was started without the header")
+}
+
+func TestStopRootOnce(t *testing.T) {
+	root := NewTask(rootTaskName, "")
+	root.Stopped = make(chan struct{})
+	require.True(t, stopRoot(root))
+	// a second shutdown must not close it again
+	require.False(t, stopRoot(root))
+}
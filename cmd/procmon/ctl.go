@@ -0,0 +1,232 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	arg "github.com/alexflint/go-arg"
+	"github.com/pkg/errors"
+)
+
+// subcommands are dispatched on the first argument, before procmon tries to
+// load a config file
+var subcommands = map[string]func(args []string) int{
+	"ctl":      ctl,
+	"graph":    graph,
+	"validate": validate,
+	"explain":  explain,
+	limitsShim: shim,
+}
+
+// parseSubcommand parses a subcommand's arguments into dest. If the
+// subcommand shouldn't go on, because of an error or because it printed its
+// help, it returns false and the exit code.
+func parseSubcommand(program string, dest interface{}, argv []string) (int, bool) {
+	p, err := arg.NewParser(arg.Config{Program: program}, dest)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2, false
+	}
+	err = p.Parse(argv)
+	switch {
+	case err == arg.ErrHelp:
+		p.WriteHelp(os.Stdout)
+		return 0, false
+	case err != nil:
+		p.WriteUsage(os.Stderr)
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 2, false
+	}
+	return 0, true
+}
+
+type ctlargs struct {
+	Command string `arg:"positional,required" help:"status, restart, stop, start, run, or reload"`
+	Task    string `arg:"positional" help:"the task to act on"`
+	Socket  string `arg:"env:PROCMON_SOCKET" help:"control socket of the running procmon"`
+	HTTP    string `arg:"env:PROCMON_HTTP" help:"control http address of the running procmon; overrides --socket"`
+	JSON    bool   `help:"print the raw json response"`
+	DryRun  bool   `arg:"--dry-run" help:"with reload, print the plan without acting on it"`
+}
+
+func (ctlargs) Description() string {
+	return strings.TrimSpace(`
+Control a running procmon.
+
+Commands:
+  status          list every task with its state, pid, uptime and monitors
+  restart TASK    restart a task and its dependents immediately
+  stop TASK       stop a task and its dependents, and keep them stopped
+  start TASK      start a task stopped with 'stop'
+  run TASK        run a signal, periodic, or onetime task now
+  reload          reload the config file, restarting only the tasks it changes
+	`)
+}
+
+// ctlClient returns an http client and base url for the control api
+func ctlClient(args ctlargs) (*http.Client, string) {
+	if args.HTTP != "" {
+		return &http.Client{Timeout: 30 * time.Second}, "http://" + args.HTTP
+	}
+	socket := args.Socket
+	if socket == "" {
+		socket = "/tmp/procmon.sock"
+	}
+	return &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}, "http://procmon"
+}
+
+// ctlPost sends a command to the control api
+func ctlPost(client *http.Client, url string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(controlHeader, "1")
+	return client.Do(req)
+}
+
+// ctl is the client side of the control api
+func ctl(argv []string) int {
+	var args ctlargs
+	if code, ok := parseSubcommand("procmon ctl", &args, argv); !ok {
+		return code
+	}
+
+	client, base := ctlClient(args)
+	var resp *http.Response
+	var err error
+	switch args.Command {
+	case "status":
+		resp, err = client.Get(base + "/status")
+	case "restart", "stop", "start", "run":
+		if args.Task == "" {
+			fmt.Fprintf(os.Stderr, "%s requires a task name\n", args.Command)
+			return 2
+		}
+		resp, err = ctlPost(client, base+"/task/"+args.Task+"/"+args.Command)
+	case "reload":
+		resp, err = ctlPost(client, base+"/reload?dryrun="+strconv.FormatBool(args.DryRun))
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", args.Command)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, errors.Wrap(err, "contacting procmon"))
+		return 1
+	}
+	defer resp.Body.Close()
+
+	if args.JSON {
+		io.Copy(os.Stdout, resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			return 1
+		}
+		return 0
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var cr controlResponse
+		if json.NewDecoder(resp.Body).Decode(&cr) != nil || cr.Error == "" {
+			cr.Error = resp.Status
+		}
+		fmt.Fprintln(os.Stderr, cr.Error)
+		return 1
+	}
+
+	if args.Command == "reload" {
+		var plan ReloadPlan
+		if err = json.NewDecoder(resp.Body).Decode(&plan); err != nil {
+			fmt.Fprintln(os.Stderr, errors.Wrap(err, "reading response"))
+			return 1
+		}
+		writePlanTable(os.Stdout, plan)
+		if args.DryRun {
+			fmt.Println("dry run: nothing was changed")
+		}
+		return 0
+	}
+
+	if args.Command != "status" {
+		var cr controlResponse
+		if err = json.NewDecoder(resp.Body).Decode(&cr); err != nil {
+			fmt.Fprintln(os.Stderr, errors.Wrap(err, "reading response"))
+			return 1
+		}
+		fmt.Println(cr.Message)
+		return 0
+	}
+
+	var statuses []TaskStatus
+	if err = json.NewDecoder(resp.Body).Decode(&statuses); err != nil {
+		fmt.Fprintln(os.Stderr, errors.Wrap(err, "reading response"))
+		return 1
+	}
+	writeStatusTable(os.Stdout, statuses)
+	return 0
+}
+
+func writeStatusTable(w io.Writer, statuses []TaskStatus) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TASK\tKIND\tPARENT\tSTATE\tPID\tUPTIME\tFAILS\tDELAY\tNEXT\tMONITORS")
+	for _, s := range statuses {
+		pid := "-"
+		if s.PID != 0 {
+			pid = fmt.Sprint(s.PID)
+		}
+		mons := make([]string, 0, len(s.Monitors))
+		for _, m := range s.Monitors {
+			last := m.Last
+			if last == "" {
+				last = "pending"
+			}
+			mons = append(mons, fmt.Sprintf("%s(%s)=%s", m.Name, m.Type, last))
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n",
+			s.Name, s.Kind, dash(s.Parent), s.State, pid, dash(s.Uptime),
+			s.FailCount, s.RestartDelay, dash(s.NextRun), dash(strings.Join(mons, " ")),
+		)
+	}
+	tw.Flush()
+}
+
+func writePlanTable(w io.Writer, plan ReloadPlan) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ACTION\tTASK\tREASON")
+	for _, a := range plan {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", a.Action, a.Task, a.Reason)
+	}
+	tw.Flush()
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -35,6 +35,22 @@ func (e Event) Code() Event {
 	return e
 }
 
+// String implements fmt.Stringer
+func (e Event) String() string {
+	switch e {
+	case OK:
+		return "OK"
+	case Stop:
+		return "Stop"
+	case Failing:
+		return "Failing"
+	case Failed:
+		return "Failed"
+	default:
+		return fmt.Sprintf("Event(%d)", int(e))
+	}
+}
+
 // ErrorEvent is an Event that can carry an error as well
 type ErrorEvent struct {
 	Evt Event
@@ -0,0 +1,331 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+type explainargs struct {
+	Configfile string `arg:"positional,required" help:"the name of the .toml config file to load"`
+	NoCheck    bool   `help:"set this to disable checking that envvar substitutions are fully resolved"`
+}
+
+func (explainargs) Description() string {
+	return strings.TrimSpace(`
+Describe what procmon would do with a config file, without starting anything.
+
+The tasks are shown with every environment variable interpolated: the
+long-running tasks in the order they're started, then the signal, scheduled
+and onetime tasks, and then what each signal does.
+	`)
+}
+
+// explain is the explain subcommand
+func explain(argv []string) int {
+	var args explainargs
+	if code, ok := parseSubcommand("procmon explain", &args, argv); !ok {
+		return code
+	}
+
+	cfg, err := Load(args.Configfile, args.NoCheck)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err = WriteExplanation(os.Stdout, cfg, time.Now()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// WriteExplanation describes a config: its tasks in start order, their
+// monitors, the special tasks and the signal bindings. Scheduled tasks show
+// their next run after now.
+//
+// Like WriteGraph, it works from the config alone.
+func WriteExplanation(w io.Writer, cfg Config, now time.Time) error {
+	deps, err := cfg.Dependencies()
+	if err != nil {
+		return err
+	}
+
+	if len(cfg.Prologue) > 0 {
+		fmt.Fprintln(w, "Prologue, checked before anything starts:")
+		for _, mon := range cfg.Prologue {
+			fmt.Fprintf(w, "  %s\n", describeMonitor(mon))
+		}
+		fmt.Fprintln(w)
+	}
+
+	// a task starts once everything it depends on is running, so the tasks
+	// in each stage start together
+	stage := make(map[string]int)
+	var stageOf func(name string) int
+	stageOf = func(name string) int {
+		if s, ok := stage[name]; ok {
+			return s
+		}
+		s := 1
+		for _, d := range deps[name] {
+			if ds := stageOf(d) + 1; ds > s {
+				s = ds
+			}
+		}
+		stage[name] = s
+		return s
+	}
+	var started, special []ConfigTask
+	for _, ct := range cfg.Task {
+		// onetime tasks with a parent run once each time it starts
+		if ct.longRunning() || (ct.Parent != "" && parseBool(ct.Specials["onetime"], false) &&
+			parseSignal(ct.Specials["signal"]) == nil) {
+			started = append(started, ct)
+		} else {
+			special = append(special, ct)
+		}
+	}
+	sort.SliceStable(started, func(i, j int) bool {
+		return stageOf(started[i].Name) < stageOf(started[j].Name)
+	})
+
+	fmt.Fprintln(w, "Tasks, in start order:")
+	for i, ct := range started {
+		if i == 0 || stageOf(ct.Name) != stageOf(started[i-1].Name) {
+			fmt.Fprintf(w, "  stage %d\n", stageOf(ct.Name))
+		}
+		fmt.Fprintf(w, "    %s\n", ct.Name)
+		ds := deps[ct.Name]
+		switch {
+		case len(ds) == 0:
+			explainField(w, "after", "procmon starts")
+		case len(ds) == 1:
+			explainField(w, "after", ds[0])
+		default:
+			explainField(w, "after", fmt.Sprintf("%s; also requires %s", ds[0], strings.Join(ds[1:], ", ")))
+		}
+		if parseBool(ct.Specials["onetime"], false) {
+			explainField(w, "onetime", "runs once each time its parent starts")
+		}
+		explainTask(w, ct)
+	}
+
+	if len(special) > 0 {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "Special tasks:")
+	}
+	prerunOf := make(map[string][]string)
+	for _, ct := range cfg.Task {
+		for _, p := range ct.Prerun {
+			prerunOf[p] = append(prerunOf[p], ct.Name)
+		}
+	}
+	for _, ct := range special {
+		fmt.Fprintf(w, "    %s\n", ct.Name)
+		var triggers []string
+		if s := ct.Specials["signal"]; s != nil {
+			triggers = append(triggers, fmt.Sprintf("signal %v", s))
+		}
+		t := &Task{Shutdown: parseBool(ct.Specials["shutdown"], false)}
+		t.Periodic, _ = parseDuration(ct.Specials["periodic"], 0)
+		if buildSchedule(t, ct.Specials) == nil && t.Schedule != nil {
+			when := fmt.Sprintf("every %s", t.Periodic)
+			if expr := specialString(ct.Specials, "cron"); expr != "" {
+				when = "cron " + expr
+				if tz := specialString(ct.Specials, "timezone"); tz != "" {
+					when += " " + tz
+				}
+			}
+			if next := t.Schedule.Next(now); !next.IsZero() {
+				when += ", next " + next.Format(time.RFC3339)
+			}
+			triggers = append(triggers, when)
+		}
+		if users := prerunOf[ct.Name]; len(users) > 0 {
+			triggers = append(triggers, "prerun of "+strings.Join(users, ", "))
+		}
+		for _, other := range cfg.Task {
+			if other.Restart["run"] == ct.Name && other.Restart["action"] == BreakerRun {
+				triggers = append(triggers, "restart breaker of "+other.Name)
+			}
+		}
+		if len(triggers) == 0 {
+			triggers = append(triggers, "never")
+		}
+		explainField(w, "runs on", strings.Join(triggers, "; "))
+		if t.Shutdown {
+			explainField(w, "shutdown", "stops the long-running tasks while it runs, then starts them again")
+		}
+		if t.Window != nil {
+			explainField(w, "window", t.Window.String())
+		}
+		if parseBool(ct.Specials["terminate"], false) {
+			explainField(w, "terminate", "procmon exits once it has run")
+		}
+		if t.Overlap == OverlapSkip {
+			explainField(w, "overlap", "skipped while the previous run is still going")
+		}
+		explainTask(w, ct)
+	}
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Signals:")
+	handlers := map[os.Signal]string{
+		syscall.SIGTERM: "kill every task and exit",
+		syscall.SIGINT:  "stop every task and exit",
+	}
+	for _, ct := range cfg.Task {
+		if sig := parseSignal(ct.Specials["signal"]); sig != nil {
+			handlers[sig] = "run task " + ct.Name
+			if sig == syscall.SIGTERM {
+				handlers[sig] += ", then exit"
+			}
+		}
+	}
+	if sig := parseSignal(cfg.Control["reload_signal"]); sig != nil {
+		handlers[sig] = "reload the config file"
+	}
+	if sig := parseSignal(cfg.Logger["reopen_signal"]); sig != nil {
+		handlers[sig] = "reopen the log files"
+	}
+	for _, sig := range []os.Signal{syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2} {
+		if h, ok := handlers[sig]; ok {
+			fmt.Fprintf(w, "  %-8s %s\n", signalName(sig), h)
+		}
+	}
+
+	if cfg.Control["socket"] != "" || cfg.Control["http"] != "" || cfg.Metrics["addr"] != "" {
+		fmt.Fprintln(w)
+	}
+	if s := cfg.Control["socket"]; s != "" {
+		fmt.Fprintf(w, "Control socket: %s\n", s)
+	}
+	if s := cfg.Control["http"]; s != "" {
+		fmt.Fprintf(w, "Control http: %s\n", s)
+	}
+	if addr := cfg.Metrics["addr"]; addr != "" {
+		path := cfg.Metrics["path"]
+		if path == "" {
+			path = "/metrics"
+		}
+		fmt.Fprintf(w, "Metrics: http://%s%s\n", addr, path)
+	}
+	return nil
+}
+
+// explainTask writes the details common to every kind of task
+func explainTask(w io.Writer, ct ConfigTask) {
+	explainField(w, "command", commandLine(ct.Path, ct.Args))
+	if len(ct.Prerun) > 0 {
+		explainField(w, "prerun", strings.Join(ct.Prerun, ", "))
+	}
+	for i, mon := range ct.Monitors {
+		key := ""
+		if i == 0 {
+			key = "monitors"
+		}
+		explainField(w, key, describeMonitor(mon))
+	}
+	if ct.Stdout != "" {
+		explainField(w, "stdout", ct.Stdout)
+	}
+	if ct.Stderr != "" {
+		explainField(w, "stderr", ct.Stderr)
+	}
+	if p, err := BuildRestartPolicy(ct.Restart); err == nil && p != nil {
+		s := fmt.Sprintf("wait %s, then %g times longer each time, up to %s", p.Initial, p.Multiplier, p.Max)
+		if p.MaxRestarts > 0 {
+			s += fmt.Sprintf("; after %d restarts within %s, %s", p.MaxRestarts, p.Window, p.Action)
+			if p.Action == BreakerRun {
+				s += " " + p.Run
+			}
+		}
+		explainField(w, "restart", s)
+	}
+	var limits []string
+	for _, k := range sortedKeys(ct.Limits) {
+		limits = append(limits, k+"="+ct.Limits[k])
+	}
+	for _, f := range []struct{ key, value string }{{"user", ct.User}, {"group", ct.Group}, {"dir", ct.Dir}} {
+		if f.value != "" {
+			limits = append(limits, f.key+"="+f.value)
+		}
+	}
+	if len(limits) > 0 {
+		explainField(w, "limits", strings.Join(limits, " "))
+	}
+}
+
+func explainField(w io.Writer, key, value string) {
+	fmt.Fprintf(w, "      %-10s %s\n", key, value)
+}
+
+// describeMonitor summarizes a monitor on one line
+func describeMonitor(mon map[string]string) string {
+	s := fmt.Sprintf("%s: %s", mon["name"], mon["type"])
+	for _, k := range sortedKeys(mon) {
+		switch k {
+		case "name", "type", "period", "retries":
+		default:
+			s += fmt.Sprintf(" %s=%s", k, mon[k])
+		}
+	}
+	if mon["name"] == "ready" {
+		return s
+	}
+	period := mon["period"]
+	if period == "" {
+		period = "15s"
+	}
+	s += ", every " + period
+	if r := mon["retries"]; r != "" {
+		s += ", " + r + " retries"
+	} else {
+		s += ", observed only"
+	}
+	return s
+}
+
+// commandLine quotes the arguments that need it
+func commandLine(path string, args []string) string {
+	parts := []string{path}
+	for _, a := range args {
+		if a == "" || strings.ContainsAny(a, " \t\"'$") {
+			a = strconv.Quote(a)
+		}
+		parts = append(parts, a)
+	}
+	return strings.Join(parts, " ")
+}
+
+// signalName gives the conventional name of a signal
+func signalName(sig os.Signal) string {
+	switch sig {
+	case syscall.SIGHUP:
+		return "SIGHUP"
+	case syscall.SIGINT:
+		return "SIGINT"
+	case syscall.SIGTERM:
+		return "SIGTERM"
+	case syscall.SIGUSR1:
+		return "SIGUSR1"
+	case syscall.SIGUSR2:
+		return "SIGUSR2"
+	}
+	return sig.String()
+}
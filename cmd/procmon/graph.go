@@ -0,0 +1,104 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+type graphargs struct {
+	Configfile string `arg:"positional,required" help:"the name of the .toml config file to load"`
+	NoCheck    bool   `help:"set this to disable checking that envvar substitutions are fully resolved"`
+}
+
+func (graphargs) Description() string {
+	return strings.TrimSpace(`
+Print the task dependency graph of a config file in graphviz dot format.
+
+Solid edges lead from a task to the dependents it starts and restarts,
+dashed edges from the other tasks named in depends_on, and dotted edges
+from prerun tasks. Render it with, for example:
+
+  procmon graph config.toml | dot -Tsvg > tasks.svg
+	`)
+}
+
+// graph is the graph subcommand
+func graph(argv []string) int {
+	var args graphargs
+	if code, ok := parseSubcommand("procmon graph", &args, argv); !ok {
+		return code
+	}
+
+	cfg, err := Load(args.Configfile, args.NoCheck)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err = WriteGraph(os.Stdout, cfg); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// WriteGraph writes the dependency graph of a config in dot format.
+//
+// It works from the config alone rather than building the tasks, so that
+// it doesn't open any log files.
+func WriteGraph(w io.Writer, cfg Config) error {
+	deps, err := cfg.Dependencies()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w, "digraph procmon {")
+	fmt.Fprintln(w, "\trankdir=LR;")
+	fmt.Fprintf(w, "\t%q [shape=box];\n", rootTaskName)
+	for _, ct := range cfg.Task {
+		switch {
+		case parseSignal(ct.Specials["signal"]) != nil:
+			fmt.Fprintf(w, "\t%q [shape=diamond, label=%q];\n",
+				ct.Name, fmt.Sprintf("%s\n%s", ct.Name, ct.Specials["signal"]))
+		case specialString(ct.Specials, "cron") != "":
+			fmt.Fprintf(w, "\t%q [shape=diamond, label=%q];\n",
+				ct.Name, fmt.Sprintf("%s\ncron %s", ct.Name, specialString(ct.Specials, "cron")))
+		case !ct.longRunning() && ct.Specials["periodic"] != nil:
+			fmt.Fprintf(w, "\t%q [shape=diamond, label=%q];\n",
+				ct.Name, fmt.Sprintf("%s\nevery %v", ct.Name, ct.Specials["periodic"]))
+		case !ct.longRunning():
+			fmt.Fprintf(w, "\t%q [shape=ellipse, style=dashed];\n", ct.Name)
+		default:
+			fmt.Fprintf(w, "\t%q;\n", ct.Name)
+		}
+	}
+	for _, ct := range cfg.Task {
+		for _, p := range ct.Prerun {
+			fmt.Fprintf(w, "\t%q -> %q [style=dotted, label=\"prerun\"];\n", p, ct.Name)
+		}
+		if !ct.longRunning() {
+			continue
+		}
+		ds := deps[ct.Name]
+		if len(ds) == 0 {
+			fmt.Fprintf(w, "\t%q -> %q;\n", rootTaskName, ct.Name)
+			continue
+		}
+		fmt.Fprintf(w, "\t%q -> %q;\n", ds[0], ct.Name)
+		for _, d := range ds[1:] {
+			fmt.Fprintf(w, "\t%q -> %q [style=dashed];\n", d, ct.Name)
+		}
+	}
+	fmt.Fprintln(w, "}")
+	return nil
+}
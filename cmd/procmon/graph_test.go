@@ -0,0 +1,124 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+// dependsConfig has a database, a cache, and an api which needs both,
+// plus an indexer which is a child of the api and also needs the cache
+func dependsConfig() Config {
+	return Config{
+		Task: []ConfigTask{
+			{Name: "api", Path: "/bin/api", DependsOn: []string{"db", "cache"}},
+			{Name: "db", Path: "/bin/db"},
+			{Name: "cache", Path: "/bin/cache"},
+			{Name: "indexer", Path: "/bin/indexer", Parent: "api", DependsOn: []string{"cache"}},
+			{Name: "pre", Path: "/bin/true", Specials: map[string]interface{}{"onetime": true}},
+			{Name: "backup", Path: "/bin/backup", Prerun: []string{"pre"}, Specials: map[string]interface{}{"periodic": "1h"}},
+		},
+	}
+}
+
+func TestDependencies(t *testing.T) {
+	cfg := dependsConfig()
+	deps, err := cfg.Dependencies()
+	require.NoError(t, err)
+	require.Equal(t, []string{"db", "cache"}, deps["api"])
+	require.Equal(t, []string{"api", "cache"}, deps["indexer"])
+	require.Empty(t, deps["db"])
+}
+
+func TestDependenciesErrors(t *testing.T) {
+	for name, tt := range map[string]struct {
+		task ConfigTask
+		want string
+	}{
+		"unknown":  {ConfigTask{Name: "x", DependsOn: []string{"nope"}}, "unknown task nope"},
+		"self":     {ConfigTask{Name: "x", DependsOn: []string{"x"}}, "depends on itself"},
+		"special":  {ConfigTask{Name: "x", DependsOn: []string{"pre"}}, "not a long-running task"},
+		"periodic": {ConfigTask{Name: "x", DependsOn: []string{"db"}, Specials: map[string]interface{}{"periodic": "1m"}}, "only long-running tasks"},
+	} {
+		cfg := dependsConfig()
+		cfg.Task = append(cfg.Task, tt.task)
+		_, err := cfg.Dependencies()
+		require.Error(t, err, name)
+		require.Contains(t, err.Error(), tt.want, name)
+	}
+}
+
+func TestDependenciesCycle(t *testing.T) {
+	cfg := dependsConfig()
+	cfg.Task[1].DependsOn = []string{"indexer"}
+	_, err := cfg.Dependencies()
+	require.Error(t, err)
+	require.Equal(t, "dependency cycle: api -> db -> indexer -> api", err.Error())
+	_, err = cfg.BuildTasks(reloadLogger())
+	require.Error(t, err)
+}
+
+func TestBuildTasksDependsOn(t *testing.T) {
+	cfg := dependsConfig()
+	tasks, err := cfg.BuildTasks(reloadLogger())
+	require.NoError(t, err)
+	api, db, cache, indexer := tasks.All["api"], tasks.All["db"], tasks.All["cache"], tasks.All["indexer"]
+
+	require.Equal(t, []*Task{db, cache}, tasks.Main)
+	require.Equal(t, []*Task{api}, db.Dependents)
+	require.Same(t, db, api.parent)
+	require.Equal(t, []*Task{cache}, api.Requires)
+	require.Equal(t, []*Task{indexer}, api.Dependents)
+	require.Equal(t, []*Task{cache}, indexer.Requires)
+	require.Equal(t, []*Task{api, indexer}, cache.requiredBy)
+}
+
+func TestWriteGraph(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, WriteGraph(&buf, dependsConfig()))
+	out := buf.String()
+	for _, line := range []string{
+		`"procmon" -> "db";`,
+		`"procmon" -> "cache";`,
+		`"db" -> "api";`,
+		`"cache" -> "api" [style=dashed];`,
+		`"api" -> "indexer";`,
+		`"cache" -> "indexer" [style=dashed];`,
+		`"pre" -> "backup" [style=dotted, label="prerun"];`,
+		`"backup" [shape=diamond, label="backup\nevery 1h"];`,
+	} {
+		require.Contains(t, out, line)
+	}
+	require.NotContains(t, out, `-> "backup";`)
+}
+
+func TestWaitForRequirementsWarns(t *testing.T) {
+	defer func(d time.Duration) { requirementWarning = d }(requirementWarning)
+	requirementWarning = 150 * time.Millisecond
+
+	logger := logrus.New()
+	buf := new(bytes.Buffer)
+	logger.Out = buf
+	db := NewTask("db", "/bin/db")
+	api := NewTask("api", "/bin/api")
+	api.Logger = logger
+	api.AddRequirement(db)
+
+	stop := make(chan struct{})
+	time.AfterFunc(400*time.Millisecond, func() { close(stop) })
+	require.False(t, api.waitForRequirements(stop))
+	require.Contains(t, buf.String(), "still waiting for dependencies")
+	require.Contains(t, buf.String(), "db")
+}
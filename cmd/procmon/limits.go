@@ -0,0 +1,487 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// limitsShim is the hidden subcommand which applies a task's limits to
+// itself and then execs the task, so that the limits are in place before
+// the task runs any of its own code
+const limitsShim = "__limits"
+
+// where the cgroup v2 hierarchy is mounted
+var cgroupMount = "/sys/fs/cgroup"
+
+// procmon moves itself into this leaf of its own cgroup before the tasks'
+// groups are created beside it, since a cgroup with processes of its own
+// can't delegate controllers to children
+const cgroupLeaf = "procmon"
+
+var (
+	cgroupParentOnce sync.Once
+	cgroupParent     string
+	cgroupParentErr  error
+)
+
+// the rlimits which can be set, by config name
+var rlimits = map[string]int{
+	"nofile": syscall.RLIMIT_NOFILE,
+	"as":     syscall.RLIMIT_AS,
+	"core":   syscall.RLIMIT_CORE,
+}
+
+// I/O scheduling classes, as used by ioprio_set(2)
+var ioClasses = map[string]int{
+	"realtime":    1,
+	"rt":          1,
+	"best-effort": 2,
+	"be":          2,
+	"idle":        3,
+}
+
+// Limits are the resource limits and process settings of a task.
+//
+// The rlimits, nice and ionice values are applied by running the task
+// through procmon's limits shim, which only then switches to the task's
+// user and group, so that it may still lower nice values and raise hard
+// limits. Memory and CPU limits use a cgroup v2 group per task, if the
+// hierarchy is available and writable; otherwise they're skipped with a
+// warning.
+type Limits struct {
+	Rlimits map[string]uint64 `json:"rlimits,omitempty"`
+	Nice    *int              `json:"nice,omitempty"`
+	IOPrio  int               `json:"ioprio,omitempty"`
+	// Handshake makes the shim wait until procmon has put it in its cgroup
+	Handshake bool    `json:"handshake,omitempty"`
+	UID       *uint32 `json:"uid,omitempty"`
+	GID       *uint32 `json:"gid,omitempty"`
+
+	Dir    string  `json:"-"`
+	Memory uint64  `json:"-"`
+	CPU    float64 `json:"-"`
+
+	cgroup string
+	ooms   int
+}
+
+// LimitError reports that a task was stopped by one of its limits
+type LimitError struct {
+	Limit  string
+	Detail string
+}
+
+func (e LimitError) Error() string {
+	return fmt.Sprintf("%s limit exceeded: %s", e.Limit, e.Detail)
+}
+
+// BuildLimits builds a task's limits from its config. It returns nil if
+// the task has none, so that it's run directly.
+func BuildLimits(ct ConfigTask) (*Limits, error) {
+	if len(ct.Limits) == 0 && ct.Dir == "" && ct.User == "" && ct.Group == "" {
+		return nil, nil
+	}
+	l := &Limits{Dir: ct.Dir}
+	for k, v := range ct.Limits {
+		switch k {
+		case "nofile", "as", "core":
+			n, err := parseLimit(v)
+			if err != nil {
+				return nil, errors.Wrap(err, "limit "+k)
+			}
+			if l.Rlimits == nil {
+				l.Rlimits = make(map[string]uint64)
+			}
+			l.Rlimits[k] = n
+		case "nice":
+			n, err := strconv.Atoi(v)
+			if err != nil || n < -20 || n > 19 {
+				return nil, fmt.Errorf("limit nice must be between -20 and 19, not %q", v)
+			}
+			l.Nice = &n
+		case "ionice":
+			p, err := parseIONice(v)
+			if err != nil {
+				return nil, err
+			}
+			l.IOPrio = p
+		case "memory":
+			n, err := parseBytes(v)
+			if err != nil || n == 0 {
+				return nil, fmt.Errorf("limit memory must be a size like 512M, not %q", v)
+			}
+			l.Memory = n
+		case "cpu":
+			n, err := strconv.ParseFloat(v, 64)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("limit cpu must be a positive number of cpus, not %q", v)
+			}
+			l.CPU = n
+		default:
+			return nil, errors.New("unknown limit " + k)
+		}
+	}
+	l.Handshake = l.Memory != 0 || l.CPU != 0
+
+	if ct.User != "" {
+		u, err := lookupUser(ct.User)
+		if err != nil {
+			return nil, err
+		}
+		uid, _ := strconv.ParseUint(u.Uid, 10, 32)
+		gid, _ := strconv.ParseUint(u.Gid, 10, 32)
+		l.UID, l.GID = uint32p(uid), uint32p(gid)
+	}
+	if ct.Group != "" {
+		g, err := lookupGroup(ct.Group)
+		if err != nil {
+			return nil, err
+		}
+		gid, _ := strconv.ParseUint(g.Gid, 10, 32)
+		l.GID = uint32p(gid)
+	}
+	return l, nil
+}
+
+func uint32p(n uint64) *uint32 {
+	u := uint32(n)
+	return &u
+}
+
+func lookupUser(name string) (*user.User, error) {
+	if _, err := strconv.ParseUint(name, 10, 32); err == nil {
+		if u, err := user.LookupId(name); err == nil {
+			return u, nil
+		}
+		// a bare uid needn't be in /etc/passwd
+		return &user.User{Uid: name, Gid: name}, nil
+	}
+	u, err := user.Lookup(name)
+	return u, errors.Wrap(err, "user")
+}
+
+func lookupGroup(name string) (*user.Group, error) {
+	if _, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return &user.Group{Gid: name}, nil
+	}
+	g, err := user.LookupGroup(name)
+	return g, errors.Wrap(err, "group")
+}
+
+// parseLimit parses an rlimit, which is a size or "unlimited"
+func parseLimit(v string) (uint64, error) {
+	if strings.TrimSpace(strings.ToLower(v)) == "unlimited" {
+		return ^uint64(0), nil
+	}
+	return parseBytes(v)
+}
+
+// parseIONice parses an I/O scheduling class and level, like "idle" or
+// "best-effort:4", into an ioprio_set(2) value
+func parseIONice(v string) (int, error) {
+	parts := strings.SplitN(v, ":", 2)
+	class, ok := ioClasses[strings.ToLower(strings.TrimSpace(parts[0]))]
+	if !ok {
+		return 0, fmt.Errorf("limit ionice class must be realtime, best-effort or idle, not %q", parts[0])
+	}
+	level := 4
+	if len(parts) == 2 {
+		var err error
+		level, err = strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || level < 0 || level > 7 {
+			return 0, fmt.Errorf("limit ionice level must be between 0 and 7, not %q", parts[1])
+		}
+	}
+	return class<<13 | level, nil
+}
+
+// shimmed is true if the task has to be run through the limits shim
+func (l *Limits) shimmed() bool {
+	return len(l.Rlimits) > 0 || l.Nice != nil || l.IOPrio != 0 || l.Handshake
+}
+
+// Command builds the command which runs path with the limits applied. If
+// the returned file isn't nil, it must be passed to Attach once the command
+// has started.
+func (l *Limits) Command(path string, args ...string) (*exec.Cmd, *os.File, error) {
+	if l == nil {
+		return exec.Command(path, args...), nil, nil
+	}
+	cmd := exec.Command(path, args...)
+	var handshake *os.File
+	if l.shimmed() {
+		self, err := os.Executable()
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "finding procmon for the limits shim")
+		}
+		spec, err := json.Marshal(l)
+		if err != nil {
+			return nil, nil, err
+		}
+		cmd = exec.Command(self, append([]string{limitsShim, string(spec), path}, args...)...)
+		if l.Handshake {
+			r, w, err := os.Pipe()
+			if err != nil {
+				return nil, nil, errors.Wrap(err, "creating handshake pipe")
+			}
+			cmd.ExtraFiles = []*os.File{r}
+			handshake = w
+		}
+	}
+	cmd.Dir = l.Dir
+	// the shim changes user itself, after applying the limits
+	if !l.shimmed() && (l.UID != nil || l.GID != nil) {
+		cred := &syscall.Credential{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())}
+		if l.UID != nil {
+			cred.Uid = *l.UID
+		}
+		if l.GID != nil {
+			cred.Gid = *l.GID
+		}
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: cred}
+	}
+	return cmd, handshake, nil
+}
+
+// Attach finishes starting a command built by Command: it puts the process
+// in the task's cgroup, if there is one, and lets the shim go on.
+func (l *Limits) Attach(task string, cmd *exec.Cmd, handshake *os.File) error {
+	if handshake == nil {
+		return nil
+	}
+	defer handshake.Close()
+	cmd.ExtraFiles[0].Close()
+	err := l.setupCgroup(task)
+	if err == nil {
+		l.ooms = l.oomKills()
+		err = ioutil.WriteFile(filepath.Join(l.cgroup, "cgroup.procs"), []byte(strconv.Itoa(cmd.Process.Pid)), 0644)
+		err = errors.Wrap(err, "joining cgroup")
+	}
+	// the shim waits for this whatever happened
+	handshake.Write([]byte{1})
+	return err
+}
+
+// Exceeded works out whether a process which exited was stopped by one of
+// its limits. It returns nil if not.
+func (l *Limits) Exceeded(state *os.ProcessState) *LimitError {
+	if l == nil || state == nil {
+		return nil
+	}
+	if l.cgroup != "" {
+		if n := l.oomKills(); n > l.ooms {
+			l.ooms = n
+			return &LimitError{"memory", fmt.Sprintf("killed by the oom killer at the cgroup limit of %d bytes", l.Memory)}
+		}
+	}
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		switch ws.Signal() {
+		case syscall.SIGXCPU:
+			return &LimitError{"cpu", "received SIGXCPU"}
+		case syscall.SIGXFSZ:
+			return &LimitError{"fsize", "received SIGXFSZ"}
+		}
+	}
+	return nil
+}
+
+// Release removes the task's cgroup once its process has exited, so that
+// the next start creates it afresh. A cgroup which still has processes in
+// it, such as ones the task left behind, can't be removed.
+func (l *Limits) Release() error {
+	if l == nil || l.cgroup == "" {
+		return nil
+	}
+	err := os.Remove(l.cgroup)
+	l.cgroup = ""
+	return errors.Wrap(err, "removing cgroup")
+}
+
+// setupCgroup creates the task's cgroup, under procmon's own, and sets its
+// memory and cpu limits
+func (l *Limits) setupCgroup(task string) error {
+	if l.cgroup != "" {
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(cgroupMount, "cgroup.controllers")); err != nil {
+		return errors.New("cgroup v2 is not available")
+	}
+	cgroupParentOnce.Do(func() {
+		cgroupParent, cgroupParentErr = leaveCgroup()
+	})
+	if cgroupParentErr != nil {
+		return cgroupParentErr
+	}
+	parent := cgroupParent
+	var controllers []string
+	if l.Memory != 0 {
+		controllers = append(controllers, "+memory")
+	}
+	if l.CPU != 0 {
+		controllers = append(controllers, "+cpu")
+	}
+	err := ioutil.WriteFile(filepath.Join(parent, "cgroup.subtree_control"), []byte(strings.Join(controllers, " ")), 0644)
+	if err != nil {
+		return errors.Wrap(err, "enabling cgroup controllers")
+	}
+	dir := filepath.Join(parent, "procmon-"+task)
+	if err = os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+		return errors.Wrap(err, "creating cgroup")
+	}
+	if l.Memory != 0 {
+		err = ioutil.WriteFile(filepath.Join(dir, "memory.max"), []byte(strconv.FormatUint(l.Memory, 10)), 0644)
+		if err != nil {
+			return errors.Wrap(err, "setting memory.max")
+		}
+	}
+	if l.CPU != 0 {
+		const period = 100000
+		quota := fmt.Sprintf("%d %d", int(l.CPU*period), period)
+		if err = ioutil.WriteFile(filepath.Join(dir, "cpu.max"), []byte(quota), 0644); err != nil {
+			return errors.Wrap(err, "setting cpu.max")
+		}
+	}
+	l.cgroup = dir
+	return nil
+}
+
+// leaveCgroup moves procmon, and anything else in its cgroup, into a leaf
+// below it, so that the cgroup can enable controllers for the tasks' groups.
+// It returns the path of the cgroup procmon was in.
+func leaveCgroup() (string, error) {
+	own, err := ownCgroup()
+	if err != nil {
+		return "", err
+	}
+	parent := filepath.Join(cgroupMount, own)
+	leaf := filepath.Join(parent, cgroupLeaf)
+	if filepath.Base(parent) == cgroupLeaf {
+		// we moved ourselves already, before a restart of procmon
+		return filepath.Dir(parent), nil
+	}
+	if err = os.Mkdir(leaf, 0755); err != nil && !os.IsExist(err) {
+		return "", errors.Wrap(err, "creating procmon's own cgroup")
+	}
+	procs, err := ioutil.ReadFile(filepath.Join(parent, "cgroup.procs"))
+	if err != nil {
+		return "", errors.Wrap(err, "reading cgroup processes")
+	}
+	for _, pid := range strings.Fields(string(procs)) {
+		err = ioutil.WriteFile(filepath.Join(leaf, "cgroup.procs"), []byte(pid), 0644)
+		// a process may have exited since the list was read
+		if err != nil && pid == strconv.Itoa(os.Getpid()) {
+			return "", errors.Wrap(err, "moving procmon to its own cgroup")
+		}
+	}
+	return parent, nil
+}
+
+// ownCgroup returns procmon's cgroup v2 path from /proc/self/cgroup
+func ownCgroup() (string, error) {
+	f, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if strings.HasPrefix(s.Text(), "0::") {
+			return strings.TrimPrefix(s.Text(), "0::"), nil
+		}
+	}
+	return "", errors.New("procmon is not in a cgroup v2 group")
+}
+
+// oomKills reads how many of the cgroup's processes the oom killer has killed
+func (l *Limits) oomKills() int {
+	data, err := ioutil.ReadFile(filepath.Join(l.cgroup, "memory.events"))
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			n, _ := strconv.Atoi(fields[1])
+			return n
+		}
+	}
+	return 0
+}
+
+// shim is the limits shim: procmon __limits SPEC PATH ARGS...
+// It applies the limits to itself, switches to the task's user and group,
+// and execs the task in its place.
+func shim(argv []string) int {
+	// nice, ionice and the user apply to this thread, which must be the one
+	// which execs the task
+	runtime.LockOSThread()
+	if len(argv) < 2 {
+		fmt.Fprintln(os.Stderr, "usage: procmon", limitsShim, "SPEC PATH [ARGS...]")
+		return 2
+	}
+	var l Limits
+	if err := json.Unmarshal([]byte(argv[0]), &l); err != nil {
+		fmt.Fprintln(os.Stderr, errors.Wrap(err, "reading limits"))
+		return 2
+	}
+	if l.Handshake {
+		hs := os.NewFile(3, "handshake")
+		hs.Read(make([]byte, 1))
+		hs.Close()
+	}
+	for name, n := range l.Rlimits {
+		rl := syscall.Rlimit{Cur: n, Max: n}
+		if err := syscall.Setrlimit(rlimits[name], &rl); err != nil {
+			fmt.Fprintln(os.Stderr, errors.Wrap(err, "setting limit "+name))
+			return 126
+		}
+	}
+	if l.Nice != nil {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, 0, *l.Nice); err != nil {
+			fmt.Fprintln(os.Stderr, errors.Wrap(err, "setting nice"))
+			return 126
+		}
+	}
+	if l.IOPrio != 0 {
+		if err := ioprioSet(l.IOPrio); err != nil {
+			fmt.Fprintln(os.Stderr, errors.Wrap(err, "setting ionice"))
+			return 126
+		}
+	}
+	if l.UID != nil || l.GID != nil {
+		if err := setCredentials(l.UID, l.GID); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 126
+		}
+	}
+	path, err := exec.LookPath(argv[1])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 127
+	}
+	err = syscall.Exec(path, argv[1:], os.Environ())
+	fmt.Fprintln(os.Stderr, errors.Wrap(err, "exec "+path))
+	return 127
+}
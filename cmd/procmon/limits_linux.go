@@ -0,0 +1,47 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// ioprioSet sets the I/O scheduling class and level of this process
+func ioprioSet(prio int) error {
+	const ioprioWhoProcess = 1
+	_, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, 0, uintptr(prio))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// setCredentials switches this thread to the given group and user, with no
+// supplementary groups, as exec.Cmd's Credential does for a child. The
+// syscall package can't change them for the whole process, but the task
+// only inherits the thread which execs it.
+func setCredentials(uid, gid *uint32) error {
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_SETGROUPS, 0, 0, 0); errno != 0 {
+		return errors.Wrap(errno, "setgroups")
+	}
+	if gid != nil {
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_SETGID, uintptr(*gid), 0, 0); errno != 0 {
+			return errors.Wrap(errno, "setgid")
+		}
+	}
+	if uid != nil {
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_SETUID, uintptr(*uid), 0, 0); errno != 0 {
+			return errors.Wrap(errno, "setuid")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"errors"
+	"syscall"
+)
+
+// ioprioSet is only supported on linux
+func ioprioSet(prio int) error {
+	return errors.New("ionice is only supported on linux")
+}
+
+// setCredentials switches this process to the given group and user, with
+// no supplementary groups
+func setCredentials(uid, gid *uint32) error {
+	if err := syscall.Setgroups(nil); err != nil {
+		return err
+	}
+	if gid != nil {
+		if err := syscall.Setgid(int(*gid)); err != nil {
+			return err
+		}
+	}
+	if uid != nil {
+		if err := syscall.Setuid(int(*uid)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// the test binary stands in for procmon when a test runs the limits shim
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == limitsShim {
+		os.Exit(shim(os.Args[2:]))
+	}
+	os.Exit(m.Run())
+}
+
+func TestBuildLimits(t *testing.T) {
+	l, err := BuildLimits(ConfigTask{Name: "x"})
+	require.NoError(t, err)
+	require.Nil(t, l)
+
+	l, err = BuildLimits(ConfigTask{
+		Name: "x",
+		Dir:  "/tmp",
+		User: "0",
+		Limits: map[string]string{
+			"nofile": "4096",
+			"as":     "2G",
+			"core":   "unlimited",
+			"nice":   "10",
+			"ionice": "best-effort:7",
+			"memory": "512M",
+			"cpu":    "1.5",
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[string]uint64{"nofile": 4096, "as": 2 << 30, "core": ^uint64(0)}, l.Rlimits)
+	require.Equal(t, 10, *l.Nice)
+	require.Equal(t, 2<<13|7, l.IOPrio)
+	require.Equal(t, uint64(512<<20), l.Memory)
+	require.Equal(t, 1.5, l.CPU)
+	require.Equal(t, uint32(0), *l.UID)
+	require.True(t, l.Handshake)
+	require.True(t, l.shimmed())
+
+	for _, bad := range []map[string]string{
+		{"nofile": "lots"},
+		{"nice": "20"},
+		{"ionice": "fast"},
+		{"ionice": "idle:9"},
+		{"memory": "0"},
+		{"cpu": "-1"},
+		{"stack": "8M"},
+	} {
+		_, err = BuildLimits(ConfigTask{Name: "x", Limits: bad})
+		require.Error(t, err, "%v", bad)
+	}
+}
+
+func TestLimitsCommand(t *testing.T) {
+	// without rlimits, the task is run directly
+	l := &Limits{Dir: "/tmp"}
+	cmd, hs, err := l.Command("/bin/sh", "-c", "pwd")
+	require.NoError(t, err)
+	require.Nil(t, hs)
+	require.Equal(t, "/bin/sh", cmd.Path)
+	out, err := cmd.Output()
+	require.NoError(t, err)
+	require.Equal(t, "/tmp", strings.TrimSpace(string(out)))
+
+	// with them, it's run through the shim
+	nice := 5
+	l = &Limits{Rlimits: map[string]uint64{"nofile": 64}, Nice: &nice}
+	cmd, hs, err = l.Command("/bin/sh", "-c", "ulimit -n; cut -d' ' -f19 /proc/self/stat")
+	require.NoError(t, err)
+	require.Nil(t, hs)
+	require.Equal(t, limitsShim, cmd.Args[1])
+	out, err = cmd.Output()
+	require.NoError(t, err)
+	require.Equal(t, "64\n5\n", string(out))
+}
+
+func TestLimitsExceeded(t *testing.T) {
+	var l *Limits
+	require.Nil(t, l.Exceeded(nil))
+
+	l = &Limits{}
+	cmd := exec.Command("/bin/sh", "-c", "exit 1")
+	require.Error(t, cmd.Run())
+	require.Nil(t, l.Exceeded(cmd.ProcessState))
+
+	cmd = exec.Command("/bin/sh", "-c", "kill -XCPU $$")
+	require.Error(t, cmd.Run())
+	lerr := l.Exceeded(cmd.ProcessState)
+	require.NotNil(t, lerr)
+	require.Equal(t, "cpu", lerr.Limit)
+}
+
+func TestLimitsHandshakeWithoutCgroups(t *testing.T) {
+	defer func(m string) { cgroupMount = m }(cgroupMount)
+	cgroupMount = "/nonexistent"
+
+	l := &Limits{Memory: 1 << 30, Handshake: true}
+	cmd, hs, err := l.Command("/bin/echo", "ok")
+	require.NoError(t, err)
+	require.NotNil(t, hs)
+	var out strings.Builder
+	cmd.Stdout = &out
+	require.NoError(t, cmd.Start())
+	// the shim still runs the task if the cgroup can't be set up
+	require.Error(t, l.Attach("x", cmd, hs))
+	require.NoError(t, cmd.Wait())
+	require.Equal(t, "ok\n", out.String())
+}
+
+func TestLimitsShimChangesUserLast(t *testing.T) {
+	if runtime.GOOS != "linux" || os.Getuid() != 0 {
+		t.Skip("needs root on linux")
+	}
+	// only root can lower nice, so it must be applied before the shim
+	// becomes nobody
+	nice := -5
+	nobody := uint32(65534)
+	l := &Limits{Rlimits: map[string]uint64{"nofile": 64}, Nice: &nice, UID: &nobody, GID: &nobody}
+	cmd, _, err := l.Command("/bin/sh", "-c", "id -u; id -g; ulimit -Hn; cut -d' ' -f19 /proc/self/stat")
+	require.NoError(t, err)
+	require.Nil(t, cmd.SysProcAttr)
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(out))
+	require.Equal(t, "65534\n65534\n64\n-5\n", string(out))
+}
+
+func TestLeaveCgroup(t *testing.T) {
+	own, err := ownCgroup()
+	if err != nil {
+		t.Skip(err)
+	}
+	dir, err := ioutil.TempDir("", "cgroup")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer func(m string) { cgroupMount = m }(cgroupMount)
+	cgroupMount = dir
+
+	parent := filepath.Join(dir, own)
+	require.NoError(t, os.MkdirAll(parent, 0755))
+	pid := strconv.Itoa(os.Getpid())
+	require.NoError(t, ioutil.WriteFile(filepath.Join(parent, "cgroup.procs"), []byte(pid+"\n"), 0644))
+
+	got, err := leaveCgroup()
+	require.NoError(t, err)
+	require.Equal(t, parent, got)
+	procs, err := ioutil.ReadFile(filepath.Join(parent, cgroupLeaf, "cgroup.procs"))
+	require.NoError(t, err)
+	require.Equal(t, pid, string(procs))
+}
+
+func TestLimitsRelease(t *testing.T) {
+	var l *Limits
+	require.NoError(t, l.Release())
+
+	dir, err := ioutil.TempDir("", "cgroup")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	l = &Limits{cgroup: filepath.Join(dir, "procmon-x")}
+	require.NoError(t, os.Mkdir(l.cgroup, 0755))
+	require.NoError(t, l.Release())
+	require.Equal(t, "", l.cgroup)
+	_, err = os.Stat(filepath.Join(dir, "procmon-x"))
+	require.True(t, os.IsNotExist(err))
+}
@@ -14,33 +14,66 @@ import (
 	"os"
 	"os/signal"
 	"sort"
+	"sync"
 	"syscall"
 	"time"
 
 	arg "github.com/alexflint/go-arg"
 )
 
+// SignalTable dispatches operating system signals to functions.
+// The functions can be replaced while it is running.
+type SignalTable struct {
+	lock    sync.Mutex
+	sigs    map[os.Signal]func()
+	sigchan chan os.Signal
+}
+
 // WatchSignals can set up functions to call on various operating system signals.
-func WatchSignals(sigs map[os.Signal]func()) {
-	signals := make([]os.Signal, 0)
-	for s := range sigs {
-		signals = append(signals, s)
-	}
+func WatchSignals(sigs map[os.Signal]func()) *SignalTable {
+	st := &SignalTable{sigchan: make(chan os.Signal, 1)}
+	st.Replace(sigs)
 	go func() {
-		sigchan := make(chan os.Signal, 1)
-		signal.Notify(sigchan, signals...)
 		for {
-			sig := <-sigchan
+			sig := <-st.sigchan
+			st.lock.Lock()
+			f := st.sigs[sig]
+			st.lock.Unlock()
+			if f == nil {
+				continue
+			}
 			switch sig {
 			// we always want to terminate on SIGTERM
 			case syscall.SIGTERM:
-				sigs[sig]()
+				f()
 				os.Exit(0)
 			default:
-				sigs[sig]()
+				// a handler may run a long task, or shut everything down
+				// and wait; other signals, SIGTERM above all, mustn't wait
+				// for it
+				go f()
 			}
 		}
 	}()
+	return st
+}
+
+// Replace swaps in a new set of signal functions. Signals which are no
+// longer handled revert to their default behavior.
+func (st *SignalTable) Replace(sigs map[os.Signal]func()) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	for s := range st.sigs {
+		if _, ok := sigs[s]; !ok {
+			signal.Reset(s)
+		}
+	}
+	signals := make([]os.Signal, 0)
+	for s := range sigs {
+		signals = append(signals, s)
+	}
+	signal.Notify(st.sigchan, signals...)
+	st.sigs = sigs
 }
 
 // loads the arguments and the configuration and returns the loaded
@@ -69,9 +102,9 @@ func loadConfig() Config {
 
 // killall returns a function that kills everything by telling
 // the root tasks to kill themselves.
-func killall(mainTasks []*Task) func() {
+func killall(tasks *Tasks) func() {
 	return func() {
-		for _, t := range mainTasks {
+		for _, t := range tasks.Main {
 			t.Logger.Println("shutting down tasks by killing them")
 			t.Kill()
 		}
@@ -80,11 +113,11 @@ func killall(mainTasks []*Task) func() {
 }
 
 // shutdown returns a function that can shut things down more politely, kinda
-func shutdown(root *Task, mainTasks []*Task) func() {
+func shutdown(root *Task, tasks *Tasks) func() {
 	return func() {
 		root.Logger.Print("shutting down by closing Stopped channel on the root")
-		close(root.Stopped)
-		exitcode := waitForTasksToDie(root, mainTasks)
+		stopRoot(root)
+		exitcode := waitForTasksToDie(root, tasks.Main)
 		os.Exit(exitcode)
 	}
 }
@@ -95,12 +128,25 @@ func shutdown(root *Task, mainTasks []*Task) func() {
 // Then we run the task, and when it is finished, we check task.Terminate.
 // If task.Terminate is defined, we call killall. Otherwise, if necessary
 // (task.Shutdown was true) we run the root task again.
-func runfunc(task, root *Task, mainTasks, periodicTasks []*Task) func() {
+func runfunc(task, root *Task, tasks *Tasks) func() {
 	return func() {
+		if task.Window != nil && !task.Window.Contains(time.Now()) {
+			root.Logger.WithField("task", task.Name).WithField("window", task.Window.String()).
+				Warn("not running shutdown task outside its maintenance window")
+			return
+		}
+		if !task.beginRun() {
+			root.Logger.WithField("task", task.Name).Warn("skipping run; the previous run is still going")
+			return
+		}
+		defer task.endRun()
 		if task.Shutdown {
+			if !stopRoot(root) {
+				root.Logger.WithField("task", task.Name).Warn("skipping run; the tasks are already shut down")
+				return
+			}
 			root.Logger.Warn("running shutdown task, temporarily stopping all tasks")
-			close(root.Stopped)
-			exitcode := waitForTasksToDie(root, mainTasks)
+			exitcode := waitForTasksToDie(root, tasks.Main)
 			root.Logger.WithField("exitcode", exitcode).Debug("all tasks terminated")
 		}
 		tempstop := make(chan struct{})
@@ -108,21 +154,39 @@ func runfunc(task, root *Task, mainTasks, periodicTasks []*Task) func() {
 		close(tempstop)
 		root.Logger.Debug("finished running shutdown task")
 		if task.Terminate {
-			killall(mainTasks)()
+			killall(tasks)()
 		}
 		if task.Shutdown {
 			root.Logger.Debug("restarting main tasks")
-			startChildren(root, mainTasks, periodicTasks)
+			startChildren(root, tasks)
 			root.Logger.Warn("shutdown processing complete")
 		}
 	}
 }
 
+// rootLock guards root.Stopped, which signals, schedules, the control api
+// and restart breakers may all try to close at once
+var rootLock sync.Mutex
+
+// stopRoot closes root.Stopped, unless it is already closed. It reports
+// whether it closed it.
+func stopRoot(root *Task) bool {
+	rootLock.Lock()
+	defer rootLock.Unlock()
+	if !isOpen(root.Stopped) {
+		return false
+	}
+	close(root.Stopped)
+	return true
+}
+
 // Helper function to set up root.Stopped and start its child tasks.
-func startChildren(root *Task, mainTasks, periodicTasks []*Task) {
+func startChildren(root *Task, tasks *Tasks) {
+	rootLock.Lock()
 	root.Stopped = make(chan struct{})
+	rootLock.Unlock()
 	root.StartChildren()
-	setupPeriodic(root, mainTasks, periodicTasks)
+	setupPeriodic(root, tasks)
 }
 
 func waitForTasksToDie(root *Task, mainTasks []*Task) int {
@@ -162,35 +226,59 @@ func waitForTasksToDie(root *Task, mainTasks []*Task) int {
 	}
 }
 
-func setupSighandlers(root *Task, tasks Tasks) {
+func sighandlers(root *Task, tasks *Tasks) map[os.Signal]func() {
 	// define some default sighandlers; they can be overridden in the
 	// config file and additional ones can be defined
-	sighandlers := map[os.Signal]func(){
-		syscall.SIGTERM: killall(tasks.Main),
-		syscall.SIGINT:  shutdown(root, tasks.Main),
+	handlers := map[os.Signal]func(){
+		syscall.SIGTERM: killall(tasks),
+		syscall.SIGINT:  shutdown(root, tasks),
 	}
 	for sig, task := range tasks.Signals {
-		sighandlers[sig] = runfunc(task, root, tasks.Main, tasks.Periodic)
+		handlers[sig] = runfunc(task, root, tasks)
 	}
-	WatchSignals(sighandlers)
+	return handlers
 }
 
-func setupPeriodic(root *Task, mainTasks, periodicTasks []*Task) {
+func setupPeriodic(root *Task, tasks *Tasks) {
+	// a reload replaces the periodic tasks, so they need their own way to stop
+	if tasks.periodicStop != nil {
+		close(tasks.periodicStop)
+	}
+	stop := make(chan struct{})
+	tasks.periodicStop = stop
 	// set up the execution of any periodic tasks
-	for _, t := range periodicTasks {
-		f := runfunc(t, root, mainTasks, periodicTasks)
-		dur := t.Periodic
+	for _, t := range tasks.Periodic {
+		t := t
+		f := runfunc(t, root, tasks)
 		logger := t.Logger
-		logger.WithField("task", root.Name).WithField("period", dur).Info("setting up periodic task")
+		logger.WithField("task", t.Name).Info("setting up periodic task")
 		go func() {
-			ticker := time.NewTicker(dur)
-			defer ticker.Stop()
+			// each run is scheduled from the time the previous one was due,
+			// not from when it finished, so that runs don't drift later
+			next := time.Now()
 			for {
+				var skipped int
+				next, skipped = nextDue(t.Schedule, next, time.Now())
+				if skipped > 0 {
+					logger.WithField("task", t.Name).WithField("skipped", skipped).
+						Warn("previous run overran; skipping missed runs")
+				}
+				if next.IsZero() {
+					logger.WithField("task", t.Name).Error("schedule never runs again")
+					return
+				}
+				t.setNextRun(next)
+				logger.WithField("task", t.Name).WithField("next", next.Format(time.RFC3339)).Info("next run scheduled")
+				timer := time.NewTimer(time.Until(next))
 				select {
-				case <-ticker.C:
-					logger.WithField("task", root.Name).Info("periodic task running")
+				case <-timer.C:
+					logger.WithField("task", t.Name).Info("periodic task running")
 					f()
 				case <-root.Stopped:
+					timer.Stop()
+					return
+				case <-stop:
+					timer.Stop()
 					return
 				}
 			}
@@ -199,6 +287,12 @@ func setupPeriodic(root *Task, mainTasks, periodicTasks []*Task) {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if sub, ok := subcommands[os.Args[1]]; ok {
+			os.Exit(sub(os.Args[2:]))
+		}
+	}
+
 	cfg := loadConfig()
 
 	// Init honeycomb filters if applicable; no-op otherwise.
@@ -231,8 +325,23 @@ func main() {
 	for i := range tasks.Main {
 		root.AddDependent(tasks.Main[i])
 	}
-	startChildren(root, tasks.Main, tasks.Periodic)
-	setupSighandlers(root, tasks)
+	bindBreakers(root, &tasks)
+	startChildren(root, &tasks)
+
+	reloader, err := NewReloader(cfg, root, &tasks, logger)
+	if err != nil {
+		logger.WithError(err).Fatal("aborting because reload settings were invalid")
+	}
+	reloader.sigs = WatchSignals(reloader.sighandlers())
+
+	_, err = startController(cfg, root, &tasks, reloader, logger)
+	if err != nil {
+		logger.WithError(err).Fatal("could not start control api")
+	}
+	err = startMetrics(cfg, &tasks, logger)
+	if err != nil {
+		logger.WithError(err).Fatal("could not start metrics server")
+	}
 
 	// and run almost forever
 	logstatus := time.NewTicker(15 * time.Second)
@@ -0,0 +1,182 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+// Metrics are always collected, but only served if the config has a
+// [metrics] section with an addr.
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	metricStarts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "procmon",
+		Name:      "task_starts_total",
+		Help:      "Number of times each task's process has been started.",
+	}, []string{"task"})
+	metricRestarts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "procmon",
+		Name:      "task_restarts_total",
+		Help:      "Number of times each task has been restarted by its parent after stopping.",
+	}, []string{"task", "reason"})
+	metricMonitorChecks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "procmon",
+		Name:      "monitor_checks_total",
+		Help:      "Number of behavior monitor checks by task, monitor, monitor type, and result.",
+	}, []string{"task", "monitor", "type", "result"})
+	metricCascades = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "procmon",
+		Name:      "child_kill_cascades_total",
+		Help:      "Number of times stopping a task also stopped its dependents.",
+	}, []string{"task"})
+	metricShutdownSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "procmon",
+		Name:      "shutdown_duration_seconds",
+		Help:      "Time taken for a task and its dependents to shut down.",
+		Buckets:   []float64{.05, .1, .25, .5, 1, 2, 5, 10, 30, 75},
+	}, []string{"task"})
+	metricShutdownTimeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "procmon",
+		Name:      "shutdown_timeouts_total",
+		Help:      "Number of times a task exceeded MaxShutdown and had to be destroyed.",
+	}, []string{"task"})
+	metricBreakerTrips = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "procmon",
+		Name:      "restart_breaker_trips_total",
+		Help:      "Number of times a task restarted too often and its restart policy gave up on it.",
+	}, []string{"task", "action"})
+	metricLimitsExceeded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "procmon",
+		Name:      "limits_exceeded_total",
+		Help:      "Number of times a task was stopped by one of its resource limits.",
+	}, []string{"task", "limit"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		metricStarts,
+		metricRestarts,
+		metricMonitorChecks,
+		metricCascades,
+		metricShutdownSeconds,
+		metricShutdownTimeouts,
+		metricBreakerTrips,
+		metricLimitsExceeded,
+	)
+}
+
+// taskCollector reports the current state of each task at scrape time
+type taskCollector struct {
+	tasks *Tasks
+
+	up           *prometheus.Desc
+	sinceStart   *prometheus.Desc
+	failCount    *prometheus.Desc
+	restartDelay *prometheus.Desc
+	maxShutdown  *prometheus.Desc
+}
+
+func newTaskCollector(tasks *Tasks) *taskCollector {
+	labels := []string{"task"}
+	return &taskCollector{
+		tasks: tasks,
+		up: prometheus.NewDesc("procmon_task_up",
+			"1 if the task's process is running, else 0.", labels, nil),
+		sinceStart: prometheus.NewDesc("procmon_task_seconds_since_start",
+			"Seconds since the task's process was last started.", labels, nil),
+		failCount: prometheus.NewDesc("procmon_task_failcount",
+			"The task's FailCount.", labels, nil),
+		restartDelay: prometheus.NewDesc("procmon_task_restart_delay_seconds",
+			"How long the task's parent will wait before restarting it.", labels, nil),
+		maxShutdown: prometheus.NewDesc("procmon_task_max_shutdown_seconds",
+			"The task's MaxShutdown.", labels, nil),
+	}
+}
+
+// Describe implements prometheus.Collector
+func (c *taskCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.up
+	ch <- c.sinceStart
+	ch <- c.failCount
+	ch <- c.restartDelay
+	ch <- c.maxShutdown
+}
+
+// Collect implements prometheus.Collector
+func (c *taskCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, t := range c.tasks.list() {
+		name := t.Name
+		snap := t.snapshot()
+		up := 0.0
+		if snap.pid != 0 {
+			up = 1
+		}
+		ch <- prometheus.MustNewConstMetric(c.up, prometheus.GaugeValue, up, name)
+		if !snap.started.IsZero() {
+			ch <- prometheus.MustNewConstMetric(c.sinceStart, prometheus.GaugeValue,
+				time.Since(snap.started).Seconds(), name)
+		}
+		ch <- prometheus.MustNewConstMetric(c.failCount, prometheus.GaugeValue,
+			float64(snap.failCount), name)
+		ch <- prometheus.MustNewConstMetric(c.restartDelay, prometheus.GaugeValue,
+			snap.restartDelay.Seconds(), name)
+		ch <- prometheus.MustNewConstMetric(c.maxShutdown, prometheus.GaugeValue,
+			t.MaxShutdown.Seconds(), name)
+	}
+}
+
+// monitorResult buckets an event into a pass or fail for metrics
+func monitorResult(e Eventer) string {
+	if e.Code() == OK {
+		return "pass"
+	}
+	return "fail"
+}
+
+// MetricsKeys are the keys of the [metrics] section
+var MetricsKeys = []string{"addr", "path"}
+
+// startMetrics serves metrics if the config asks for it
+func startMetrics(cfg Config, tasks *Tasks, logger logrus.FieldLogger) error {
+	addr := cfg.Metrics["addr"]
+	if addr == "" {
+		return nil
+	}
+	err := metricsRegistry.Register(newTaskCollector(tasks))
+	if err != nil {
+		return errors.Wrap(err, "registering task metrics")
+	}
+	path := cfg.Metrics["path"]
+	if path == "" {
+		path = "/metrics"
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrap(err, "listening on metrics address")
+	}
+	logger.WithField("addr", l.Addr().String()).WithField("path", path).Info("serving metrics")
+	go func() {
+		err := http.Serve(l, mux)
+		logger.WithError(err).Error("metrics server stopped")
+	}()
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTaskCollector(t *testing.T) {
+	a := NewTask("a", "/bin/true")
+	a.FailCount = 3
+	a.RestartDelay = 4 * time.Second
+	b := NewTask("b", "/bin/true")
+	b.started = time.Now().Add(-time.Minute)
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(newTaskCollector(&Tasks{All: map[string]*Task{"a": a, "b": b}}))
+	mfs, err := reg.Gather()
+	require.NoError(t, err)
+
+	values := make(map[string]map[string]float64)
+	for _, mf := range mfs {
+		values[mf.GetName()] = make(map[string]float64)
+		for _, m := range mf.GetMetric() {
+			values[mf.GetName()][m.GetLabel()[0].GetValue()] = m.GetGauge().GetValue()
+		}
+	}
+	require.Equal(t, 3.0, values["procmon_task_failcount"]["a"])
+	require.Equal(t, 4.0, values["procmon_task_restart_delay_seconds"]["a"])
+	require.Equal(t, 0.0, values["procmon_task_up"]["b"])
+	require.Equal(t, 5.0, values["procmon_task_max_shutdown_seconds"]["b"])
+	// a has never started, so it has no time since start
+	require.NotContains(t, values["procmon_task_seconds_since_start"], "a")
+	require.InDelta(t, 60, values["procmon_task_seconds_since_start"]["b"], 5)
+}
+
+func Test_monitorResult(t *testing.T) {
+	require.Equal(t, "pass", monitorResult(OK))
+	require.Equal(t, "fail", monitorResult(Failed))
+	require.Equal(t, "fail", monitorResult(ErrorEvent{Evt: Failing}))
+}
@@ -10,6 +10,7 @@ package main
 // - -- --- ---- -----
 
 import (
+	"sync"
 	"time"
 )
 
@@ -20,9 +21,16 @@ import (
 // If the done channel is closed, the Monitor terminates.
 // Monitors are designed to be easily aggregated and wrapped like middleware.
 type Monitor struct {
+	Name   string
+	Type   string
+	Task   string
 	D      time.Duration
 	Status chan Eventer
 	Test   func() Eventer
+
+	lock   sync.Mutex
+	last   Eventer
+	lastAt time.Time
 }
 
 // Listener is the interface for the Listen method. It expects to be called as a goroutine.
@@ -49,16 +57,54 @@ func (m *Monitor) Listen(done chan struct{}) {
 		case <-done:
 			return
 		case <-time.After(m.D):
-			m.Status <- m.Test()
+			e := m.Test()
+			m.record(e)
+			send(m.Status, e, done)
 		}
 	}
 }
 
+// send delivers an event unless done is closed first, so that monitors
+// don't block forever once nothing is listening
+func send(status chan Eventer, e Eventer, done chan struct{}) {
+	select {
+	case status <- e:
+	case <-done:
+	}
+}
+
+func (m *Monitor) record(e Eventer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.last = e
+	m.lastAt = time.Now()
+	metricMonitorChecks.WithLabelValues(m.Task, m.Name, m.Type, monitorResult(e)).Inc()
+}
+
+// Last returns the most recent result of the monitor's test and when it
+// happened. If the test has not yet run, the Eventer is nil.
+func (m *Monitor) Last() (Eventer, time.Time) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.last, m.lastAt
+}
+
 // FailMonitor wraps a monitor and only sends Failure events; it sends one
 // when it receives one from its wrapped monitor.
+//
+// A FailMonitor's Status is the task's Status channel, which is replaced
+// each time the task starts; the task sets it before calling Listen.
+//
+// If Observe is set, failures are only recorded, and the task is never
+// stopped.
 type FailMonitor struct {
-	Child  *Monitor
-	Status chan Eventer
+	Child   *Monitor
+	Status  chan Eventer
+	Observe bool
+
+	// events from the child, possibly by way of a RetryMonitor
+	in    chan Eventer
+	retry *RetryMonitor
 }
 
 // asserts that FailMonitor is in fact a Listener
@@ -69,23 +115,37 @@ func NewFailMonitor(child *Monitor) *FailMonitor {
 	fm := FailMonitor{
 		Child:  child,
 		Status: child.Status,
+		in:     make(chan Eventer),
 	}
-	child.Status = make(chan Eventer)
+	child.Status = fm.in
 	return &fm
 }
 
+// WithRetries inserts a RetryMonitor between the FailMonitor and its child,
+// so that the task is only stopped after more than retries successive
+// failures. It must be called before Listen.
+func (m *FailMonitor) WithRetries(retries int) *FailMonitor {
+	m.retry = NewRetryMonitor(m.Child, retries)
+	return m
+}
+
 // Listen implements listener, and should be called as a goroutine.
 // It returns Stop when its child monitor returns Failed or Stop,
 // otherwise it swallows the event.
 func (m *FailMonitor) Listen(done chan struct{}) {
-	go m.Child.Listen(done)
+	if m.retry != nil {
+		go m.retry.Listen(done)
+	} else {
+		go m.Child.Listen(done)
+	}
 	for {
 		select {
 		case <-done:
 			return
-		case stat := <-m.Child.Status:
-			if stat == Failed || stat == Stop {
-				m.Status <- Stop
+		case stat := <-m.in:
+			// pingers report failures as ErrorEvents, so compare codes
+			if c := stat.Code(); !m.Observe && (c == Failed || c == Stop) {
+				send(m.Status, Stop, done)
 			}
 		}
 	}
@@ -120,7 +180,7 @@ func NewRetryMonitor(m *Monitor, retries int) *RetryMonitor {
 	// the system worked
 	m.Test = func() Eventer {
 		e := rm.test()
-		if e == OK {
+		if e.Code() == OK {
 			rm.failCount = 0
 		}
 		return e
@@ -138,15 +198,15 @@ func (m *RetryMonitor) Listen(done chan struct{}) {
 		case <-done:
 			return
 		case e := <-m.childStatus:
-			if e == Failed || e == Stop {
+			if c := e.Code(); c == Failed || c == Stop {
 				m.failCount++
 				if m.failCount > m.Retries {
-					m.status <- Stop
+					send(m.status, Stop, done)
 				} else {
-					m.status <- Failing
+					send(m.status, Failing, done)
 				}
 			} else {
-				m.status <- e
+				send(m.status, e, done)
 			}
 		}
 	}
@@ -10,13 +10,19 @@ package main
 // - -- --- ---- -----
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
+	"os/exec"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 
 	"github.com/go-redis/redis"
@@ -123,3 +129,245 @@ func EnsureDir(name string, permissions os.FileMode) func() Eventer {
 		return OK
 	}
 }
+
+// TendermintHeight returns a function that asks a tendermint RPC server for
+// its status and fails if the latest block height hasn't advanced within
+// the given duration. It's meant for the node whose ports are all up but
+// which has stopped making blocks.
+func TendermintHeight(u string, within, timeout time.Duration, logger logrus.FieldLogger) func() Eventer {
+	client := http.Client{Timeout: timeout}
+	u = strings.TrimSuffix(u, "/") + "/status"
+	var height int64
+	var advanced time.Time
+	return func() Eventer {
+		logger.WithField("url", u).WithField("pinger", "TendermintHeight").Debug("pinging")
+		if advanced.IsZero() {
+			advanced = time.Now()
+		}
+		resp, err := client.Get(u)
+		if err != nil {
+			return NewErrorEvent(Failed, err)
+		}
+		defer resp.Body.Close()
+		var status struct {
+			Result struct {
+				SyncInfo struct {
+					LatestBlockHeight json.Number `json:"latest_block_height"`
+				} `json:"sync_info"`
+			} `json:"result"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&status)
+		if err != nil {
+			return NewErrorEvent(Failed, errors.Wrap(err, "decoding tendermint status"))
+		}
+		h, err := status.Result.SyncInfo.LatestBlockHeight.Int64()
+		if err != nil {
+			return NewErrorEvent(Failed, errors.Wrap(err, "reading block height"))
+		}
+		if h > height {
+			height = h
+			advanced = time.Now()
+			return OK
+		}
+		if stalled := time.Since(advanced); stalled > within {
+			logger.WithField("url", u).WithField("pinger", "TendermintHeight").
+				WithField("height", h).WithField("stalled", stalled).Debug("height not advancing")
+			return NewErrorEvent(Failed, fmt.Errorf("block height %d has not advanced in %s", h, stalled.Round(time.Second)))
+		}
+		return OK
+	}
+}
+
+// ExecPinger returns a function that runs a shell command and expects it to
+// exit with the given code before the timeout.
+func ExecPinger(command string, expect int, timeout time.Duration, logger logrus.FieldLogger) func() Eventer {
+	return func() Eventer {
+		logger.WithField("command", command).WithField("pinger", "ExecPinger").Debug("running")
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		err := exec.CommandContext(ctx, "/bin/sh", "-c", command).Run()
+		if ctx.Err() == context.DeadlineExceeded {
+			return NewErrorEvent(Failed, fmt.Errorf("%q did not finish within %s", command, timeout))
+		}
+		code := 0
+		if err != nil {
+			ee, ok := err.(*exec.ExitError)
+			if !ok {
+				return NewErrorEvent(Failed, err)
+			}
+			code = ee.Sys().(syscall.WaitStatus).ExitStatus()
+		}
+		if code != expect {
+			return NewErrorEvent(Failed, fmt.Errorf("%q exited with %d; expected %d", command, code, expect))
+		}
+		return OK
+	}
+}
+
+// FileFresh returns a function that fails unless the named file exists and
+// was modified within the given duration.
+func FileFresh(name string, maxage time.Duration) func() Eventer {
+	return func() Eventer {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return NewErrorEvent(Failed, err)
+		}
+		if age := time.Since(fi.ModTime()); age > maxage {
+			return NewErrorEvent(Failed, fmt.Errorf("%s was last modified %s ago", name, age.Round(time.Second)))
+		}
+		return OK
+	}
+}
+
+// DiskFree returns a function that fails if the filesystem containing path
+// has fewer than minfree bytes or less than minpct percent available.
+// Either threshold may be zero to disable it.
+func DiskFree(path string, minfree uint64, minpct float64) func() Eventer {
+	return func() Eventer {
+		var fs syscall.Statfs_t
+		err := syscall.Statfs(path, &fs)
+		if err != nil {
+			return NewErrorEvent(Failed, err)
+		}
+		avail := fs.Bavail * uint64(fs.Bsize)
+		total := fs.Blocks * uint64(fs.Bsize)
+		if avail < minfree {
+			return NewErrorEvent(Failed, fmt.Errorf("%s has %d bytes free; want %d", path, avail, minfree))
+		}
+		if total > 0 {
+			if pct := 100 * float64(avail) / float64(total); pct < minpct {
+				return NewErrorEvent(Failed, fmt.Errorf("%s has %.1f%% free; want %.1f%%", path, pct, minpct))
+			}
+		}
+		return OK
+	}
+}
+
+// HTTPJSON returns a function that gets a URL, finds a value in the JSON
+// response with a dotted path, and compares it with the expected value.
+//
+// The path is a list of object keys and array indices separated by dots,
+// like "result.sync_info.catching_up" or "validators.0.address". The op is
+// one of eq, ne, lt, le, gt, ge or exists; the ordered comparisons are
+// numeric. For eq and ne, strings are compared without their quotes and
+// other values in their JSON form.
+func HTTPJSON(u, path, op, expect string, timeout time.Duration, logger logrus.FieldLogger) func() Eventer {
+	client := http.Client{Timeout: timeout}
+	return func() Eventer {
+		logger.WithField("url", u).WithField("pinger", "HTTPJSON").Debug("pinging")
+		resp, err := client.Get(u)
+		if err != nil {
+			return NewErrorEvent(Failed, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode > 299 || resp.StatusCode < 200 {
+			return NewErrorEvent(Failed, fmt.Errorf("Got status code %d (%s) from %s",
+				resp.StatusCode, resp.Status, u))
+		}
+		var doc interface{}
+		dec := json.NewDecoder(resp.Body)
+		dec.UseNumber()
+		if err = dec.Decode(&doc); err != nil {
+			return NewErrorEvent(Failed, errors.Wrap(err, "decoding response"))
+		}
+		v, found := jsonPath(doc, path)
+		if !found {
+			return NewErrorEvent(Failed, fmt.Errorf("%s not found in response from %s", path, u))
+		}
+		if op == "exists" {
+			return OK
+		}
+		ok, err := compareJSON(v, op, expect)
+		if err != nil {
+			return NewErrorEvent(Failed, err)
+		}
+		if !ok {
+			return NewErrorEvent(Failed, fmt.Errorf("%s = %s; want %s %s", path, jsonString(v), op, expect))
+		}
+		return OK
+	}
+}
+
+// jsonPath finds the value at a dotted path in a decoded JSON document
+func jsonPath(doc interface{}, path string) (interface{}, bool) {
+	if path == "" {
+		return doc, true
+	}
+	for _, key := range strings.Split(path, ".") {
+		switch d := doc.(type) {
+		case map[string]interface{}:
+			v, ok := d[key]
+			if !ok {
+				return nil, false
+			}
+			doc = v
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(d) {
+				return nil, false
+			}
+			doc = d[i]
+		default:
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// jsonString formats a decoded JSON value for comparison: strings without
+// quotes, everything else as JSON
+func jsonString(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	js, _ := json.Marshal(v)
+	return string(js)
+}
+
+func compareJSON(v interface{}, op, expect string) (bool, error) {
+	switch op {
+	case "", "eq":
+		return jsonString(v) == expect, nil
+	case "ne":
+		return jsonString(v) != expect, nil
+	case "lt", "le", "gt", "ge":
+		got, err := strconv.ParseFloat(jsonString(v), 64)
+		if err != nil {
+			return false, fmt.Errorf("%s is not a number", jsonString(v))
+		}
+		want, err := strconv.ParseFloat(expect, 64)
+		if err != nil {
+			return false, fmt.Errorf("%s is not a number", expect)
+		}
+		switch op {
+		case "lt":
+			return got < want, nil
+		case "le":
+			return got <= want, nil
+		case "gt":
+			return got > want, nil
+		default:
+			return got >= want, nil
+		}
+	default:
+		return false, fmt.Errorf("unknown comparison %q", op)
+	}
+}
+
+// parseBytes parses a size like "512M" or "10GB"; suffixes are powers of 1024
+func parseBytes(size string) (uint64, error) {
+	s := strings.ToUpper(strings.TrimSpace(size))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+	mult := uint64(1)
+	if s != "" {
+		if i := strings.IndexByte("KMGT", s[len(s)-1]); i >= 0 {
+			mult = 1 << (10 * uint(i+1))
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return uint64(n * float64(mult)), nil
+}
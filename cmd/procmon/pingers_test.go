@@ -0,0 +1,157 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTendermintHeight(t *testing.T) {
+	var height int64 = 10
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/status", r.URL.Path)
+		fmt.Fprintf(w, `{"jsonrpc":"2.0","id":"","result":{"sync_info":{"latest_block_height":"%d"}}}`,
+			atomic.LoadInt64(&height))
+	}))
+	defer srv.Close()
+
+	ping := TendermintHeight(srv.URL, 100*time.Millisecond, time.Second, reloadLogger())
+	require.Equal(t, OK, ping())
+	// not advancing, but not for long enough yet
+	require.Equal(t, OK, ping())
+	time.Sleep(150 * time.Millisecond)
+	require.Equal(t, Failed, ping().Code())
+	atomic.AddInt64(&height, 1)
+	require.Equal(t, OK, ping())
+}
+
+func TestExecPinger(t *testing.T) {
+	require.Equal(t, OK, ExecPinger("true", 0, time.Second, reloadLogger())())
+	require.Equal(t, Failed, ExecPinger("false", 0, time.Second, reloadLogger())().Code())
+	require.Equal(t, OK, ExecPinger("exit 3", 3, time.Second, reloadLogger())())
+	require.Equal(t, Failed, ExecPinger("sleep 5", 0, 50*time.Millisecond, reloadLogger())().Code())
+}
+
+func TestFileFresh(t *testing.T) {
+	f, err := ioutil.TempFile("", "filefresh")
+	require.NoError(t, err)
+	f.Close()
+	defer os.Remove(f.Name())
+
+	require.Equal(t, OK, FileFresh(f.Name(), time.Minute)())
+	old := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(f.Name(), old, old))
+	require.Equal(t, Failed, FileFresh(f.Name(), time.Minute)().Code())
+	require.Equal(t, Failed, FileFresh(f.Name()+".missing", time.Minute)().Code())
+}
+
+func TestDiskFree(t *testing.T) {
+	require.Equal(t, OK, DiskFree("/", 1, 0)())
+	require.Equal(t, Failed, DiskFree("/", 1<<62, 0)().Code())
+	require.Equal(t, Failed, DiskFree("/", 0, 101)().Code())
+}
+
+func TestHTTPJSON(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"result":{"catching_up":false,"peers":[{"id":"abc","height":12}]}}`)
+	}))
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		path, op, value string
+		want            Event
+	}{
+		{"result.catching_up", "", "false", OK},
+		{"result.catching_up", "eq", "true", Failed},
+		{"result.peers.0.id", "eq", "abc", OK},
+		{"result.peers.0.id", "ne", "abc", Failed},
+		{"result.peers.0.height", "ge", "12", OK},
+		{"result.peers.0.height", "gt", "12", Failed},
+		{"result.peers.0.id", "lt", "12", Failed},
+		{"result.peers.1", "exists", "", Failed},
+		{"result.peers", "exists", "", OK},
+		{"result.missing", "eq", "x", Failed},
+	} {
+		ping := HTTPJSON(srv.URL, tt.path, tt.op, tt.value, time.Second, reloadLogger())
+		require.Equal(t, tt.want, ping().Code(), "%s %s %s", tt.path, tt.op, tt.value)
+	}
+}
+
+func Test_parseBytes(t *testing.T) {
+	for in, want := range map[string]uint64{
+		"100":    100,
+		"1K":     1024,
+		"1.5KB":  1536,
+		"512M":   512 << 20,
+		"10GiB":  10 << 30,
+		"2t":     2 << 40,
+		" 3 MB ": 3 << 20,
+	} {
+		got, err := parseBytes(in)
+		require.NoError(t, err, in)
+		require.Equal(t, want, got, in)
+	}
+	for _, in := range []string{"", "G", "-1K", "lots"} {
+		_, err := parseBytes(in)
+		require.Error(t, err, in)
+	}
+}
+
+func TestFailMonitorWithRetries(t *testing.T) {
+	status := make(chan Eventer, 1)
+	var tests int64
+	m := NewMonitor(status, time.Millisecond, func() Eventer {
+		atomic.AddInt64(&tests, 1)
+		return NewErrorEvent(Failed, errors.New("nope"))
+	})
+	fm := NewFailMonitor(m).WithRetries(2)
+	done := make(chan struct{})
+	defer close(done)
+	go fm.Listen(done)
+
+	select {
+	case e := <-status:
+		require.Equal(t, Stop, e)
+		require.True(t, atomic.LoadInt64(&tests) >= 3)
+	case <-time.After(time.Second):
+		t.Fatal("retry monitor never stopped the task")
+	}
+}
+
+func TestObservingFailMonitorNeverStops(t *testing.T) {
+	status := make(chan Eventer, 1)
+	m := NewMonitor(status, time.Millisecond, func() Eventer {
+		return NewErrorEvent(Failed, errors.New("nope"))
+	})
+	fm := NewFailMonitor(m)
+	fm.Observe = true
+	done := make(chan struct{})
+	defer close(done)
+	go fm.Listen(done)
+
+	select {
+	case e := <-status:
+		t.Fatalf("observing monitor sent %v", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+	last, _ := m.Last()
+	require.NotNil(t, last)
+	require.Equal(t, Failed, last.Code())
+}
@@ -0,0 +1,220 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// What to do when a task's restart breaker trips
+const (
+	BreakerPark = "park"
+	BreakerStop = "stop"
+	BreakerRun  = "run"
+)
+
+// RestartPolicy controls how long a task's parent waits before restarting
+// it after a failure, and gives up on it if it fails too often.
+//
+// The first restart after a failure waits Initial; each further restart
+// multiplies the wait by Multiplier, up to Max, and Jitter spreads each wait
+// randomly by up to that fraction either way. Once the task has stayed up
+// for longer than Window (or Max, if there's no window), the wait starts
+// again from Initial.
+//
+// If the task fails more than MaxRestarts times within Window, the breaker
+// trips: the task is parked, so that it's not restarted until an operator
+// runs `procmon ctl start` for it, and Action is taken. With BreakerStop,
+// procmon shuts everything down; with BreakerRun, it also runs the special
+// task named by Run.
+type RestartPolicy struct {
+	Initial     time.Duration
+	Multiplier  float64
+	Max         time.Duration
+	Jitter      float64
+	MaxRestarts int
+	Window      time.Duration
+	Action      string
+	Run         string
+
+	lock     sync.Mutex
+	delay    time.Duration
+	restarts []time.Time
+	// act carries out Action when the breaker trips; it's bound to the
+	// running tasks by bindBreakers
+	act func()
+}
+
+// RestartKeys are the keys BuildRestartPolicy reads
+var RestartKeys = []string{"initial", "multiplier", "max", "jitter", "max_restarts", "window", "action", "run"}
+
+// BuildRestartPolicy builds a policy from a task's [task.restart] table.
+// It returns nil if the table is empty, so that the task keeps the default
+// restart behavior.
+func BuildRestartPolicy(m map[string]string) (*RestartPolicy, error) {
+	if len(m) == 0 {
+		return nil, nil
+	}
+	p := &RestartPolicy{Multiplier: 2, Action: BreakerPark}
+	var err error
+	if p.Initial, err = parseDuration(m["initial"], time.Second); err != nil {
+		return nil, errors.Wrap(err, "restart initial")
+	}
+	if p.Max, err = parseDuration(m["max"], 5*time.Minute); err != nil {
+		return nil, errors.Wrap(err, "restart max")
+	}
+	if p.Window, err = parseDuration(m["window"], 0); err != nil {
+		return nil, errors.Wrap(err, "restart window")
+	}
+	if s := m["multiplier"]; s != "" {
+		if p.Multiplier, err = strconv.ParseFloat(s, 64); err != nil || p.Multiplier < 1 {
+			return nil, fmt.Errorf("restart multiplier must be a number no less than 1, not %q", s)
+		}
+	}
+	if s := m["jitter"]; s != "" {
+		if p.Jitter, err = strconv.ParseFloat(s, 64); err != nil || p.Jitter < 0 || p.Jitter > 1 {
+			return nil, fmt.Errorf("restart jitter must be a fraction between 0 and 1, not %q", s)
+		}
+	}
+	if s := m["max_restarts"]; s != "" {
+		if p.MaxRestarts, err = strconv.Atoi(s); err != nil || p.MaxRestarts < 1 {
+			return nil, fmt.Errorf("restart max_restarts must be a positive integer, not %q", s)
+		}
+		if p.Window == 0 {
+			return nil, errors.New("restart max_restarts requires a window")
+		}
+	}
+	if s := m["action"]; s != "" {
+		p.Action = s
+	}
+	switch p.Action {
+	case BreakerPark, BreakerStop:
+	case BreakerRun:
+		p.Run = m["run"]
+		if p.Run == "" {
+			return nil, errors.New("restart action run requires the name of a task to run")
+		}
+	default:
+		return nil, fmt.Errorf("restart action must be park, stop, or run, not %q", p.Action)
+	}
+	if p.Initial > p.Max {
+		return nil, errors.New("restart initial must not be greater than max")
+	}
+	return p, nil
+}
+
+// Failed records that the task failed at now, having started at started. It
+// returns how long to wait before restarting it, and whether the breaker
+// tripped.
+func (p *RestartPolicy) Failed(now, started time.Time) (time.Duration, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	stable := p.Window
+	if stable == 0 {
+		stable = p.Max
+	}
+	if p.delay == 0 || now.Sub(started) > stable {
+		p.delay = p.Initial
+	} else {
+		p.delay = time.Duration(float64(p.delay) * p.Multiplier)
+		if p.delay > p.Max {
+			p.delay = p.Max
+		}
+	}
+	delay := p.delay
+	if p.Jitter > 0 {
+		delay += time.Duration(float64(delay) * p.Jitter * (2*rand.Float64() - 1))
+	}
+
+	if p.MaxRestarts == 0 {
+		return delay, false
+	}
+	p.restarts = append(p.restarts, now)
+	recent := p.restarts[:0]
+	for _, r := range p.restarts {
+		if now.Sub(r) < p.Window {
+			recent = append(recent, r)
+		}
+	}
+	p.restarts = recent
+	return delay, len(p.restarts) > p.MaxRestarts
+}
+
+// Recent returns the number of failures within the window
+func (p *RestartPolicy) Recent() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.restarts)
+}
+
+// Reset forgets the task's failures, so that it starts again with a clean
+// slate once an operator releases it
+func (p *RestartPolicy) Reset() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.delay = 0
+	p.restarts = nil
+}
+
+// tripBreaker parks a child which has failed too often and takes its
+// policy's action
+func (t *Task) tripBreaker(child *Task) {
+	p := child.Policy
+	child.Logger.WithField("task", child.Name).
+		WithField("parent", t.Name).
+		WithField("event", "restart_breaker_tripped").
+		WithField("restarts", p.Recent()).
+		WithField("max_restarts", p.MaxRestarts).
+		WithField("window", p.Window).
+		WithField("failcount", child.FailCount).
+		WithField("action", p.Action).
+		WithField("run", p.Run).
+		Error("task restarted too often; giving up on it")
+	metricBreakerTrips.WithLabelValues(child.Name, p.Action).Inc()
+	child.Hold()
+	if p.act != nil {
+		go p.act()
+	}
+}
+
+// bindBreakers connects the restart policies' actions to the running tasks.
+// It must be called again whenever the tasks are replaced.
+func bindBreakers(root *Task, tasks *Tasks) {
+	for _, t := range tasks.All {
+		p := t.Policy
+		if p == nil {
+			continue
+		}
+		switch p.Action {
+		case BreakerStop:
+			p.act = func() {
+				if isOpen(root.Stopped) {
+					shutdown(root, tasks)()
+				}
+			}
+		case BreakerRun:
+			name := p.Run
+			p.act = func() {
+				if task, ok := tasks.get(name); ok {
+					runfunc(task, root, tasks)()
+				} else {
+					root.Logger.WithField("task", name).Error("restart breaker task not found")
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildRestartPolicy(t *testing.T) {
+	p, err := BuildRestartPolicy(nil)
+	require.NoError(t, err)
+	require.Nil(t, p)
+
+	p, err = BuildRestartPolicy(map[string]string{
+		"initial":      "2s",
+		"multiplier":   "1.5",
+		"max":          "1m",
+		"jitter":       "0.1",
+		"max_restarts": "5",
+		"window":       "10m",
+		"action":       "run",
+		"run":          "snapshot",
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2*time.Second, p.Initial)
+	require.Equal(t, 1.5, p.Multiplier)
+	require.Equal(t, time.Minute, p.Max)
+	require.Equal(t, 0.1, p.Jitter)
+	require.Equal(t, 5, p.MaxRestarts)
+	require.Equal(t, 10*time.Minute, p.Window)
+	require.Equal(t, BreakerRun, p.Action)
+	require.Equal(t, "snapshot", p.Run)
+
+	for _, bad := range []map[string]string{
+		{"multiplier": "0.5"},
+		{"jitter": "2"},
+		{"max_restarts": "3"},
+		{"max_restarts": "none", "window": "1m"},
+		{"action": "explode"},
+		{"action": "run"},
+		{"initial": "1h", "max": "1m"},
+	} {
+		_, err = BuildRestartPolicy(bad)
+		require.Error(t, err, "%v", bad)
+	}
+}
+
+func TestRestartPolicyBackoff(t *testing.T) {
+	p := &RestartPolicy{Initial: time.Second, Multiplier: 2, Max: 5 * time.Second}
+	now := time.Now()
+	var delays []time.Duration
+	for i := 0; i < 5; i++ {
+		d, tripped := p.Failed(now, now)
+		require.False(t, tripped)
+		delays = append(delays, d)
+	}
+	require.Equal(t, []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second,
+	}, delays)
+
+	// a task which stayed up longer than max starts again from initial
+	d, _ := p.Failed(now.Add(time.Minute), now)
+	require.Equal(t, time.Second, d)
+
+	p.Jitter = 0.5
+	for i := 0; i < 20; i++ {
+		d, _ = p.Failed(now, now)
+		require.True(t, d >= 1*time.Second && d <= 8*time.Second, d)
+	}
+}
+
+func TestRestartPolicyBreaker(t *testing.T) {
+	p := &RestartPolicy{Initial: time.Second, Multiplier: 1, Max: time.Second, MaxRestarts: 2, Window: time.Minute}
+	now := time.Now()
+	_, tripped := p.Failed(now, now)
+	require.False(t, tripped)
+	_, tripped = p.Failed(now.Add(30*time.Second), now)
+	require.False(t, tripped)
+	// the first failure has left the window
+	_, tripped = p.Failed(now.Add(61*time.Second), now)
+	require.False(t, tripped)
+	_, tripped = p.Failed(now.Add(62*time.Second), now)
+	require.True(t, tripped)
+	require.Equal(t, 3, p.Recent())
+	p.Reset()
+	require.Equal(t, 0, p.Recent())
+}
+
+func TestRestartBreakerParksTask(t *testing.T) {
+	parent := NewTask("parent", "")
+	parent.Logger = reloadLogger()
+	parent.Stopped = make(chan struct{})
+	defer close(parent.Stopped)
+
+	child := NewTask("crasher", "/bin/sh", "-c", "exit 1")
+	child.Logger = reloadLogger()
+	child.Policy = &RestartPolicy{
+		Initial: time.Millisecond, Multiplier: 1, Max: time.Millisecond,
+		MaxRestarts: 2, Window: time.Minute, Action: BreakerRun, Run: "notify",
+	}
+	acted := make(chan struct{})
+	child.Policy.act = func() { close(acted) }
+
+	child.Start(parent.Stopped)
+	go parent.childMonitor(child)
+
+	select {
+	case <-acted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("breaker never tripped")
+	}
+	require.NotNil(t, child.held())
+	require.Equal(t, 3, child.FailCount)
+}
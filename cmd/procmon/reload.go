@@ -0,0 +1,626 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Reload actions
+const (
+	ReloadStop    = "stop"
+	ReloadRestart = "restart"
+	ReloadStart   = "start"
+	ReloadRebind  = "rebind"
+	ReloadKeep    = "keep"
+)
+
+// the order in which actions are listed in a plan
+var reloadOrder = map[string]int{
+	ReloadStop:    0,
+	ReloadRestart: 1,
+	ReloadStart:   2,
+	ReloadRebind:  3,
+	ReloadKeep:    4,
+}
+
+// ReloadAction is what a reload does to a single task
+type ReloadAction struct {
+	Action string `json:"action"`
+	Task   string `json:"task"`
+	Reason string `json:"reason"`
+}
+
+// A ReloadPlan describes everything a reload will do
+type ReloadPlan []ReloadAction
+
+// actions maps task names to their actions
+func (p ReloadPlan) actions() map[string]string {
+	acts := make(map[string]string, len(p))
+	for _, a := range p {
+		acts[a.Task] = a.Action
+	}
+	return acts
+}
+
+// Reloader reloads the config file and reconciles the running tasks with it.
+//
+// Only tasks whose definition, environment, or ancestors changed are
+// restarted; everything else keeps running undisturbed.
+type Reloader struct {
+	lock   sync.Mutex
+	cfg    Config
+	root   *Task
+	tasks  *Tasks
+	sigs   *SignalTable
+	signal os.Signal
+	reopen os.Signal
+	logger logrus.FieldLogger
+}
+
+// NewReloader creates a Reloader for the running tasks.
+//
+// If the config's [control] section names a reload_signal, that signal
+// triggers a reload; it must not also be bound to a task. Likewise the
+// [logger] section's reopen_signal reopens the log files.
+func NewReloader(cfg Config, root *Task, tasks *Tasks, logger logrus.FieldLogger) (*Reloader, error) {
+	r := &Reloader{
+		cfg:    cfg,
+		root:   root,
+		tasks:  tasks,
+		logger: logger,
+	}
+	if name := cfg.Control["reload_signal"]; name != "" {
+		r.signal = parseSignal(name)
+		if r.signal == nil {
+			return nil, errors.New("unknown reload_signal " + name)
+		}
+	}
+	if name := cfg.Logger["reopen_signal"]; name != "" {
+		r.reopen = parseSignal(name)
+		if r.reopen == nil {
+			return nil, errors.New("unknown reopen_signal " + name)
+		}
+		if r.reopen == r.signal {
+			return nil, errors.New("reopen_signal and reload_signal must differ")
+		}
+	}
+	if err := r.checkSignal(tasks); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// checkSignal ensures that the reload and reopen signals don't conflict
+// with the tasks
+func (r *Reloader) checkSignal(tasks *Tasks) error {
+	for _, s := range []struct {
+		name string
+		sig  os.Signal
+	}{
+		{"reload_signal", r.signal},
+		{"reopen_signal", r.reopen},
+	} {
+		if s.sig == nil {
+			continue
+		}
+		if s.sig == syscall.SIGTERM || s.sig == syscall.SIGINT {
+			return fmt.Errorf("%s cannot be %s", s.name, s.sig)
+		}
+		if t, ok := tasks.Signals[s.sig]; ok {
+			return fmt.Errorf("%s %s is also bound to task %s", s.name, s.sig, t.Name)
+		}
+	}
+	return nil
+}
+
+// sighandlers returns the signal handlers for the tasks, plus the reload and
+// reopen signals
+func (r *Reloader) sighandlers() map[os.Signal]func() {
+	handlers := sighandlers(r.root, r.tasks)
+	if r.signal != nil {
+		handlers[r.signal] = func() {
+			r.logger.WithField("signal", r.signal).Info("reloading config on signal")
+			if _, err := r.Reload(false); err != nil {
+				r.logger.WithError(err).Error("reload failed")
+			}
+		}
+	}
+	if r.reopen != nil {
+		handlers[r.reopen] = func() {
+			r.logger.WithField("signal", r.reopen).Info("reopening log files on signal")
+			if err := ReopenLogFiles(); err != nil {
+				r.logger.WithError(err).Error("reopening log files failed")
+			}
+		}
+	}
+	return handlers
+}
+
+// Reload loads the config file again and reconciles the running tasks with
+// it. The plan is logged before anything is done. If dryrun is set, nothing
+// else is done.
+func (r *Reloader) Reload(dryrun bool) (ReloadPlan, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	cfg, err := Load(r.cfg.filename, r.cfg.nocheck)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading config")
+	}
+	// the plan is made before any output is opened, so that a dry run or a
+	// failed reload leaves no files behind
+	tasks, err := cfg.buildTasks(r.logger)
+	if err != nil {
+		return nil, errors.Wrap(err, "building tasks")
+	}
+	if err = r.checkSignal(&tasks); err != nil {
+		return nil, err
+	}
+
+	plan := planReload(r.cfg, cfg, r.tasks, &tasks)
+	for _, a := range plan {
+		r.logger.WithField("action", a.Action).
+			WithField("task", a.Task).
+			WithField("reason", a.Reason).
+			WithField("dryrun", dryrun).
+			Info("reload plan")
+	}
+	if dryrun {
+		return plan, nil
+	}
+	// kept tasks go on using the outputs they already have
+	kept := make(map[string]bool)
+	for name, action := range plan.actions() {
+		if action == ReloadKeep {
+			kept[name] = true
+		}
+	}
+	if err = cfg.openOutputs(&tasks, kept); err != nil {
+		return nil, errors.Wrap(err, "opening task outputs")
+	}
+	for _, section := range []struct {
+		name      string
+		old, next interface{}
+	}{
+		{"logger", r.cfg.Logger, cfg.Logger},
+		{"control", r.cfg.Control, cfg.Control},
+		{"metrics", r.cfg.Metrics, cfg.Metrics},
+		{"prologue", r.cfg.Prologue, cfg.Prologue},
+	} {
+		if !reflect.DeepEqual(section.old, section.next) {
+			r.logger.WithField("section", section.name).Warn("config section changed; this takes effect when procmon restarts")
+		}
+	}
+
+	r.apply(plan, tasks)
+	r.cfg = cfg
+	r.logger.WithField("actions", len(plan)).Info("reload complete")
+	return plan, nil
+}
+
+// fingerprints identifies the definition of each task in a config,
+// including the definitions of its prerun tasks
+func fingerprints(c Config) map[string]string {
+	fps := make(map[string]string, len(c.Task))
+	for _, ct := range c.Task {
+		h := sha256.New()
+		js, _ := json.Marshal(ct)
+		h.Write(js)
+		for _, p := range ct.Prerun {
+			h.Write([]byte(fps[p]))
+		}
+		fps[ct.Name] = hex.EncodeToString(h.Sum(nil))
+	}
+	return fps
+}
+
+// treeTasks returns the long-running tasks: the ones which have a parent or
+// which will be given the root as a parent
+func treeTasks(tasks *Tasks) map[string]*Task {
+	tree := make(map[string]*Task)
+	for _, t := range tasks.Main {
+		tree[t.Name] = t
+	}
+	for name, t := range tasks.All {
+		if t.parent != nil {
+			tree[name] = t
+		}
+	}
+	return tree
+}
+
+// planReload works out how to get from the old config and tasks to the new
+// ones. It doesn't change anything.
+func planReload(oldCfg, newCfg Config, old, next *Tasks) ReloadPlan {
+	oldDefs := make(map[string]ConfigTask)
+	for _, ct := range oldCfg.Task {
+		oldDefs[ct.Name] = ct
+	}
+	oldFps := fingerprints(oldCfg)
+	newFps := fingerprints(newCfg)
+	envChanged := !reflect.DeepEqual(oldCfg.Env, newCfg.Env)
+
+	// changed explains why a task present in both configs must be rebuilt,
+	// or returns "" if it needn't be
+	changed := func(ct ConfigTask) string {
+		od := oldDefs[ct.Name]
+		switch {
+		case envChanged:
+			return "environment changed"
+		case oldFps[ct.Name] == newFps[ct.Name]:
+			return ""
+		case od.Parent != ct.Parent:
+			return fmt.Sprintf("parent changed from %q to %q", od.Parent, ct.Parent)
+		case !reflect.DeepEqual(od.DependsOn, ct.DependsOn):
+			return "dependencies changed"
+		case !reflect.DeepEqual(od, ct):
+			return "definition changed"
+		default:
+			return "prerun task changed"
+		}
+	}
+	newDefs := make(map[string]ConfigTask)
+	for _, ct := range newCfg.Task {
+		newDefs[ct.Name] = ct
+	}
+
+	oldTree := treeTasks(old)
+	newTree := treeTasks(next)
+	var plan ReloadPlan
+	add := func(action, task, reason string) {
+		plan = append(plan, ReloadAction{Action: action, Task: task, Reason: reason})
+	}
+
+	// decide which tree tasks must be replaced. A task can only be kept if
+	// its parent and everything it requires are kept, so propagate
+	// replacements until nothing more changes; cause records the task whose
+	// change is ultimately responsible.
+	// Go through them in config order so the reasons are stable.
+	actions := make(map[string]string)
+	reasons := make(map[string]string)
+	cause := make(map[string]string)
+	for _, ct := range newCfg.Task {
+		name := ct.Name
+		if newTree[name] == nil {
+			continue
+		}
+		switch {
+		case oldTree[name] == nil && old.All[name] != nil:
+			actions[name], reasons[name] = ReloadStart, "was a special task"
+		case oldTree[name] == nil:
+			actions[name], reasons[name] = ReloadStart, "new task"
+		case changed(newDefs[name]) != "":
+			actions[name], reasons[name] = ReloadRestart, changed(newDefs[name])
+		default:
+			continue
+		}
+		cause[name] = name
+	}
+	for more := true; more; {
+		more = false
+		for _, ct := range newCfg.Task {
+			name := ct.Name
+			t := newTree[name]
+			if t == nil || actions[name] != "" {
+				continue
+			}
+			if t.parent != nil && actions[t.parent.Name] != "" {
+				c := cause[t.parent.Name]
+				actions[name], reasons[name] = ReloadRestart, fmt.Sprintf("ancestor %s restarts", c)
+				cause[name] = c
+				more = true
+				continue
+			}
+			for _, req := range t.Requires {
+				if actions[req.Name] != "" {
+					actions[name], reasons[name] = ReloadRestart, fmt.Sprintf("dependency %s restarts", req.Name)
+					cause[name] = req.Name
+					more = true
+					break
+				}
+			}
+		}
+	}
+
+	// list them from the top of the new tree down
+	var walk func(ts []*Task)
+	walk = func(ts []*Task) {
+		for _, t := range ts {
+			if actions[t.Name] == "" {
+				add(ReloadKeep, t.Name, "unchanged")
+			} else {
+				add(actions[t.Name], t.Name, reasons[t.Name])
+			}
+			walk(t.Dependents)
+		}
+	}
+	walk(next.Main)
+
+	for _, ct := range oldCfg.Task {
+		name := ct.Name
+		if oldTree[name] != nil && newTree[name] == nil {
+			if next.All[name] != nil {
+				add(ReloadStop, name, "no longer a long-running task")
+			} else {
+				add(ReloadStop, name, "removed from config")
+			}
+		}
+	}
+
+	// special tasks are never running between uses, so they are simply
+	// replaced and their signals and schedules bound again
+	for _, ct := range newCfg.Task {
+		name := ct.Name
+		if newTree[name] != nil {
+			continue
+		}
+		switch {
+		case old.All[name] == nil || oldTree[name] != nil:
+			add(ReloadRebind, name, "new special task")
+		case changed(ct) != "":
+			add(ReloadRebind, name, changed(ct))
+		default:
+			add(ReloadKeep, name, "unchanged")
+		}
+	}
+	for _, ct := range oldCfg.Task {
+		if oldTree[ct.Name] == nil && next.All[ct.Name] == nil {
+			add(ReloadRebind, ct.Name, "special task removed")
+		}
+	}
+
+	sort.SliceStable(plan, func(i, j int) bool {
+		return reloadOrder[plan[i].Action] < reloadOrder[plan[j].Action]
+	})
+	return plan
+}
+
+// apply carries out a plan, replacing the running tasks with the new ones
+// wherever they differ
+func (r *Reloader) apply(plan ReloadPlan, tasks Tasks) {
+	acts := plan.actions()
+	oldTree := treeTasks(r.tasks)
+	all := make(map[string]*Task)
+	var addAll func(t *Task)
+	addAll = func(t *Task) {
+		all[t.Name] = t
+		for _, ch := range t.Dependents {
+			addAll(ch)
+		}
+	}
+
+	type adoption struct {
+		parent, child *Task
+	}
+	var detached []*Task
+	var adopted []adoption
+
+	// rewire makes the children of a kept task match the new config; kept
+	// children keep running and are rewired in turn
+	var rewire func(t *Task, children []*Task)
+	rewire = func(t *Task, children []*Task) {
+		deps := make([]*Task, 0, len(children))
+		kept := make(map[*Task]bool)
+		for _, nc := range children {
+			if acts[nc.Name] == ReloadKeep {
+				oc := r.tasks.All[nc.Name]
+				kept[oc] = true
+				deps = append(deps, oc)
+				all[oc.Name] = oc
+				rewire(oc, nc.Dependents)
+				continue
+			}
+			nc.parent = t
+			deps = append(deps, nc)
+			adopted = append(adopted, adoption{t, nc})
+			addAll(nc)
+		}
+		for _, oc := range t.Dependents {
+			if !kept[oc] {
+				detached = append(detached, oc)
+			}
+		}
+		t.Dependents = deps
+	}
+	tasksLock.Lock()
+	rewire(r.root, tasks.Main)
+	// unchanged special tasks carry on as they are, with their outputs and
+	// the guard which keeps their runs from overlapping
+	for name, t := range tasks.All {
+		if _, ok := all[name]; ok {
+			continue
+		}
+		if acts[name] == ReloadKeep {
+			t = r.tasks.All[name]
+		}
+		all[name] = t
+	}
+	// new tasks may require or prerun kept ones, so point them at whichever
+	// task object survives, and rebuild the reverse links to match
+	for _, t := range all {
+		t.requiredBy = nil
+	}
+	for _, t := range all {
+		for i, req := range t.Requires {
+			t.Requires[i] = all[req.Name]
+			t.Requires[i].requiredBy = append(t.Requires[i].requiredBy, t)
+		}
+		for i, pre := range t.Prerun {
+			t.Prerun[i] = all[pre.Name]
+		}
+	}
+	signals := make(map[os.Signal]*Task, len(tasks.Signals))
+	for sig, t := range tasks.Signals {
+		signals[sig] = all[t.Name]
+	}
+	periodic := make([]*Task, 0, len(tasks.Periodic))
+	for _, t := range tasks.Periodic {
+		periodic = append(periodic, all[t.Name])
+	}
+	// the special tasks which were replaced or removed
+	var retired []*Task
+	for name, t := range r.tasks.All {
+		if oldTree[name] == nil && all[name] != t {
+			retired = append(retired, t)
+		}
+	}
+	tasksLock.Unlock()
+
+	// everything which is going away has to be gone before its replacement
+	// starts, or they'll fight over ports and files
+	for _, t := range detached {
+		r.detach(t)
+	}
+	for _, t := range detached {
+		r.waitForExit(t)
+		closeOutputs(t)
+	}
+
+	tasksLock.Lock()
+	r.tasks.Main = r.root.Dependents
+	r.tasks.Signals = signals
+	r.tasks.Periodic = periodic
+	r.tasks.All = all
+	tasksLock.Unlock()
+	bindBreakers(r.root, r.tasks)
+	if r.sigs != nil {
+		r.sigs.Replace(r.sighandlers())
+	}
+	// if the root is stopped, a shutdown task is running and will set up
+	// the periodic tasks when it restarts everything
+	if isOpen(r.root.Stopped) {
+		setupPeriodic(r.root, r.tasks)
+	}
+
+	// nothing starts a retired special task any more, but it may be in the
+	// middle of a run, so its outputs are closed once that's over
+	for _, t := range retired {
+		t := t
+		go func() {
+			// wait for the run whatever the overlap policy, and never end
+			// it, so that no stray run can start after the close
+			t.runGuard <- struct{}{}
+			closeOutputs(t)
+		}()
+	}
+
+	for _, a := range adopted {
+		stopped := a.parent.Stopped
+		if !isOpen(stopped) {
+			// the parent will start it when the parent starts
+			continue
+		}
+		a := a
+		go func() {
+			a.child.Start(stopped)
+			go a.parent.childMonitor(a.child)
+		}()
+	}
+}
+
+// detach stops a task for good; it is held so that its parent doesn't
+// restart it, and it has already been removed from its parent's dependents
+func (r *Reloader) detach(t *Task) {
+	t.Hold()
+	// the old parent's childMonitor waits for a held child to be released,
+	// which will never happen now
+	t.drop()
+	if t.Status == nil || !t.running() {
+		return
+	}
+	select {
+	case t.Status <- Stop:
+		r.logger.WithField("task", t.Name).Warn("stopping task removed by reload")
+	case <-time.After(5 * time.Second):
+		r.logger.WithField("task", t.Name).Error("timed out asking task to stop")
+	}
+}
+
+// waitForExit waits until a task and all its dependents have exited, or
+// until they should have
+func (r *Reloader) waitForExit(t *Task) {
+	deadline := time.Now().Add(shutdownBudget(t) + time.Second)
+	for anyRunning(t) && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// shutdownBudget is the longest a task and its dependents should take to
+// shut down; dependents are shut down in parallel before their parent
+func shutdownBudget(t *Task) time.Duration {
+	var longest time.Duration
+	for _, ch := range t.Dependents {
+		if d := shutdownBudget(ch); d > longest {
+			longest = d
+		}
+	}
+	return t.MaxShutdown + longest
+}
+
+func anyRunning(t *Task) bool {
+	if t.running() {
+		return true
+	}
+	for _, ch := range t.Dependents {
+		if anyRunning(ch) {
+			return true
+		}
+	}
+	return false
+}
+
+func isOpen(ch chan struct{}) bool {
+	if ch == nil {
+		return false
+	}
+	select {
+	case <-ch:
+		return false
+	default:
+		return true
+	}
+}
+
+// closeOutputs closes any files the task's output is written to
+func closeOutputs(t *Task) {
+	for _, w := range []io.Writer{t.Stdout, t.Stderr} {
+		if pw, ok := w.(*PrefixWriter); ok {
+			w = pw.W
+		}
+		switch f := w.(type) {
+		case *LogFile:
+			f.Close()
+		case *os.File:
+			if f != os.Stdout && f != os.Stderr {
+				f.Close()
+			}
+		}
+	}
+}
+
+func closeAllOutputs(tasks Tasks) {
+	for _, t := range tasks.All {
+		closeOutputs(t)
+	}
+}
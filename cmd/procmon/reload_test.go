@@ -0,0 +1,279 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func reloadLogger() logrus.FieldLogger {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	return logger
+}
+
+// reloadConfig is a chain a <- b <- c with a prerun task for a and a
+// signal task
+func reloadConfig() Config {
+	return Config{
+		Env: map[string]string{"X": "1"},
+		Task: []ConfigTask{
+			{Name: "pre", Path: "/bin/true", Specials: map[string]interface{}{"onetime": true}},
+			{Name: "a", Path: "/bin/a", Prerun: []string{"pre"}},
+			{Name: "b", Path: "/bin/b", Parent: "a"},
+			{Name: "c", Path: "/bin/c", Parent: "b"},
+			{Name: "hup", Path: "/bin/hup", Specials: map[string]interface{}{"onetime": true, "signal": "HUP"}},
+		},
+	}
+}
+
+// running builds tasks from the config and attaches them to a root, as
+// main does
+func running(t *testing.T, cfg Config) (*Task, *Tasks) {
+	tasks, err := cfg.BuildTasks(reloadLogger())
+	require.NoError(t, err)
+	root := NewTask(rootTaskName, "")
+	root.Logger = reloadLogger()
+	for _, m := range tasks.Main {
+		root.AddDependent(m)
+	}
+	return root, &tasks
+}
+
+func planFor(t *testing.T, oldCfg, newCfg Config) map[string]ReloadAction {
+	_, old := running(t, oldCfg)
+	next, err := newCfg.BuildTasks(reloadLogger())
+	require.NoError(t, err)
+	plan := planReload(oldCfg, newCfg, old, &next)
+	byTask := make(map[string]ReloadAction)
+	for _, a := range plan {
+		_, dup := byTask[a.Task]
+		require.False(t, dup, "task %s appears twice in plan", a.Task)
+		byTask[a.Task] = a
+	}
+	return byTask
+}
+
+func TestPlanReloadUnchanged(t *testing.T) {
+	plan := planFor(t, reloadConfig(), reloadConfig())
+	require.Len(t, plan, 5)
+	for _, a := range plan {
+		require.Equal(t, ReloadKeep, a.Action, a.Task)
+	}
+}
+
+func TestPlanReloadChangedDefinition(t *testing.T) {
+	cfg := reloadConfig()
+	cfg.Task[2].Args = []string{"--verbose"}
+	plan := planFor(t, reloadConfig(), cfg)
+	require.Equal(t, ReloadKeep, plan["a"].Action)
+	require.Equal(t, ReloadRestart, plan["b"].Action)
+	require.Equal(t, "definition changed", plan["b"].Reason)
+	require.Equal(t, ReloadRestart, plan["c"].Action)
+	require.Equal(t, "ancestor b restarts", plan["c"].Reason)
+	require.Equal(t, ReloadKeep, plan["hup"].Action)
+}
+
+func TestPlanReloadChangedPrerun(t *testing.T) {
+	cfg := reloadConfig()
+	cfg.Task[0].Args = []string{"-x"}
+	plan := planFor(t, reloadConfig(), cfg)
+	require.Equal(t, ReloadRebind, plan["pre"].Action)
+	require.Equal(t, ReloadRestart, plan["a"].Action)
+	require.Equal(t, "prerun task changed", plan["a"].Reason)
+	require.Equal(t, ReloadRestart, plan["b"].Action)
+	require.Equal(t, ReloadRestart, plan["c"].Action)
+}
+
+func TestPlanReloadEnvironment(t *testing.T) {
+	cfg := reloadConfig()
+	cfg.Env = map[string]string{"X": "2"}
+	plan := planFor(t, reloadConfig(), cfg)
+	require.Equal(t, ReloadRestart, plan["a"].Action)
+	require.Equal(t, "environment changed", plan["a"].Reason)
+	require.Equal(t, ReloadRebind, plan["hup"].Action)
+}
+
+func TestPlanReloadAddRemoveReparent(t *testing.T) {
+	cfg := reloadConfig()
+	// c moves from b to a; b is removed; d is next
+	cfg.Task[3].Parent = "a"
+	cfg.Task = append(cfg.Task[:2], cfg.Task[3:]...)
+	cfg.Task = append(cfg.Task, ConfigTask{Name: "d", Path: "/bin/d", Parent: "a"})
+	plan := planFor(t, reloadConfig(), cfg)
+	require.Equal(t, ReloadKeep, plan["a"].Action)
+	require.Equal(t, ReloadStop, plan["b"].Action)
+	require.Equal(t, ReloadRestart, plan["c"].Action)
+	require.Contains(t, plan["c"].Reason, "parent changed")
+	require.Equal(t, ReloadStart, plan["d"].Action)
+}
+
+func TestReloadApply(t *testing.T) {
+	oldCfg := reloadConfig()
+	root, old := running(t, oldCfg)
+	a, b, c, hup := old.All["a"], old.All["b"], old.All["c"], old.All["hup"]
+
+	cfg := reloadConfig()
+	cfg.Task[3].Args = []string{"--new"}
+	cfg.Task = append(cfg.Task, ConfigTask{Name: "d", Path: "/bin/d", Parent: "a"})
+	next, err := cfg.BuildTasks(reloadLogger())
+	require.NoError(t, err)
+
+	r := &Reloader{cfg: oldCfg, root: root, tasks: old, logger: reloadLogger()}
+	r.apply(planReload(oldCfg, cfg, old, &next), next)
+
+	// nothing was running, so nothing was started, but the tree is rewired
+	require.Equal(t, []*Task{a}, old.Main)
+	require.Same(t, a, old.All["a"])
+	require.Same(t, b, old.All["b"])
+	require.False(t, c == old.All["c"], "c should be replaced")
+	require.Equal(t, []string{"--new"}, old.All["c"].Args)
+	require.Same(t, b, old.All["c"].parent)
+	require.Equal(t, []*Task{old.All["c"]}, b.Dependents)
+	require.Len(t, a.Dependents, 2)
+	require.Same(t, old.All["d"], a.Dependents[1])
+	// the old c is held so nothing restarts it
+	require.NotNil(t, c.held())
+	// the unchanged special task carries on as it was
+	require.Same(t, hup, old.All["hup"])
+	require.Same(t, hup, old.Signals[parseSignal("HUP")])
+	require.Same(t, old.All["pre"], a.Prerun[0])
+}
+
+func TestReloadRetiresSpecialTask(t *testing.T) {
+	oldCfg := reloadConfig()
+	root, old := running(t, oldCfg)
+	hup := old.All["hup"]
+	out, err := ioutil.TempFile("", "hup")
+	require.NoError(t, err)
+	defer os.Remove(out.Name())
+	hup.Stdout = out
+
+	cfg := reloadConfig()
+	cfg.Task[4].Args = []string{"--new"}
+	next, err := cfg.BuildTasks(reloadLogger())
+	require.NoError(t, err)
+
+	// the old task is in the middle of a run
+	require.True(t, hup.beginRun())
+	r := &Reloader{cfg: oldCfg, root: root, tasks: old, logger: reloadLogger()}
+	r.apply(planReload(oldCfg, cfg, old, &next), next)
+	require.False(t, hup == old.All["hup"], "hup should be replaced")
+
+	time.Sleep(50 * time.Millisecond)
+	_, err = out.WriteString("still running\n")
+	require.NoError(t, err, "output closed during a run")
+
+	hup.endRun()
+	require.Eventually(t, func() bool {
+		_, err := out.WriteString("done\n")
+		return err != nil
+	}, time.Second, 10*time.Millisecond, "output of a retired task should be closed")
+}
+
+func TestPlanReloadDependency(t *testing.T) {
+	cfg := dependsConfig()
+	cfg.Task[2].Args = []string{"--size=2G"}
+	plan := planFor(t, dependsConfig(), cfg)
+	require.Equal(t, ReloadKeep, plan["db"].Action)
+	require.Equal(t, ReloadRestart, plan["cache"].Action)
+	require.Equal(t, ReloadRestart, plan["api"].Action)
+	require.Equal(t, "dependency cache restarts", plan["api"].Reason)
+	require.Equal(t, ReloadRestart, plan["indexer"].Action)
+	require.Equal(t, "ancestor cache restarts", plan["indexer"].Reason)
+
+	cfg = dependsConfig()
+	cfg.Task[0].DependsOn = []string{"db"}
+	plan = planFor(t, dependsConfig(), cfg)
+	require.Equal(t, ReloadRestart, plan["api"].Action)
+	require.Equal(t, "dependencies changed", plan["api"].Reason)
+	require.Equal(t, ReloadKeep, plan["cache"].Action)
+}
+
+func TestReloadApplyDependency(t *testing.T) {
+	oldCfg := dependsConfig()
+	root, old := running(t, oldCfg)
+	db, cache := old.All["db"], old.All["cache"]
+
+	cfg := dependsConfig()
+	cfg.Task[0].Args = []string{"--new"}
+	next, err := cfg.BuildTasks(reloadLogger())
+	require.NoError(t, err)
+
+	r := &Reloader{cfg: oldCfg, root: root, tasks: old, logger: reloadLogger()}
+	r.apply(planReload(oldCfg, cfg, old, &next), next)
+
+	api := old.All["api"]
+	require.Equal(t, []string{"--new"}, api.Args)
+	require.Same(t, db, api.parent)
+	require.Equal(t, []*Task{cache}, api.Requires)
+	require.Equal(t, []*Task{cache}, old.All["indexer"].Requires)
+	require.Len(t, cache.requiredBy, 2)
+	for _, rb := range cache.requiredBy {
+		require.Same(t, old.All[rb.Name], rb)
+	}
+}
+
+func TestReloadDryRunOpensNoOutputs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "procmon.toml")
+	write := func(body string) {
+		require.NoError(t, ioutil.WriteFile(path, []byte(body), 0644))
+	}
+
+	write("[[task]]\nname = \"a\"\npath = \"/bin/a\"\n")
+	cfg, err := Load(path, true)
+	require.NoError(t, err)
+	root, old := running(t, cfg)
+	r, err := NewReloader(cfg, root, old, reloadLogger())
+	require.NoError(t, err)
+
+	logfile := filepath.Join(dir, "a.log")
+	write(fmt.Sprintf("[[task]]\nname = \"a\"\npath = \"/bin/a\"\nstdout = %q\n", logfile))
+	plan, err := r.Reload(true)
+	require.NoError(t, err)
+	require.Equal(t, ReloadRestart, plan.actions()["a"])
+	_, err = os.Stat(logfile)
+	require.True(t, os.IsNotExist(err), "a dry run created %s", logfile)
+}
+
+func TestDroppedChildEndsChildMonitor(t *testing.T) {
+	parent := NewTask("parent", "")
+	parent.Logger = reloadLogger()
+	parent.Stopped = make(chan struct{})
+	defer close(parent.Stopped)
+	child := NewTask("child", "/bin/true")
+	child.Logger = reloadLogger()
+	child.Stopped = make(chan struct{})
+	close(child.Stopped)
+	child.Hold()
+
+	done := make(chan struct{})
+	go func() {
+		parent.childMonitor(child)
+		close(done)
+	}()
+	child.drop()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("childMonitor still waiting for a dropped child")
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// the suffix of rotated files; it sorts in time order
+const rotatedFormat = "20060102T150405.000"
+
+// Rotation says when a log file is rotated and how long old ones are kept.
+// The zero value never rotates.
+type Rotation struct {
+	// rotate once the file would grow past MaxSize bytes
+	MaxSize uint64
+	// remove rotated files older than MaxAge
+	MaxAge time.Duration
+	// keep at most Keep rotated files
+	Keep int
+	// gzip rotated files
+	Compress bool
+}
+
+// RotationKeys are the keys BuildRotation reads
+var RotationKeys = []string{"max_size", "max_age", "keep", "compress"}
+
+// BuildRotation reads rotation settings from a [logger] or [task.logs]
+// table, starting from the defaults def
+func BuildRotation(m map[string]string, def Rotation) (Rotation, error) {
+	r := def
+	var err error
+	if s := m["max_size"]; s != "" {
+		if r.MaxSize, err = parseBytes(s); err != nil {
+			return r, errors.Wrap(err, "max_size")
+		}
+	}
+	if r.MaxAge, err = parseDuration(m["max_age"], r.MaxAge); err != nil {
+		return r, errors.Wrap(err, "max_age")
+	}
+	if s := m["keep"]; s != "" {
+		if r.Keep, err = strconv.Atoi(s); err != nil || r.Keep < 0 {
+			return r, fmt.Errorf("keep must be a number of files, not %q", s)
+		}
+	}
+	r.Compress = parseBool(m["compress"], r.Compress)
+	return r, nil
+}
+
+// LogFile is a log file which rotates itself as it's written, and can be
+// reopened after something else has moved it.
+//
+// Every LogFile is registered by name, so that the stdout and stderr of a
+// task, or the old and new tasks during a reload, share one LogFile if
+// they're written to the same file. Close only closes the file once all of
+// its users have closed it.
+type LogFile struct {
+	Name     string
+	Rotation Rotation
+
+	lock   sync.Mutex
+	f      *os.File
+	size   uint64
+	users  int
+	pruner sync.WaitGroup
+	// rotations are compressed and pruned one at a time
+	pruning sync.Mutex
+}
+
+var (
+	logFilesLock sync.Mutex
+	logFiles     = make(map[string]*LogFile)
+)
+
+// OpenLogFile opens a log file for appending, or returns the LogFile which
+// already has it open
+func OpenLogFile(name string, r Rotation) (*LogFile, error) {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return nil, err
+	}
+	logFilesLock.Lock()
+	defer logFilesLock.Unlock()
+	if lf, ok := logFiles[abs]; ok {
+		lf.users++
+		return lf, nil
+	}
+	lf := &LogFile{Name: abs, Rotation: r, users: 1}
+	if err = lf.open(); err != nil {
+		return nil, err
+	}
+	logFiles[abs] = lf
+	return lf, nil
+}
+
+// ReopenLogFiles reopens every log file, after something like logrotate
+// has moved them
+func ReopenLogFiles() error {
+	logFilesLock.Lock()
+	defer logFilesLock.Unlock()
+	var errs []string
+	for _, lf := range logFiles {
+		if err := lf.Reopen(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (lf *LogFile) open() error {
+	f, err := os.OpenFile(lf.Name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	lf.f = f
+	lf.size = uint64(info.Size())
+	return nil
+}
+
+// Write implements io.Writer, rotating the file first if the write would
+// take it past its maximum size
+func (lf *LogFile) Write(p []byte) (int, error) {
+	lf.lock.Lock()
+	defer lf.lock.Unlock()
+	if lf.f == nil {
+		return 0, os.ErrClosed
+	}
+	if lf.Rotation.MaxSize > 0 && lf.size > 0 && lf.size+uint64(len(p)) > lf.Rotation.MaxSize {
+		if err := lf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := lf.f.Write(p)
+	lf.size += uint64(n)
+	return n, err
+}
+
+// Rotate moves the current file aside and starts a new one
+func (lf *LogFile) Rotate() error {
+	lf.lock.Lock()
+	defer lf.lock.Unlock()
+	if lf.f == nil {
+		return os.ErrClosed
+	}
+	return lf.rotate()
+}
+
+func (lf *LogFile) rotate() error {
+	lf.f.Close()
+	lf.f = nil
+	rotated := lf.Name + "." + time.Now().Format(rotatedFormat)
+	if err := os.Rename(lf.Name, rotated); err != nil {
+		// keep writing to the file we have rather than losing output
+		if oerr := lf.open(); oerr != nil {
+			return oerr
+		}
+		return errors.Wrap(err, "rotating "+lf.Name)
+	}
+	if err := lf.open(); err != nil {
+		return err
+	}
+	// compressing and pruning can take a while, so they don't hold up
+	// the writers
+	lf.pruner.Add(1)
+	go func() {
+		defer lf.pruner.Done()
+		lf.pruning.Lock()
+		defer lf.pruning.Unlock()
+		if lf.Rotation.Compress {
+			compressFile(rotated)
+		}
+		lf.prune()
+	}()
+	return nil
+}
+
+// Reopen closes the file and opens its name again
+func (lf *LogFile) Reopen() error {
+	lf.lock.Lock()
+	defer lf.lock.Unlock()
+	if lf.f == nil {
+		return nil
+	}
+	lf.f.Close()
+	lf.f = nil
+	return lf.open()
+}
+
+// Close implements io.Closer
+func (lf *LogFile) Close() error {
+	logFilesLock.Lock()
+	lf.users--
+	last := lf.users == 0
+	if last {
+		delete(logFiles, lf.Name)
+	}
+	logFilesLock.Unlock()
+	if !last {
+		return nil
+	}
+	lf.pruner.Wait()
+	lf.lock.Lock()
+	defer lf.lock.Unlock()
+	if lf.f == nil {
+		return nil
+	}
+	err := lf.f.Close()
+	lf.f = nil
+	return err
+}
+
+// rotated lists the rotated copies of the file, oldest first
+func (lf *LogFile) rotated() []string {
+	matches, _ := filepath.Glob(lf.Name + ".*")
+	var files []string
+	for _, m := range matches {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(m, lf.Name+"."), ".gz")
+		if _, err := time.Parse(rotatedFormat, suffix); err == nil {
+			files = append(files, m)
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+// prune removes rotated files beyond the number to keep or older than the
+// maximum age
+func (lf *LogFile) prune() {
+	files := lf.rotated()
+	for i, name := range files {
+		remove := lf.Rotation.Keep > 0 && i < len(files)-lf.Rotation.Keep
+		if !remove && lf.Rotation.MaxAge > 0 {
+			if info, err := os.Stat(name); err == nil && time.Since(info.ModTime()) > lf.Rotation.MaxAge {
+				remove = true
+			}
+		}
+		if remove {
+			os.Remove(name)
+		}
+	}
+}
+
+// compressFile gzips a file, replacing it with name.gz
+func compressFile(name string) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(name+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err = io.Copy(zw, in); err == nil {
+		err = zw.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+	return os.Remove(name)
+}
+
+// PrefixWriter starts each line written through it with a timestamp and
+// the task name. Lines which look like JSON objects are passed through
+// untouched, so that structured logs stay parseable.
+type PrefixWriter struct {
+	W    io.Writer
+	Task string
+
+	lock sync.Mutex
+	// the next byte starts a line
+	start bool
+	now   func() time.Time
+}
+
+// NewPrefixWriter creates a PrefixWriter
+func NewPrefixWriter(w io.Writer, task string) *PrefixWriter {
+	return &PrefixWriter{W: w, Task: task, start: true, now: time.Now}
+}
+
+// Write implements io.Writer
+func (pw *PrefixWriter) Write(p []byte) (int, error) {
+	pw.lock.Lock()
+	defer pw.lock.Unlock()
+	var buf bytes.Buffer
+	for _, b := range p {
+		if pw.start {
+			pw.start = false
+			if b != '{' {
+				fmt.Fprintf(&buf, "%s [%s] ", pw.now().UTC().Format("2006-01-02T15:04:05.000Z"), pw.Task)
+			}
+		}
+		buf.WriteByte(b)
+		if b == '\n' {
+			pw.start = true
+		}
+	}
+	if _, err := pw.W.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
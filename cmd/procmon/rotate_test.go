@@ -0,0 +1,118 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildRotation(t *testing.T) {
+	def, err := BuildRotation(map[string]string{"max_size": "10M", "keep": "3"}, Rotation{})
+	require.NoError(t, err)
+	r, err := BuildRotation(map[string]string{"max_age": "24h", "compress": "true", "keep": "5"}, def)
+	require.NoError(t, err)
+	require.Equal(t, Rotation{MaxSize: 10 << 20, MaxAge: 24 * time.Hour, Keep: 5, Compress: true}, r)
+
+	_, err = BuildRotation(map[string]string{"keep": "-1"}, Rotation{})
+	require.Error(t, err)
+	_, err = BuildRotation(map[string]string{"max_size": "big"}, Rotation{})
+	require.Error(t, err)
+}
+
+func TestLogFileRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotate")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "task.log")
+
+	lf, err := OpenLogFile(name, Rotation{MaxSize: 10, Keep: 2, Compress: true})
+	require.NoError(t, err)
+	// stdout and stderr share the file
+	lf2, err := OpenLogFile(name, Rotation{})
+	require.NoError(t, err)
+	require.Same(t, lf, lf2)
+	require.NoError(t, lf2.Close())
+
+	// one and two fit in 10 bytes, then three and four each need a new
+	// file, five fits with four, and six needs another; only the last two
+	// rotated files are kept
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n", "five\n", "six\n"} {
+		// make sure the rotated names differ
+		time.Sleep(2 * time.Millisecond)
+		_, err = lf.Write([]byte(line))
+		require.NoError(t, err)
+	}
+	require.NoError(t, lf.Close())
+
+	data, err := ioutil.ReadFile(name)
+	require.NoError(t, err)
+	require.Equal(t, "six\n", string(data))
+	rotated := lf.rotated()
+	require.Len(t, rotated, 2)
+	require.True(t, strings.HasSuffix(rotated[1], ".gz"), rotated[1])
+	f, err := os.Open(rotated[1])
+	require.NoError(t, err)
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	data, err = ioutil.ReadAll(zr)
+	require.NoError(t, err)
+	require.Equal(t, "four\nfive\n", string(data))
+}
+
+func TestLogFileReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotate")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "task.log")
+
+	lf, err := OpenLogFile(name, Rotation{})
+	require.NoError(t, err)
+	defer lf.Close()
+	lf.Write([]byte("before\n"))
+	// as logrotate would
+	require.NoError(t, os.Rename(name, name+".1"))
+	require.NoError(t, ReopenLogFiles())
+	lf.Write([]byte("after\n"))
+
+	data, err := ioutil.ReadFile(name)
+	require.NoError(t, err)
+	require.Equal(t, "after\n", string(data))
+	data, err = ioutil.ReadFile(name + ".1")
+	require.NoError(t, err)
+	require.Equal(t, "before\n", string(data))
+}
+
+func TestPrefixWriter(t *testing.T) {
+	var buf bytes.Buffer
+	pw := NewPrefixWriter(&buf, "ndaunode")
+	pw.now = func() time.Time { return time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC) }
+	// writes don't line up with lines
+	for _, s := range []string{"hel", "lo\nwor", "ld\n{\"json\":", "true}\n", "\n"} {
+		n, err := pw.Write([]byte(s))
+		require.NoError(t, err)
+		require.Equal(t, len(s), n)
+	}
+	require.Equal(t,
+		"2019-05-01T12:00:00.000Z [ndaunode] hello\n"+
+			"2019-05-01T12:00:00.000Z [ndaunode] world\n"+
+			"{\"json\":true}\n"+
+			"2019-05-01T12:00:00.000Z [ndaunode] \n",
+		buf.String())
+}
@@ -0,0 +1,335 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// What to do when a special task is triggered while it's still running
+const (
+	OverlapWait = "wait"
+	OverlapSkip = "skip"
+)
+
+// A Schedule says when a periodic task runs next
+type Schedule interface {
+	// Next returns the first time the task should run after the given time
+	Next(after time.Time) time.Time
+}
+
+// everySchedule runs a task at a fixed interval
+type everySchedule time.Duration
+
+// Next implements Schedule
+func (e everySchedule) Next(after time.Time) time.Time {
+	return after.Add(time.Duration(e))
+}
+
+// cronSchedule runs a task at the times matched by a cron expression
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// with both day fields restricted, a day matching either will do
+	domStar, dowStar bool
+	loc              *time.Location
+}
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var monthNames = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+var dayNames = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+// ParseCron parses a standard five-field cron expression (minute, hour,
+// day of month, month, day of week), or one of @yearly, @monthly, @weekly,
+// @daily and @hourly, to run in the given location
+func ParseCron(expr string, loc *time.Location) (Schedule, error) {
+	if d, ok := cronDescriptors[strings.ToLower(strings.TrimSpace(expr))]; ok {
+		expr = d
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q must have 5 fields", expr)
+	}
+	c := &cronSchedule{loc: loc}
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, errors.Wrap(err, "cron minute")
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, errors.Wrap(err, "cron hour")
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, errors.Wrap(err, "cron day of month")
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12, monthNames); err != nil {
+		return nil, errors.Wrap(err, "cron month")
+	}
+	if c.dow, err = parseCronField(fields[4], 0, 7, dayNames); err != nil {
+		return nil, errors.Wrap(err, "cron day of week")
+	}
+	// 7 is another name for Sunday
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.domStar = strings.HasPrefix(fields[2], "*")
+	c.dowStar = strings.HasPrefix(fields[4], "*")
+	return c, nil
+}
+
+// parseCronField parses a comma-separated list of *, values, ranges, and
+// either of those with a /step, into a bitset
+func parseCronField(field string, min, max int, names map[string]int) (uint64, error) {
+	value := func(s string) (int, error) {
+		if n, ok := names[strings.ToLower(s)]; ok {
+			return n, nil
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < min || n > max {
+			return 0, fmt.Errorf("%q is not between %d and %d", s, min, max)
+		}
+		return n, nil
+	}
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("bad step in %q", part)
+			}
+			part = part[:i]
+		}
+		lo, hi := min, max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			ends := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = value(ends[0]); err != nil {
+				return 0, err
+			}
+			if hi, err = value(ends[1]); err != nil {
+				return 0, err
+			}
+			if lo > hi {
+				return 0, fmt.Errorf("range %q is backwards", part)
+			}
+		default:
+			var err error
+			if lo, err = value(part); err != nil {
+				return 0, err
+			}
+			if step == 1 {
+				hi = lo
+			}
+		}
+		for n := lo; n <= hi; n += step {
+			bits |= 1 << uint(n)
+		}
+	}
+	return bits, nil
+}
+
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Next implements Schedule
+func (c *cronSchedule) Next(after time.Time) time.Time {
+	t := after.In(c.loc).Truncate(time.Minute).Add(time.Minute)
+	// an expression like 0 0 30 2 * never matches
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, c.loc)
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, c.loc)
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, c.loc)
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// Window is a daily time range, like a maintenance window. It may wrap
+// around midnight.
+type Window struct {
+	// minutes after midnight
+	Start, End int
+	Loc        *time.Location
+}
+
+// ParseWindow parses a window like "02:00-04:30" in the given location
+func ParseWindow(s string, loc *time.Location) (*Window, error) {
+	ends := strings.SplitN(s, "-", 2)
+	if len(ends) != 2 {
+		return nil, fmt.Errorf("window %q must look like 02:00-04:00", s)
+	}
+	w := &Window{Loc: loc}
+	for i, end := range ends {
+		hm, err := time.Parse("15:04", strings.TrimSpace(end))
+		if err != nil {
+			return nil, fmt.Errorf("window %q must look like 02:00-04:00", s)
+		}
+		m := hm.Hour()*60 + hm.Minute()
+		if i == 0 {
+			w.Start = m
+		} else {
+			w.End = m
+		}
+	}
+	if w.Start == w.End {
+		return nil, fmt.Errorf("window %q is empty", s)
+	}
+	return w, nil
+}
+
+// Contains is true if t is within the window
+func (w *Window) Contains(t time.Time) bool {
+	t = t.In(w.Loc)
+	m := t.Hour()*60 + t.Minute()
+	if w.Start < w.End {
+		return m >= w.Start && m < w.End
+	}
+	return m >= w.Start || m < w.End
+}
+
+func (w *Window) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d %s", w.Start/60, w.Start%60, w.End/60, w.End%60, w.Loc)
+}
+
+// SpecialsKeys are the specials a task understands
+var SpecialsKeys = []string{"onetime", "periodic", "terminate", "shutdown", "signal", "cron", "timezone", "window", "overlap"}
+
+// specialString returns a special as a string, or "" if it isn't one
+func specialString(specials map[string]interface{}, key string) string {
+	s, _ := specials[key].(string)
+	return s
+}
+
+// buildSchedule sets up a task's schedule, maintenance window and overlap
+// policy from its specials
+func buildSchedule(t *Task, specials map[string]interface{}) error {
+	loc := time.Local
+	if tz := specialString(specials, "timezone"); tz != "" {
+		var err error
+		if loc, err = time.LoadLocation(tz); err != nil {
+			return errors.Wrap(err, "timezone")
+		}
+	}
+	if expr := specialString(specials, "cron"); expr != "" {
+		if t.Periodic != 0 {
+			return errors.New("a task can't have both cron and periodic")
+		}
+		s, err := ParseCron(expr, loc)
+		if err != nil {
+			return err
+		}
+		t.Schedule = s
+	} else if t.Periodic != 0 {
+		t.Schedule = everySchedule(t.Periodic)
+	}
+	if w := specialString(specials, "window"); w != "" {
+		if !t.Shutdown {
+			return errors.New("a maintenance window only applies to shutdown tasks")
+		}
+		var err error
+		if t.Window, err = ParseWindow(w, loc); err != nil {
+			return err
+		}
+	}
+	switch o := specialString(specials, "overlap"); o {
+	case "", OverlapWait:
+		t.Overlap = OverlapWait
+	case OverlapSkip:
+		t.Overlap = OverlapSkip
+	default:
+		return fmt.Errorf("overlap must be wait or skip, not %q", o)
+	}
+	return nil
+}
+
+// beginRun claims a special task for a run; it returns false if the task is
+// still running and its overlap policy is to skip. Otherwise, it waits for
+// the previous run to finish. endRun must be called after a successful
+// beginRun.
+func (t *Task) beginRun() bool {
+	if t.Overlap == OverlapSkip {
+		select {
+		case t.runGuard <- struct{}{}:
+			return true
+		default:
+			return false
+		}
+	}
+	t.runGuard <- struct{}{}
+	return true
+}
+
+func (t *Task) endRun() {
+	<-t.runGuard
+}
+
+// nextDue returns the first time after due that a schedule runs which
+// isn't before now. Runs don't overlap, so if the previous one overran, the
+// times it missed are skipped; it also returns how many were.
+func nextDue(s Schedule, due, now time.Time) (time.Time, int) {
+	next := s.Next(due)
+	skipped := 0
+	for !next.IsZero() && next.Before(now) {
+		next = s.Next(next)
+		skipped++
+	}
+	return next, skipped
+}
+
+// setNextRun records when a scheduled task runs next
+func (t *Task) setNextRun(next time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.nextRun = next
+}
+
+// NextRun returns when a scheduled task runs next, or the zero time
+func (t *Task) NextRun() time.Time {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.nextRun
+}
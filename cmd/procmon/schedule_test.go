@@ -0,0 +1,135 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCronNext(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	require.NoError(t, err)
+	// a Wednesday
+	from := time.Date(2019, 5, 1, 12, 34, 56, 0, time.UTC)
+
+	for _, tt := range []struct {
+		expr string
+		loc  *time.Location
+		want time.Time
+	}{
+		{"*/15 * * * *", time.UTC, time.Date(2019, 5, 1, 12, 45, 0, 0, time.UTC)},
+		{"0 3 * * *", time.UTC, time.Date(2019, 5, 2, 3, 0, 0, 0, time.UTC)},
+		{"0 3 * * *", ny, time.Date(2019, 5, 2, 3, 0, 0, 0, ny)},
+		{"30 2 * * sun", time.UTC, time.Date(2019, 5, 5, 2, 30, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.UTC, time.Date(2019, 5, 5, 0, 0, 0, 0, time.UTC)},
+		{"0 9-17/4 * * mon-fri", time.UTC, time.Date(2019, 5, 1, 13, 0, 0, 0, time.UTC)},
+		{"0 0 1 jan *", time.UTC, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.UTC, time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.UTC, time.Date(2019, 5, 1, 13, 0, 0, 0, time.UTC)},
+		// with both days restricted, either matches: the 15th or a friday
+		{"0 0 15 * fri", time.UTC, time.Date(2019, 5, 3, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.UTC, time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.UTC, time.Time{}},
+	} {
+		s, err := ParseCron(tt.expr, tt.loc)
+		require.NoError(t, err, tt.expr)
+		got := s.Next(from)
+		require.True(t, tt.want.Equal(got), "%s: want %s, got %s", tt.expr, tt.want, got)
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{
+		"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *",
+		"* * * 13 *", "* * * * 8", "5-1 * * * *", "*/0 * * * *", "@sometimes",
+	} {
+		_, err := ParseCron(expr, time.UTC)
+		require.Error(t, err, expr)
+	}
+}
+
+func TestWindow(t *testing.T) {
+	w, err := ParseWindow("02:00-04:30", time.UTC)
+	require.NoError(t, err)
+	at := func(h, m int) time.Time { return time.Date(2019, 5, 1, h, m, 0, 0, time.UTC) }
+	require.False(t, w.Contains(at(1, 59)))
+	require.True(t, w.Contains(at(2, 0)))
+	require.True(t, w.Contains(at(4, 29)))
+	require.False(t, w.Contains(at(4, 30)))
+
+	// wrapping around midnight
+	w, err = ParseWindow("23:00-01:00", time.UTC)
+	require.NoError(t, err)
+	require.True(t, w.Contains(at(23, 30)))
+	require.True(t, w.Contains(at(0, 30)))
+	require.False(t, w.Contains(at(12, 0)))
+
+	for _, bad := range []string{"2am", "02:00", "02:00-25:00", "03:00-03:00"} {
+		_, err = ParseWindow(bad, time.UTC)
+		require.Error(t, err, bad)
+	}
+}
+
+func TestBuildSchedule(t *testing.T) {
+	task := NewTask("backup", "/bin/true")
+	task.Shutdown = true
+	require.NoError(t, buildSchedule(task, map[string]interface{}{
+		"cron": "0 3 * * *", "timezone": "Europe/Berlin", "window": "02:00-05:00", "overlap": "skip",
+	}))
+	require.NotNil(t, task.Schedule)
+	require.Equal(t, "Europe/Berlin", task.Window.Loc.String())
+	require.Equal(t, OverlapSkip, task.Overlap)
+
+	task = NewTask("t", "/bin/true")
+	task.Periodic = time.Minute
+	require.NoError(t, buildSchedule(task, nil))
+	require.Equal(t, everySchedule(time.Minute), task.Schedule)
+	require.Equal(t, OverlapWait, task.Overlap)
+
+	for _, bad := range []map[string]interface{}{
+		{"cron": "0 3 * * *", "periodic": "1m"},
+		{"cron": "whenever"},
+		{"timezone": "Mars/Olympus_Mons"},
+		{"window": "02:00-03:00"},
+		{"overlap": "sometimes"},
+	} {
+		task = NewTask("t", "/bin/true")
+		task.Periodic, _ = parseDuration(bad["periodic"], 0)
+		require.Error(t, buildSchedule(task, bad), "%v", bad)
+	}
+}
+
+func TestBeginRunSkip(t *testing.T) {
+	task := NewTask("t", "/bin/true")
+	task.Overlap = OverlapSkip
+	require.True(t, task.beginRun())
+	require.False(t, task.beginRun())
+	task.endRun()
+	require.True(t, task.beginRun())
+	task.endRun()
+}
+
+func TestNextDue(t *testing.T) {
+	s := everySchedule(time.Minute)
+	due := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	// a run which finished in time doesn't push the next one back
+	next, skipped := nextDue(s, due, due.Add(20*time.Second))
+	require.Equal(t, due.Add(time.Minute), next)
+	require.Equal(t, 0, skipped)
+
+	// one which overran by two and a half minutes misses two runs
+	next, skipped = nextDue(s, due, due.Add(150*time.Second))
+	require.Equal(t, due.Add(3*time.Minute), next)
+	require.Equal(t, 2, skipped)
+}
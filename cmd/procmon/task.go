@@ -30,6 +30,19 @@ const (
 	ndauapiTaskName    = "ndauapi"
 )
 
+// requirementWarning is how often a task which is still waiting for its
+// dependencies to be ready says so
+var requirementWarning = 30 * time.Second
+
+// Reasons a task is restarted. Only failures, including exceeding a limit,
+// count against the task.
+const (
+	RestartFailure    = "failure"
+	RestartOperator   = "operator"
+	RestartDependency = "dependency"
+	RestartLimit      = "limit"
+)
+
 // Task is a restartable process; it can be monitored and
 // restarted.
 //
@@ -98,6 +111,9 @@ type Task struct {
 	Env          []string
 	Onetime      bool
 	Periodic     time.Duration
+	Schedule     Schedule
+	Window       *Window
+	Overlap      string
 	Terminate    bool
 	Shutdown     bool
 	MaxShutdown  time.Duration
@@ -110,12 +126,63 @@ type Task struct {
 	Logger       logrus.FieldLogger
 	FailCount    int
 	RestartDelay time.Duration
+	Policy       *RestartPolicy
+	Limits       *Limits
 	Monitors     []*FailMonitor
 	Prerun       []*Task
 	Dependents   []*Task
+	Requires     []*Task
+
+	cmd        *exec.Cmd
+	dying      bool
+	parent     *Task
+	requiredBy []*Task
+	started    time.Time
+	// holds a token while a special task runs
+	runGuard chan struct{}
+
+	// lock guards the restart controls below. It also guards FailCount,
+	// RestartDelay, Status, started and pid, which the control api and
+	// metrics read from outside the task's own goroutines.
+	lock    sync.Mutex
+	release chan struct{}
+	restart string
+	nextRun time.Time
+	pid     int
+	// closed when a reload removes the task for good
+	dropped chan struct{}
+}
+
+// a taskSnapshot is a consistent copy of a task's changing state
+type taskSnapshot struct {
+	failCount    int
+	restartDelay time.Duration
+	status       chan Eventer
+	started      time.Time
+	pid          int
+}
+
+// snapshot copies the task's changing state under its lock
+func (t *Task) snapshot() taskSnapshot {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return taskSnapshot{
+		failCount:    t.FailCount,
+		restartDelay: t.RestartDelay,
+		status:       t.Status,
+		started:      t.started,
+		pid:          t.pid,
+	}
+}
 
-	cmd   *exec.Cmd
-	dying bool
+// setPID records the task's running process, or 0 once it has exited
+func (t *Task) setPID(pid int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.pid = pid
+	if pid != 0 {
+		t.started = time.Now()
+	}
 }
 
 // NewTask creates a Task (but does not start it)
@@ -130,6 +197,9 @@ func NewTask(name string, path string, args ...string) *Task {
 		Ready:        func() Eventer { return OK },
 		Monitors:     make([]*FailMonitor, 0),
 		RestartDelay: time.Second,
+		Overlap:      OverlapWait,
+		runGuard:     make(chan struct{}, 1),
+		dropped:      make(chan struct{}),
 	}
 }
 
@@ -168,11 +238,25 @@ func (t *Task) exitMonitor() {
 	// the new one by mistake
 	status := t.Status
 	err := t.cmd.Wait()
-	if err != nil {
+	t.setPID(0)
+	if lerr := t.Limits.Exceeded(t.cmd.ProcessState); lerr != nil {
+		t.Logger.WithField("task", t.Name).
+			WithField("event", "limit_exceeded").
+			WithField("limit", lerr.Limit).
+			WithError(lerr).
+			Error("task stopped by a resource limit")
+		metricLimitsExceeded.WithLabelValues(t.Name, lerr.Limit).Inc()
+		t.lock.Lock()
+		if t.restart == "" {
+			t.restart = RestartLimit
+		}
+		t.lock.Unlock()
+	} else if err != nil {
 		t.Logger.WithField("task", t.Name).WithError(err).Error("task terminated")
 	} else {
 		t.Logger.WithField("task", t.Name).Warn("terminated")
 	}
+	t.releaseLimits()
 	status <- Stop
 }
 
@@ -186,6 +270,8 @@ func (t *Task) exitMonitor() {
 // If the current task's Stopped channel is closed, this
 // monitor terminates
 // It also reduces restart time if a task is well-behaved after having failed.
+// A child with a restart policy is delayed as the policy says instead, and
+// is parked if the policy's breaker trips.
 func (t *Task) childMonitor(child *Task) {
 	// allow the default restart delay to be overridden in the environment
 	var defaultRestartDelay = 10 * time.Second
@@ -196,28 +282,89 @@ func (t *Task) childMonitor(child *Task) {
 	}
 	for {
 		select {
-		case <-time.After(t.RestartDelay):
+		case <-time.After(t.snapshot().restartDelay):
 			// we double the RestartDelay every time the task restarts,
 			// and we reduce it asymptotically to the default value
 			// as the task lives longer without restarting
+			t.lock.Lock()
 			t.RestartDelay = defaultRestartDelay +
 				((t.RestartDelay-defaultRestartDelay)*9)/10
+			t.lock.Unlock()
 		case <-t.Stopped:
 			return
+		case <-child.dropped:
+			return
 		case <-child.Stopped:
+			// an operator may have asked for the child to stay down;
+			// if so, wait until they release it
+			if release := child.held(); release != nil {
+				t.Logger.WithField("task", t.Name).WithField("child", child.Name).
+					Info("childmonitor holding stopped child")
+				select {
+				case <-release:
+					t.Logger.WithField("task", t.Name).WithField("child", child.Name).
+						Info("childmonitor starting released child")
+					metricRestarts.WithLabelValues(child.Name, RestartOperator).Inc()
+					if child.Policy != nil {
+						child.Policy.Reset()
+					}
+					child.Start(t.Stopped)
+					continue
+				case <-t.Stopped:
+					return
+				case <-child.dropped:
+					return
+				}
+			}
+			// a restart requested by an operator or caused by a dependency
+			// is not a failure, so it shouldn't be delayed or counted
+			// against the child
+			delay := child.snapshot().restartDelay
+			reason := child.takeRestart()
+			failed := reason == RestartFailure || reason == RestartLimit
+			switch {
+			case !failed:
+				delay = 0
+			case child.Policy != nil:
+				var tripped bool
+				delay, tripped = child.Policy.Failed(time.Now(), child.snapshot().started)
+				if tripped {
+					child.lock.Lock()
+					child.FailCount++
+					child.lock.Unlock()
+					t.tripBreaker(child)
+					continue
+				}
+			}
 			// we want to delay for the sleep time but
 			// we don't want to miss it if our task is stopped
 			// because we don't want to restart the child
 			// if its parent is restarting
 			select {
-			case <-time.After(child.RestartDelay):
-				child.FailCount++
-				child.RestartDelay *= 2
+			case <-time.After(delay):
+				// the child may have been held while we were waiting;
+				// its Stopped channel is still closed, so looping again
+				// takes us back to the hold above
+				if child.held() != nil {
+					continue
+				}
+				child.lock.Lock()
+				switch {
+				case !failed:
+				case child.Policy != nil:
+					child.FailCount++
+					child.RestartDelay = delay
+				default:
+					child.FailCount++
+					child.RestartDelay *= 2
+				}
+				child.lock.Unlock()
 				// this will replace the child's Stopped channel
 				t.Logger.WithField("task", t.Name).WithField("child", child.Name).
 					WithField("delay", child.RestartDelay).
 					WithField("failcount", child.FailCount).
 					Debugf("childmonitor restarting child")
+				metricRestarts.WithLabelValues(child.Name, reason).Inc()
 				child.Start(t.Stopped)
 			case <-t.Stopped:
 				t.Logger.WithField("task", t.Name).WithField("child", child.Name).
@@ -270,6 +417,11 @@ func (t *Task) setOutputStreams() {
 
 // Start begins a new version of the task.
 func (t *Task) Start(parentstop chan struct{}) {
+	// everything we depend on has to be ready first
+	if !t.waitForRequirements(parentstop) {
+		return
+	}
+
 	// run the prerun tasks first
 	for _, prerun := range t.Prerun {
 		prerun.Start(parentstop)
@@ -281,7 +433,12 @@ func (t *Task) Start(parentstop chan struct{}) {
 	}
 
 	t.Logger.WithField("task", t.Name).Info("Starting")
-	t.cmd = exec.Command(t.Path, t.Args...)
+	cmd, handshake, err := t.Limits.Command(t.Path, t.Args...)
+	if err != nil {
+		t.Logger.WithField("task", t.Name).WithError(err).Error("could not apply limits")
+		return
+	}
+	t.cmd = cmd
 	t.setOutputStreams()
 
 	// start the task and wait for it to be ready
@@ -297,7 +454,14 @@ func (t *Task) Start(parentstop chan struct{}) {
 	// if it's a onetime task, just run it and be done
 	if t.Onetime {
 		t.Logger.WithField("task", t.Name).Debug("running onetime task")
-		err := t.cmd.Run()
+		err = t.cmd.Start()
+		if err == nil {
+			t.setPID(t.cmd.Process.Pid)
+			t.attachLimits(handshake)
+			err = t.cmd.Wait()
+			t.setPID(0)
+			t.releaseLimits()
+		}
 		if err != nil {
 			t.Logger.WithField("task", t.Name).WithError(err).Error("onetime task failed")
 		} else {
@@ -306,11 +470,14 @@ func (t *Task) Start(parentstop chan struct{}) {
 		return
 	}
 
-	err := t.cmd.Start()
+	err = t.cmd.Start()
 	if err != nil {
 		t.Logger.WithField("task", t.Name).WithError(err).Error("errored on startup")
 		return
 	}
+	t.setPID(t.cmd.Process.Pid)
+	t.attachLimits(handshake)
+	metricStarts.WithLabelValues(t.Name).Inc()
 
 	if t.cmd != nil && t.cmd.Process != nil {
 		t.Logger.WithField("task", t.Name).WithField("pid", t.cmd.Process.Pid).WithField("task", t.Name).Info("waiting for ready")
@@ -323,19 +490,23 @@ func (t *Task) Start(parentstop chan struct{}) {
 		case <-loopticker.C:
 			if t.Exited() {
 				t.Logger.WithField("task", t.Name).Error("task exited while starting up")
+				t.setPID(0)
 				return
 			}
 			// go check again
 		case <-toolong.C:
 			t.Logger.WithField("task", t.Name).Error("took too long to start up")
 			t.Kill()
+			t.setPID(0)
 			return
 		}
 	}
 	t.Logger.WithField("task", t.Name).WithField("pid", t.cmd.Process.Pid).Debug("task started and is ready")
 
 	// now we need the Status channel
+	t.lock.Lock()
 	t.Status = make(chan Eventer, 1)
+	t.lock.Unlock()
 	// make a Stopped channel
 	t.Stopped = make(chan struct{})
 
@@ -351,6 +522,22 @@ func (t *Task) Start(parentstop chan struct{}) {
 	t.StartChildren()
 }
 
+// releaseLimits removes what the task's limits set up for a process which
+// has exited
+func (t *Task) releaseLimits() {
+	if err := t.Limits.Release(); err != nil {
+		t.Logger.WithField("task", t.Name).WithError(err).Warn("could not clean up after limits")
+	}
+}
+
+// attachLimits finishes applying the task's limits to its new process. If
+// the cgroup limits can't be applied, the task runs without them.
+func (t *Task) attachLimits(handshake *os.File) {
+	if err := t.Limits.Attach(t.Name, t.cmd, handshake); err != nil {
+		t.Logger.WithField("task", t.Name).WithError(err).Warn("running without cgroup limits")
+	}
+}
+
 // StartChildren starts all of the task's children
 func (t *Task) StartChildren() {
 	t.Logger.WithField("task", t.Name).Info("starting children")
@@ -377,6 +564,9 @@ func (t *Task) StartChildren() {
 // that watch the task for bad behavior
 func (t *Task) startBehaviorMonitors() {
 	for _, m := range t.Monitors {
+		// the monitors were built before the task had a Status channel,
+		// and it's replaced each time the task starts
+		m.Status = t.Status
 		go m.Listen(t.Stopped)
 	}
 	t.Logger.WithField("task", t.Name).WithField("monitorcount", len(t.Monitors)).Debug("behavior monitors started")
@@ -396,6 +586,7 @@ func (t *Task) waitForShutdown() {
 			looptimer.Reset(looptime)
 		case <-toolong.C:
 			t.Logger.WithField("task", t.Name).Error("did not shut down nicely, killing it")
+			metricShutdownTimeouts.WithLabelValues(t.Name).Inc()
 			t.Destroy()
 		}
 	}
@@ -416,6 +607,7 @@ func (t *Task) Kill() {
 
 	// record that we're stopping
 	t.dying = true
+	began := time.Now()
 	t.Logger.WithField("task", t.Name).Warn("starting to kill process")
 	t.killDependents()
 	if !t.Exited() {
@@ -423,18 +615,20 @@ func (t *Task) Kill() {
 		t.cmd.Process.Signal(syscall.SIGTERM)
 		t.waitForShutdown()
 	}
+	metricShutdownSeconds.WithLabelValues(t.Name).Observe(time.Since(began).Seconds())
 	t.Logger.WithField("task", t.Name).Debug("done killing")
 	return
 }
 
-// killDependents ends the dependents of a running task
-// but doesn't touch the task itself.
+// killDependents ends the dependents of a running task and the tasks
+// which require it, but doesn't touch the task itself.
 // The tasks are killed in parallel and this function only returns when
 // they have all died.
 func (t *Task) killDependents() {
-	if len(t.Dependents) == 0 {
+	if len(t.Dependents) == 0 && len(t.requiredBy) == 0 {
 		return
 	}
+	metricCascades.WithLabelValues(t.Name).Inc()
 	wg := sync.WaitGroup{}
 	for _, ch := range t.Dependents {
 		ch := ch
@@ -444,6 +638,20 @@ func (t *Task) killDependents() {
 			wg.Done()
 		}()
 	}
+	// tasks which require this one are restarted by their own parents,
+	// once this one is ready again
+	for _, rb := range t.requiredBy {
+		rb := rb
+		if !rb.running() {
+			continue
+		}
+		rb.markRestart(RestartDependency)
+		wg.Add(1)
+		go func() {
+			rb.Kill()
+			wg.Done()
+		}()
+	}
 	wg.Wait()
 	t.Logger.WithField("task", t.Name).Info("Done killing dependents")
 	return
@@ -477,6 +685,118 @@ func (t *Task) Exited() bool {
 // is alive, its children will also be started.
 func (t *Task) AddDependent(ch *Task) {
 	t.Dependents = append(t.Dependents, ch)
+	ch.parent = t
+}
+
+// AddRequirement adds a task which must be ready before this one starts,
+// besides its parent. If the requirement stops, this task is stopped too,
+// and its parent restarts it once the requirement is ready again.
+func (t *Task) AddRequirement(dep *Task) {
+	t.Requires = append(t.Requires, dep)
+	dep.requiredBy = append(dep.requiredBy, t)
+}
+
+// ready is true once a task has started and passed its ready monitor, until
+// it stops again
+func (t *Task) ready() bool {
+	return t.running() && isOpen(t.Stopped)
+}
+
+// waitForRequirements waits until every task this one requires is ready.
+// It returns false if parentstop is closed first. A requirement which never
+// becomes ready would hold the task back silently, so the wait is logged
+// again as a warning every requirementWarning.
+func (t *Task) waitForRequirements(parentstop chan struct{}) bool {
+	began := time.Now()
+	var warned time.Time
+	for {
+		var waiting []string
+		for _, dep := range t.Requires {
+			if !dep.ready() {
+				waiting = append(waiting, dep.Name)
+			}
+		}
+		if len(waiting) == 0 {
+			return true
+		}
+		switch {
+		case warned.IsZero():
+			t.Logger.WithField("task", t.Name).WithField("waiting", waiting).Info("waiting for dependencies")
+			warned = time.Now()
+		case time.Since(warned) >= requirementWarning:
+			t.Logger.WithField("task", t.Name).WithField("waiting", waiting).
+				WithField("waited", time.Since(began).Round(time.Second).String()).
+				Warn("still waiting for dependencies")
+			warned = time.Now()
+		}
+		select {
+		case <-parentstop:
+			return false
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// running is a quiet version of !Exited: it doesn't log or signal the process
+func (t *Task) running() bool {
+	return t.cmd != nil && t.cmd.Process != nil && t.cmd.ProcessState == nil
+}
+
+// Hold asks the task's parent not to restart it the next time it stops.
+// It stays down until Release is called.
+func (t *Task) Hold() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.release == nil {
+		t.release = make(chan struct{})
+	}
+}
+
+// Release lets a held task be started again.
+func (t *Task) Release() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.release != nil {
+		close(t.release)
+		t.release = nil
+	}
+}
+
+// held returns the channel which will be closed when the task is released,
+// or nil if the task is not held.
+func (t *Task) held() chan struct{} {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.release
+}
+
+// drop tells the task's parent to stop monitoring it
+func (t *Task) drop() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if isOpen(t.dropped) {
+		close(t.dropped)
+	}
+}
+
+// markRestart records why the task is about to be stopped
+func (t *Task) markRestart(reason string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.restart = reason
+}
+
+// takeRestart reports why the task most recently stopped, and clears that
+// record. Unless something said otherwise, it failed.
+func (t *Task) takeRestart() string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	r := t.restart
+	t.restart = ""
+	if r == "" {
+		return RestartFailure
+	}
+	return r
 }
 
 // Destroy does an os-level kill on a task and all its dependents
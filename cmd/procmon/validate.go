@@ -0,0 +1,716 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/BurntSushi/toml"
+	"github.com/sirupsen/logrus"
+)
+
+type validateargs struct {
+	Configfile string `arg:"positional,required" help:"the name of the .toml config file to check"`
+	NoCheck    bool   `help:"set this to disable checking that envvar substitutions are fully resolved"`
+}
+
+func (validateargs) Description() string {
+	return strings.TrimSpace(`
+Check a config file without starting anything.
+
+Every problem found is reported with the line it's on, rather than just the
+first. Warnings, such as a task binary which isn't installed on this machine,
+are reported too but don't make the check fail.
+	`)
+}
+
+// validate is the validate subcommand
+func validate(argv []string) int {
+	var args validateargs
+	if code, ok := parseSubcommand("procmon validate", &args, argv); !ok {
+		return code
+	}
+
+	problems := Validate(args.Configfile, args.NoCheck)
+	errs := 0
+	for _, p := range problems {
+		if p.Line > 0 {
+			fmt.Printf("%s:%d: %s\n", args.Configfile, p.Line, p)
+		} else {
+			fmt.Printf("%s: %s\n", args.Configfile, p)
+		}
+		if !p.Warning {
+			errs++
+		}
+	}
+	if errs > 0 {
+		fmt.Fprintf(os.Stderr, "%d errors, %d warnings\n", errs, len(problems)-errs)
+		return 1
+	}
+	if len(problems) == 0 {
+		fmt.Printf("%s: ok\n", args.Configfile)
+	}
+	return 0
+}
+
+// A Problem is something wrong with a config file
+type Problem struct {
+	// the line it's on, or 0 if that isn't known
+	Line int
+	// where it is in the config, like task[2].monitors[0]
+	Path string
+	// the name of the task it's in, if any
+	Task    string
+	Message string
+	// a warning doesn't stop procmon from running the config
+	Warning bool
+}
+
+func (p Problem) String() string {
+	s := p.Message
+	switch {
+	case p.Task != "":
+		s = fmt.Sprintf("%s (%s): %s", p.Path, p.Task, s)
+	case p.Path != "":
+		s = p.Path + ": " + s
+	}
+	if p.Warning {
+		s = "warning: " + s
+	}
+	return s
+}
+
+// Validate checks a whole config file without starting anything, and
+// returns every problem it finds, in the order they appear in the file
+func Validate(filename string, nocheck bool) []Problem {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return []Problem{{Message: err.Error()}}
+	}
+	c := &checker{lines: tomlLines(string(data))}
+
+	// the raw decode tells us about keys that procmon doesn't know
+	var raw Config
+	md, err := toml.Decode(string(data), &raw)
+	if err != nil {
+		return []Problem{{Line: errorLine(err), Message: err.Error()}}
+	}
+	for _, k := range md.Undecoded() {
+		c.unknownKey(k.String())
+	}
+
+	cfg, err := loadForCheck(filename)
+	if err != nil {
+		c.add(Problem{Message: err.Error()})
+		return c.sorted()
+	}
+	c.check(cfg, nocheck)
+	return c.sorted()
+}
+
+// loadForCheck loads a config without checking its environment, which
+// Validate does itself so that it can report every problem
+func loadForCheck(filename string) (cfg Config, err error) {
+	// interpolation panics on values that aren't strings or bools
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	return Load(filename, true)
+}
+
+// errorLine finds the line number in a toml error
+func errorLine(err error) int {
+	m := regexp.MustCompile(`line (\d+)`).FindStringSubmatch(err.Error())
+	if m == nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(m[1])
+	return n
+}
+
+// tomlLines maps the tables and keys in a toml file to the lines they're
+// on. Elements of arrays of tables are numbered from 0, so that the name of
+// the second monitor of the third task is task[2].monitors[1].
+//
+// The toml package doesn't report positions, so this is a simple scanner
+// which only needs to be good enough to point at the right place.
+func tomlLines(data string) map[string]int {
+	lines := make(map[string]int)
+	// the number of elements seen in each array, by path
+	counts := make(map[string]int)
+	// the path of the latest element of each array, by table name
+	current := make(map[string]string)
+	resolve := func(name string) string {
+		parts := strings.Split(name, ".")
+		path := ""
+		for i, part := range parts {
+			if elem, ok := current[strings.Join(parts[:i+1], ".")]; ok && i < len(parts)-1 {
+				path = elem
+				continue
+			}
+			path = joinPath(path, strings.Trim(part, `"' `))
+		}
+		return path
+	}
+	key := regexp.MustCompile(`^["']?[A-Za-z0-9_-]+["']?$`)
+	table := ""
+	for i, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		n := i + 1
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, "[["):
+			end := strings.Index(line, "]]")
+			if end < 0 {
+				continue
+			}
+			name := strings.TrimSpace(line[2:end])
+			array := resolve(name)
+			elem := fmt.Sprintf("%s[%d]", array, counts[array])
+			counts[array]++
+			for k := range current {
+				if strings.HasPrefix(k, name+".") {
+					delete(current, k)
+				}
+			}
+			current[name] = elem
+			table = elem
+			lines[elem] = n
+		case strings.HasPrefix(line, "["):
+			end := strings.Index(line, "]")
+			if end < 0 {
+				continue
+			}
+			table = resolve(strings.TrimSpace(line[1:end]))
+			if _, ok := lines[table]; !ok {
+				lines[table] = n
+			}
+		default:
+			eq := strings.Index(line, "=")
+			if eq < 0 {
+				continue
+			}
+			k := strings.TrimSpace(line[:eq])
+			if !key.MatchString(k) {
+				continue
+			}
+			path := joinPath(table, strings.Trim(k, `"'`))
+			if _, ok := lines[path]; !ok {
+				lines[path] = n
+			}
+		}
+	}
+	return lines
+}
+
+func joinPath(table, key string) string {
+	if table == "" {
+		return key
+	}
+	return table + "." + key
+}
+
+var arrayIndex = regexp.MustCompile(`\[\d+\]`)
+
+// checker collects the problems with a config
+type checker struct {
+	lines    map[string]int
+	problems []Problem
+}
+
+// line finds the line of a path, or of the nearest table containing it
+func (c *checker) line(path string) int {
+	for path != "" {
+		if n, ok := c.lines[path]; ok {
+			return n
+		}
+		i := strings.LastIndexAny(path, ".[")
+		if i < 0 {
+			break
+		}
+		path = path[:i]
+	}
+	return 0
+}
+
+func (c *checker) add(p Problem) {
+	if p.Line == 0 {
+		p.Line = c.line(p.Path)
+	}
+	c.problems = append(c.problems, p)
+}
+
+func (c *checker) errorf(path, task, format string, args ...interface{}) {
+	c.add(Problem{Path: path, Task: task, Message: fmt.Sprintf(format, args...)})
+}
+
+func (c *checker) warnf(path, task, format string, args ...interface{}) {
+	c.add(Problem{Path: path, Task: task, Message: fmt.Sprintf(format, args...), Warning: true})
+}
+
+func (c *checker) sorted() []Problem {
+	sort.SliceStable(c.problems, func(i, j int) bool {
+		return c.problems[i].Line < c.problems[j].Line
+	})
+	return c.problems
+}
+
+// unknownKey reports a key that procmon doesn't use, everywhere it
+// appears. It's only a warning, since procmon ignores it, but it's often a
+// typo.
+func (c *checker) unknownKey(key string) {
+	var paths []string
+	for path := range c.lines {
+		if arrayIndex.ReplaceAllString(path, "") == key {
+			paths = append(paths, path)
+		}
+	}
+	if len(paths) == 0 {
+		paths = append(paths, key)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		c.warnf(path, "", "unknown key")
+	}
+}
+
+// knownKeys reports the keys of a table that aren't in known
+func (c *checker) knownKeys(path, task string, m map[string]string, known []string) {
+	for _, k := range sortedKeys(m) {
+		if !contains(known, k) {
+			c.warnf(joinPath(path, k), task, "unknown key")
+		}
+	}
+}
+
+var envVariable = regexp.MustCompile(`\${?[a-zA-Z0-9_]+}?`)
+
+// unresolved reports values which still look like they refer to an
+// environment variable after interpolation
+func (c *checker) unresolved(path, task, value string, warning bool) {
+	m := envVariable.FindString(value)
+	if m == "" {
+		return
+	}
+	c.add(Problem{Path: path, Task: task, Message: "unresolved environment variable " + m, Warning: warning})
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// check checks a loaded config
+func (c *checker) check(cfg Config, nocheck bool) {
+	if !nocheck {
+		for _, k := range sortedKeys(cfg.Env) {
+			c.unresolved("env."+k, "", cfg.Env[k], true)
+		}
+	}
+	c.checkSections(cfg)
+	for i, mon := range cfg.Prologue {
+		path := fmt.Sprintf("prologue[%d]", i)
+		if !nocheck {
+			for _, k := range sortedKeys(mon) {
+				c.unresolved(joinPath(path, k), "", mon[k], true)
+			}
+		}
+		c.checkMonitor(path, "", mon)
+	}
+	c.checkTasks(cfg, nocheck)
+}
+
+// checkSections checks the [logger], [control] and [metrics] sections
+func (c *checker) checkSections(cfg Config) {
+	c.knownKeys("logger", "", cfg.Logger, LoggerKeys)
+	switch cfg.Logger["format"] {
+	case "", "json", "text", "plain":
+	default:
+		c.errorf("logger.format", "", "format must be json or text, not %q", cfg.Logger["format"])
+	}
+	switch cfg.Logger["level"] {
+	case "", "info", "debug", "warn", "warning", "err", "error":
+	default:
+		c.errorf("logger.level", "", "level must be debug, info, warn or error, not %q", cfg.Logger["level"])
+	}
+	if _, err := BuildRotation(cfg.Logger, Rotation{}); err != nil {
+		c.errorf("logger", "", "%s", err)
+	}
+	c.checkOutput("logger.output", "", cfg.Logger["output"])
+
+	c.knownKeys("control", "", cfg.Control, ControlKeys)
+	if addr := cfg.Control["http"]; addr != "" {
+		if err := checkLoopback(addr); err != nil {
+			c.errorf("control.http", "", "%s", err)
+		}
+	}
+
+	c.knownKeys("metrics", "", cfg.Metrics, MetricsKeys)
+	if addr := cfg.Metrics["addr"]; addr != "" {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			c.errorf("metrics.addr", "", "%s", err)
+		}
+	}
+
+	var reload os.Signal
+	for _, s := range []struct {
+		path string
+		name string
+	}{
+		{"control.reload_signal", cfg.Control["reload_signal"]},
+		{"logger.reopen_signal", cfg.Logger["reopen_signal"]},
+	} {
+		if s.name == "" {
+			continue
+		}
+		sig := parseSignal(s.name)
+		switch {
+		case sig == nil:
+			c.errorf(s.path, "", "unknown signal %s", s.name)
+		case sig == syscall.SIGTERM || sig == syscall.SIGINT:
+			c.errorf(s.path, "", "cannot be %s", sig)
+		case sig == reload:
+			c.errorf(s.path, "", "reopen_signal and reload_signal must differ")
+		}
+		if reload == nil {
+			reload = sig
+		}
+	}
+}
+
+// checkOutput checks that a file output can be created
+func (c *checker) checkOutput(path, task, output string) {
+	switch output {
+	case "", LoggerOutputStdout, LoggerOutputStderr, LoggerOutputSuppress:
+		return
+	}
+	if info, err := os.Stat(filepath.Dir(output)); err != nil || !info.IsDir() {
+		c.warnf(path, task, "directory %s does not exist", filepath.Dir(output))
+	}
+}
+
+// checkMonitor checks a monitor without running it
+func (c *checker) checkMonitor(path, task string, mon map[string]string) {
+	keys, ok := MonitorKeys[mon["type"]]
+	if !ok {
+		if mon["type"] == "" {
+			c.errorf(path, task, "monitor has no type")
+		} else {
+			c.errorf(joinPath(path, "type"), task, "unknown monitor type %s", mon["type"])
+		}
+		return
+	}
+	c.knownKeys(path, task, mon, append(append([]string{}, MonitorCommonKeys...), keys...))
+	if mon["type"] == "http" {
+		// the http pinger can't be built with a bad url, but a url which
+		// still refers to the environment has already been warned about,
+		// and may well parse once the variable is set
+		if _, err := http.NewRequest("GET", mon["url"], nil); err != nil {
+			if !envVariable.MatchString(mon["url"]) {
+				c.errorf(joinPath(path, "url"), task, "%s", err)
+			}
+			return
+		}
+	}
+	// BuildMonitor fills in defaults, so give it a copy
+	m := make(map[string]string)
+	for k, v := range mon {
+		m[k] = v
+	}
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	if _, err := BuildMonitor(m, logger); err != nil {
+		c.errorf(path, task, "%s", err)
+	}
+	if _, err := parseDuration(mon["period"], 0); err != nil {
+		c.errorf(joinPath(path, "period"), task, "%s", err)
+	}
+	if r := mon["retries"]; r != "" {
+		if _, err := strconv.Atoi(r); err != nil {
+			c.errorf(joinPath(path, "retries"), task, "retries must be a number, not %q", r)
+		}
+	}
+}
+
+// checkTasks checks every task, and how they refer to each other
+func (c *checker) checkTasks(cfg Config, nocheck bool) {
+	defs := make(map[string]ConfigTask)
+	for _, ct := range cfg.Task {
+		if _, ok := defs[ct.Name]; !ok {
+			defs[ct.Name] = ct
+		}
+	}
+	// tasks which are run by other tasks, rather than on their own
+	referenced := make(map[string]bool)
+	for _, ct := range cfg.Task {
+		for _, p := range ct.Prerun {
+			referenced[p] = true
+		}
+		referenced[ct.Restart["run"]] = true
+	}
+	reload := parseSignal(cfg.Control["reload_signal"])
+	reopen := parseSignal(cfg.Logger["reopen_signal"])
+
+	seen := make(map[string]int)
+	signals := make(map[os.Signal]string)
+	deps := make(map[string][]string)
+	for i, ct := range cfg.Task {
+		path := fmt.Sprintf("task[%d]", i)
+		name := ct.Name
+		if !nocheck {
+			c.unresolvedTask(path, ct)
+		}
+		switch j, dup := seen[name]; {
+		case name == "":
+			c.errorf(path, "", "task has no name")
+		case dup:
+			c.errorf(path+".name", name, "task[%d] already has this name", j)
+		default:
+			seen[name] = i
+		}
+		c.checkPath(path, ct)
+
+		if ct.Parent != "" {
+			deps[name] = append(deps[name], ct.Parent)
+			if _, ok := seen[ct.Parent]; !ok {
+				if _, later := defs[ct.Parent]; later {
+					c.errorf(path+".parent", name, "parent %s must be defined before this task", ct.Parent)
+				} else {
+					c.errorf(path+".parent", name, "unknown parent task %s", ct.Parent)
+				}
+			}
+		}
+		for _, p := range ct.Prerun {
+			if _, ok := seen[p]; !ok {
+				if _, later := defs[p]; later {
+					c.errorf(path+".prerun", name, "prerun task %s must be defined before this task", p)
+				} else {
+					c.errorf(path+".prerun", name, "unknown prerun task %s", p)
+				}
+			}
+		}
+		for _, d := range ct.DependsOn {
+			dt, ok := defs[d]
+			switch {
+			case d == name:
+				c.errorf(path+".depends_on", name, "task depends on itself")
+			case !ok:
+				c.errorf(path+".depends_on", name, "unknown task %s", d)
+			case !ct.longRunning():
+				c.errorf(path+".depends_on", name, "only long-running tasks can have depends_on")
+			case !dt.longRunning():
+				c.errorf(path+".depends_on", name, "%s is not a long-running task", d)
+			default:
+				deps[name] = append(deps[name], d)
+			}
+		}
+
+		for j, mon := range ct.Monitors {
+			c.checkMonitor(fmt.Sprintf("%s.monitors[%d]", path, j), name, mon)
+		}
+
+		c.checkOutput(path+".stdout", name, ct.Stdout)
+		c.checkOutput(path+".stderr", name, ct.Stderr)
+		c.knownKeys(path+".logs", name, ct.Logs, LogsKeys)
+		if rot, err := BuildRotation(cfg.Logger, Rotation{}); err == nil {
+			if _, err = BuildRotation(ct.Logs, rot); err != nil {
+				c.errorf(path+".logs", name, "%s", err)
+			}
+		}
+		if _, err := parseDuration(ct.MaxStartup, 0); err != nil {
+			c.errorf(path+".maxstartup", name, "%s", err)
+		}
+		if _, err := parseDuration(ct.MaxShutdown, 0); err != nil {
+			c.errorf(path+".maxshutdown", name, "%s", err)
+		}
+
+		c.knownKeys(path+".restart", name, ct.Restart, RestartKeys)
+		policy, err := BuildRestartPolicy(ct.Restart)
+		switch {
+		case err != nil:
+			c.errorf(path+".restart", name, "%s", err)
+		case policy != nil && !ct.longRunning():
+			c.errorf(path+".restart", name, "only long-running tasks are restarted")
+		case policy != nil && policy.Action == BreakerRun:
+			rt, ok := defs[policy.Run]
+			if !ok {
+				c.errorf(path+".restart.run", name, "unknown task %s", policy.Run)
+			} else if rt.longRunning() {
+				c.errorf(path+".restart.run", name, "%s must be a special task", policy.Run)
+			}
+		}
+
+		if _, err := BuildLimits(ct); err != nil {
+			c.errorf(path+".limits", name, "%s", err)
+		}
+
+		c.checkSpecials(path, ct, referenced[name])
+		if sig := parseSignal(ct.Specials["signal"]); sig != nil {
+			switch {
+			case signals[sig] != "":
+				c.errorf(path+".specials.signal", name, "%s is also bound to task %s", sig, signals[sig])
+			case sig == reload:
+				c.errorf(path+".specials.signal", name, "%s is also the reload_signal", sig)
+			case sig == reopen:
+				c.errorf(path+".specials.signal", name, "%s is also the reopen_signal", sig)
+			case sig == syscall.SIGTERM:
+				c.warnf(path+".specials.signal", name, "binding SIGTERM means procmon exits without stopping the other tasks")
+			}
+			if signals[sig] == "" {
+				signals[sig] = name
+			}
+		}
+	}
+
+	for _, rc := range cfg.RotationConflicts() {
+		c.errorf(rc.Path, rc.Task, "%s", rc)
+	}
+
+	names := make([]string, len(cfg.Task))
+	for i, ct := range cfg.Task {
+		names[i] = ct.Name
+	}
+	if cycle := dependencyCycle(deps, names); cycle != nil {
+		c.errorf(fmt.Sprintf("task[%d].depends_on", seen[cycle[0]]), cycle[0],
+			"dependency cycle: %s", strings.Join(cycle, " -> "))
+	}
+}
+
+// checkPath checks that a task's binary exists on this machine
+func (c *checker) checkPath(path string, ct ConfigTask) {
+	switch {
+	case ct.Path == "":
+		c.errorf(path, ct.Name, "task has no path")
+	case strings.Contains(ct.Path, "$"):
+		// already reported as unresolved
+	case strings.Contains(ct.Path, "/"):
+		info, err := os.Stat(ct.Path)
+		switch {
+		case err != nil:
+			c.warnf(path+".path", ct.Name, "%s does not exist", ct.Path)
+		case info.IsDir() || info.Mode()&0111 == 0:
+			c.warnf(path+".path", ct.Name, "%s is not executable", ct.Path)
+		}
+	default:
+		if _, err := exec.LookPath(ct.Path); err != nil {
+			c.warnf(path+".path", ct.Name, "%s is not in the PATH", ct.Path)
+		}
+	}
+}
+
+// checkSpecials checks the specials of a task, and whether it ever runs
+func (c *checker) checkSpecials(path string, ct ConfigTask, referenced bool) {
+	name := ct.Name
+	path += ".specials"
+	for _, k := range sortedSpecials(ct.Specials) {
+		if !contains(SpecialsKeys, k) {
+			c.warnf(joinPath(path, k), name, "unknown special")
+		}
+	}
+	t := &Task{}
+	var err error
+	if t.Periodic, err = parseDuration(ct.Specials["periodic"], 0); err != nil {
+		c.errorf(path+".periodic", name, "%s", err)
+	}
+	t.Shutdown = parseBool(ct.Specials["shutdown"], false)
+	if err = buildSchedule(t, ct.Specials); err != nil {
+		c.errorf(path, name, "%s", err)
+	}
+	if s, ok := ct.Specials["signal"]; ok && parseSignal(s) == nil {
+		c.errorf(path+".signal", name, "unknown signal %v", s)
+	}
+	if ct.longRunning() {
+		for _, k := range []string{"shutdown", "terminate"} {
+			if parseBool(ct.Specials[k], false) {
+				c.warnf(joinPath(path, k), name, "%s has no effect on a long-running task", k)
+			}
+		}
+		return
+	}
+	if parseBool(ct.Specials["onetime"], false) && ct.Parent == "" && !referenced &&
+		parseSignal(ct.Specials["signal"]) == nil && t.Schedule == nil {
+		c.warnf(path+".onetime", name, "task is never run; it has no parent and isn't a prerun task")
+	}
+}
+
+func sortedSpecials(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// unresolvedTask reports the values of a task which still refer to an
+// environment variable. They're only warnings, because a task may expect
+// its arguments to be expanded by a shell.
+func (c *checker) unresolvedTask(path string, ct ConfigTask) {
+	for _, f := range []struct{ key, value string }{
+		{"name", ct.Name}, {"path", ct.Path}, {"stdout", ct.Stdout}, {"stderr", ct.Stderr},
+		{"parent", ct.Parent}, {"dir", ct.Dir}, {"user", ct.User}, {"group", ct.Group},
+	} {
+		c.unresolved(joinPath(path, f.key), ct.Name, f.value, true)
+	}
+	for _, list := range []struct {
+		key    string
+		values []string
+	}{
+		{"args", ct.Args}, {"prerun", ct.Prerun}, {"depends_on", ct.DependsOn},
+	} {
+		for _, v := range list.values {
+			c.unresolved(joinPath(path, list.key), ct.Name, v, true)
+		}
+	}
+	for _, table := range []struct {
+		key string
+		m   map[string]string
+	}{
+		{"restart", ct.Restart}, {"limits", ct.Limits}, {"logs", ct.Logs},
+	} {
+		for _, k := range sortedKeys(table.m) {
+			c.unresolved(joinPath(path, table.key+"."+k), ct.Name, table.m[k], true)
+		}
+	}
+	for _, k := range sortedSpecials(ct.Specials) {
+		c.unresolved(path+".specials."+k, ct.Name, specialString(ct.Specials, k), true)
+	}
+	for i, mon := range ct.Monitors {
+		for _, k := range sortedKeys(mon) {
+			c.unresolved(fmt.Sprintf("%s.monitors[%d].%s", path, i, k), ct.Name, mon[k], true)
+		}
+	}
+}
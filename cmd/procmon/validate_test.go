@@ -0,0 +1,214 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const badConfig = `[env]
+PORT = "8080"
+
+[logger]
+level = "loud"
+
+[[task]]
+    name = "api"
+    path = "/bin/sh"
+    args = ["-c", "serve $PORT $MISSING"]
+    parnet = "db"
+    depends_on = ["db", "ghost"]
+
+    [[task.monitors]]
+        name = "health"
+        type = "http"
+        url = "http://localhost:$PORT/health"
+        retries = "many"
+
+    [[task.monitors]]
+        name = "disk"
+        type = "floppy"
+
+[[task]]
+    name = "db"
+    path = "/bin/sh"
+    parent = "later"
+
+    [task.specials]
+        signal = "SIGWINCH"
+
+    [task.restart]
+        action = "explode"
+
+[[task]]
+    name = "later"
+    path = "/bin/sh"
+    depends_on = ["api"]
+`
+
+// writeConfig writes a config file into dir
+func writeConfig(t *testing.T, dir, content string) string {
+	name := filepath.Join(dir, "config.toml")
+	require.NoError(t, ioutil.WriteFile(name, []byte(content), 0644))
+	return name
+}
+
+func TestTomlLines(t *testing.T) {
+	lines := tomlLines(badConfig)
+	require.Equal(t, 5, lines["logger.level"])
+	require.Equal(t, 7, lines["task[0]"])
+	require.Equal(t, 11, lines["task[0].parnet"])
+	require.Equal(t, 14, lines["task[0].monitors[0]"])
+	require.Equal(t, 18, lines["task[0].monitors[0].retries"])
+	require.Equal(t, 22, lines["task[0].monitors[1].type"])
+	require.Equal(t, 27, lines["task[1].parent"])
+	require.Equal(t, 30, lines["task[1].specials.signal"])
+	require.Equal(t, 33, lines["task[1].restart.action"])
+	require.Equal(t, 35, lines["task[2]"])
+}
+
+func TestValidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var got []string
+	for _, p := range Validate(writeConfig(t, dir, badConfig), false) {
+		got = append(got, fmt.Sprintf("%d: %s", p.Line, p))
+	}
+	want := []string{
+		"5: logger.level: level must be debug, info, warn or error, not \"loud\"",
+		"10: warning: task[0].args (api): unresolved environment variable $MISSING",
+		"11: warning: task[0].parnet: unknown key",
+		"12: task[0].depends_on (api): unknown task ghost",
+		// the cycle is found even though other dependencies are bad
+		"12: task[0].depends_on (api): dependency cycle: api -> db -> later -> api",
+		"18: task[0].monitors[0].retries (api): retries must be a number, not \"many\"",
+		"22: task[0].monitors[1].type (api): unknown monitor type floppy",
+		"27: task[1].parent (db): parent later must be defined before this task",
+		"30: task[1].specials.signal (db): unknown signal SIGWINCH",
+		"32: task[1].restart (db): restart action must be park, stop, or run, not \"explode\"",
+	}
+	require.Equal(t, want, got)
+}
+
+func TestValidateSyntaxError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	problems := Validate(writeConfig(t, dir, "[[task]]\nname = \"x\"\npath = \n"), false)
+	require.Len(t, problems, 1)
+	require.Equal(t, 3, problems[0].Line)
+}
+
+func TestRotationConflicts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	log := filepath.Join(dir, "shared.log")
+
+	cfg := Config{Task: []ConfigTask{
+		{Name: "a", Path: "/bin/true", Stdout: log, Stderr: log},
+		{Name: "b", Path: "/bin/true", Stdout: log, Logs: map[string]string{"keep": "3"}},
+	}}
+	rcs := cfg.RotationConflicts()
+	require.Len(t, rcs, 1)
+	require.Equal(t, "task[1].stdout", rcs[0].Path)
+	require.Equal(t, "task[0].stdout", rcs[0].FirstPath)
+	_, err = cfg.BuildTasks(reloadLogger())
+	require.Error(t, err)
+
+	// the same settings, however they're arrived at, don't conflict
+	cfg.Logger = map[string]string{"keep": "3"}
+	require.Empty(t, cfg.RotationConflicts())
+}
+
+func TestValidateSample(t *testing.T) {
+	for _, p := range Validate("sample.toml", false) {
+		require.True(t, p.Warning, p.String())
+	}
+}
+
+func TestValidateUnresolvedIsWarning(t *testing.T) {
+	dir, err := ioutil.TempDir("", "validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := `[env]
+URL = "http://localhost:$VALIDATE_MISSING_PORT"
+
+[[task]]
+    name = "api"
+    path = "/bin/sh"
+
+    [[task.monitors]]
+        name = "health"
+        type = "http"
+        url = "http://localhost:$VALIDATE_MISSING_PORT/health"
+`
+	problems := Validate(writeConfig(t, dir, config), false)
+	require.Len(t, problems, 2)
+	for _, p := range problems {
+		require.True(t, p.Warning, p.String())
+	}
+}
+
+func TestMonitorKeysAreBuilt(t *testing.T) {
+	logger := reloadLogger()
+	for typ := range MonitorKeys {
+		_, err := BuildMonitor(map[string]string{"type": typ}, logger)
+		if err != nil {
+			require.NotContains(t, err.Error(), "has no builder", typ)
+		}
+	}
+	_, err := BuildMonitor(map[string]string{"type": "floppy"}, logger)
+	require.EqualError(t, err, "unknown monitor type floppy")
+}
+
+func TestExplain(t *testing.T) {
+	cfg := dependsConfig()
+	cfg.Task = append(cfg.Task,
+		ConfigTask{Name: "hup", Path: "/bin/echo", Args: []string{"hello there"},
+			Specials: map[string]interface{}{"signal": "HUP", "shutdown": true}},
+	)
+	cfg.Task[0].Monitors = []map[string]string{{"name": "ready", "type": "http", "url": "http://localhost/ready"}}
+	cfg.Control = map[string]string{"reload_signal": "USR2"}
+
+	var buf bytes.Buffer
+	now := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, WriteExplanation(&buf, cfg, now))
+	out := buf.String()
+
+	// db and cache start first, then api, then its child
+	stages := []string{"stage 1\n    db\n", "    cache\n", "stage 2\n    api\n", "stage 3\n    indexer\n"}
+	pos := 0
+	for _, s := range stages {
+		i := strings.Index(out[pos:], s)
+		require.True(t, i >= 0, "%q not in order in\n%s", s, out)
+		pos += i
+	}
+	require.Contains(t, out, "after      db; also requires cache")
+	require.Contains(t, out, "monitors   ready: http url=http://localhost/ready\n")
+	require.Contains(t, out, "runs on    every 1h0m0s, next 2019-06-01T13:00:00Z")
+	require.Contains(t, out, "runs on    prerun of backup")
+	require.Contains(t, out, `command    /bin/echo "hello there"`)
+	require.Contains(t, out, "SIGHUP   run task hup")
+	require.Contains(t, out, "SIGUSR2  reload the config file")
+}
@@ -11,7 +11,23 @@ import (
 	math "github.com/ndau/ndaumath/pkg/types"
 )
 
+type encodeCmd struct {
+	Name  string `arg:"positional,required" help:"name of the sysvar"`
+	Value string `arg:"positional,required" help:"JSON representation of the value"`
+}
+
+type decodeCmd struct {
+	Name string `arg:"positional,required" help:"name of the sysvar"`
+	Data string `arg:"positional,required" help:"base64 msgp encoding of the value"`
+}
+
+type listCmd struct{}
+
 type args struct {
+	Encode *encodeCmd `arg:"subcommand:encode" help:"encode a named sysvar from JSON"`
+	Decode *decodeCmd `arg:"subcommand:decode" help:"decode a named sysvar into JSON"`
+	List   *listCmd   `arg:"subcommand:list" help:"list the sysvars known to encode and decode"`
+
 	Address  []address.Address `arg:"-a,separate" help:"encode this ndau address"`
 	Bytes    []string          `arg:"-b,separate" help:"encode these base64'd bytes (i.e. chaincode)"`
 	Duration []math.Duration   `arg:"-d,separate" help:"encode this duration"`
@@ -26,6 +42,10 @@ func (args) Description() string {
 Encode specific types into appropriate formats for a SetSysvar tx
 
 Each flag may be set multiple times.
+
+Alternately, the encode and decode subcommands look up the type of a named
+sysvar, converting between its JSON representation and the base64 msgp
+encoding used on the blockchain.
 	`
 }
 
@@ -49,6 +69,26 @@ func main() {
 	var args args
 	arg.MustParse(&args)
 
+	switch {
+	case args.Encode != nil:
+		bytes, err := encode(args.Encode.Name, []byte(args.Encode.Value))
+		check(err, "encoding %s", args.Encode.Name)
+		output(args.Encode.Value, bytes)
+		return
+	case args.Decode != nil:
+		bytes, err := base64.StdEncoding.DecodeString(args.Decode.Data)
+		check(err, "decoding base64 encoding")
+		js, err := decode(args.Decode.Name, bytes)
+		check(err, "decoding %s", args.Decode.Name)
+		fmt.Println(string(js))
+		return
+	case args.List != nil:
+		for _, name := range knownSysvars() {
+			fmt.Printf("%-45s %s\n", name, typeName(name))
+		}
+		return
+	}
+
 	for _, v := range args.Address {
 		bytes, err := v.MarshalMsg(nil)
 		check(err, "msgp marshaling address")
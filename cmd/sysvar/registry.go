@@ -0,0 +1,127 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/ndau/msgp-well-known-types/wkt"
+	"github.com/ndau/ndaumath/pkg/address"
+	"github.com/ndau/ndaumath/pkg/eai"
+	math "github.com/ndau/ndaumath/pkg/types"
+	sv "github.com/ndau/system_vars/pkg/system_vars"
+	"github.com/pkg/errors"
+	"github.com/tinylib/msgp/msgp"
+)
+
+// a sysvarValue is a pointer to an instance of a sysvar's Go type
+type sysvarValue interface {
+	msgp.Marshaler
+	msgp.Unmarshaler
+}
+
+// registry maps sysvar names to constructors for their Go types
+var registry = map[string]func() sysvarValue{
+	sv.EAIFeeTableName:                             func() sysvarValue { return new(sv.EAIFeeTable) },
+	sv.LockedRateTableName:                         func() sysvarValue { return new(eai.RateTable) },
+	sv.UnlockedRateTableName:                       func() sysvarValue { return new(eai.RateTable) },
+	sv.TxFeeScriptName:                             func() sysvarValue { return new(wkt.Bytes) },
+	sv.SIBScriptName:                               func() sysvarValue { return new(wkt.Bytes) },
+	sv.DefaultRecourseDurationName:                 func() sysvarValue { return new(math.Duration) },
+	sv.NodeRewardNominationTimeoutName:             func() sysvarValue { return new(math.Duration) },
+	sv.MinDurationBetweenNodeRewardNominationsName: func() sysvarValue { return new(math.Duration) },
+	sv.MinNodeRegistrationStakeName:                func() sysvarValue { return new(math.Ndau) },
+	sv.AccountAttributesName:                       func() sysvarValue { return new(sv.AccountAttributes) },
+}
+
+// systemAccounts names every system account; each stores its address in a
+// sysvar
+var systemAccounts = map[string]sv.SysAcct{
+	"CommandValidatorChange": sv.CommandValidatorChange,
+	"NodeRulesAccount":       sv.NodeRulesAccount,
+	"NominateNodeReward":     sv.NominateNodeReward,
+	"ReleaseFromEndowment":   sv.ReleaseFromEndowment,
+	"RecordPrice":            sv.RecordPrice,
+	"SetSysvar":              sv.SetSysvar,
+}
+
+func init() {
+	for _, sa := range systemAccounts {
+		registry[sa.Address] = func() sysvarValue { return new(address.Address) }
+	}
+}
+
+// lookup returns a fresh instance of the named sysvar's type
+func lookup(name string) (sysvarValue, error) {
+	mk, ok := registry[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown sysvar %q; use 'sysvar list' to see known sysvars", name)
+	}
+	return mk(), nil
+}
+
+// knownSysvars returns the sorted names of every registered sysvar
+func knownSysvars() []string {
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// typeName describes the Go type of a registered sysvar
+func typeName(name string) string {
+	v, err := lookup(name)
+	if err != nil {
+		return ""
+	}
+	return reflect.TypeOf(v).Elem().String()
+}
+
+// encode parses the JSON representation of the named sysvar and returns its
+// msgp encoding
+//
+// Values whose JSON form is a string, such as durations and addresses, may
+// be supplied without the surrounding quotes.
+func encode(name string, js []byte) ([]byte, error) {
+	v, err := lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(js, v)
+	if err != nil {
+		quoted, qerr := json.Marshal(string(js))
+		if qerr != nil || json.Unmarshal(quoted, v) != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("parsing %s as %s", name, typeName(name)))
+		}
+	}
+	return v.MarshalMsg(nil)
+}
+
+// decode parses the msgp encoding of the named sysvar and returns its JSON
+// representation
+func decode(name string, data []byte) ([]byte, error) {
+	v, err := lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	leftover, err := v.UnmarshalMsg(data)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("decoding %s as %s", name, typeName(name)))
+	}
+	if len(leftover) > 0 {
+		return nil, fmt.Errorf("%d trailing bytes after %s", len(leftover), name)
+	}
+	return json.MarshalIndent(v, "", "  ")
+}
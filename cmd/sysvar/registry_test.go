@@ -0,0 +1,105 @@
+package main
+
+// ----- ---- --- -- -
+// Copyright 2019 Oneiro NA, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License 2.0 (the "License").  You may not use
+// this file except in compliance with the License.  You can obtain a copy
+// in the file LICENSE in the source distribution or at
+// https://www.apache.org/licenses/LICENSE-2.0.txt
+// - -- --- ---- -----
+
+import (
+	"go/constant"
+	"go/importer"
+	"go/token"
+	"go/types"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ndau/ndaumath/pkg/address"
+	math "github.com/ndau/ndaumath/pkg/types"
+	sv "github.com/ndau/system_vars/pkg/system_vars"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoundtripEveryType(t *testing.T) {
+	for _, name := range knownSysvars() {
+		t.Run(name, func(t *testing.T) {
+			v, err := lookup(name)
+			require.NoError(t, err)
+			if a, ok := v.(*address.Address); ok {
+				// the zero address is not valid, so it has no json form
+				*a, err = address.Generate(address.KindUser, make([]byte, 32))
+				require.NoError(t, err)
+			}
+
+			data, err := v.MarshalMsg(nil)
+			require.NoError(t, err)
+
+			js, err := decode(name, data)
+			require.NoError(t, err)
+
+			redata, err := encode(name, js)
+			require.NoError(t, err)
+			require.Equal(t, data, redata)
+		})
+	}
+}
+
+// TestRegistryIsComplete fails when system_vars gains a sysvar which the
+// registry doesn't know how to encode.
+func TestRegistryIsComplete(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	imp := importer.ForCompiler(token.NewFileSet(), "source", nil).(types.ImporterFrom)
+	pkg, err := imp.ImportFrom("github.com/ndau/system_vars/pkg/system_vars", wd, 0)
+	require.NoError(t, err)
+
+	scope := pkg.Scope()
+	for _, ident := range scope.Names() {
+		switch obj := scope.Lookup(ident).(type) {
+		case *types.Const:
+			if !obj.Exported() || !strings.HasSuffix(ident, "Name") || obj.Val().Kind() != constant.String {
+				continue
+			}
+			name := constant.StringVal(obj.Val())
+			_, ok := registry[name]
+			require.True(t, ok, "sysvar %s (%s) is not in the registry", name, ident)
+		case *types.Var:
+			if !obj.Exported() || obj.Type().String() != pkg.Path()+".SysAcct" {
+				continue
+			}
+			_, ok := systemAccounts[ident]
+			require.True(t, ok, "system account %s is not in the registry", ident)
+		}
+	}
+}
+
+func TestEncodeUnquoted(t *testing.T) {
+	quoted, err := encode(sv.DefaultRecourseDurationName, []byte(`"1h"`))
+	require.NoError(t, err)
+	unquoted, err := encode(sv.DefaultRecourseDurationName, []byte(`1h`))
+	require.NoError(t, err)
+	require.Equal(t, quoted, unquoted)
+
+	var d math.Duration
+	_, err = d.UnmarshalMsg(quoted)
+	require.NoError(t, err)
+	require.Equal(t, math.Duration(math.Hour), d)
+}
+
+func TestUnknownSysvar(t *testing.T) {
+	_, err := encode("NoSuchSysvar", []byte(`1`))
+	require.Error(t, err)
+	_, err = decode("NoSuchSysvar", nil)
+	require.Error(t, err)
+}
+
+func TestDecodeTrailingBytes(t *testing.T) {
+	data, err := encode(sv.DefaultRecourseDurationName, []byte(`"1h"`))
+	require.NoError(t, err)
+	_, err = decode(sv.DefaultRecourseDurationName, append(data, 0))
+	require.Error(t, err)
+}